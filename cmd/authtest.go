@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Jonwing/mario/pkg/ssh"
+	"github.com/spf13/cobra"
+	"time"
+)
+
+// newAuthTestCommand builds the `auth-test` command which only logs in the ssh server with a
+// key to tell whether the key is accepted, no tunnel is defined or opened, e.g.
+//
+//	mario auth-test --server user@host.com:22 --key ~/.ssh/other_rsa
+func newAuthTestCommand(b *baseCommand) *cobra.Command {
+	var server, key string
+	cmd := &cobra.Command{
+		Use:   "auth-test",
+		Short: "test whether the ssh server accepts a key, without opening a tunnel",
+		Long: "Perform the ssh handshake and authentication with the server like a tunnel does,\n" +
+			"then report the server version and the host key. The global proxy and agent are used.",
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return b.runAuthTest(normalizeInput(server), normalizeInput(key))
+		},
+	}
+	cmd.Flags().StringVarP(&server, "server", "s", "", "the ssh server in form of user@host:port")
+	cmd.Flags().StringVarP(&key, "key", "k", "", "the private key file path, default to the global one(--pk)")
+	return cmd
+}
+
+func (b *baseCommand) runAuthTest(server, key string) error {
+	if server == "" {
+		return errors.New("the ssh server is required, e.g. --server user@host.com:22")
+	}
+	if key == "" {
+		key = b.pkPath
+	}
+	pk, err := PrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	opts := make([]ssh.Option, 0)
+	proxy, err := proxyURL(b.proxy)
+	if err != nil {
+		return err
+	}
+	if proxy != nil {
+		opts = append(opts, ssh.WithProxy(proxy))
+	}
+	if b.agentSocket != "" {
+		opts = append(opts, ssh.WithAgent(b.agentSocket))
+	}
+	if challenge := keyboardInteractive(b.kbdCommand, true); challenge != nil {
+		opts = append(opts, ssh.WithKeyboardInteractive(challenge))
+	}
+
+	result, err := ssh.AuthTest(server, pk, time.Duration(b.heartbeatInterval)*time.Second, opts...)
+	if err != nil {
+		fmt.Printf("auth failed for %s with key %s\n", server, key)
+		return err
+	}
+	fmt.Printf("auth succeeded for %s with key %s\n", server, key)
+	fmt.Printf("  server version: %s\n", result.ServerVersion)
+	fmt.Printf("  client version: %s\n", result.ClientVersion)
+	fmt.Printf("  host key:       %s %s\n", result.HostKeyType, result.HostKeyFingerprint)
+	fmt.Printf("  took:           %s\n", result.Took.Round(time.Millisecond))
+	return nil
+}
@@ -0,0 +1,109 @@
+package cmd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/Jonwing/mario/internal"
+	"github.com/Jonwing/mario/pkg/ssh"
+	"github.com/spf13/cobra"
+	"os"
+	"strings"
+	"time"
+)
+
+// batchLine is a tunnel spec read from stdin
+type batchLine struct {
+	no   int
+	link string
+	tns  []*internal.TunnelInfo
+	errs []error
+}
+
+// newBatchCommand builds the `batch` command which opens a tunnel for each link read from
+// stdin and serves them until interrupted, e.g.
+//
+//	cat specs.txt | mario batch
+//
+// each line is a link like the --link flag of `open`, blank lines and lines starting
+// with `#` are ignored.
+func newBatchCommand(b *baseCommand) *cobra.Command {
+	return &cobra.Command{
+		Use:   "batch",
+		Short: "open tunnels of the links read from stdin, one link per line",
+		Long: "Open a tunnel for each link read from stdin and serve them until interrupted.\n" +
+			"Each line is a link like the --link flag of open, e.g. :1080:192.168.1.2:1080@user@host.com:22,\n" +
+			"blank lines and lines starting with # are ignored.",
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return b.runBatch(os.Stdin)
+		},
+	}
+}
+
+func (b *baseCommand) runBatch(in *os.File) error {
+	release, err := b.acquirePidfile()
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	dashBoard := internal.DefaultDashboard(b.pkPath, b.heartbeatInterval)
+	if err := b.configMario(dashBoard.Mario); err != nil {
+		return err
+	}
+	logger := newLogger(b.debug)
+	dashBoard.Mario.Logger = logger
+	defer handleSignals(dashBoard, logger)()
+	if err := dashBoard.Work(); err != nil {
+		return err
+	}
+
+	lines := make([]*batchLine, 0)
+	scanner := bufio.NewScanner(in)
+	for no := 1; scanner.Scan(); no++ {
+		txt := strings.TrimSpace(scanner.Text())
+		if txt == "" || strings.HasPrefix(txt, "#") {
+			continue
+		}
+		line := &batchLine{no: no, link: txt}
+		lines = append(lines, line)
+		local, remote, server, err := parseLink(txt)
+		if err != nil {
+			line.errs = []error{err}
+			continue
+		}
+		line.tns, line.errs = openTunnels(dashBoard, "", internal.SourceBatch, local, server, remote, "")
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	var opened, failed int
+	timeout := time.Duration(b.heartbeatInterval) * time.Second
+	for _, line := range lines {
+		for _, tn := range line.tns {
+			if err := tn.WaitForStatus(ssh.StatusConnected, timeout); err != nil {
+				line.errs = append(line.errs, fmt.Errorf("tunnel %d %s: %v", tn.GetID(), tn.Represent(), err))
+				continue
+			}
+			opened++
+			fmt.Printf("line %d: tunnel %d opened: %s\n", line.no, tn.GetID(), tn.Represent())
+		}
+		for _, err := range line.errs {
+			failed++
+			fmt.Printf("line %d: %s\n", line.no, err.Error())
+		}
+	}
+	fmt.Printf("%d tunnel(s) opened, %d failed\n", opened, failed)
+
+	if opened == 0 {
+		dashBoard.Quit()
+		return errors.New("no tunnel to serve")
+	}
+	fmt.Println("serving, press Ctrl-C to stop")
+	waitForInterrupt()
+	dashBoard.Quit()
+	return nil
+}
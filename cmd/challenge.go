@@ -0,0 +1,132 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	sh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/terminal"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// challengeCommandTimeout is how long the helper command of --kbd-interactive-command may take
+const challengeCommandTimeout = time.Minute
+
+// terminalChallenge answers the keyboard-interactive questions of the ssh servers, e.g. an
+// OTP, by asking the user on the terminal. The secret answers are read without echo.
+type terminalChallenge struct {
+	// mu asks the questions of one server at a time, the tunnels may connect together
+	mu sync.Mutex
+
+	in *bufio.Reader
+
+	out io.Writer
+
+	// fd the terminal the secret answers are read from
+	fd int
+}
+
+func newTerminalChallenge() *terminalChallenge {
+	return &terminalChallenge{in: bufio.NewReader(os.Stdin), out: os.Stdout, fd: int(os.Stdin.Fd())}
+}
+
+func (c *terminalChallenge) answer(user, instruction string, questions []string, echos []bool) ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if instruction != "" {
+		fmt.Fprintf(c.out, "%s (%s)\n", instruction, user)
+	}
+	answers := make([]string, len(questions))
+	for i, q := range questions {
+		fmt.Fprint(c.out, q)
+		if i < len(echos) && echos[i] {
+			line, err := c.in.ReadString('\n')
+			if err != nil && line == "" {
+				return nil, err
+			}
+			answers[i] = strings.TrimRight(line, "\r\n")
+			continue
+		}
+		secret, err := terminal.ReadPassword(c.fd)
+		fmt.Fprintln(c.out)
+		if err != nil {
+			return nil, err
+		}
+		answers[i] = string(secret)
+	}
+	return answers, nil
+}
+
+// commandChallenge answers the keyboard-interactive questions with the output of command,
+// e.g. a script reading the OTP from a vault. The questions are written to its stdin and the
+// answers are read from its stdout, one per line. The user and the instruction of the server
+// are passed in $MARIO_SSH_USER and $MARIO_SSH_INSTRUCTION.
+func commandChallenge(command string) sh.KeyboardInteractiveChallenge {
+	return func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+		if len(questions) == 0 {
+			return nil, nil
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), challengeCommandTimeout)
+		defer cancel()
+		shell, flag := "sh", "-c"
+		if runtime.GOOS == "windows" {
+			shell, flag = "cmd", "/C"
+		}
+		c := exec.CommandContext(ctx, shell, flag, command)
+		c.Env = append(os.Environ(), "MARIO_SSH_USER="+user, "MARIO_SSH_INSTRUCTION="+instruction)
+		c.Stdin = strings.NewReader(strings.Join(questions, "\n") + "\n")
+		c.Stderr = os.Stderr
+		out, err := c.Output()
+		if err != nil {
+			return nil, fmt.Errorf("keyboard-interactive command failed: %v", err)
+		}
+		answers := make([]string, 0, len(questions))
+		scanner := bufio.NewScanner(bytes.NewReader(out))
+		for scanner.Scan() && len(answers) < len(questions) {
+			answers = append(answers, strings.TrimRight(scanner.Text(), "\r"))
+		}
+		if len(answers) < len(questions) {
+			return nil, fmt.Errorf("keyboard-interactive command answered %d of %d questions",
+				len(answers), len(questions))
+		}
+		return answers, nil
+	}
+}
+
+// readPassword reads a password on the terminal without echo
+func readPassword(prompt string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		return "", errors.New("stdin is not a terminal")
+	}
+	fmt.Print(prompt)
+	password, err := terminal.ReadPassword(fd)
+	fmt.Println()
+	if err != nil {
+		return "", err
+	}
+	if len(password) == 0 {
+		return "", errors.New("the password is empty")
+	}
+	return string(password), nil
+}
+
+// keyboardInteractive returns how the keyboard-interactive questions are answered: by the
+// command if given, otherwise on the terminal if prompting is allowed, nil if neither
+func keyboardInteractive(command string, prompting bool) sh.KeyboardInteractiveChallenge {
+	if command != "" {
+		return commandChallenge(command)
+	}
+	if prompting && terminal.IsTerminal(int(os.Stdin.Fd())) {
+		return newTerminalChallenge().answer
+	}
+	return nil
+}
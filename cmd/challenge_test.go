@@ -0,0 +1,29 @@
+package cmd
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestCommandChallenge(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the commands are written for sh")
+	}
+	questions := []string{"Password: ", "OTP: "}
+
+	// the answers are the lines printed by the command
+	answers, err := commandChallenge(`sed 's/: $//'; echo "$MARIO_SSH_USER"`)("mario", "", questions, []bool{false, false})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(answers) != 2 || answers[0] != "Password" || answers[1] != "OTP" {
+		t.Errorf("unexpected answers %q", answers)
+	}
+
+	if _, err := commandChallenge("echo 123456")("mario", "", questions, []bool{false, false}); err == nil {
+		t.Error("expected an error for the missing answer")
+	}
+	if _, err := commandChallenge("exit 1")("mario", "", questions, []bool{false, false}); err == nil {
+		t.Error("expected an error for the failed command")
+	}
+}
@@ -0,0 +1,583 @@
+package cmd
+
+import (
+	"bytes"
+	stdjson "encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Jonwing/mario/internal"
+	"github.com/Jonwing/mario/pkg/ssh"
+	json "github.com/json-iterator/go"
+	"net"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	tunnelFieldPtn     = regexp.MustCompile(`^tunnels\[\d+\]\.([^.\[]+)$`)
+	socksFieldPtn      = regexp.MustCompile(`^socks\.([^.\[]+)$`)
+	socksRouteFieldPtn = regexp.MustCompile(`^socks\.routes\[\d+\]\.([^.\[]+)$`)
+	templateFieldPtn   = regexp.MustCompile(`^templates\[\d+\]\.([^.\[]+)$`)
+	templateTunnelPtn  = regexp.MustCompile(`^templates\[\d+\]\.tunnel\.([^.\[]+)$`)
+)
+
+// configProblem describes a single mistake found in a config file
+type configProblem struct {
+	// line is the 1-based line number in the config file, 0 if unknown
+	line int
+
+	// field is the json path of the problematic field, e.g. tunnels[0].map_to
+	field string
+
+	msg string
+}
+
+func (p *configProblem) String() string {
+	buf := &strings.Builder{}
+	if p.line > 0 {
+		buf.WriteString("line " + strconv.Itoa(p.line) + ": ")
+	}
+	if p.field != "" {
+		buf.WriteString(p.field + ": ")
+	}
+	buf.WriteString(p.msg)
+	return buf.String()
+}
+
+// configErrors collects all the problems of a config file so that they can be
+// reported at once
+type configErrors []*configProblem
+
+func (e configErrors) Error() string {
+	lines := make([]string, 0, len(e)+1)
+	lines = append(lines, fmt.Sprintf("config has %d problem(s):", len(e)))
+	for _, p := range e {
+		lines = append(lines, "    "+p.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// parseConfig decodes and validates the content of a config file. All the problems
+// found, including unknown keys, missing fields and malformed addresses, are returned
+// together as configErrors.
+func parseConfig(content []byte) (*tConfigs, error) {
+	paths, lines, err := indexConfigLines(content)
+	if err != nil {
+		return nil, configErrors{syntaxProblem(content, err)}
+	}
+
+	problems := make(configErrors, 0)
+	problems = append(problems, unknownKeys(paths, lines)...)
+
+	cfg := &tConfigs{Tunnels: make([]*tConfig, 0)}
+	err = json.Unmarshal(content, cfg)
+	if err != nil {
+		// json-iterator doesn't tell where the mistyped value is, the standard decoder does
+		if typeErr, ok := stdjson.Unmarshal(content, &tConfigs{}).(*stdjson.UnmarshalTypeError); ok {
+			err = typeErr
+		}
+		problems = append(problems, syntaxProblem(content, err))
+		return nil, problems
+	}
+
+	for i, tn := range cfg.Tunnels {
+		prefix := "tunnels[" + strconv.Itoa(i) + "]"
+		if tn != nil {
+			tn.origin = prefix
+		}
+		problems = append(problems, checkTunnelConfig(prefix, tn, lines)...)
+	}
+	instances, tplProblems := expandTemplates(cfg.Templates, lines)
+	problems = append(problems, tplProblems...)
+	cfg.Tunnels = append(cfg.Tunnels, instances...)
+	problems = append(problems, checkDependencies(cfg.Tunnels, lines)...)
+	if cfg.Socks != nil {
+		problems = append(problems, checkSocksConfig(cfg, lines)...)
+	}
+
+	if len(problems) > 0 {
+		sort.SliceStable(problems, func(i, j int) bool {
+			return problems[i].line < problems[j].line
+		})
+		return nil, problems
+	}
+	return cfg, nil
+}
+
+// checkTunnelConfig checks the required fields and address formats of the tunnel at prefix,
+// e.g. tunnels[0]
+func checkTunnelConfig(prefix string, tn *tConfig, lines map[string]int) (problems []*configProblem) {
+	if tn == nil {
+		return []*configProblem{{line: lines[prefix], field: prefix, msg: "tunnel should be an object"}}
+	}
+	add := func(field, msg string) {
+		p := prefix + "." + field
+		line, ok := lines[p]
+		if !ok {
+			line = lines[prefix]
+		}
+		problems = append(problems, &configProblem{line: line, field: p, msg: msg})
+	}
+
+	if tn.Local == "" {
+		add("local", "required field is missing")
+	} else if err := checkHostPort(tn.Local); err != nil {
+		add("local", err.Error())
+	}
+
+	if tn.SshServer == "" {
+		add("ssh_server", "required field is missing")
+	} else if err := checkServer(tn.SshServer); err != nil {
+		add("ssh_server", err.Error())
+	}
+
+	if tn.Reverse && (tn.Dynamic || len(tn.Backends) > 0 || tn.UDP || tn.RemoteProbe > 0) {
+		add("reverse", "a reverse tunnel forwards to local, dynamic, backends, udp and remote_probe are not supported")
+	}
+	if tn.RemoteBind != "" && !tn.Reverse {
+		add("remote_bind", "the host listened on the ssh server, only a reverse tunnel has it")
+	}
+	if tn.Dynamic {
+		if tn.MapTo != "" {
+			add("map_to", "a dynamic tunnel forwards to the destinations requested by the clients, map_to is not allowed")
+		}
+		if len(tn.Backends) > 0 || tn.UDP || tn.RemoteProbe > 0 {
+			add("dynamic", "backends, udp and remote_probe need map_to")
+		}
+	} else if tn.MapTo == "" {
+		add("map_to", "required field is missing")
+	} else if err := checkHostPort(tn.MapTo); err != nil {
+		add("map_to", err.Error())
+	}
+
+	if tn.MaxConnectionAge < 0 {
+		add("max_connection_age", "should not be negative")
+	}
+	if tn.WarnConnections < 0 {
+		add("warn_connections", "should not be negative")
+	}
+	if tn.MaxConns < 0 {
+		add("max_conns", "should not be negative")
+	}
+	if tn.Heartbeat < 0 {
+		add("heartbeat", "should not be negative")
+	}
+	if tn.DialTimeout < 0 {
+		add("dial_timeout", "should not be negative")
+	}
+	if tn.IdleTimeout < 0 {
+		add("idle_timeout", "should not be negative")
+	}
+	if tn.MaxRetries < 0 {
+		add("max_retries", "should not be negative")
+	}
+	if err := checkAuth(tn.Auth); err != nil {
+		add("auth", err.Error())
+	}
+	if err := checkJumpHosts(tn.Jump); err != nil {
+		add("jump", err.Error())
+	}
+	if _, err := internal.ParseSchedule(tn.Schedule); err != nil {
+		add("schedule", err.Error())
+	}
+	if tn.RemoteProbe < 0 {
+		add("remote_probe", "should not be negative")
+	} else if tn.RemoteProbe == 0 && tn.ReconnectOnRemoteDown {
+		add("reconnect_on_remote_down", "requires remote_probe")
+	}
+	if _, err := ssh.ParseKeepaliveMethod(tn.Keepalive); err != nil {
+		add("keepalive", err.Error())
+	}
+	if tn.MaxKeepaliveMisses < 0 {
+		add("max_keepalive_misses", "should not be negative")
+	}
+	for i, backend := range tn.Backends {
+		if err := checkHostPort(backend); err != nil {
+			add("backends["+strconv.Itoa(i)+"]", err.Error())
+		}
+	}
+	if _, err := ssh.ParseBalanceStrategy(tn.Balance); err != nil {
+		add("balance", err.Error())
+	}
+	return
+}
+
+// checkSocksConfig checks the SOCKS proxy config, the tunnels it routes to must be
+// defined in the config
+func checkSocksConfig(cfg *tConfigs, lines map[string]int) (problems []*configProblem) {
+	add := func(field, msg string) {
+		line, ok := lines[field]
+		if !ok {
+			line = lines["socks"]
+		}
+		problems = append(problems, &configProblem{line: line, field: field, msg: msg})
+	}
+	names := make(map[string]bool, len(cfg.Tunnels))
+	for _, tn := range cfg.Tunnels {
+		if tn != nil {
+			names[tn.Name] = true
+		}
+	}
+	checkTunnel := func(field, name string) {
+		if !names[name] {
+			add(field, "tunnel "+strconv.Quote(name)+" is not defined in tunnels")
+		}
+	}
+
+	sc := cfg.Socks
+	if sc.Listen == "" {
+		add("socks.listen", "required field is missing")
+	} else if err := checkHostPort(sc.Listen); err != nil {
+		add("socks.listen", err.Error())
+	}
+	if len(sc.Routes) == 0 && sc.Default == "" {
+		add("socks.routes", "either routes or default is required")
+	}
+	for i, rt := range sc.Routes {
+		prefix := "socks.routes[" + strconv.Itoa(i) + "]"
+		if rt == nil {
+			add(prefix, "route should be an object")
+			continue
+		}
+		if _, _, err := net.ParseCIDR(rt.CIDR); err != nil {
+			add(prefix+".cidr", "invalid CIDR "+strconv.Quote(rt.CIDR))
+		}
+		if rt.Tunnel == "" {
+			add(prefix+".tunnel", "required field is missing")
+		} else {
+			checkTunnel(prefix+".tunnel", rt.Tunnel)
+		}
+	}
+	if sc.Default != "" {
+		checkTunnel("socks.default", sc.Default)
+	}
+	return
+}
+
+// checkDependencies checks that the tunnels depended on are defined and there is no cycle
+func checkDependencies(tns []*tConfig, lines map[string]int) (problems []*configProblem) {
+	defined := make(map[string]bool, len(tns))
+	for _, tn := range tns {
+		if tn != nil {
+			defined[tn.Name] = true
+		}
+	}
+	for i, tn := range tns {
+		if tn == nil {
+			continue
+		}
+		for j, dep := range tn.DependsOn {
+			field := "tunnels[" + strconv.Itoa(i) + "].depends_on[" + strconv.Itoa(j) + "]"
+			if dep == tn.Name {
+				problems = append(problems, &configProblem{line: lines[field], field: field, msg: "tunnel can not depend on itself"})
+			} else if !defined[dep] {
+				problems = append(problems, &configProblem{
+					line: lines[field], field: field, msg: "tunnel " + strconv.Quote(dep) + " is not defined in tunnels"})
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return
+	}
+	if _, err := orderByDependencies(tns); err != nil {
+		problems = append(problems, &configProblem{line: lines["tunnels"], field: "tunnels", msg: err.Error()})
+	}
+	return
+}
+
+// selectOnly leaves the tunnels not named in names and not depended on by the named ones
+// opened without connecting, so that they can be brought up later.
+func selectOnly(tns []*tConfig, names []string) error {
+	byName := make(map[string]*tConfig, len(tns))
+	for _, tn := range tns {
+		byName[tn.Name] = tn
+	}
+	selected := make(map[string]bool, len(names))
+	queue := make([]string, 0, len(names))
+	for _, name := range names {
+		if _, ok := byName[name]; !ok {
+			return fmt.Errorf("tunnel %s is not defined in the config", strconv.Quote(name))
+		}
+		queue = append(queue, name)
+	}
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		if selected[name] {
+			continue
+		}
+		selected[name] = true
+		if tn := byName[name]; tn != nil {
+			queue = append(queue, tn.DependsOn...)
+		}
+	}
+	for _, tn := range tns {
+		if !selected[tn.Name] {
+			tn.DontConnect = true
+		}
+	}
+	return nil
+}
+
+// orderByDependencies sorts the tunnels so that every tunnel comes after the tunnels it
+// depends on. Tunnels without dependencies come first, and the order in the config is kept
+// otherwise. An error describing the cycle is returned if the dependencies have one.
+func orderByDependencies(tns []*tConfig) ([]*tConfig, error) {
+	byName := make(map[string]*tConfig, len(tns))
+	for _, tn := range tns {
+		byName[tn.Name] = tn
+	}
+	pending := make(map[*tConfig]int, len(tns))
+	dependents := make(map[string][]*tConfig)
+	queue := make([]*tConfig, 0, len(tns))
+	for _, tn := range tns {
+		for _, dep := range tn.DependsOn {
+			if _, ok := byName[dep]; ok {
+				pending[tn]++
+				dependents[dep] = append(dependents[dep], tn)
+			}
+		}
+		if pending[tn] == 0 {
+			queue = append(queue, tn)
+		}
+	}
+	ordered := make([]*tConfig, 0, len(tns))
+	for len(queue) > 0 {
+		tn := queue[0]
+		queue = queue[1:]
+		ordered = append(ordered, tn)
+		for _, d := range dependents[tn.Name] {
+			pending[d]--
+			if pending[d] == 0 {
+				queue = append(queue, d)
+			}
+		}
+	}
+	if len(ordered) == len(tns) {
+		return ordered, nil
+	}
+
+	// walk through the unresolved tunnels to find the cycle
+	var start *tConfig
+	for _, tn := range tns {
+		if pending[tn] > 0 {
+			start = tn
+			break
+		}
+	}
+	visited := make(map[string]int)
+	path := make([]string, 0)
+	for tn := start; ; {
+		if idx, ok := visited[tn.Name]; ok {
+			path = append(path[idx:], tn.Name)
+			break
+		}
+		visited[tn.Name] = len(path)
+		path = append(path, tn.Name)
+		for _, dep := range tn.DependsOn {
+			if d, ok := byName[dep]; ok && pending[d] > 0 {
+				tn = d
+				break
+			}
+		}
+	}
+	return nil, errors.New("dependency cycle: " + strings.Join(path, " -> "))
+}
+
+// checkHostPort checks that the address is in form of "host:port"
+func checkHostPort(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return errors.New("invalid address " + strconv.Quote(addr) + ", should be in form of host:port")
+	}
+	return checkPort(port)
+}
+
+func checkPort(port string) error {
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 0 || p > 65535 {
+		return errors.New("invalid port " + strconv.Quote(port))
+	}
+	return nil
+}
+
+// checkServer checks that the address is in form of "[user@]host[:port]", the user may come
+// from the ssh_config of the host
+func checkServer(server string) error {
+	host := server
+	if i := strings.LastIndex(server, "@"); i >= 0 {
+		host = server[i+1:]
+		if i == 0 || host == "" {
+			return errors.New("invalid ssh server " + strconv.Quote(server) + ", should be in form of [user@]host[:port]")
+		}
+	}
+	if _, port, err := net.SplitHostPort(host); err == nil {
+		return checkPort(port)
+	}
+	return nil
+}
+
+// checkJumpHosts checks the jump hosts separated by commas, each is an ssh server
+func checkJumpHosts(jump string) error {
+	for _, hop := range ssh.ParseJumpHosts(jump) {
+		if err := checkServer(hop); err != nil {
+			return errors.New("invalid jump host: " + err.Error())
+		}
+	}
+	return nil
+}
+
+// unknownKeys reports keys that are not known by the config structs
+func unknownKeys(paths []string, lines map[string]int) (problems []*configProblem) {
+	topFields := jsonFields(tConfigs{})
+	nested := []struct {
+		ptn   *regexp.Regexp
+		known map[string]bool
+	}{
+		{tunnelFieldPtn, jsonFields(tConfig{})},
+		{socksFieldPtn, jsonFields(socksConfig{})},
+		{socksRouteFieldPtn, jsonFields(socksRouteConfig{})},
+		{templateFieldPtn, jsonFields(tunnelTemplate{})},
+		{templateTunnelPtn, jsonFields(tConfig{})},
+	}
+	for _, p := range paths {
+		var key string
+		var known map[string]bool
+		if !strings.ContainsAny(p, ".[") {
+			key, known = p, topFields
+		} else {
+			for _, n := range nested {
+				if m := n.ptn.FindStringSubmatch(p); m != nil {
+					key, known = m[1], n.known
+					break
+				}
+			}
+			if known == nil {
+				continue
+			}
+		}
+		if known[key] {
+			continue
+		}
+		msg := "unknown field"
+		if s := suggestField(key, known); s != "" {
+			msg += ", did you mean " + strconv.Quote(s) + "?"
+		}
+		problems = append(problems, &configProblem{line: lines[p], field: p, msg: msg})
+	}
+	return
+}
+
+// suggestField returns the known field which only differs from key by cases or underscores
+func suggestField(key string, known map[string]bool) string {
+	normalize := func(s string) string {
+		return strings.ToLower(strings.Replace(strings.Replace(s, "_", "", -1), "-", "", -1))
+	}
+	nk := normalize(key)
+	for f := range known {
+		if normalize(f) == nk {
+			return f
+		}
+	}
+	return ""
+}
+
+// jsonFields returns the json names of the fields of struct v
+func jsonFields(v interface{}) map[string]bool {
+	tp := reflect.TypeOf(v)
+	fields := make(map[string]bool, tp.NumField())
+	for i := 0; i < tp.NumField(); i++ {
+		name := strings.Split(tp.Field(i).Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" {
+			fields[name] = true
+		}
+	}
+	return fields
+}
+
+// indexConfigLines walks through the json document and records the line number of every
+// object key and array element by its json path, e.g. "tunnels[1].map_to". The paths are
+// returned in document order. It's walked by the standard decoder, json-iterator has no
+// tokens with their offsets.
+func indexConfigLines(content []byte) (paths []string, lines map[string]int, err error) {
+	dec := stdjson.NewDecoder(bytes.NewReader(content))
+	lines = make(map[string]int)
+
+	var walk func(path string) error
+	walk = func(path string) error {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		if _, ok := lines[path]; !ok && path != "" {
+			lines[path] = lineAt(content, dec.InputOffset())
+		}
+		delim, ok := tok.(stdjson.Delim)
+		if !ok {
+			return nil
+		}
+		switch delim {
+		case '{':
+			for dec.More() {
+				key, err := dec.Token()
+				if err != nil {
+					return err
+				}
+				p, _ := key.(string)
+				if path != "" {
+					p = path + "." + p
+				}
+				paths = append(paths, p)
+				lines[p] = lineAt(content, dec.InputOffset())
+				if err := walk(p); err != nil {
+					return err
+				}
+			}
+		case '[':
+			for i := 0; dec.More(); i++ {
+				p := path + "[" + strconv.Itoa(i) + "]"
+				paths = append(paths, p)
+				if err := walk(p); err != nil {
+					return err
+				}
+			}
+		}
+		// consume the closing delimiter
+		_, err = dec.Token()
+		return err
+	}
+
+	if err = walk(""); err != nil {
+		return nil, nil, err
+	}
+	if len(paths) == 0 && !bytes.HasPrefix(bytes.TrimSpace(content), []byte("{")) {
+		return nil, nil, errors.New("config should be a json object")
+	}
+	return paths, lines, nil
+}
+
+// syntaxProblem converts a json decoding error to a configProblem with line context
+func syntaxProblem(content []byte, err error) *configProblem {
+	switch e := err.(type) {
+	case *stdjson.SyntaxError:
+		return &configProblem{line: lineAt(content, e.Offset), msg: e.Error()}
+	case *stdjson.UnmarshalTypeError:
+		return &configProblem{
+			line:  lineAt(content, e.Offset),
+			field: e.Field,
+			msg:   "should be a " + e.Type.String() + " but got " + e.Value,
+		}
+	}
+	return &configProblem{msg: err.Error()}
+}
+
+// lineAt returns the 1-based line number of the offset in content
+func lineAt(content []byte, offset int64) int {
+	if offset > int64(len(content)) {
+		offset = int64(len(content))
+	}
+	return bytes.Count(content[:offset], []byte("\n")) + 1
+}
@@ -0,0 +1,190 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSelectOnly(t *testing.T) {
+	tns := []*tConfig{
+		{Name: "bastion"},
+		{Name: "db", DependsOn: []string{"bastion"}},
+		{Name: "cache"},
+		{Name: "web", DontConnect: true},
+	}
+	if err := selectOnly(tns, []string{"db", "web"}); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]bool{"bastion": false, "db": false, "cache": true, "web": true}
+	for _, tn := range tns {
+		if tn.DontConnect != want[tn.Name] {
+			t.Errorf("tunnel %s: do_not_connect = %v, want %v", tn.Name, tn.DontConnect, want[tn.Name])
+		}
+	}
+
+	if err := selectOnly(tns, []string{"nope"}); err == nil {
+		t.Error("expected an error selecting an undefined tunnel")
+	}
+}
+
+func TestParseConfig_Heartbeat(t *testing.T) {
+	cfg, err := parseConfig([]byte(`{"tunnels": [{"name": "db", "local": ":13306", "ssh_server": "mario@host:22",
+		"map_to": "127.0.0.1:3306", "heartbeat": 5}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Tunnels[0].Heartbeat != 5 {
+		t.Errorf("unexpected heartbeat %d", cfg.Tunnels[0].Heartbeat)
+	}
+
+	_, err = parseConfig([]byte(`{"tunnels": [{"name": "db", "local": ":13306", "ssh_server": "mario@host:22",
+		"map_to": "127.0.0.1:3306", "heartbeat": -1}]}`))
+	if err == nil || !strings.Contains(err.Error(), "tunnels[0].heartbeat") {
+		t.Errorf("expected an error of the negative heartbeat, got %v", err)
+	}
+}
+
+func TestParseConfig_Auth(t *testing.T) {
+	cfg, err := parseConfig([]byte(`{"tunnels": [{"name": "db", "local": ":13306", "ssh_server": "mario@host:22",
+		"map_to": "127.0.0.1:3306", "auth": "password"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Tunnels[0].Auth != authPassword {
+		t.Errorf("unexpected auth %q", cfg.Tunnels[0].Auth)
+	}
+	// the password is asked on the terminal only
+	if err := readPasswords(cfg.Tunnels, false); err == nil || !strings.Contains(err.Error(), "db") {
+		t.Errorf("expected an error of the password of db without a terminal, got %v", err)
+	}
+
+	_, err = parseConfig([]byte(`{"tunnels": [{"name": "db", "local": ":13306", "ssh_server": "mario@host:22",
+		"map_to": "127.0.0.1:3306", "auth": "token"}]}`))
+	if err == nil || !strings.Contains(err.Error(), "tunnels[0].auth") {
+		t.Errorf("expected an error of the unknown auth, got %v", err)
+	}
+}
+
+func TestParseConfig_Options(t *testing.T) {
+	cases := []struct {
+		field string
+
+		// good and bad the fields added to the tunnel, bad is an error of field
+		good, bad string
+
+		// got the value parsed into the tunnel, opts the options it makes
+		got  func(tn *tConfig) interface{}
+		want interface{}
+		opts int
+	}{
+		{"jump", `"jump": "luigi@bastion:2222,inner"`, `"jump": "bastion,@inner"`,
+			func(tn *tConfig) interface{} { return tn.Jump }, "luigi@bastion:2222,inner", 1},
+		{"reverse", `"reverse": true`, `"reverse": true, "backends": ["127.0.0.1:9001"]`,
+			func(tn *tConfig) interface{} { return tn.Reverse }, true, 1},
+		{"remote_bind", `"reverse": true, "remote_bind": "0.0.0.0"`, `"remote_bind": "0.0.0.0"`,
+			func(tn *tConfig) interface{} { return tn.RemoteBind }, "0.0.0.0", 2},
+		{"max_retries", `"max_retries": 3`, `"max_retries": -1`,
+			func(tn *tConfig) interface{} { return tn.MaxRetries }, 3, 1},
+		{"max_conns", `"max_conns": 100`, `"max_conns": -1`,
+			func(tn *tConfig) interface{} { return tn.MaxConns }, 100, 1},
+		{"idle_timeout", `"idle_timeout": 300`, `"idle_timeout": -1`,
+			func(tn *tConfig) interface{} { return tn.IdleTimeout }, 300, 1},
+		{"max_keepalive_misses", `"max_keepalive_misses": 3`, `"max_keepalive_misses": -1`,
+			func(tn *tConfig) interface{} { return tn.MaxKeepaliveMisses }, 3, 1},
+	}
+	tunnel := func(fields string) []byte {
+		return []byte(`{"tunnels": [{"name": "db", "local": ":13306", "ssh_server": "mario@host:22",
+			"map_to": "127.0.0.1:3306", ` + fields + `}]}`)
+	}
+	for _, c := range cases {
+		cfg, err := parseConfig(tunnel(c.good))
+		if err != nil {
+			t.Errorf("%s: %v", c.field, err)
+			continue
+		}
+		if got := c.got(cfg.Tunnels[0]); got != c.want {
+			t.Errorf("%s: got %v, want %v", c.field, got, c.want)
+		}
+		if n := len(cfg.Tunnels[0].options()); n != c.opts {
+			t.Errorf("%s: expected %d options, got %d", c.field, c.opts, n)
+		}
+
+		_, err = parseConfig(tunnel(c.bad))
+		if err == nil || !strings.Contains(err.Error(), "tunnels[0]."+c.field) {
+			t.Errorf("%s: expected an error of %s, got %v", c.field, c.bad, err)
+		}
+	}
+}
+
+func TestParseConfig_Dynamic(t *testing.T) {
+	cfg, err := parseConfig([]byte(`{"tunnels": [{"name": "proxy", "local": "127.0.0.1:1080", "ssh_server": "mario@host:22",
+		"dynamic": true}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.Tunnels[0].Dynamic || cfg.Tunnels[0].MapTo != "" {
+		t.Errorf("unexpected dynamic tunnel %+v", cfg.Tunnels[0])
+	}
+
+	_, err = parseConfig([]byte(`{"tunnels": [{"name": "proxy", "local": "127.0.0.1:1080", "ssh_server": "mario@host:22",
+		"dynamic": true, "map_to": "127.0.0.1:80", "udp": true}]}`))
+	if err == nil || !strings.Contains(err.Error(), "tunnels[0].map_to") || !strings.Contains(err.Error(), "tunnels[0].dynamic") {
+		t.Errorf("expected the errors of map_to and udp of the dynamic tunnel, got %v", err)
+	}
+}
+
+func TestParseConfig_Schedule(t *testing.T) {
+	cfg, err := parseConfig([]byte(`{"tunnels": [{"name": "db", "local": ":13306", "ssh_server": "mario@host:22",
+		"map_to": "127.0.0.1:3306", "schedule": ["mon-fri 09:00-18:00", "sat 10:00-12:00"]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Tunnels[0].Schedule) != 2 {
+		t.Errorf("expected 2 windows, got %v", cfg.Tunnels[0].Schedule)
+	}
+
+	_, err = parseConfig([]byte(`{"tunnels": [{"name": "db", "local": ":13306", "ssh_server": "mario@host:22",
+		"map_to": "127.0.0.1:3306", "schedule": ["weekdays 09:00-18:00"]}]}`))
+	if err == nil || !strings.Contains(err.Error(), "tunnels[0].schedule") {
+		t.Errorf("expected an error of the schedule, got %v", err)
+	}
+}
+
+func TestParseConfig_Templates(t *testing.T) {
+	cfg, err := parseConfig([]byte(`{"tunnels": [], "templates": [{
+		"tunnel": {"name": "db-{{.env}}", "local": ":{{.port}}", "ssh_server": "mario@{{.env}}.corp:22",
+			"map_to": "127.0.0.1:5432", "backends": ["10.0.0.2:5432"], "env": {"STAGE": "{{.env}}"}},
+		"instances": [{"env": "prod", "port": "15432"}, {"env": "staging", "port": "25432"}]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Tunnels) != 2 {
+		t.Fatalf("expected 2 tunnels expanded, got %d", len(cfg.Tunnels))
+	}
+	staging := cfg.Tunnels[1]
+	if staging.Name != "db-staging" || staging.Local != ":25432" || staging.SshServer != "mario@staging.corp:22" ||
+		staging.Env["STAGE"] != "staging" {
+		t.Errorf("unexpected instance %+v", staging)
+	}
+	if cfg.Tunnels[0].Env["STAGE"] != "prod" {
+		t.Error("the instances should not share the env of the template")
+	}
+	if kept := withoutInstances(cfg.Tunnels); len(kept) != 0 {
+		t.Errorf("the instances should not be written back, got %d", len(kept))
+	}
+
+	_, err = parseConfig([]byte(`{"tunnels": [], "templates": [{
+		"tunnel": {"name": "db-{{.env}}", "local": ":{{.port}}", "ssh_server": "mario@host:22", "map_to": "127.0.0.1:5432"},
+		"instances": [{"env": "prod"}]}]}`))
+	if err == nil || !strings.Contains(err.Error(), `templates[0].instances[0]`) ||
+		!strings.Contains(err.Error(), `variable "port" is not provided`) {
+		t.Errorf("expected an error of the missing variable, got %v", err)
+	}
+
+	_, err = parseConfig([]byte(`{"tunnels": [], "templates": [{
+		"tunnel": {"name": "db-{{.env}}", "local": ":{{.port}}", "ssh_server": "mario@host:22", "map_to": "127.0.0.1"},
+		"instances": [{"env": "prod", "port": "15432"}]}]}`))
+	if err == nil || !strings.Contains(err.Error(), "templates[0].instances[0].map_to") {
+		t.Errorf("expected an error of the expanded tunnel, got %v", err)
+	}
+}
@@ -0,0 +1,117 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/Jonwing/mario/internal"
+	"github.com/Jonwing/mario/pkg/ssh"
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	// defaultCycleDelay is the pause between reconnecting two tunnels by `cycle`
+	defaultCycleDelay = 2 * time.Second
+
+	// defaultCycleTimeout is how long `cycle` waits for a tunnel to reconnect
+	defaultCycleTimeout = 30 * time.Second
+)
+
+// cycleCommand reconnects the tunnels one at a time for a rolling restart, e.g. after the
+// credentials are rotated, so that they don't reconnect all at once like `up`
+type cycleCommand struct {
+	command
+
+	// delay the pause between two tunnels
+	delay time.Duration
+
+	// timeout how long a tunnel is waited for to reconnect before moving on
+	timeout time.Duration
+}
+
+func (c *cycleCommand) ClearFlags() {
+	c.command.ClearFlags()
+	c.delay = defaultCycleDelay
+	c.timeout = defaultCycleTimeout
+}
+
+func (c *cycleCommand) Run(cmd *cobra.Command, args []string) {
+	tns := make([]*internal.TunnelInfo, 0)
+	for _, tn := range c.root.dashboard.GetTunnels() {
+		// the tunnels closed or never connected are left as they are, unless they are broken
+		if st := tn.Status(); (st == ssh.StatusClosed || st == ssh.StatusNew) && tn.Error() == nil {
+			continue
+		}
+		tns = append(tns, tn)
+	}
+	if len(tns) == 0 {
+		fmt.Println("no tunnels to cycle")
+		return
+	}
+
+	rows := make([][]string, 0, len(tns))
+	failed := 0
+	for idx, tn := range tns {
+		if idx > 0 {
+			time.Sleep(c.delay)
+		}
+		fmt.Printf("[%d/%d] reconnecting %s...\n", idx+1, len(tns), tn.GetName())
+		started := time.Now()
+		result := "connected"
+		if err := c.restart(tn); err != nil {
+			failed++
+			result = err.Error()
+		}
+		took := time.Since(started).Round(time.Millisecond).String()
+		fmt.Printf("[%d/%d] %s: %s in %s\n", idx+1, len(tns), tn.GetName(), result, took)
+		rows = append(rows, []string{strconv.Itoa(tn.GetID()), tn.GetName(), result, took})
+	}
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"id", "name", "result", "took"})
+	table.SetAutoWrapText(false)
+	table.SetRowLine(false)
+	table.AppendBulk(rows)
+	table.Render()
+	fmt.Printf("%d reconnected, %d failed\n", len(tns)-failed, failed)
+}
+
+// restart reconnects the tunnel and waits until it's connected or failed
+func (c *cycleCommand) restart(tn *internal.TunnelInfo) error {
+	waiting := make(chan error, 1)
+	c.root.dashboard.Mario.Restart(tn, waiting)
+	select {
+	case err := <-waiting:
+		if err != nil {
+			return err
+		}
+	case <-time.After(c.timeout):
+		return fmt.Errorf("not reconnected after %s", c.timeout)
+	}
+	return tn.WaitForStatus(ssh.StatusConnected, c.timeout)
+}
+
+func NewCycleCommand(root *interactiveCmd) *cycleCommand {
+	c := &cycleCommand{
+		command: command{
+			root: root,
+			name: "cycle",
+			cmd: &cobra.Command{
+				Use:   "cycle",
+				Short: "reconnect the tunnels one at a time, e.g. for a rolling restart after rotating the keys",
+				Args:  cobra.NoArgs,
+			},
+			children: make([]promptCommand, 0),
+		},
+		delay:   defaultCycleDelay,
+		timeout: defaultCycleTimeout,
+	}
+	c.cmd.Run = c.Run
+	c.cmd.Flags().DurationVar(&c.delay, "delay", defaultCycleDelay,
+		"the pause between reconnecting two tunnels")
+	c.cmd.Flags().DurationVar(&c.timeout, "timeout", defaultCycleTimeout,
+		"how long a tunnel is waited for to reconnect before moving on to the next")
+	return c
+}
@@ -0,0 +1,198 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/Jonwing/mario/pkg/ssh"
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	changeAdded   = "added"
+	changeRemoved = "removed"
+	changeChanged = "changed"
+)
+
+// tunnelChange is a difference of a tunnel between two sets of tunnel configs
+type tunnelChange struct {
+	// kind is one of added, removed and changed
+	kind string
+
+	name string
+
+	// fields describes the changed fields in form of "field: old -> new"
+	fields []string
+}
+
+// diffTunnels compares the tunnel configs from `from` to `to` by name. Tunnels only in `to`
+// are added, tunnels only in `from` are removed, and tunnels in both with different
+// settings are changed. Changes are sorted by name.
+func diffTunnels(from, to []*tConfig) []*tunnelChange {
+	index := func(cfgs []*tConfig) map[string]*tConfig {
+		m := make(map[string]*tConfig, len(cfgs))
+		for _, c := range cfgs {
+			if c != nil {
+				m[c.Name] = c
+			}
+		}
+		return m
+	}
+	fromIdx, toIdx := index(from), index(to)
+
+	changes := make([]*tunnelChange, 0)
+	for name, f := range fromIdx {
+		t, ok := toIdx[name]
+		if !ok {
+			changes = append(changes, &tunnelChange{kind: changeRemoved, name: name})
+			continue
+		}
+		if fields := diffTunnelFields(f, t); len(fields) > 0 {
+			changes = append(changes, &tunnelChange{kind: changeChanged, name: name, fields: fields})
+		}
+	}
+	for name := range toIdx {
+		if _, ok := fromIdx[name]; !ok {
+			changes = append(changes, &tunnelChange{kind: changeAdded, name: name})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].name < changes[j].name
+	})
+	return changes
+}
+
+// diffTunnelFields lists the fields that differ between two configs of the same tunnel
+func diffTunnelFields(from, to *tConfig) (fields []string) {
+	cmp := func(name, a, b string) {
+		if a != b {
+			fields = append(fields, name+": "+strconv.Quote(a)+" -> "+strconv.Quote(b))
+		}
+	}
+	autoReconnect := func(c *tConfig) string {
+		return strconv.FormatBool(c.AutoReconnect == nil || *c.AutoReconnect)
+	}
+	keepalive := func(c *tConfig) string {
+		if c.Keepalive == "" {
+			return string(ssh.KeepaliveGlobalRequest)
+		}
+		return c.Keepalive
+	}
+	balance := func(c *tConfig) string {
+		if c.Balance == "" && len(c.Backends) > 0 {
+			return string(ssh.BalanceRoundRobin)
+		}
+		return c.Balance
+	}
+	auth := func(c *tConfig) string {
+		if c.Auth == "" {
+			return authPublicKey
+		}
+		return c.Auth
+	}
+	keepaliveReply := func(c *tConfig) string {
+		return strconv.FormatBool(c.KeepaliveReply == nil || *c.KeepaliveReply)
+	}
+	cmp("local", from.Local, to.Local)
+	cmp("ssh_server", from.SshServer, to.SshServer)
+	cmp("map_to", from.MapTo, to.MapTo)
+	cmp("private_key", from.PrivateKey, to.PrivateKey)
+	cmp("max_connection_age", strconv.Itoa(from.MaxConnectionAge), strconv.Itoa(to.MaxConnectionAge))
+	cmp("heartbeat", strconv.Itoa(from.Heartbeat), strconv.Itoa(to.Heartbeat))
+	cmp("dial_timeout", strconv.Itoa(from.DialTimeout), strconv.Itoa(to.DialTimeout))
+	cmp("auto_reconnect", autoReconnect(from), autoReconnect(to))
+	cmp("idle_timeout", strconv.Itoa(from.IdleTimeout), strconv.Itoa(to.IdleTimeout))
+	cmp("max_retries", strconv.Itoa(from.MaxRetries), strconv.Itoa(to.MaxRetries))
+	cmp("identity_agent", from.IdentityAgent, to.IdentityAgent)
+	cmp("warn_connections", strconv.Itoa(from.WarnConnections), strconv.Itoa(to.WarnConnections))
+	cmp("max_conns", strconv.Itoa(from.MaxConns), strconv.Itoa(to.MaxConns))
+	cmp("env", formatEnv(from.Env), formatEnv(to.Env))
+	cmp("keepalive", keepalive(from), keepalive(to))
+	cmp("keepalive_reply", keepaliveReply(from), keepaliveReply(to))
+	cmp("max_keepalive_misses", strconv.Itoa(from.MaxKeepaliveMisses), strconv.Itoa(to.MaxKeepaliveMisses))
+	cmp("backends", strings.Join(from.Backends, ","), strings.Join(to.Backends, ","))
+	cmp("balance", balance(from), balance(to))
+	cmp("auth", auth(from), auth(to))
+	cmp("remote_probe", strconv.Itoa(from.RemoteProbe), strconv.Itoa(to.RemoteProbe))
+	cmp("reconnect_on_remote_down", strconv.FormatBool(from.ReconnectOnRemoteDown),
+		strconv.FormatBool(to.ReconnectOnRemoteDown))
+	cmp("reverse", strconv.FormatBool(from.Reverse), strconv.FormatBool(to.Reverse))
+	cmp("remote_bind", from.RemoteBind, to.RemoteBind)
+	cmp("dynamic", strconv.FormatBool(from.Dynamic), strconv.FormatBool(to.Dynamic))
+	cmp("jump", from.Jump, to.Jump)
+	cmp("udp", strconv.FormatBool(from.UDP), strconv.FormatBool(to.UDP))
+	cmp("schedule", strings.Join(from.Schedule, ", "), strings.Join(to.Schedule, ", "))
+	return
+}
+
+// formatEnv formats the environment variables as sorted name=value pairs
+func formatEnv(env map[string]string) string {
+	pairs := make([]string, 0, len(env))
+	for k, v := range env {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, " ")
+}
+
+// diffCommand shows how the running tunnels differ from a config file
+type diffCommand struct {
+	command
+
+	table *tablewriter.Table
+}
+
+func (d *diffCommand) Run(cmd *cobra.Command, args []string) {
+	file := path.Join(GetUserHome(), "tunnels.json")
+	if len(args) > 0 {
+		file = args[0]
+	}
+	loaded, err := LoadJsonConfig(file)
+	if err != nil {
+		fmt.Println("can not load", file, "because of:", err)
+		return
+	}
+
+	running := make([]*tConfig, 0)
+	for _, tn := range d.root.dashboard.GetTunnels() {
+		running = append(running, tunnelConfig(tn))
+	}
+
+	// show the changes from the file to the running tunnels, so "added" tunnels are
+	// the ones that would be added to the file by save
+	changes := diffTunnels(loaded.Tunnels, running)
+	if len(changes) == 0 {
+		fmt.Println("running tunnels are the same as", file)
+		return
+	}
+	d.table.ClearRows()
+	for _, c := range changes {
+		d.table.Append([]string{c.kind, c.name, strings.Join(c.fields, "\n")})
+	}
+	d.table.Render()
+}
+
+func NewDiffCommand(root *interactiveCmd) *diffCommand {
+	d := &diffCommand{
+		command: command{
+			root: root,
+			name: "diff",
+			cmd: &cobra.Command{
+				Use:   "diff [config file]",
+				Short: "compare running tunnels with a config file, default to ~/tunnels.json",
+				Args:  cobra.MaximumNArgs(1),
+			},
+			children: make([]promptCommand, 0),
+		},
+		table: tablewriter.NewWriter(os.Stdout),
+	}
+	d.table.SetHeader([]string{"change", "name", "detail"})
+	d.table.SetAutoWrapText(false)
+	d.table.SetRowLine(true)
+	d.cmd.Run = d.Run
+	return d
+}
@@ -0,0 +1,134 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/c-bata/go-prompt"
+	"github.com/spf13/cobra"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultEditTimeout is how long `edit` waits for the tunnel to reconnect with the new addresses
+const defaultEditTimeout = 30 * time.Second
+
+// editCommand changes the local address, the ssh server and the remote of a tunnel in place, the
+// id, name and settings of the tunnel are kept
+// usage:
+//
+//	edit <tunnel_id> [--local addr] [--server user@host] [--remote addr]
+//	edit --name tunnel_name [--local addr] [--server user@host] [--remote addr]
+type editCommand struct {
+	command
+
+	tunnelName string
+
+	local  string
+	server string
+	remote string
+
+	// timeout how long the tunnel is waited for to reconnect
+	timeout time.Duration
+
+	listCmd *listCommand
+}
+
+func (c *editCommand) ClearFlags() {
+	c.command.ClearFlags()
+	c.tunnelName = ""
+	c.local = ""
+	c.server = ""
+	c.remote = ""
+	c.timeout = defaultEditTimeout
+}
+
+func (c *editCommand) Complete(args []string, word string) []prompt.Suggest {
+	suggests := make([]prompt.Suggest, 0)
+	if strings.HasPrefix(word, "--") {
+		c.cmd.Flags().VisitAll(flagHasPrefix(word, &suggests))
+		return suggests
+	}
+	byName := len(args) > 2 && (args[len(args)-2] == "--name" || args[len(args)-2] == "-n")
+	for _, tn := range c.root.dashboard.GetTunnels() {
+		if byName {
+			suggests = append(suggests, prompt.Suggest{
+				Text:        tn.GetName(),
+				Description: "ID: " + strconv.Itoa(tn.GetID()) + "(" + tn.GetStatus() + ")",
+			})
+			continue
+		}
+		suggests = append(suggests, prompt.Suggest{
+			Text:        strconv.Itoa(tn.GetID()),
+			Description: tn.GetName() + "(" + tn.GetStatus() + ")",
+		})
+	}
+	return prompt.FilterHasPrefix(suggests, word, true)
+}
+
+func (c *editCommand) Run(cmd *cobra.Command, args []string) {
+	if len(args) == 0 && c.tunnelName == "" {
+		fmt.Println("specify tunnel id or tunnel name")
+		return
+	}
+	c.local, c.server, c.remote = normalizeInput(c.local), normalizeInput(c.server), normalizeInput(c.remote)
+	if c.local == "" && c.server == "" && c.remote == "" {
+		fmt.Println("[Error]Should specify at least one of --local, --server and --remote")
+		return
+	}
+	var idOrName interface{} = c.tunnelName
+	if len(args) > 0 {
+		id, err := strconv.Atoi(args[0])
+		if err != nil {
+			fmt.Println("id should be a number", args[0])
+			return
+		}
+		idOrName = id
+	}
+	tn, ok := c.root.dashboard.GetTunnel(idOrName)
+	if !ok {
+		fmt.Printf("tunnel with id or name %v not found\n", idOrName)
+		return
+	}
+
+	waiting := make(chan error, 1)
+	if err := c.root.dashboard.Mario.Edit(tn, c.local, c.server, c.remote, waiting); err != nil {
+		fmt.Printf("tunnel %s is not edited: %s\n", tn.GetName(), err.Error())
+		return
+	}
+	select {
+	case err := <-waiting:
+		if err != nil {
+			fmt.Printf("tunnel %s failed to reconnect after editing: %s\n", tn.GetName(), err.Error())
+			return
+		}
+	case <-time.After(c.timeout):
+		fmt.Printf("tunnel %s is not reconnected after %s\n", tn.GetName(), c.timeout)
+		return
+	}
+	c.listCmd.Run(nil, nil)
+}
+
+func NewEditCommand(root *interactiveCmd, listCmd *listCommand) *editCommand {
+	c := &editCommand{
+		command: command{
+			root: root,
+			name: "edit",
+			cmd: &cobra.Command{
+				Use:   "edit [tunnel id] [--local addr] [--server user@host] [--remote addr]",
+				Short: "change the local address, the ssh server or the remote of a tunnel and reconnect it",
+				Args:  cobra.MaximumNArgs(1),
+			},
+			children: make([]promptCommand, 0),
+		},
+		timeout: defaultEditTimeout,
+		listCmd: listCmd,
+	}
+	c.cmd.Run = c.Run
+	c.cmd.Flags().StringVarP(&c.tunnelName, "name", "n", "", "specify tunnel name")
+	c.cmd.Flags().StringVar(&c.local, "local", "", "the new local address, e.g. :15432")
+	c.cmd.Flags().StringVar(&c.server, "server", "", "the new ssh server, e.g. user@host:22")
+	c.cmd.Flags().StringVar(&c.remote, "remote", "", "the new remote address, e.g. 127.0.0.1:5433")
+	c.cmd.Flags().DurationVar(&c.timeout, "timeout", defaultEditTimeout,
+		"how long the tunnel is waited for to reconnect with the new addresses")
+	return c
+}
@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/Jonwing/mario/internal"
+	"github.com/spf13/cobra"
+	"io"
+	"os"
+)
+
+// exitCommand quits mario, it asks for confirmation if there are connections being served
+type exitCommand struct {
+	command
+
+	force bool
+
+	// in where the answer of the confirmation is read from
+	in io.Reader
+}
+
+func (c *exitCommand) ClearFlags() {
+	c.command.ClearFlags()
+	c.force = false
+}
+
+func (c *exitCommand) Run(cmd *cobra.Command, args []string) {
+	if !c.force {
+		tunnels, conns := activeTunnels(c.root.dashboard.GetTunnels())
+		if conns > 0 && !confirm(c.in, fmt.Sprintf(
+			"%d tunnels with %d active connections — exit anyway? [y/N] ", tunnels, conns)) {
+			return
+		}
+	}
+	c.root.dashboard.Quit()
+	c.root.exitParser.Exit()
+}
+
+// activeTunnels counts the tunnels serving connections and their connections
+func activeTunnels(tns []*internal.TunnelInfo) (tunnels, conns int) {
+	for _, tn := range tns {
+		if n := tn.ConnectionCount(); n > 0 {
+			tunnels++
+			conns += n
+		}
+	}
+	return tunnels, conns
+}
+
+func NewExitCommand(root *interactiveCmd) *exitCommand {
+	c := &exitCommand{
+		command: command{
+			root: root,
+			name: "exit",
+			cmd: &cobra.Command{
+				Use:   "exit",
+				Short: "exit mario, confirm first if there are active connections",
+				Args:  cobra.NoArgs,
+			},
+			children: make([]promptCommand, 0),
+		},
+		in: os.Stdin,
+	}
+	c.cmd.Run = c.Run
+	c.cmd.Flags().BoolVarP(&c.force, "force", "f", false, "exit without confirmation")
+	return c
+}
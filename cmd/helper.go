@@ -1,12 +1,29 @@
 package cmd
 
 import (
+	"bufio"
 	"bytes"
-	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Jonwing/mario/internal"
+	"github.com/Jonwing/mario/pkg/ssh"
+	json "github.com/json-iterator/go"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh/terminal"
 	"io"
 	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"os/signal"
 	"os/user"
 	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
 func GetUserHome() string {
@@ -28,8 +45,49 @@ func PrivateKey(path string) (io.Reader, error) {
 type tConfigs struct {
 	// TunnelTimeout timeout for a tunnel in seconds
 	TunnelTimeout int `json:"tunnel_timeout,omitempty"`
+	// DialTimeout how long connecting to an ssh server may take in seconds, it overrides --dial-timeout
+	DialTimeout int `json:"dial_timeout,omitempty"`
 	// Tunnels list of tunnel config
 	Tunnels []*tConfig `json:"tunnels"`
+	// Socks runs a SOCKS5 proxy routing requests through the tunnels
+	Socks *socksConfig `json:"socks,omitempty"`
+	// Templates define similar tunnels by variables, they are expanded into Tunnels when loaded
+	Templates []*tunnelTemplate `json:"templates,omitempty"`
+}
+
+// socksConfig configures the SOCKS5 proxy which picks a tunnel for each request by
+// its destination
+type socksConfig struct {
+	// Listen the local address of the proxy, e.g. 127.0.0.1:1080
+	Listen string `json:"listen"`
+
+	// Routes the destinations routed to each tunnel, the most specific one wins
+	Routes []*socksRouteConfig `json:"routes"`
+
+	// Default name of the tunnel for destinations matching no route, these requests
+	// are refused if it's empty
+	Default string `json:"default,omitempty"`
+}
+
+type socksRouteConfig struct {
+	// CIDR the destination network, e.g. 10.0.0.0/8
+	CIDR string `json:"cidr"`
+
+	// Tunnel name of the tunnel to dial through
+	Tunnel string `json:"tunnel"`
+}
+
+// routes converts the route configs to routes of the SOCKS router
+func (c *socksConfig) routes() ([]*internal.SocksRoute, error) {
+	routes := make([]*internal.SocksRoute, 0, len(c.Routes))
+	for _, rc := range c.Routes {
+		rt, err := internal.ParseSocksRoute(rc.CIDR, rc.Tunnel)
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, rt)
+	}
+	return routes, nil
 }
 
 type tConfig struct {
@@ -44,17 +102,800 @@ type tConfig struct {
 	PrivateKey string `json:"private_key,omitempty"`
 
 	DontConnect bool `json:"do_not_connect,omitempty"`
+
+	// MaxConnectionAge the max lifetime of the ssh connection in seconds, the tunnel
+	// reconnects once it is exceeded. 0 means no limit
+	MaxConnectionAge int `json:"max_connection_age,omitempty"`
+
+	// AutoReconnect whether to reconnect when the health check fails, default to true
+	AutoReconnect *bool `json:"auto_reconnect,omitempty"`
+
+	// MaxRetries gives up reconnecting after this many failed reconnects in a row, the tunnel
+	// is left errored until it's brought up. 0 means retrying forever
+	MaxRetries int `json:"max_retries,omitempty"`
+
+	// IdentityAgent the unix socket of the ssh agent to authenticate with, like the
+	// IdentityAgent of OpenSSH. It overrides --agent-socket
+	IdentityAgent string `json:"identity_agent,omitempty"`
+
+	// WarnConnections warns once the tunnel serves more connections than it at the same
+	// time, 0 means never
+	WarnConnections int `json:"warn_connections,omitempty"`
+
+	// MaxConns caps the connections the tunnel serves at the same time, the ones beyond are
+	// closed right away. 0 means no cap
+	MaxConns int `json:"max_conns,omitempty"`
+
+	// DependsOn names of the tunnels that must be connected before this one is connected
+	DependsOn []string `json:"depends_on,omitempty"`
+
+	// Env environment variables requested on the sessions opened on the tunnel, the ssh
+	// server ignores those not in its AcceptEnv
+	Env map[string]string `json:"env,omitempty"`
+
+	// Keepalive how the ssh connection is checked: global(the keepalive@openssh.com request,
+	// default) or session(opening a session)
+	Keepalive string `json:"keepalive,omitempty"`
+
+	// KeepaliveReply whether the keepalive request waits for the reply, default to true
+	KeepaliveReply *bool `json:"keepalive_reply,omitempty"`
+
+	// MaxKeepaliveMisses the keepalives failed in a row it takes to reconnect, like the
+	// ServerAliveCountMax of OpenSSH. 0 means 1, the first failure reconnects
+	MaxKeepaliveMisses int `json:"max_keepalive_misses,omitempty"`
+
+	// Backends more remote addresses to spread the connections over together with map_to
+	Backends []string `json:"backends,omitempty"`
+
+	// Balance how a backend is picked for a connection: round-robin(default) or random
+	Balance string `json:"balance,omitempty"`
+
+	// Heartbeat the check-alive interval of the tunnel in seconds, it overrides tunnel_timeout.
+	// 0 means tunnel_timeout
+	Heartbeat int `json:"heartbeat,omitempty"`
+
+	// DialTimeout how long connecting to ssh_server may take in seconds, it overrides the global
+	// dial_timeout. 0 means the global one
+	DialTimeout int `json:"dial_timeout,omitempty"`
+
+	// IdleTimeout closes the connections moving no bytes for this many seconds, 0 means never
+	IdleTimeout int `json:"idle_timeout,omitempty"`
+
+	// RemoteProbe probes map_to through the ssh connection on every health check, the remote
+	// is down after this many failed probes in a row. 0 means no probing
+	RemoteProbe int `json:"remote_probe,omitempty"`
+
+	// ReconnectOnRemoteDown whether to reconnect the ssh connection once the remote is down,
+	// in case the forwarding is broken while the connection looks fine
+	ReconnectOnRemoteDown bool `json:"reconnect_on_remote_down,omitempty"`
+
+	// Auth how the tunnel authenticates: publickey(default) or password, which falls back to
+	// a password read from the terminal when the tunnel is opened if the keys are rejected
+	Auth string `json:"auth,omitempty"`
+
+	// Reverse makes the tunnel listen on map_to of ssh_server and forward the connections back
+	// to local like `ssh -R`, e.g. "local": "127.0.0.1:3000", "map_to": ":9000"
+	Reverse bool `json:"reverse,omitempty"`
+
+	// RemoteBind the host a reverse tunnel listens on of ssh_server in place of the one of
+	// map_to, the loopback if neither gives one. A non-loopback host like 0.0.0.0 needs
+	// GatewayPorts clientspecified in the sshd_config of the server.
+	RemoteBind string `json:"remote_bind,omitempty"`
+
+	// Dynamic makes the tunnel a SOCKS5 proxy on local dialing the destinations requested by the
+	// clients through ssh_server like `ssh -D`, map_to should be empty
+	Dynamic bool `json:"dynamic,omitempty"`
+
+	// Jump the jump hosts to reach ssh_server through like ProxyJump of OpenSSH, separated by
+	// commas, e.g. user@bastion:22,inner. "none" ignores the ProxyJump of ssh_config
+	Jump string `json:"jump,omitempty"`
+
+	// UDP forwards the datagrams sent to local over UDP too, each framed by its length in 2
+	// bytes into a TCP stream to map_to, which is a DNS server or `mario udp-relay`
+	UDP bool `json:"udp,omitempty"`
+
+	// Schedule the time windows the tunnel is up in, in the local time, e.g. "mon-fri 09:00-18:00".
+	// The tunnel is closed outside the windows, empty means always up
+	Schedule []string `json:"schedule,omitempty"`
+
+	// password the password of password auth, it's never written to the config
+	password string
+
+	// fromTemplate whether the tunnel is expanded from one of the templates
+	fromTemplate bool
+
+	// origin where the tunnel is defined in the config file, e.g. tunnels[0] or
+	// templates[0].instances[1]
+	origin string
+}
+
+// The auth of the tunnels
+const (
+	authPublicKey = "publickey"
+	authPassword  = "password"
+)
+
+// checkAuth checks the auth of a tunnel, empty means publickey
+func checkAuth(auth string) error {
+	switch auth {
+	case "", authPublicKey, authPassword:
+		return nil
+	}
+	return errors.New("unknown auth " + strconv.Quote(auth) + ", should be " + authPublicKey + " or " + authPassword)
+}
+
+// readPasswords asks for the password of every tunnel authenticating with password auth, on
+// the terminal since the password is never stored
+func readPasswords(tns []*tConfig, prompting bool) error {
+	for _, tn := range tns {
+		if tn.Auth != authPassword || tn.password != "" {
+			continue
+		}
+		if !prompting {
+			return fmt.Errorf("tunnel %s uses password auth, which needs the password typed on the terminal", tn.Name)
+		}
+		password, err := readPassword(fmt.Sprintf("password of %s for tunnel %s: ", tn.SshServer, tn.Name))
+		if err != nil {
+			return fmt.Errorf("failed to read the password of tunnel %s: %v", tn.Name, err)
+		}
+		tn.password = password
+	}
+	return nil
+}
+
+// options converts the optional settings of the tunnel to ssh options
+func (c *tConfig) options() []ssh.Option {
+	opts := make([]ssh.Option, 0)
+	if c.MaxConnectionAge > 0 {
+		opts = append(opts, ssh.WithMaxConnectionAge(time.Duration(c.MaxConnectionAge)*time.Second))
+	}
+	if c.Heartbeat > 0 {
+		opts = append(opts, ssh.WithHealthCheckInterval(time.Duration(c.Heartbeat)*time.Second))
+	}
+	if c.DialTimeout > 0 {
+		opts = append(opts, ssh.WithDialTimeout(time.Duration(c.DialTimeout)*time.Second))
+	}
+	if c.IdleTimeout > 0 {
+		opts = append(opts, ssh.WithIdleTimeout(time.Duration(c.IdleTimeout)*time.Second))
+	}
+	if c.AutoReconnect != nil {
+		opts = append(opts, ssh.WithAutoReconnect(*c.AutoReconnect))
+	}
+	if c.MaxRetries > 0 {
+		opts = append(opts, ssh.WithMaxRetries(c.MaxRetries))
+	}
+	if c.IdentityAgent != "" {
+		opts = append(opts, ssh.WithAgent(c.IdentityAgent))
+	}
+	if c.WarnConnections > 0 {
+		opts = append(opts, ssh.WithWarnConnections(c.WarnConnections))
+	}
+	if c.MaxConns > 0 {
+		opts = append(opts, ssh.WithMaxConnectors(c.MaxConns))
+	}
+	if len(c.Env) > 0 {
+		opts = append(opts, ssh.WithEnv(c.Env))
+	}
+	if c.Keepalive != "" || c.KeepaliveReply != nil {
+		// the config has been validated
+		method, _ := ssh.ParseKeepaliveMethod(c.Keepalive)
+		opts = append(opts, ssh.WithKeepalive(method, c.KeepaliveReply == nil || *c.KeepaliveReply))
+	}
+	if c.MaxKeepaliveMisses > 1 {
+		opts = append(opts, ssh.WithMaxKeepaliveMisses(c.MaxKeepaliveMisses))
+	}
+	if len(c.Backends) > 0 {
+		strategy, _ := ssh.ParseBalanceStrategy(c.Balance)
+		opts = append(opts, ssh.WithBackends(c.Backends, strategy))
+	}
+	if c.Auth == authPassword && c.password != "" {
+		opts = append(opts, ssh.WithPassword(c.password))
+	}
+	if c.RemoteProbe > 0 {
+		opts = append(opts, ssh.WithRemoteProbe(c.RemoteProbe, c.ReconnectOnRemoteDown))
+	}
+	if c.UDP {
+		opts = append(opts, ssh.WithUDP())
+	}
+	if c.Reverse {
+		opts = append(opts, ssh.WithReverse())
+	}
+	if c.RemoteBind != "" {
+		opts = append(opts, ssh.WithRemoteBind(c.RemoteBind))
+	}
+	if c.Jump != "" {
+		opts = append(opts, ssh.WithJumpHosts(ssh.ParseJumpHosts(c.Jump)))
+	}
+	return opts
+}
+
+// tunnelConfig converts a running tunnel back to its config
+func tunnelConfig(tn *internal.TunnelInfo) *tConfig {
+	_, maxRetries := tn.GetRetries()
+	cfg := &tConfig{
+		Name:             tn.GetName(),
+		Local:            tn.GetLocal(),
+		SshServer:        tn.GetConfiguredServer(),
+		MapTo:            tn.GetRemote(),
+		PrivateKey:       tn.GetPrivateKeyPath(),
+		DontConnect:      tn.GetClosed(),
+		MaxConnectionAge: int(tn.GetMaxConnectionAge().Seconds()),
+		Heartbeat:        int(tn.GetHeartbeat().Seconds()),
+		DialTimeout:      int(tn.GetDialTimeout().Seconds()),
+		IdleTimeout:      int(tn.GetIdleTimeout().Seconds()),
+		MaxRetries:       maxRetries,
+		IdentityAgent:    tn.GetAgentSocket(),
+		WarnConnections:  tn.GetWarnConnections(),
+		MaxConns:         tn.GetMaxConnectors(),
+		UDP:              tn.GetUDP(),
+		Jump:             strings.Join(tn.GetConfiguredJumpHosts(), ","),
+		Dynamic:          tn.GetRemote() == "",
+		Reverse:          tn.GetReverse(),
+		RemoteBind:       tn.GetRemoteBind(),
+		Schedule:         tn.GetSchedule().Windows(),
+	}
+	if env := tn.GetEnv(); len(env) > 0 {
+		cfg.Env = env
+	}
+	if !tn.GetAutoReconnect() {
+		autoReconnect := false
+		cfg.AutoReconnect = &autoReconnect
+	}
+	if method, reply := tn.GetKeepalive(); method != ssh.KeepaliveGlobalRequest || !reply {
+		cfg.Keepalive = string(method)
+		if !reply {
+			cfg.KeepaliveReply = &reply
+		}
+	}
+	if _, max := tn.GetKeepaliveMisses(); max > 1 {
+		cfg.MaxKeepaliveMisses = max
+	}
+	if backends := tn.GetBackends(); len(backends) > 0 {
+		cfg.Backends = backends
+		if balance := tn.GetBalance(); balance != ssh.BalanceRoundRobin {
+			cfg.Balance = string(balance)
+		}
+	}
+	if probes, reconnect := tn.GetRemoteProbe(); probes > 0 {
+		cfg.RemoteProbe, cfg.ReconnectOnRemoteDown = probes, reconnect
+	}
+	if tn.GetPasswordAuth() {
+		cfg.Auth = authPassword
+	}
+	return cfg
+}
+
+// rebase makes the heartbeat and the dial timeout of the tunnel, which tunnelConfig leaves out
+// if they are the globals of running, relative to the globals of saved instead, so that they
+// are only written if they differ from those of the file the tunnel is saved into
+func (c *tConfig) rebase(running, saved *tConfigs) {
+	c.Heartbeat = rebaseTimeout(c.Heartbeat, running.TunnelTimeout, saved.TunnelTimeout)
+	c.DialTimeout = rebaseTimeout(c.DialTimeout, running.DialTimeout, saved.DialTimeout)
+}
+
+// rebaseTimeout returns the timeout of a tunnel relative to the global saved, 0 means the global.
+// A saved global of 0 isn't known until loaded, the running one is assumed.
+func rebaseTimeout(timeout, running, saved int) int {
+	if timeout == 0 {
+		timeout = running
+	}
+	if saved == 0 {
+		saved = running
+	}
+	if timeout == saved {
+		return 0
+	}
+	return timeout
 }
 
+// LoadJsonConfig reads the config file and validates it, problems found in the
+// file are reported together in the returned error.
 func LoadJsonConfig(path string) (*tConfigs, error) {
-	newCfg := &tConfigs{Tunnels: make([]*tConfig, 0)}
 	content, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
-	err = json.Unmarshal(content, newCfg)
+	return parseConfig(content)
+}
+
+// writeFileAtomic writes data to a temporary file in the same directory and renames it to
+// path, so path is either left untouched or fully written. The mode of an existing file is kept.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) (err error) {
+	if info, err := os.Stat(path); err == nil {
+		perm = info.Mode().Perm()
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tmp.Close()
+			_ = os.Remove(tmp.Name())
+		}
+	}()
+	if _, err = tmp.Write(data); err != nil {
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+	if err = tmp.Chmod(perm); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// defaultConfigFile is the config file save and open --persist write when no path is given
+func defaultConfigFile() string {
+	return path.Join(GetUserHome(), "tunnels.json")
+}
+
+// persistTunnels writes the tunnels to the config file at path, replacing the entries of
+// the same names and appending the others. The file is created with the timeout if it
+// doesn't exist, and the previous version is kept as its backup.
+func persistTunnels(path string, cfgs []*tConfig, timeout int) error {
+	configs, err := LoadJsonConfig(path)
+	if os.IsNotExist(err) {
+		configs, err = &tConfigs{Tunnels: make([]*tConfig, 0), TunnelTimeout: timeout}, nil
+	}
+	if err != nil {
+		// don't overwrite a config file that we can't understand
+		return fmt.Errorf("can not merge with existing file %s: %v", path, err)
+	}
+	for _, cfg := range cfgs {
+		replaced := false
+		for i, old := range configs.Tunnels {
+			if old.Name == cfg.Name {
+				// an instance of the templates is kept by its template
+				if !old.fromTemplate {
+					configs.Tunnels[i] = cfg
+				}
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			configs.Tunnels = append(configs.Tunnels, cfg)
+		}
+	}
+	configs.Tunnels = withoutInstances(configs.Tunnels)
+	marshaled, err := json.MarshalIndent(configs, "", "    ")
+	if err != nil {
+		return err
+	}
+	if err = rotateBackups(path, defaultBackups); err != nil {
+		return fmt.Errorf("can not back up %s: %v", path, err)
+	}
+	return writeFileAtomic(path, marshaled, 0644)
+}
+
+// backupName returns the name of the idx-th backup of path, the newest one is path.bak,
+// followed by path.bak.1, path.bak.2...
+func backupName(path string, idx int) string {
+	if idx == 0 {
+		return path + ".bak"
+	}
+	return path + ".bak." + strconv.Itoa(idx)
+}
+
+// rotateBackups keeps a copy of path as its newest backup and shifts the older ones,
+// at most n backups are kept. Nothing is done if path doesn't exist or n <= 0.
+func rotateBackups(path string, n int) error {
+	if n <= 0 {
+		return nil
+	}
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for i := n - 1; i > 0; i-- {
+		err = os.Rename(backupName(path, i-1), backupName(path, i))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(backupName(path, 0), content, info.Mode().Perm())
+}
+
+// proxyURL returns the HTTP proxy to reach ssh servers through, it's the proxy given or
+// the one in $HTTPS_PROXY if not given. nil means no proxy.
+func proxyURL(proxy string) (*url.URL, error) {
+	if proxy == "" {
+		proxy = os.Getenv("HTTPS_PROXY")
+	}
+	if proxy == "" {
+		proxy = os.Getenv("https_proxy")
+	}
+	if proxy == "" {
+		return nil, nil
+	}
+	u, err := ssh.ParseProxy(proxy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy %s: %v", proxy, err)
+	}
+	return u, nil
+}
+
+// maxPortRange limits how many tunnels a single port range can expand to
+const maxPortRange = 256
+
+// expandPortRange expands an address whose port is a range, e.g. "10.0.0.5:9000-9010",
+// into addresses with a single port each. An address with a single port is returned as is.
+func expandPortRange(addr string) ([]string, error) {
+	host, port, err := net.SplitHostPort(addr)
 	if err != nil {
 		return nil, err
 	}
-	return newCfg, nil
+	bounds := strings.SplitN(port, "-", 2)
+	if len(bounds) == 1 {
+		if _, err := strconv.Atoi(port); err != nil {
+			return nil, errors.New("port must be a number: " + port)
+		}
+		return []string{addr}, nil
+	}
+	from, err := strconv.Atoi(bounds[0])
+	if err != nil {
+		return nil, errors.New("port must be a number: " + bounds[0])
+	}
+	to, err := strconv.Atoi(bounds[1])
+	if err != nil {
+		return nil, errors.New("port must be a number: " + bounds[1])
+	}
+	if from > to || from < 0 || to > 65535 {
+		return nil, errors.New("invalid port range " + port)
+	}
+	if to-from+1 > maxPortRange {
+		return nil, fmt.Errorf("port range %s is too large, at most %d ports are allowed", port, maxPortRange)
+	}
+	addrs := make([]string, 0, to-from+1)
+	for p := from; p <= to; p++ {
+		addrs = append(addrs, net.JoinHostPort(host, strconv.Itoa(p)))
+	}
+	return addrs, nil
+}
+
+// dumpTunnels writes a snapshot of all the tunnels to the log
+func dumpTunnels(dashboard *internal.Dashboard, logger *zap.SugaredLogger) {
+	tns := dashboard.GetTunnels()
+	logger.Infow("tunnels snapshot", "count", len(tns))
+	for _, tn := range tns {
+		var errStr string
+		if tn.Error() != nil {
+			errStr = tn.Error().Error()
+		}
+		logger.Infow("tunnel",
+			"id", tn.GetID(), "name", tn.GetName(), "status", tn.GetStatus(),
+			"link", tn.Represent(), "error", errStr)
+	}
+}
+
+const (
+	timeFormatRelative = "relative"
+	timeFormatRFC3339  = "rfc3339"
+)
+
+// formatTime displays t in the local timezone. format is either "relative" for
+// e.g. "2m ago", "rfc3339", or a layout of the time package like "15:04:05".
+func formatTime(t time.Time, format string) string {
+	if t.IsZero() {
+		return "-"
+	}
+	switch strings.ToLower(format) {
+	case "", timeFormatRelative:
+		return relativeTime(time.Since(t))
+	case timeFormatRFC3339:
+		return t.Local().Format(time.RFC3339)
+	}
+	return t.Local().Format(format)
+}
+
+func relativeTime(d time.Duration) string {
+	switch {
+	case d < time.Second:
+		return "just now"
+	case d < time.Minute:
+		return strconv.Itoa(int(d/time.Second)) + "s ago"
+	case d < time.Hour:
+		return strconv.Itoa(int(d/time.Minute)) + "m ago"
+	case d < 24*time.Hour:
+		return strconv.Itoa(int(d/time.Hour)) + "h ago"
+	}
+	return strconv.Itoa(int(d/(24*time.Hour))) + "d ago"
+}
+
+// formatBytes displays n in the binary units, e.g. 512B, 1.5KiB or 20.0MiB
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return strconv.FormatUint(n, 10) + "B"
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit && exp < 4; m /= unit {
+		div *= unit
+		exp++
+	}
+	return strconv.FormatFloat(float64(n)/float64(div), 'f', 1, 64) + string("KMGTP"[exp]) + "iB"
+}
+
+// formatRate displays the bytes per second, e.g. 1.5KiB/s
+func formatRate(bytesPerSec float64) string {
+	return formatBytes(uint64(bytesPerSec)) + "/s"
+}
+
+// tunnelBytes displays the bytes moved by the tunnel in both directions
+func tunnelBytes(tn *internal.TunnelInfo) string {
+	in, out := tn.GetBytes()
+	return formatBytes(in + out)
+}
+
+// remark describes what's going on with the tunnel, e.g. its error
+func remark(tn *internal.TunnelInfo) string {
+	notes := make([]string, 0)
+	if retry := tn.GetNextRetry(); !retry.IsZero() && tn.Error() != nil {
+		wait := time.Until(retry)
+		if wait < 0 {
+			wait = 0
+		}
+		notes = append(notes, "retrying in "+strconv.Itoa(int(wait.Seconds()+0.5))+"s")
+	}
+	if tn.Error() != nil {
+		notes = append(notes, tn.Error().Error())
+	}
+	if tn.OverWarnConnections() {
+		notes = append(notes, "over "+strconv.Itoa(tn.GetWarnConnections())+" connections")
+	}
+	return strings.Join(notes, ": ")
+}
+
+// maskedHost replaces the users, hosts and IPs in the masked output
+const maskedHost = "***"
+
+// hostPortPattern matches the addresses like 10.0.0.1:22, host.corp:22 or [::1]:22, and the
+// bare IPs and domain names in a text
+var hostPortPattern = regexp.MustCompile(`(\[[0-9A-Fa-f:.]+\]|[A-Za-z0-9][A-Za-z0-9.\-]*):(\d+)|` +
+	`\b\d{1,3}(\.\d{1,3}){3}\b|\b[A-Za-z0-9\-]+(\.[A-Za-z0-9\-]+)*\.[A-Za-z]{2,}\b`)
+
+// maskAddr redacts the user and host of an address like user@host:22, only the port is kept
+func maskAddr(addr string) string {
+	if at := strings.LastIndex(addr, "@"); at >= 0 {
+		addr = addr[at+1:]
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return maskedHost
+	}
+	if host == "" {
+		return ":" + port
+	}
+	return maskedHost + ":" + port
+}
+
+// maskLink is the masked Represent of the tunnel
+func maskLink(tn *internal.TunnelInfo) string {
+	remote := "socks5"
+	if tn.GetRemote() != "" {
+		remote = maskAddr(tn.GetRemote())
+	}
+	if tn.GetReverse() {
+		return maskAddr(tn.GetLocal()) + " <- " + maskAddr(tn.GetServer()) + " <- " + remote
+	}
+	return maskAddr(tn.GetLocal()) + " -> " + maskAddr(tn.GetServer()) + " -> " + remote
+}
+
+// maskText redacts the addresses in a free text like an error message, the ports are kept
+func maskText(s string) string {
+	return hostPortPattern.ReplaceAllStringFunc(s, func(m string) string {
+		if i := strings.LastIndex(m, ":"); i >= 0 && !strings.HasSuffix(m, "]") {
+			if _, err := strconv.Atoi(m[i+1:]); err == nil {
+				return maskedHost + m[i:]
+			}
+		}
+		return maskedHost
+	})
+}
+
+// lineCounter counts the lines written through it
+type lineCounter struct {
+	w io.Writer
+
+	lines int
+}
+
+func (c *lineCounter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.lines += bytes.Count(p[:n], []byte("\n"))
+	return n, err
+}
+
+// watchInPlace calls render every interval until it's interrupted, the lines rendered
+// through out are erased before rendering again, so it looks like refreshing in place
+func watchInPlace(out *lineCounter, interval time.Duration, render func()) {
+	if interval <= 0 {
+		fmt.Println("interval should be positive")
+		return
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt)
+	ticker := time.NewTicker(interval)
+	// hide the cursor while redrawing, and show it again whatever happens
+	fmt.Print("\x1b[?25l")
+	defer func() {
+		ticker.Stop()
+		signal.Stop(sigs)
+		fmt.Print("\x1b[?25h")
+	}()
+
+	for {
+		out.lines = 0
+		render()
+		fmt.Println("refreshing every", interval.String()+", press Ctrl-C to stop")
+		select {
+		case <-sigs:
+			return
+		case <-ticker.C:
+		}
+		// move the cursor back to the top and clear everything below
+		fmt.Printf("\x1b[%dA\x1b[J", out.lines+1)
+	}
+}
+
+// minColumnWidth the narrowest a column is wrapped to on a narrow terminal
+const minColumnWidth = 6
+
+// terminalWidth returns the width of the terminal of stdout, 0 if stdout isn't a terminal
+func terminalWidth() int {
+	width, _, err := terminal.GetSize(int(os.Stdout.Fd()))
+	if err != nil {
+		return 0
+	}
+	return width
+}
+
+// columnWidth returns the width that each of the n columns of a table gets from the width,
+// taking the borders and paddings of the columns into account
+func columnWidth(width, n int) int {
+	w := (width-1)/n - 3
+	if w < minColumnWidth {
+		return minColumnWidth
+	}
+	return w
+}
+
+// newLogger builds the logger, debug logs are only written if debug is true
+func newLogger(debug bool) *zap.SugaredLogger {
+	logger, _ := newLeveledLogger(debug)
+	return logger
+}
+
+// newLeveledLogger is newLogger whose level can be changed on the fly through the returned level
+func newLeveledLogger(debug bool) (*zap.SugaredLogger, zap.AtomicLevel) {
+	var config zap.Config
+	if debug {
+		config = zap.NewDevelopmentConfig()
+	} else {
+		config = zap.NewProductionConfig()
+	}
+	logger, _ := config.Build()
+	return logger.Sugar(), config.Level
+}
+
+// normalizeInput cleans up a pasted value: surrounding whitespaces, including newlines,
+// and a pair of surrounding quotes are stripped
+func normalizeInput(in string) string {
+	in = strings.TrimSpace(in)
+	if len(in) >= 2 && (in[0] == '"' || in[0] == '\'') && in[len(in)-1] == in[0] {
+		in = strings.TrimSpace(in[1 : len(in)-1])
+	}
+	return in
+}
+
+// parseLink splits a link in form of <local>:<remote>@<user>@<ssh_server>, e.g.
+// :1080:192.168.1.2:1080@user@host.com:22, into its local, remote and server parts. The IPv6
+// hosts are in brackets, e.g. [::1]:1080:[2001:db8::1]:80@user@[2001:db8::2]:22. The port of
+// the server may be omitted, it's looked up in ssh_config and defaults to 22, see ssh.NewTunnel.
+func parseLink(link string) (local, remote, server string, err error) {
+	link = normalizeInput(link)
+	// this should split the link into [mapping, server] slice
+	parts := strings.SplitN(link, "@", 2)
+	if len(parts) != 2 {
+		return "", "", "", errors.New("wrong link: " + link)
+	}
+	// the local address ends at the colon after its port, the rest is the remote
+	local, remote, ok := cutHostPort(parts[0])
+	if !ok || remote == "" {
+		return "", "", "", errors.New("wrong link: " + link)
+	}
+	if _, _, err := net.SplitHostPort(remote); err != nil {
+		return "", "", "", errors.New("wrong link: " + link)
+	}
+	return local, remote, parts[1], nil
+}
+
+// cutHostPort cuts the leading host:port off s which is followed by a colon, the host may be
+// empty or an IPv6 literal in brackets. It returns false if s doesn't start with one.
+func cutHostPort(s string) (hostPort, rest string, ok bool) {
+	i := 0
+	if strings.HasPrefix(s, "[") {
+		if i = strings.Index(s, "]"); i < 0 {
+			return "", "", false
+		}
+	}
+	colon := strings.Index(s[i:], ":")
+	if colon < 0 {
+		return "", "", false
+	}
+	portStart := i + colon + 1
+	end := strings.Index(s[portStart:], ":")
+	if end < 0 {
+		return "", "", false
+	}
+	hostPort, rest = s[:portStart+end], s[portStart+end+1:]
+	if _, _, err := net.SplitHostPort(hostPort); err != nil {
+		return "", "", false
+	}
+	return hostPort, rest, true
+}
+
+// openTunnels opens tunnels from local to remote through server. Both local and remote
+// may be port ranges of the same size like :8000-8010, in which case a tunnel is opened
+// for each pair of the aligned ports, and the names are suffixed with the local ports.
+func openTunnels(dashboard *internal.Dashboard, name, source, local, server, remote, pk string, opts ...ssh.Option) (tns []*internal.TunnelInfo, errs []error) {
+	locals, err := expandPortRange(local)
+	if err != nil {
+		return nil, []error{fmt.Errorf("wrong local address %s: %v", local, err)}
+	}
+	remotes, err := expandPortRange(remote)
+	if err != nil {
+		return nil, []error{fmt.Errorf("wrong remote address %s: %v", remote, err)}
+	}
+	if len(locals) != len(remotes) {
+		return nil, []error{fmt.Errorf(
+			"local ports(%d) and remote ports(%d) should be of the same size", len(locals), len(remotes))}
+	}
+
+	for idx := range locals {
+		tName := name
+		if tName != "" && len(locals) > 1 {
+			_, port, _ := net.SplitHostPort(locals[idx])
+			tName += "-" + port
+		}
+		tn, err := dashboard.NewTunnel(tName, source, locals[idx], server, remotes[idx], pk, false, opts...)
+		if err != nil {
+			errs = append(errs, fmt.Errorf(
+				"local: %s server: %s remote: %s error: %v", locals[idx], server, remotes[idx], err))
+			continue
+		}
+		tns = append(tns, tn)
+	}
+	return
+}
+
+// waitForInterrupt blocks until mario is interrupted or terminated
+func waitForInterrupt() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	<-sigs
+	signal.Stop(sigs)
+}
+
+// confirm prints the question and tells whether the answer read from in is yes
+func confirm(in io.Reader, question string) bool {
+	fmt.Print(question)
+	answer, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && answer == "" {
+		fmt.Println()
+		return false
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
 }
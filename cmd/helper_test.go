@@ -0,0 +1,209 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeInput(t *testing.T) {
+	cases := []struct {
+		in   string
+		want string
+	}{
+		{"user@host.com:22", "user@host.com:22"},
+		{"user@host.com:22 \n", "user@host.com:22"},
+		{"\tuser@host.com:22\t", "user@host.com:22"},
+		{`"user@host.com:22"`, "user@host.com:22"},
+		{"'user@host.com:22'\r\n", "user@host.com:22"},
+		{`" user@host.com:22 "`, "user@host.com:22"},
+		// unpaired quotes are left as is
+		{`"user@host.com:22`, `"user@host.com:22`},
+		{`"user@host.com:22'`, `"user@host.com:22'`},
+		{"", ""},
+		{`"`, `"`},
+	}
+	for _, c := range cases {
+		if got := normalizeInput(c.in); got != c.want {
+			t.Errorf("normalizeInput(%q) = %q, want %q", c.in, got, c.want)
+		}
+	}
+}
+
+func TestParseLink(t *testing.T) {
+	const want = ":1080:192.168.1.2:1080@user@host.com:22"
+	for _, link := range []string{
+		want,
+		want + "\n",
+		"  " + want + " \t",
+		`"` + want + `"` + "\n",
+		"'" + want + "'",
+	} {
+		local, remote, server, err := parseLink(link)
+		if err != nil {
+			t.Errorf("parseLink(%q) failed: %v", link, err)
+			continue
+		}
+		if local != ":1080" || remote != "192.168.1.2:1080" || server != "user@host.com:22" {
+			t.Errorf("parseLink(%q) = %q, %q, %q", link, local, remote, server)
+		}
+	}
+
+	local, remote, server, err := parseLink("[::1]:1080:[2001:db8::1]:80@user@[2001:db8::2]:22")
+	if err != nil || local != "[::1]:1080" || remote != "[2001:db8::1]:80" || server != "user@[2001:db8::2]:22" {
+		t.Errorf("parseLink of IPv6 = %q, %q, %q, %v", local, remote, server, err)
+	}
+	// the port of the server is left to ssh_config and the default
+	if _, _, server, err := parseLink(":1080:127.0.0.1:80@user@host.com"); err != nil || server != "user@host.com" {
+		t.Errorf("parseLink without the server port = %q, %v", server, err)
+	}
+
+	for _, link := range []string{"", "no-at-sign", ":1080@user@host.com", "[::1:1080:127.0.0.1:80@user@host.com",
+		"::1:1080:127.0.0.1:80@user@host.com", ":1080:2001:db8::1:80@user@host.com"} {
+		if _, _, _, err := parseLink(link); err == nil {
+			t.Errorf("parseLink(%q) should fail", link)
+		}
+	}
+}
+
+func TestColumnWidth(t *testing.T) {
+	cases := []struct {
+		width, n, want int
+	}{
+		{201, 10, 17},
+		{80, 10, minColumnWidth},
+		{0, 3, minColumnWidth},
+	}
+	for _, c := range cases {
+		if got := columnWidth(c.width, c.n); got != c.want {
+			t.Errorf("columnWidth(%d, %d) = %d, want %d", c.width, c.n, got, c.want)
+		}
+	}
+}
+
+func TestConfirm(t *testing.T) {
+	cases := map[string]bool{
+		"y\n":   true,
+		"YES\n": true,
+		" y ":   true,
+		"\n":    false,
+		"n\n":   false,
+		"":      false,
+		"yep\n": false,
+	}
+	for in, want := range cases {
+		if got := confirm(strings.NewReader(in), ""); got != want {
+			t.Errorf("confirm(%q) = %v, want %v", in, got, want)
+		}
+	}
+}
+
+func TestMask(t *testing.T) {
+	addrs := map[string]string{
+		"mario@bastion.corp:22": "***:22",
+		"10.0.0.1:3306":         "***:3306",
+		":1080":                 ":1080",
+		"[fe80::1]:22":          "***:22",
+		"nonsense":              "***",
+	}
+	for addr, want := range addrs {
+		if got := maskAddr(addr); got != want {
+			t.Errorf("maskAddr(%q) = %q, want %q", addr, got, want)
+		}
+	}
+
+	texts := map[string]string{
+		"dial tcp 10.0.0.1:22: connect: connection refused":  "dial tcp ***:22: connect: connection refused",
+		"lookup db.internal.corp on 10.0.0.53: no such host": "lookup *** on ***: no such host",
+		"ssh: handshake failed: EOF":                         "ssh: handshake failed: EOF",
+		"retrying in 3s: [::1]:22 refused":                   "retrying in 3s: ***:22 refused",
+	}
+	for text, want := range texts {
+		if got := maskText(text); got != want {
+			t.Errorf("maskText(%q) = %q, want %q", text, got, want)
+		}
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	sizes := map[uint64]string{
+		0:                  "0B",
+		1023:               "1023B",
+		1536:               "1.5KiB",
+		20 << 20:           "20.0MiB",
+		3<<30 + 512<<20:    "3.5GiB",
+		uint64(2048) << 50: "2048.0PiB",
+	}
+	for n, want := range sizes {
+		if got := formatBytes(n); got != want {
+			t.Errorf("formatBytes(%d) = %q, want %q", n, got, want)
+		}
+	}
+}
+
+func TestRebaseTimeout(t *testing.T) {
+	cases := []struct {
+		timeout, running, saved, want int
+	}{
+		{0, 15, 15, 0},
+		{0, 15, 30, 15},
+		{30, 15, 30, 0},
+		{20, 15, 30, 20},
+		// the global of the file defaults to the running one
+		{0, 15, 0, 0},
+		{20, 15, 0, 20},
+	}
+	for _, c := range cases {
+		if got := rebaseTimeout(c.timeout, c.running, c.saved); got != c.want {
+			t.Errorf("rebaseTimeout(%d, %d, %d) = %d, want %d", c.timeout, c.running, c.saved, got, c.want)
+		}
+	}
+}
+
+func TestPersistTunnels(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mario")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "tunnels.json")
+
+	db := &tConfig{Name: "db", Local: ":3306", SshServer: "mario@bastion:22", MapTo: "10.0.0.1:3306"}
+	if err := persistTunnels(file, []*tConfig{db}, 15); err != nil {
+		t.Fatal(err)
+	}
+	cache := &tConfig{Name: "cache", Local: ":6379", SshServer: "mario@bastion:22", MapTo: "10.0.0.2:6379"}
+	moved := &tConfig{Name: "db", Local: ":3307", SshServer: "mario@bastion:22", MapTo: "10.0.0.1:3306"}
+	if err := persistTunnels(file, []*tConfig{moved, cache}, 30); err != nil {
+		t.Fatal(err)
+	}
+
+	configs, err := LoadJsonConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if configs.TunnelTimeout != 15 {
+		t.Errorf("the timeout of the existing file should be kept, got %d", configs.TunnelTimeout)
+	}
+	if len(configs.Tunnels) != 2 {
+		t.Fatalf("got %d tunnels, want db updated and cache appended", len(configs.Tunnels))
+	}
+	if configs.Tunnels[0].Name != "db" || configs.Tunnels[0].Local != ":3307" {
+		t.Errorf("db should be updated in place, got %+v", configs.Tunnels[0])
+	}
+	if configs.Tunnels[1].Name != "cache" {
+		t.Errorf("cache should be appended, got %+v", configs.Tunnels[1])
+	}
+	if _, err := os.Stat(backupName(file, 0)); err != nil {
+		t.Errorf("the previous version should be backed up: %v", err)
+	}
+
+	if err := ioutil.WriteFile(file, []byte("{not json"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := persistTunnels(file, []*tConfig{cache}, 15); err == nil {
+		t.Error("a file that can not be parsed should not be overwritten")
+	}
+}
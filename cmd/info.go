@@ -0,0 +1,171 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/Jonwing/mario/internal"
+	"github.com/c-bata/go-prompt"
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// infoCommand prints the details of a tunnel, including the settings not shown by `list`
+type infoCommand struct {
+	command
+
+	tunnelName string
+}
+
+func (c *infoCommand) ClearFlags() {
+	c.command.ClearFlags()
+	c.tunnelName = ""
+}
+
+func (c *infoCommand) Complete(args []string, word string) []prompt.Suggest {
+	suggests := make([]prompt.Suggest, 0)
+	if strings.HasPrefix(word, "--") {
+		c.cmd.Flags().VisitAll(flagHasPrefix(word, &suggests))
+		return suggests
+	}
+	byName := len(args) > 2 && (args[len(args)-2] == "--name" || args[len(args)-2] == "-n")
+	for _, tn := range c.root.dashboard.GetTunnels() {
+		if byName {
+			suggests = append(suggests, prompt.Suggest{
+				Text:        tn.GetName(),
+				Description: "ID: " + strconv.Itoa(tn.GetID()) + "(" + tn.GetStatus() + ")",
+			})
+			continue
+		}
+		suggests = append(suggests, prompt.Suggest{
+			Text:        strconv.Itoa(tn.GetID()),
+			Description: tn.GetName() + "(" + tn.GetStatus() + ")",
+		})
+	}
+	return prompt.FilterHasPrefix(suggests, word, true)
+}
+
+func (c *infoCommand) Run(cmd *cobra.Command, args []string) {
+	if len(args) == 0 && c.tunnelName == "" {
+		fmt.Println("specify tunnel id or tunnel name")
+		return
+	}
+	var idOrName interface{} = c.tunnelName
+	if len(args) > 0 {
+		id, err := strconv.Atoi(args[0])
+		if err != nil {
+			fmt.Println("id should be a number", args[0])
+			return
+		}
+		idOrName = id
+	}
+	tn, ok := c.root.dashboard.GetTunnel(idOrName)
+	if !ok {
+		fmt.Printf("tunnel with id or name %v not found\n", idOrName)
+		return
+	}
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetAutoWrapText(false)
+	table.SetRowLine(false)
+	table.AppendBulk(tunnelDetails(tn, c.root.timeFormat))
+	table.Render()
+}
+
+// tunnelDetails returns the fields of the tunnel as rows of name and value
+func tunnelDetails(tn *internal.TunnelInfo, timeFormat string) [][]string {
+	orDefault := func(v, def string) string {
+		if v == "" {
+			return def
+		}
+		return v
+	}
+	keepalive, reply := tn.GetKeepalive()
+	missed, maxMisses := tn.GetKeepaliveMisses()
+	heartbeat := "global"
+	if hb := tn.GetHeartbeat(); hb > 0 {
+		heartbeat = hb.String()
+	}
+	dialTimeout := "global"
+	if d := tn.GetDialTimeout(); d > 0 {
+		dialTimeout = d.String()
+	}
+	idleTimeout := "never"
+	if d := tn.GetIdleTimeout(); d > 0 {
+		idleTimeout = d.String()
+	}
+	auth := authPublicKey
+	if tn.GetPasswordAuth() {
+		auth += ", " + authPassword
+	}
+	lastErrorAt, errorCount := tn.GetLastError()
+	failedRetries, maxRetries := tn.GetRetries()
+	retries := strconv.Itoa(failedRetries) + " failed, max: forever"
+	if maxRetries > 0 {
+		retries = strconv.Itoa(failedRetries) + " failed, max: " + strconv.Itoa(maxRetries)
+	}
+	remoteProbe := "-"
+	if probes, reconnect := tn.GetRemoteProbe(); probes > 0 {
+		remoteProbe = "down after " + strconv.Itoa(probes) + " failures, reconnect: " + strconv.FormatBool(reconnect)
+	}
+	rows := [][]string{
+		{"id", strconv.Itoa(tn.GetID())},
+		{"name", tn.GetName()},
+		{"source", orDefault(tn.GetSource(), "-")},
+		{"status", tn.GetStatus()},
+		{"schedule", orDefault(tn.GetSchedule().String(), "always")},
+		{"local", tn.GetLocal()},
+		{"direction", tn.Representation().Direction},
+		{"local url", tn.LocalURL()},
+		{"udp", strconv.FormatBool(tn.GetUDP())},
+		{"server", tn.GetServer()},
+		{"jump hosts", orDefault(strings.Join(tn.GetJumpHosts(), ", "), "-")},
+		{"server ips", orDefault(strings.Join(tn.GetResolvedIPs(), ", "), "-")},
+		{"remote", orDefault(tn.GetRemote(), "socks5")},
+		{"backends", orDefault(strings.Join(tn.GetBackends(), ", "), "-")},
+		{"balance", string(tn.GetBalance())},
+		{"private key", orDefault(tn.GetPrivateKeyPath(), orDefault(tn.GetIdentityFile(), "global"))},
+		{"agent socket", orDefault(tn.GetAgentSocket(), "global")},
+		{"auth", auth},
+		{"auto reconnect", strconv.FormatBool(tn.GetAutoReconnect())},
+		{"retries", retries},
+		{"max connection age", tn.GetMaxConnectionAge().String()},
+		{"heartbeat", heartbeat},
+		{"dial timeout", dialTimeout},
+		{"idle timeout", idleTimeout},
+		{"keepalive", string(keepalive) + ", reply: " + strconv.FormatBool(reply) + ", missed: " +
+			strconv.Itoa(missed) + " of " + strconv.Itoa(maxMisses)},
+		{"warn connections", strconv.Itoa(tn.GetWarnConnections())},
+		{"remote probe", remoteProbe},
+		{"env", orDefault(formatEnv(tn.GetEnv()), "-")},
+		{"connections", strconv.Itoa(tn.ConnectionCount())},
+		{"peak connections", strconv.Itoa(tn.GetPeakConnectors())},
+		{"max connectors", strconv.Itoa(tn.GetMaxConnectors()) + ", refused: " +
+			strconv.FormatUint(tn.GetCappedConnections(), 10)},
+		{"next retry", formatTime(tn.GetNextRetry(), timeFormat)},
+		{"errors", strconv.Itoa(errorCount) + ", last: " + formatTime(lastErrorAt, timeFormat)},
+	}
+	if err := tn.Error(); err != nil {
+		rows = append(rows, []string{"error", err.Error()})
+	}
+	return rows
+}
+
+func NewInfoCommand(root *interactiveCmd) *infoCommand {
+	c := &infoCommand{
+		command: command{
+			root: root,
+			name: "info",
+			cmd: &cobra.Command{
+				Use:   "info [tunnel id]",
+				Short: "print the details of a tunnel",
+				Args:  cobra.MaximumNArgs(1),
+			},
+			children: make([]promptCommand, 0),
+		},
+	}
+	c.cmd.Run = c.Run
+	c.cmd.Flags().StringVarP(&c.tunnelName, "name", "n", "", "specify tunnel name")
+	return c
+}
@@ -33,6 +33,9 @@ type iArgs struct {
 
 	// the file path to save tunnel infos [while you run `tunnel save`]
 	configOut string
+
+	// timeFormat how times are displayed, see formatTime
+	timeFormat string
 }
 
 type interactiveCmd struct {
@@ -50,11 +53,18 @@ type interactiveCmd struct {
 	children []promptCommand
 
 	logger *zap.SugaredLogger
+
+	// logLevel the level of logger which can be changed by `set log-level`
+	logLevel zap.AtomicLevel
+
+	// statusBar the throughput shown before the prompt, toggled by `set status-bar`
+	statusBar *statusBar
 }
 
 func NewInteractiveCommand(dashboard *internal.Dashboard) *interactiveCmd {
 	it := &interactiveCmd{
 		dashboard: dashboard,
+		statusBar: &statusBar{dashboard: dashboard},
 	}
 	it.command = &cobra.Command{
 		Use:   "[command]",
@@ -98,6 +108,7 @@ Use "[command] --help" for more information about a command.{{end}}
 		prompt.OptionParser(it.exitParser),
 		prompt.OptionTitle("mario: handler multiple SSH tunnels"),
 		prompt.OptionPrefix("> "),
+		prompt.OptionLivePrefix(it.statusBar.livePrefix),
 		prompt.OptionInputTextColor(prompt.Green),
 		prompt.OptionCompletionWordSeparator(completer.FilePathCompletionSeparator),
 		prompt.OptionSuggestionTextColor(prompt.DarkGray),
@@ -129,15 +140,12 @@ func (i *interactiveCmd) execute(cmd *cobra.Command, args []string) {
 }
 
 func (i *interactiveCmd) Run() {
+	stop := make(chan struct{})
+	defer close(stop)
+	go i.statusBar.refresh(i.exitParser, stop)
 	i.pmt.Run()
 }
 
 func (i *interactiveCmd) configLogger(debug bool) {
-	var logger *zap.Logger
-	if debug {
-		logger, _ = zap.NewDevelopment()
-	} else {
-		logger, _ = zap.NewProduction()
-	}
-	i.logger = logger.Sugar()
+	i.logger, i.logLevel = newLeveledLogger(debug)
 }
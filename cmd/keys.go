@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/Jonwing/mario/pkg/ssh"
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// keysCommand lists the private keys in ~/.ssh and the global key with their
+// fingerprints, it helps to pick the right key for `--key`
+type keysCommand struct {
+	command
+
+	table *tablewriter.Table
+}
+
+func (k *keysCommand) Run(cmd *cobra.Command, args []string) {
+	defaultKey := k.root.dashboard.Mario.KeyPath
+	candidates := make([]string, 0)
+	sshDir := path.Join(GetUserHome(), ".ssh")
+	if files, err := ioutil.ReadDir(sshDir); err == nil {
+		for _, f := range files {
+			if f.IsDir() || filepath.Ext(f.Name()) == ".pub" {
+				continue
+			}
+			candidates = append(candidates, path.Join(sshDir, f.Name()))
+		}
+	}
+	if defaultKey != "" && filepath.Dir(defaultKey) != sshDir {
+		candidates = append(candidates, defaultKey)
+	}
+
+	k.table.ClearRows()
+	rows := make([][]string, 0, len(candidates))
+	for _, p := range candidates {
+		info, err := ssh.InspectKey(p)
+		if err != nil {
+			// only complain about the global key, other files are not necessarily keys
+			if p == defaultKey {
+				rows = append(rows, []string{p, "", "", "default key, " + err.Error()})
+			}
+			continue
+		}
+		var remark string
+		if p == defaultKey {
+			remark = "default key"
+		}
+		if info.Encrypted {
+			if remark != "" {
+				remark += ", "
+			}
+			remark += "encrypted"
+		}
+		rows = append(rows, []string{p, info.Type, info.Fingerprint, remark})
+	}
+	if len(rows) == 0 {
+		fmt.Println("no private keys found in", sshDir)
+		return
+	}
+	k.table.AppendBulk(rows)
+	k.table.Render()
+}
+
+func NewKeysCommand(root *interactiveCmd) *keysCommand {
+	k := &keysCommand{
+		command: command{
+			root: root,
+			name: "keys",
+			cmd: &cobra.Command{
+				Use:   "keys",
+				Short: "list private keys and their fingerprints",
+			},
+			children: make([]promptCommand, 0),
+		},
+		table: tablewriter.NewWriter(os.Stdout),
+	}
+	k.table.SetHeader([]string{"path", "type", "fingerprint", "remark"})
+	k.table.SetRowLine(false)
+	k.cmd.Run = k.Run
+	return k
+}
@@ -1,15 +1,19 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
 	"github.com/Jonwing/mario/internal"
+	"github.com/Jonwing/mario/pkg/ssh"
 	json "github.com/json-iterator/go"
 	"github.com/spf13/cobra"
-	"io/ioutil"
+	"io"
 	"os"
 	"os/user"
 	"path"
 	"runtime/pprof"
+	"sync"
+	"time"
 )
 
 type baseCommand struct {
@@ -24,8 +28,45 @@ type baseCommand struct {
 	// interval to check whether tunnel is alive, default to 15 seconds, unit: second
 	heartbeatInterval int
 
+	// dialTimeout how long connecting to an ssh server may take, default to 10 seconds, unit: second
+	dialTimeout int
+
 	// Debug if true, logs the debug logs
 	debug bool
+
+	// timeFormat how times are displayed: relative, rfc3339 or a go time layout
+	timeFormat string
+
+	// agentSocket the unix socket of the ssh agent tunnels authenticate with by default
+	agentSocket string
+
+	// proxy the HTTP proxy to reach ssh servers through, default to $HTTPS_PROXY
+	proxy string
+
+	// only the names of the config tunnels connected at startup, empty means all of them
+	only []string
+
+	// jitter the fraction the health check interval of the tunnels is randomized by
+	jitter float64
+
+	// waitReady if true, the prompt only starts after the config tunnels are connected or
+	// failed, and mario exits if any of them failed
+	waitReady bool
+
+	// kbdCommand the command answering the keyboard-interactive questions of the servers,
+	// e.g. an OTP, they are asked on the terminal if it's empty
+	kbdCommand string
+
+	// sshConfig the ssh_config file resolving the host aliases, default to ~/.ssh/config,
+	// empty means not resolving
+	sshConfig string
+
+	// pidfile the file the pid is written to while serving as a daemon, i.e. --events, batch or one
+	pidfile string
+
+	// events if true, the events of the tunnels are written to stdout as JSON lines instead
+	// of prompting, see internal.Event
+	events bool
 }
 
 func (b *baseCommand) getCommand() *cobra.Command {
@@ -56,43 +97,259 @@ func (b *baseCommand) runDefault(cmd *cobra.Command, args []string) error {
 		}()
 	}
 
-	configs := &tConfigs{Tunnels: make([]*tConfig, 0), TunnelTimeout: b.heartbeatInterval}
+	if b.pidfile != "" && !b.events {
+		// the prompt exits the process on signals, the pidfile would be left behind
+		return errors.New("--pidfile is only supported with --events, batch or one")
+	}
+	release, err := b.acquirePidfile()
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	configs := &tConfigs{Tunnels: make([]*tConfig, 0), TunnelTimeout: b.heartbeatInterval, DialTimeout: b.dialTimeout}
 	// if we get a configPath, load the config
 	if b.configPath != "" {
-		content, err := ioutil.ReadFile(b.configPath)
+		loaded, err := LoadJsonConfig(b.configPath)
 		if err != nil {
 			return err
 		}
-		err = json.Unmarshal(content, configs)
-		if err != nil {
+		if loaded.TunnelTimeout == 0 {
+			loaded.TunnelTimeout = b.heartbeatInterval
+		}
+		if loaded.DialTimeout == 0 {
+			loaded.DialTimeout = b.dialTimeout
+		}
+		configs = loaded
+	}
+	if len(b.only) > 0 {
+		if err := selectOnly(configs.Tunnels, b.only); err != nil {
 			return err
 		}
 	}
+	// nobody answers the terminal while streaming the events
+	if err := readPasswords(configs.Tunnels, !b.events); err != nil {
+		return err
+	}
 	dashBoard := internal.DefaultDashboard(b.pkPath, configs.TunnelTimeout)
+	if err := b.configMario(dashBoard.Mario); err != nil {
+		return err
+	}
+	dashBoard.Mario.DialTimeout = time.Duration(configs.DialTimeout) * time.Second
 
 	tCmd := NewInteractiveCommand(dashBoard)
+	tCmd.timeFormat = b.timeFormat
 	tCmd.configLogger(b.debug)
+	dashBoard.Mario.Logger = tCmd.logger
+	defer handleSignals(dashBoard, tCmd.logger)()
 
-	err := dashBoard.Work()
+	err = dashBoard.Work()
 	if err != nil {
 		return err
 	}
-	_ = tCmd.command.Usage()
+	// stdout is kept for the events only
+	out := os.Stdout
+	if b.events {
+		out = os.Stderr
+		events, unsubscribe := dashBoard.Mario.Subscribe(eventsBuffer)
+		defer unsubscribe()
+		go writeEvents(os.Stdout, events)
+	} else {
+		_ = tCmd.command.Usage()
+	}
 
-	// establish tunnels for existed config
-	go func() {
-		for _, cfg := range configs.Tunnels {
-			err = dashBoard.NewTunnel(cfg.Name, cfg.Local, cfg.SshServer, cfg.MapTo, cfg.PrivateKey, cfg.DontConnect)
-			if err != nil {
-				fmt.Printf("[Error] tunnel `%s` open failed because of %s", cfg.Name, err.Error())
-			}
+	if configs.Socks != nil {
+		routes, err := configs.Socks.routes()
+		if err != nil {
+			return err
+		}
+		router, err := dashBoard.ServeSocks(configs.Socks.Listen, routes, configs.Socks.Default)
+		if err != nil {
+			return err
 		}
+		defer router.Close()
+		tCmd.logger.Infow("socks proxy is serving", "address", router.Addr().String())
+	}
+
+	// establish tunnels for existed config, the config has been validated to have no cycle
+	ordered, err := orderByDependencies(configs.Tunnels)
+	if err != nil {
+		return err
+	}
+	timeout := time.Duration(configs.TunnelTimeout) * time.Second
+	ready := make(chan internal.Summary, 1)
+	go func() {
+		started := openConfigured(dashBoard, ordered, internal.ConfigSource(b.configPath), timeout)
+		summary := waitSettled(started, timeout)
+		tCmd.logger.Infow("startup settled", "tunnels", summary.Total, "connected", summary.Connected,
+			"failed", summary.Failed, "pending", summary.Pending)
+		ready <- dashBoard.Summary()
 	}()
+	if b.waitReady {
+		summary := <-ready
+		fmt.Fprintf(out, "ready: %d connected, %d failed, %d pending, %d idle\n",
+			summary.Connected, summary.Failed, summary.Pending, summary.Idle)
+		if summary.Failed > 0 {
+			dashBoard.Quit()
+			return fmt.Errorf("%d tunnel(s) failed to connect at startup", summary.Failed)
+		}
+	}
 
+	if b.events {
+		waitForInterrupt()
+		dashBoard.Quit()
+		return nil
+	}
 	tCmd.Run()
 	return nil
 }
 
+// eventsBuffer is how many events are buffered for the writer of --events
+const eventsBuffer = 256
+
+// writeEvents writes every event as a JSON object in a line until events is closed
+func writeEvents(w io.Writer, events <-chan *internal.Event) {
+	enc := json.NewEncoder(w)
+	for e := range events {
+		_ = enc.Encode(e)
+	}
+}
+
+// waitSettled waits until each of the tunnels is connected or failed, or the timeout is
+// reached, then returns the summary of them
+func waitSettled(tns []*internal.TunnelInfo, timeout time.Duration) internal.Summary {
+	deadline := time.Now().Add(timeout)
+	for {
+		summary := internal.SummarizeTunnels(tns)
+		if summary.Connected+summary.Failed == summary.Total || time.Now().After(deadline) {
+			return summary
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// acquirePidfile writes the pidfile if --pidfile is given, the returned function removes it
+func (b *baseCommand) acquirePidfile() (release func(), err error) {
+	if b.pidfile == "" {
+		return func() {}, nil
+	}
+	return acquirePidfile(b.pidfile)
+}
+
+// configMario applies the global settings of the tunnels
+func (b *baseCommand) configMario(m *internal.Mario) error {
+	proxy, err := proxyURL(b.proxy)
+	if err != nil {
+		return err
+	}
+	m.Proxy = proxy
+	if b.sshConfig != "" {
+		if m.SSHConfig, err = ssh.LoadSSHConfig(b.sshConfig); err != nil {
+			return err
+		}
+	}
+	m.AgentSocket = b.agentSocket
+	if b.jitter < 0 || b.jitter > ssh.MaxJitter {
+		return fmt.Errorf("jitter should be between 0 and %v", ssh.MaxJitter)
+	}
+	m.Jitter = b.jitter
+	if b.dialTimeout <= 0 {
+		return errors.New("dial-timeout should be positive")
+	}
+	m.DialTimeout = time.Duration(b.dialTimeout) * time.Second
+	// nobody answers the terminal while streaming the events
+	m.KeyboardInteractive = keyboardInteractive(b.kbdCommand, !b.events)
+	return nil
+}
+
+// openConfigured opens the tunnels in order. A tunnel depending on others is opened without
+// connecting and only connected after they are connected, each of them waits on its own
+// dependencies so that they don't hold up the others. The tunnels being connected are returned
+// once all the dependencies are waited.
+func openConfigured(dashBoard *internal.Dashboard, cfgs []*tConfig, source string, timeout time.Duration) (started []*internal.TunnelInfo) {
+	opened := make(map[string]*openedTunnel, len(cfgs))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, cfg := range cfgs {
+		noConnect := cfg.DontConnect
+		// the config has been validated
+		schedule, _ := internal.ParseSchedule(cfg.Schedule)
+		if !schedule.Active(time.Now()) {
+			noConnect = true
+		}
+		tn, err := dashBoard.NewTunnel(cfg.Name, source, cfg.Local, cfg.SshServer, cfg.MapTo, cfg.PrivateKey,
+			noConnect || len(cfg.DependsOn) > 0, cfg.options()...)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[Error] tunnel `%s` open failed because of %s\n", cfg.Name, err.Error())
+			continue
+		}
+		if schedule != nil {
+			dashBoard.Mario.SetSchedule(tn, schedule)
+		}
+		o := &openedTunnel{tn: tn, settled: make(chan struct{})}
+		opened[cfg.Name] = o
+		if noConnect || len(cfg.DependsOn) == 0 {
+			o.connecting = !noConnect
+			close(o.settled)
+			if o.connecting {
+				mu.Lock()
+				started = append(started, tn)
+				mu.Unlock()
+			}
+			continue
+		}
+		deps := make([]*openedTunnel, 0, len(cfg.DependsOn))
+		for _, dep := range cfg.DependsOn {
+			if opened[dep] == nil {
+				fmt.Fprintf(os.Stderr, "[Error] tunnel `%s` is not connected because `%s` it depends on failed to open\n", cfg.Name, dep)
+				deps = nil
+				break
+			}
+			deps = append(deps, opened[dep])
+		}
+		if deps == nil {
+			close(o.settled)
+			continue
+		}
+		wg.Add(1)
+		go func(cfg *tConfig, o *openedTunnel, deps []*openedTunnel) {
+			defer wg.Done()
+			defer close(o.settled)
+			for i, dep := range deps {
+				<-dep.settled
+				if !dep.connecting {
+					fmt.Fprintf(os.Stderr, "[Error] tunnel `%s` is not connected because `%s` it depends on is not connected\n",
+						cfg.Name, cfg.DependsOn[i])
+					return
+				}
+				if err := dep.tn.WaitForStatus(ssh.StatusConnected, timeout); err != nil {
+					fmt.Fprintf(os.Stderr, "[Error] tunnel `%s` is not connected because `%s` it depends on is not connected: %s\n",
+						cfg.Name, cfg.DependsOn[i], err.Error())
+					return
+				}
+			}
+			dashBoard.Mario.Up(o.tn, make(chan error, 1))
+			o.connecting = true
+			mu.Lock()
+			started = append(started, o.tn)
+			mu.Unlock()
+		}(cfg, o, deps)
+	}
+	wg.Wait()
+	return started
+}
+
+// openedTunnel is a tunnel opened by openConfigured, settled is closed once it's known whether
+// the tunnel is being connected
+type openedTunnel struct {
+	tn *internal.TunnelInfo
+
+	settled chan struct{}
+
+	// connecting whether the tunnel is being connected, it's set before settled is closed
+	connecting bool
+}
+
 func (b *baseCommand) Execute() {
 	err := b.cmd.Execute()
 	if err != nil {
@@ -101,12 +358,15 @@ func (b *baseCommand) Execute() {
 }
 
 func BuildCommand() *baseCommand {
-	b := &baseCommand{heartbeatInterval: 15}
+	b := &baseCommand{heartbeatInterval: 15, dialTimeout: 10}
 	b.cmd = &cobra.Command{
 		Use:   "mario [options] [flags]",
 		Short: "mario handles pipes(ssh tunnels) for you",
-		Long:  "Manage ssh tunnels(establishing, closing, health check, reconnect...)",
-		RunE:  b.runDefault,
+		Long: "Manage ssh tunnels(establishing, closing, health check, reconnect...)\n\n" +
+			"Signals:\n" +
+			"  SIGUSR1  dump the state of all tunnels to the log\n" +
+			"  SIGUSR2  rotate the log files (a no-op while logging to stderr)",
+		RunE: b.runDefault,
 	}
 
 	if u, err := user.Current(); err == nil {
@@ -114,12 +374,51 @@ func BuildCommand() *baseCommand {
 	}
 	b.cmd.Flags().StringVarP(
 		&b.configPath, "config", "c", "", "the config file path")
-	b.cmd.Flags().StringVar(
+	b.cmd.Flags().StringSliceVar(
+		&b.only, "only", nil,
+		"only connect the config tunnels of these names and those they depend on, e.g. db,cache. "+
+			"The others are opened without connecting")
+	b.cmd.Flags().BoolVar(
+		&b.events, "events", false,
+		"write the events of the tunnels to stdout as JSON lines instead of prompting, e.g. for other tools to consume")
+	b.cmd.Flags().BoolVar(
+		&b.waitReady, "wait-ready", false,
+		"wait until the config tunnels are connected or failed before prompting, exit if any of them failed")
+	b.cmd.PersistentFlags().StringVar(
 		&b.pkPath, "pk", b.pkPath, "pk(private key): the SSH private key file path")
-	b.cmd.Flags().IntVar(
-		&b.heartbeatInterval, "i", 15, "i(interval): the check-alive interval of a tunnel in second")
-	b.cmd.Flags().BoolVarP(
+	b.cmd.PersistentFlags().IntVar(
+		&b.heartbeatInterval, "i", 15, "i(interval): the check-alive interval of a tunnel in second, a keepalive is sent on every check")
+	b.cmd.PersistentFlags().IntVar(
+		&b.dialTimeout, "dial-timeout", 10, "how long connecting to an ssh server may take in second, including the handshake")
+	b.cmd.PersistentFlags().BoolVarP(
 		&b.debug, "debug", "v", false, "(v)verbose: logs the debug info")
+	b.cmd.PersistentFlags().StringVar(
+		&b.timeFormat, "time-format", timeFormatRelative,
+		"how times are displayed in local timezone: relative(e.g. 2m ago), rfc3339 or a go time layout")
+	b.cmd.PersistentFlags().StringVar(
+		&b.agentSocket, "agent-socket", "",
+		"unix socket of the ssh agent to authenticate with, like the IdentityAgent of OpenSSH")
+	b.cmd.PersistentFlags().StringVar(
+		&b.kbdCommand, "kbd-interactive-command", "",
+		"command answering the keyboard-interactive questions of the servers (e.g. OTP), it reads the questions "+
+			"from stdin and prints an answer per line. Without it, the questions are asked on the terminal")
+	b.cmd.PersistentFlags().StringVar(
+		&b.sshConfig, "ssh-config", ssh.DefaultSSHConfigPath(),
+		"the ssh_config resolving the host aliases of the ssh servers (HostName, User, Port, IdentityFile and "+
+			"IdentityAgent), empty to disable")
+	b.cmd.PersistentFlags().StringVar(
+		&b.pidfile, "pidfile", "",
+		"write the pid to this file while running with --events, batch or one, and refuse to start if "+
+			"the process in it is still running")
+	b.cmd.PersistentFlags().StringVar(
+		&b.proxy, "proxy", "",
+		"HTTP(S) proxy to reach ssh servers through with CONNECT, e.g. http://proxy.corp:3128, default to $HTTPS_PROXY")
+
+	b.cmd.AddCommand(newBatchCommand(b))
+	b.cmd.AddCommand(newAuthTestCommand(b))
+	b.cmd.AddCommand(newValidateCommand())
+	b.cmd.AddCommand(newUDPRelayCommand())
+	b.cmd.AddCommand(newOneCommand(b))
 	return b
 }
 
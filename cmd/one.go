@@ -0,0 +1,145 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Jonwing/mario/internal"
+	"github.com/spf13/cobra"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// defaultConnectTimeout is how long `one` waits for the tunnel to connect for the first time
+const defaultConnectTimeout = time.Minute
+
+// oneOptions the flags of `one`, a subset of those of `open`
+type oneOptions struct {
+	tConfig
+
+	link string
+
+	// connectTimeout how long the tunnel is waited for to connect for the first time
+	connectTimeout time.Duration
+}
+
+// newOneCommand builds the `one` command which serves exactly one tunnel in the foreground
+// until interrupted, like `ssh -L` does, e.g. in a script or a container:
+//
+//	mario one -l :5432:10.0.0.2:5432@user@host.com:22
+//
+// It exits with 1 if the tunnel doesn't connect in time or fails for good, e.g. the key is
+// rejected, the tunnel is reconnected as usual otherwise.
+func newOneCommand(b *baseCommand) *cobra.Command {
+	o := &oneOptions{connectTimeout: defaultConnectTimeout}
+	cmd := &cobra.Command{
+		Use:     "one",
+		Aliases: []string{"foreground-one"},
+		Short:   "serve exactly one tunnel in the foreground until interrupted, exit with 1 if it can't connect",
+		Long: "Open a tunnel from the flags like the open command and serve it until interrupted or terminated,\n" +
+			"reconnecting it as usual. Exit with 1 if the tunnel isn't connected within --connect-timeout,\n" +
+			"or once it fails for good, e.g. the key is rejected.",
+		Args:          cobra.NoArgs,
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := b.runOne(o); err != nil {
+				fmt.Fprintln(os.Stderr, "error:", err.Error())
+				os.Exit(1)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVarP(&o.Name, "name", "n", "", "name of the tunnel")
+	cmd.Flags().StringVarP(&o.link, "link", "l", "",
+		"tunnel info, format: <local>:<remote>@<user>@<ssh_server>. e.g. :1080:192.168.1.2:1080@user@host.com:22")
+	cmd.Flags().StringVar(&o.Local, "local", ":8080", "local address of the tunnel to listen")
+	cmd.Flags().StringVarP(&o.SshServer, "server", "s", "", "ssh server address of the tunnel, e.g. user@host.com:22")
+	cmd.Flags().StringVarP(&o.MapTo, "remote", "r", "", "remote address of the tunnel, e.g. 192.168.1.2:1080")
+	cmd.Flags().StringVarP(&o.PrivateKey, "key", "k", "",
+		"ssh private key file path, if not provided, the global key path(--pk) will be used")
+	cmd.Flags().StringVarP(&o.Jump, "jump", "J", "",
+		"jump hosts to reach the server through like ssh -J, e.g. user@bastion:22,inner")
+	cmd.Flags().BoolVar(&o.UDP, "udp", false, "forward the datagrams sent to local over UDP too")
+	cmd.Flags().IntVar(&o.MaxConnectionAge, "max-age", 0,
+		"reconnect the ssh connection once it is older than max-age seconds, 0 means no limit")
+	cmd.Flags().StringVar(&o.Auth, "auth", "",
+		"publickey(default) or password, the password is typed on the terminal when starting")
+	cmd.Flags().DurationVar(&o.connectTimeout, "connect-timeout", defaultConnectTimeout,
+		"exit with 1 if the tunnel isn't connected for the first time within it")
+	return cmd
+}
+
+func (b *baseCommand) runOne(o *oneOptions) error {
+	cfg := &o.tConfig
+	if o.link != "" {
+		var err error
+		if cfg.Local, cfg.MapTo, cfg.SshServer, err = parseLink(o.link); err != nil {
+			return err
+		}
+	}
+	cfg.Local, cfg.SshServer, cfg.MapTo = normalizeInput(cfg.Local), normalizeInput(cfg.SshServer), normalizeInput(cfg.MapTo)
+	if cfg.SshServer == "" || cfg.MapTo == "" {
+		return errors.New("should specify the server by -s and the remote by -r, or both by -l")
+	}
+	// the flags are checked like a tunnel in the config file
+	if problems := checkTunnelConfig("tunnel", cfg, nil); len(problems) > 0 {
+		return configErrors(problems)
+	}
+	if err := readPasswords([]*tConfig{cfg}, true); err != nil {
+		return err
+	}
+
+	release, err := b.acquirePidfile()
+	if err != nil {
+		return err
+	}
+	defer release()
+	dashBoard := internal.DefaultDashboard(b.pkPath, b.heartbeatInterval)
+	if err := b.configMario(dashBoard.Mario); err != nil {
+		return err
+	}
+	logger := newLogger(b.debug)
+	dashBoard.Mario.Logger = logger
+	defer handleSignals(dashBoard, logger)()
+	if err := dashBoard.Work(); err != nil {
+		return err
+	}
+	defer dashBoard.Quit()
+
+	tn, err := dashBoard.NewTunnel(cfg.Name, internal.SourceManual, cfg.Local, cfg.SshServer, cfg.MapTo,
+		cfg.PrivateKey, false, cfg.options()...)
+	if err != nil {
+		return err
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	deadline := time.After(o.connectTimeout)
+	connected := false
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case sig := <-sigs:
+			logger.Infow("stopping the tunnel", "signal", sig.String())
+			return nil
+		case <-deadline:
+			if !connected {
+				return fmt.Errorf("tunnel %s is not connected after %s: %v", tn.Represent(), o.connectTimeout, tn.Error())
+			}
+		case <-ticker.C:
+			switch tn.GetStatus() {
+			case "connected":
+				if !connected {
+					connected = true
+					fmt.Printf("tunnel %s connected, press Ctrl-C to stop\n", tn.Represent())
+				}
+			case "failed":
+				return fmt.Errorf("tunnel %s failed: %v", tn.Represent(), tn.Error())
+			}
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// acquirePidfile writes the pid of mario to path, it fails if the file is owned by another
+// process still running so that the same service isn't started twice. The file left by a
+// process no longer running is stale and taken over. The returned function removes it.
+func acquirePidfile(path string) (release func(), err error) {
+	content, err := ioutil.ReadFile(path)
+	if err == nil {
+		pid, e := strconv.Atoi(strings.TrimSpace(string(content)))
+		if e == nil && pid != os.Getpid() && processAlive(pid) {
+			return nil, fmt.Errorf("mario is already running with pid %d, see %s", pid, path)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	pid := strconv.Itoa(os.Getpid())
+	if err = writeFileAtomic(path, []byte(pid+"\n"), 0644); err != nil {
+		return nil, err
+	}
+	return func() {
+		// the file taken over by another process is left to it
+		if content, err := ioutil.ReadFile(path); err == nil && strings.TrimSpace(string(content)) == pid {
+			_ = os.Remove(path)
+		}
+	}, nil
+}
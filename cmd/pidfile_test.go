@@ -0,0 +1,50 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestAcquirePidfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mario")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "mario.pid")
+
+	release, err := acquirePidfile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := ioutil.ReadFile(file)
+	if strings.TrimSpace(string(content)) != strconv.Itoa(os.Getpid()) {
+		t.Errorf("the pidfile should contain the pid, got %q", content)
+	}
+	release()
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Error("the pidfile should be removed on release")
+	}
+
+	// the parent, i.e. go test, is still running
+	if err := ioutil.WriteFile(file, []byte(strconv.Itoa(os.Getppid())), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := acquirePidfile(file); err == nil {
+		t.Error("expected an error for the pidfile of a running process")
+	}
+
+	// no process has a pid above the maximum of linux
+	if err := ioutil.WriteFile(file, []byte("99999999\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	release, err = acquirePidfile(file)
+	if err != nil {
+		t.Fatalf("the stale pidfile should be taken over: %v", err)
+	}
+	release()
+}
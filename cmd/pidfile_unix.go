@@ -0,0 +1,13 @@
+//go:build !windows
+// +build !windows
+
+package cmd
+
+import "syscall"
+
+// processAlive tells whether the process of pid exists, one of another user is alive too
+// though it can't be signaled
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
@@ -0,0 +1,13 @@
+package cmd
+
+import "os"
+
+// processAlive tells whether the process of pid exists, FindProcess opens it on windows
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	_ = p.Release()
+	return true
+}
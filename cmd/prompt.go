@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"fmt"
+	"github.com/Jonwing/mario/internal"
 	"github.com/Jonwing/mario/pkg/ssh"
 	"github.com/c-bata/go-prompt"
 	json "github.com/json-iterator/go"
@@ -9,11 +10,10 @@ import (
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 	"go.uber.org/atomic"
-	"io/ioutil"
 	"os"
-	"path"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type completeFunc func(cmd promptCommand, args []string, current string) []prompt.Suggest
@@ -178,28 +178,150 @@ func (c *command) ClearFlags() {
 	}
 }
 
+// wideHeader the columns of `list --wide`
+var wideHeader = []string{"id", "name", "status", "local url", "link", "server", "reconnects", "uptime", "conns", "bytes", "rate", "source", "remark"}
+
+// defaultWatchInterval is how often `list --watch` refreshes
+const defaultWatchInterval = 2 * time.Second
+
 // listCommand list the current state of all tunnels to output
 type listCommand struct {
 	command
 
 	table *tablewriter.Table
+
+	// out counts the lines of the table rendered so that they can be redrawn
+	out *lineCounter
+
+	// watch re-renders the table in place until interrupted
+	watch bool
+
+	// interval of re-rendering when watching
+	interval time.Duration
+
+	// wide shows the extra columns in wideTable
+	wide bool
+
+	wideTable *tablewriter.Table
+
+	// mask redacts the hosts in the rendered table, see maskAddr
+	mask bool
+
+	// filter only lists the tunnels whose name, local url or link contains it
+	filter string
+}
+
+func (l *listCommand) ClearFlags() {
+	l.command.ClearFlags()
+	l.watch = false
+	l.wide = false
+	l.mask = false
+	l.filter = ""
+	l.interval = defaultWatchInterval
+	// --interval implies --watch by being set, which should not outlive this run
+	if f := l.cmd.Flags().Lookup("interval"); f != nil {
+		f.Changed = false
+	}
+}
+
+func (l *listCommand) Complete(args []string, word string) []prompt.Suggest {
+	if !strings.HasPrefix(word, "--") {
+		return nil
+	}
+	suggests := make([]prompt.Suggest, 0)
+	l.cmd.Flags().VisitAll(flagHasPrefix(word, &suggests))
+	return suggests
 }
 
 func (l *listCommand) Run(cmd *cobra.Command, args []string) {
+	if cmd != nil && (l.watch || cmd.Flags().Changed("interval")) {
+		watchInPlace(l.out, l.interval, l.render)
+		return
+	}
+	l.render()
+}
+
+func (l *listCommand) render() {
+	if l.wide {
+		l.renderWide()
+		return
+	}
 	l.table.ClearRows()
-	tns := l.root.dashboard.GetTunnels()
+	tns := l.tunnels()
 	rows := make([][]string, len(tns))
 	for i, tn := range tns {
-		var errStr string
-		if tn.Error() != nil {
-			errStr = tn.Error().Error()
-		}
-		rows[i] = []string{strconv.Itoa(tn.GetID()), tn.GetName(), tn.GetStatus(), tn.Represent(), errStr}
+		link, note := l.linkAndRemark(tn)
+		rows[i] = []string{strconv.Itoa(tn.GetID()), tn.GetName(), tn.GetStatus(), l.localURL(tn), link,
+			tunnelBytes(tn), formatRate(tn.GetThroughput()), note}
 	}
 	l.table.AppendBulk(rows)
 	l.table.Render()
 }
 
+// renderWide renders the tunnels with the extra columns, on a narrow terminal the columns
+// share its width and the long cells are wrapped
+func (l *listCommand) renderWide() {
+	l.wideTable.ClearRows()
+	if width := terminalWidth(); width > 0 {
+		l.wideTable.SetColWidth(columnWidth(width, len(wideHeader)))
+	}
+	for _, tn := range l.tunnels() {
+		uptime := "-"
+		if up := tn.GetUptime(); up > 0 {
+			uptime = up.Round(time.Second).String()
+		}
+		server := tn.GetServerVersion()
+		if server == "" {
+			server = "-"
+		}
+		source := tn.GetSource()
+		if source == "" {
+			source = "-"
+		}
+		link, note := l.linkAndRemark(tn)
+		l.wideTable.Append([]string{
+			strconv.Itoa(tn.GetID()), tn.GetName(), tn.GetStatus(), l.localURL(tn), link, server,
+			strconv.Itoa(tn.GetReconnects()), uptime, strconv.Itoa(tn.ConnectionCount()), tunnelBytes(tn),
+			formatRate(tn.GetThroughput()), source, note})
+	}
+	l.wideTable.Render()
+}
+
+// tunnels returns the tunnels to list, those not matching --filter are left out
+func (l *listCommand) tunnels() []*internal.TunnelInfo {
+	tns := l.root.dashboard.GetTunnels()
+	filter := strings.ToLower(normalizeInput(l.filter))
+	if filter == "" {
+		return tns
+	}
+	matched := make([]*internal.TunnelInfo, 0, len(tns))
+	for _, tn := range tns {
+		for _, field := range []string{tn.GetName(), tn.LocalURL(), tn.Represent()} {
+			if strings.Contains(strings.ToLower(field), filter) {
+				matched = append(matched, tn)
+				break
+			}
+		}
+	}
+	return matched
+}
+
+// localURL returns the local url column of the tunnel, masked if --mask is set
+func (l *listCommand) localURL(tn *internal.TunnelInfo) string {
+	if l.mask {
+		return maskText(tn.LocalURL())
+	}
+	return tn.LocalURL()
+}
+
+// linkAndRemark returns the link and remark columns of the tunnel, masked if --mask is set
+func (l *listCommand) linkAndRemark(tn *internal.TunnelInfo) (string, string) {
+	if l.mask {
+		return maskLink(tn), maskText(remark(tn))
+	}
+	return tn.Represent(), remark(tn)
+}
+
 func NewListCommand(root *interactiveCmd) *listCommand {
 	l := &listCommand{
 		command: command{
@@ -212,10 +334,25 @@ func NewListCommand(root *interactiveCmd) *listCommand {
 			completer: nil,
 			children:  make([]promptCommand, 0),
 		},
-		table: tablewriter.NewWriter(os.Stdout),
+		out:      &lineCounter{w: os.Stdout},
+		interval: defaultWatchInterval,
 	}
-	l.table.SetHeader([]string{"id", "name", "status", "link", "remark"})
+	l.table = tablewriter.NewWriter(l.out)
+	l.table.SetHeader([]string{"id", "name", "status", "local url", "link", "bytes", "rate", "remark"})
 	l.table.SetRowLine(false)
+	l.wideTable = tablewriter.NewWriter(l.out)
+	l.wideTable.SetHeader(wideHeader)
+	l.wideTable.SetRowLine(false)
+	l.cmd.Flags().BoolVar(&l.wide, "wide", false,
+		"show the server version, reconnects, uptime, connections and source of the tunnels too")
+	l.cmd.Flags().BoolVar(&l.mask, "mask", false,
+		"redact the users, hosts and IPs in the table, only the ports are shown, e.g. for sharing it")
+	l.cmd.Flags().StringVar(&l.filter, "filter", "",
+		"only list the tunnels whose name, local url or link contains filter, e.g. --filter :5432")
+	l.cmd.Flags().BoolVarP(&l.watch, "watch", "w", false,
+		"re-render the table in place until Ctrl-C")
+	l.cmd.Flags().DurationVar(&l.interval, "interval", defaultWatchInterval,
+		"refresh interval when watching, e.g. 2s. It implies --watch")
 	return l
 }
 
@@ -243,8 +380,73 @@ type openCommand struct {
 
 	// pk private key path
 	pk string
+
+	// maxAge the max lifetime of the ssh connection in seconds
+	maxAge int
+
+	// dialTimeout how long connecting to the server may take in seconds, 0 means the global one
+	dialTimeout int
+
+	// noReconnect don't reconnect when the health check fails
+	noReconnect bool
+
+	// maxRetries give up reconnecting after this many failed reconnects in a row, 0 means never
+	maxRetries int
+
+	// idleTimeout close the connections moving no bytes for this many seconds, 0 means never
+	idleTimeout int
+
+	// agentSocket the unix socket of the ssh agent to authenticate with
+	agentSocket string
+
+	// agent authenticate with the ssh agent of $SSH_AUTH_SOCK if agentSocket isn't given
+	agent bool
+
+	// auth publickey or password, the password is read from the terminal
+	auth string
+
+	// password read for password auth
+	password string
+
+	// warnConns warns once the tunnel serves more connections than it
+	warnConns int
+
+	// maxConns closes the connections beyond this many served at the same time, 0 means no cap
+	maxConns int
+
+	// env environment variables requested on the sessions of the tunnel
+	env map[string]string
+
+	// backends the remote addresses besides remote that the connections are spread over
+	backends []string
+
+	// balance how a backend is picked: round-robin or random
+	balance string
+
+	// udp forward the datagrams sent to local over UDP too
+	udp bool
+
+	// jump the jump hosts to reach the server through, separated by commas
+	jump string
+
+	// reverse(--reverse) listen on remote of the server and forward back to local, like `ssh -R`
+	reverse bool
+
+	// remoteBind(--remote-bind) the host a reverse tunnel listens on of the server
+	remoteBind string
+
+	// socks(--socks) the local address of a SOCKS5 tunnel dialing the requested destinations
+	// through the server, like `ssh -D`
+	socks string
+
+	// persist the config file the opened tunnels are saved to, persistDefault means the
+	// default one and empty means not saving them
+	persist string
 }
 
+// persistDefault is the value of open --persist given without a path
+const persistDefault = "default"
+
 func (o *openCommand) ClearFlags() {
 	o.command.ClearFlags()
 	o.link = ""
@@ -253,6 +455,39 @@ func (o *openCommand) ClearFlags() {
 	o.remote = ""
 	o.tunnelName = ""
 	o.pk = ""
+	o.maxAge = 0
+	o.dialTimeout = 0
+	o.noReconnect = false
+	o.maxRetries = 0
+	o.idleTimeout = 0
+	o.agentSocket = ""
+	o.agent = false
+	o.auth = ""
+	o.password = ""
+	o.warnConns = 0
+	o.maxConns = 0
+	// the flag merges values into the map once it has been set, so give it a new one
+	o.env = make(map[string]string)
+	o.backends = nil
+	o.balance = ""
+	o.udp = false
+	o.jump = ""
+	o.socks = ""
+	o.reverse = false
+	o.remoteBind = ""
+	o.persist = ""
+}
+
+// options returns the optional settings of the tunnel to open
+func (o *openCommand) options() []ssh.Option {
+	cfg := &tConfig{MaxConnectionAge: o.maxAge, IdentityAgent: o.agentSocket, WarnConnections: o.warnConns, MaxConns: o.maxConns, Env: o.env,
+		Backends: o.backends, Balance: o.balance, Auth: o.auth, password: o.password, UDP: o.udp, Jump: o.jump,
+		Reverse: o.reverse, RemoteBind: o.remoteBind, MaxRetries: o.maxRetries, DialTimeout: o.dialTimeout, IdleTimeout: o.idleTimeout}
+	if o.noReconnect {
+		autoReconnect := false
+		cfg.AutoReconnect = &autoReconnect
+	}
+	return cfg.options()
 }
 
 func (o *openCommand) Complete(args []string, word string) []prompt.Suggest {
@@ -267,44 +502,123 @@ func (o *openCommand) Complete(args []string, word string) []prompt.Suggest {
 }
 
 func (o *openCommand) Run(cmd *cobra.Command, args []string) {
-	if o.link != "" {
-		// this should split the link into [mapping, server] slice
-		parts := strings.SplitN(o.link, "@", 2)
-		if len(parts) != 2 {
-			fmt.Println("wrong link: ", o.link)
+	o.link = normalizeInput(o.link)
+	o.local = normalizeInput(o.local)
+	o.server = normalizeInput(o.server)
+	o.remote = normalizeInput(o.remote)
+	o.socks = normalizeInput(o.socks)
+	if o.reverse && (o.socks != "" || len(o.backends) > 0 || o.udp) {
+		fmt.Println("[Error]--reverse forwards to local, --socks, --backends and --udp are not allowed")
+		return
+	}
+	if o.remoteBind != "" && !o.reverse {
+		fmt.Println("[Error]--remote-bind is the host listened on the server, it needs --reverse")
+		return
+	}
+	if o.socks != "" {
+		if o.link != "" || o.remote != "" || len(o.backends) > 0 || o.udp {
+			fmt.Println("[Error]--socks forwards to the requested destinations, --link, --remote, --backends and --udp are not allowed")
 			return
 		}
-		// this should split mapping into [local host, local port, remote] slice
-		mapping := strings.SplitN(parts[0], ":", 3)
-		if len(mapping) != 3 {
-			fmt.Println("wrong link: ", o.link)
+		if o.server == "" {
+			fmt.Println("[Error]Should specify server by -s")
 			return
 		}
-
-		_, err := strconv.Atoi(mapping[1])
+		if err := checkHostPort(o.socks); err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+		o.local = o.socks
+	} else if o.link != "" {
+		var err error
+		o.local, o.remote, o.server, err = parseLink(o.link)
 		if err != nil {
-			fmt.Println("port must be a number: ", mapping[1])
+			fmt.Println(err.Error())
 			return
 		}
-		o.local = strings.Join(mapping[:2], ":")
-		o.remote = mapping[2]
-
-		o.server = parts[1]
 	} else {
 		if o.server == "" || o.remote == "" {
 			fmt.Println("[Error]Should specify server by -s and remote by -r")
 			return
 		}
 	}
+	if _, err := ssh.ParseBalanceStrategy(o.balance); err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	if o.maxRetries < 0 || o.dialTimeout < 0 || o.idleTimeout < 0 || o.maxConns < 0 {
+		fmt.Println("[Error]--max-retries, --dial-timeout, --idle-timeout and --max-conns should not be negative")
+		return
+	}
+	if err := checkAuth(o.auth); err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	if o.auth == authPassword {
+		password, err := readPassword("password of " + o.server + ": ")
+		if err != nil {
+			fmt.Println("[Error]failed to read the password:", err.Error())
+			return
+		}
+		o.password = password
+	}
+	o.jump = normalizeInput(o.jump)
+	if err := checkJumpHosts(o.jump); err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	if o.agent && o.agentSocket == "" {
+		if o.agentSocket = ssh.EnvAgentSocket(); o.agentSocket == "" {
+			fmt.Println("[Error]--agent needs a running ssh agent, $SSH_AUTH_SOCK is not set")
+			return
+		}
+	}
+	for i, backend := range o.backends {
+		o.backends[i] = normalizeInput(backend)
+		if err := checkHostPort(o.backends[i]); err != nil {
+			fmt.Printf("wrong backend %s: %s\n", backend, err.Error())
+			return
+		}
+	}
 
-	err := o.root.dashboard.NewTunnel(o.tunnelName, o.local, o.server, o.remote, o.pk, false)
-	if err != nil {
-		fmt.Println(
-			"Open tunnel failed. ",
-			"local:", o.local, "server:", o.server, "remote:", o.remote, "error:", err)
+	var tns []*internal.TunnelInfo
+	var errs []error
+	if o.socks != "" {
+		tn, err := o.root.dashboard.NewTunnel(o.tunnelName, internal.SourceManual, o.local, o.server, "", o.pk, false, o.options()...)
+		if err != nil {
+			errs = append(errs, err)
+		} else {
+			tns = append(tns, tn)
+		}
+	} else {
+		tns, errs = openTunnels(o.root.dashboard, o.tunnelName, internal.SourceManual, o.local, o.server, o.remote, o.pk, o.options()...)
+	}
+	for _, err := range errs {
+		fmt.Println("Open tunnel failed. ", err)
+	}
+	if o.persist != "" && len(tns) > 0 {
+		o.save(tns)
 	}
 }
 
+// save writes the opened tunnels to the config file given by --persist
+func (o *openCommand) save(tns []*internal.TunnelInfo) {
+	output := o.persist
+	if output == persistDefault {
+		output = defaultConfigFile()
+	}
+	cfgs := make([]*tConfig, 0, len(tns))
+	for _, tn := range tns {
+		cfgs = append(cfgs, tunnelConfig(tn))
+	}
+	timeout := int(o.root.dashboard.Mario.CheckAliveInterval.Seconds())
+	if err := persistTunnels(output, cfgs, timeout); err != nil {
+		fmt.Println("the tunnel is opened but not saved:", err)
+		return
+	}
+	fmt.Printf("saved %d tunnel(s) to %s\n", len(cfgs), output)
+}
+
 // closeOrUpCommand is responsible for close or reopen a ssh tunnel
 // usage:
 // 		close
@@ -313,17 +627,22 @@ func (o *openCommand) Run(cmd *cobra.Command, args []string) {
 // 		up
 // 		up <tunnel_id>
 // 		up --name tunnel_name
+// 		up --force <tunnel_id>
 type closeOrUpCommand struct {
 	command
 
 	tunnelName string
 
+	// force(--force) `up` reconnects the connected tunnels too
+	force bool
+
 	listCmd *listCommand
 }
 
 func (c *closeOrUpCommand) ClearFlags() {
 	c.command.ClearFlags()
 	c.tunnelName = ""
+	c.force = false
 }
 
 func (c *closeOrUpCommand) Complete(args []string, word string) []prompt.Suggest {
@@ -358,6 +677,8 @@ func (c *closeOrUpCommand) Run(cmd *cobra.Command, args []string) {
 	var err error
 	if c.name == "close" {
 		method = c.root.dashboard.CloseTunnel
+	} else if c.force {
+		method = c.root.dashboard.ForceUpTunnel
 	} else {
 		method = c.root.dashboard.UpTunnel
 	}
@@ -386,16 +707,27 @@ func (c *closeOrUpCommand) Run(cmd *cobra.Command, args []string) {
 	c.listCmd.Run(nil, nil)
 }
 
+// defaultBackups is how many previous versions of the config save keeps
+const defaultBackups = 1
+
 // saveCommand saves all the ssh tunnels that mario holds to disk for next time usage
 type saveCommand struct {
 	command
 
 	// output path of the export file
 	output string
+
+	// force writes an empty config even if there is no tunnel to save
+	force bool
+
+	// backups is how many previous versions of the output file are kept
+	backups int
 }
 
 func (s *saveCommand) ClearFlags() {
 	s.output = ""
+	s.force = false
+	s.backups = defaultBackups
 	s.command.ClearFlags()
 }
 
@@ -413,47 +745,75 @@ func (s *saveCommand) Complete(args []string, word string) []prompt.Suggest {
 func (s *saveCommand) Run(cmd *cobra.Command, args []string) {
 
 	if s.output == "" {
-		s.output = path.Join(GetUserHome(), "tunnels.json")
+		s.output = defaultConfigFile()
 	}
 	tns := s.root.dashboard.GetTunnels()
+	if len(tns) == 0 && !s.force {
+		fmt.Println("no tunnels to save,", s.output, "is left untouched. use --force to write an empty config")
+		return
+	}
 	configs := make([]*tConfig, 0)
 	for _, tn := range tns {
-		cfg := new(tConfig)
-		cfg.Name = tn.GetName()
-		cfg.Local = tn.GetLocal()
-		cfg.PrivateKey = tn.GetPrivateKeyPath()
-		cfg.MapTo = tn.GetRemote()
-		cfg.SshServer = tn.GetServer()
-		configs = append(configs, cfg)
+		configs = append(configs, tunnelConfig(tn))
 	}
 
-	toSave, err := LoadJsonConfig(s.output)
+	var toSave *tConfigs
+	var err error
+	if len(tns) == 0 {
+		// forced to save nothing, so don't merge with the existing file
+		err = os.ErrNotExist
+	} else {
+		toSave, err = LoadJsonConfig(s.output)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		// don't overwrite a config file that we can't understand
+		fmt.Println("can not merge with existing file", s.output, "because of:", err)
+		return
+	}
+	running := &tConfigs{
+		TunnelTimeout: int(s.root.dashboard.Mario.CheckAliveInterval.Seconds()),
+		DialTimeout:   int(s.root.dashboard.Mario.DialTimeout.Seconds()),
+	}
 	if err == nil {
-		for _, tn := range configs {
-			idOld := false
+		for i, tn := range configs {
+			var saved *tConfig
 			for _, old := range toSave.Tunnels {
 				if tn.Name == old.Name {
-					idOld = true
+					saved = old
 					break
 				}
 			}
-			if !idOld {
+			if saved == nil {
+				tn.rebase(running, toSave)
 				toSave.Tunnels = append(toSave.Tunnels, tn)
+				continue
+			}
+			// the saved tunnel is kept as it is but whether it's closed, unless it's never been
+			// brought up, e.g. it's left out by --only
+			if tns[i].Status() != ssh.StatusNew {
+				saved.DontConnect = tn.DontConnect
 			}
 		}
 	} else {
 		toSave = &tConfigs{
 			Tunnels:       configs,
-			TunnelTimeout: int(s.root.dashboard.Mario.CheckAliveInterval.Seconds()),
+			TunnelTimeout: running.TunnelTimeout,
+			DialTimeout:   running.DialTimeout,
 		}
 	}
 
+	toSave.Tunnels = withoutInstances(toSave.Tunnels)
 	marshaled, err := json.MarshalIndent(toSave, "", "    ")
 	if err != nil {
 		fmt.Println("save tunnels failed.", "error:", err)
+		return
 	}
 
-	err = ioutil.WriteFile(s.output, marshaled, 0644)
+	if err = rotateBackups(s.output, s.backups); err != nil {
+		fmt.Println("can not back up", s.output, "because of:", err)
+		return
+	}
+	err = writeFileAtomic(s.output, marshaled, 0644)
 	if err != nil {
 		fmt.Println("can not write file to disk because of: ", "error", err)
 	}
@@ -464,12 +824,32 @@ type viewCommand struct {
 
 	tunnelName string
 
+	// closed shows the recently closed connections instead
+	closed bool
+
+	// watch re-renders the connections in place until interrupted
+	watch bool
+
+	// interval of re-rendering when watching
+	interval time.Duration
+
+	// out counts the lines rendered so that they can be redrawn
+	out *lineCounter
+
 	table *tablewriter.Table
+
+	closedTable *tablewriter.Table
 }
 
 func (c *viewCommand) ClearFlags() {
 	c.command.ClearFlags()
 	c.tunnelName = ""
+	c.closed = false
+	c.watch = false
+	c.interval = defaultWatchInterval
+	if f := c.cmd.Flags().Lookup("interval"); f != nil {
+		f.Changed = false
+	}
 }
 
 func (c *viewCommand) Complete(args []string, word string) []prompt.Suggest {
@@ -504,32 +884,80 @@ func (c *viewCommand) Run(cmd *cobra.Command, args []string) {
 		fmt.Println("specify tunnel id or tunnel name")
 		return
 	}
-	var cs []*ssh.Connector
+	var idOrName interface{} = c.tunnelName
 	if len(args) > 0 {
 		id, err := strconv.Atoi(args[0])
 		if err != nil {
 			fmt.Println("id should be a number", args[0])
 			return
 		}
-		// close tunnel with id
-		cs = c.root.dashboard.GetTunnelConnections(id)
-	} else {
-		cs = c.root.dashboard.GetTunnelConnections(c.tunnelName)
+		idOrName = id
+	}
+	render := func() {
+		c.render(idOrName)
+	}
+	if c.watch || cmd.Flags().Changed("interval") {
+		watchInPlace(c.out, c.interval, render)
+		return
 	}
+	render()
+}
+
+func (c *viewCommand) render(idOrName interface{}) {
+	if c.closed {
+		c.renderClosed(c.root.dashboard.GetClosedConnections(idOrName))
+		return
+	}
+	cs := c.root.dashboard.GetTunnelConnections(idOrName)
 
 	if len(cs) == 0 {
+		_, _ = fmt.Fprintln(c.out, "no connections")
+		// those refused by the cap are still worth seeing
+		c.renderCount(idOrName, 0)
 		return
 	}
+	defer c.renderCount(idOrName, len(cs))
 
 	c.table.ClearRows()
 	rows := make([][]string, len(cs))
 	for i, cnt := range cs {
-		rows[i] = []string{strconv.FormatUint(cnt.ID(), 10), cnt.String()}
+		rows[i] = []string{
+			strconv.FormatUint(cnt.ID(), 10), cnt.Client(), cnt.Target(), cnt.Via(),
+			formatTime(cnt.OpenedAt(), c.root.timeFormat), time.Since(cnt.OpenedAt()).Round(time.Second).String(),
+			formatBytes(cnt.BytesIn()), formatBytes(cnt.BytesOut())}
 	}
 	c.table.AppendBulk(rows)
 	c.table.Render()
 }
 
+// renderCount prints the connections of the tunnel against its cap, and how many were refused
+func (c *viewCommand) renderCount(idOrName interface{}, count int) {
+	tn, ok := c.root.dashboard.GetTunnel(idOrName)
+	if !ok {
+		return
+	}
+	if max := tn.GetMaxConnectors(); max > 0 {
+		_, _ = fmt.Fprintf(c.out, "%d of %d connections, refused: %d\n", count, max, tn.GetCappedConnections())
+		return
+	}
+	_, _ = fmt.Fprintf(c.out, "%d connections, no cap\n", count)
+}
+
+func (c *viewCommand) renderClosed(cs []*ssh.Connector) {
+	if len(cs) == 0 {
+		_, _ = fmt.Fprintln(c.out, "no connection closed recently")
+		return
+	}
+	c.closedTable.ClearRows()
+	for _, cnt := range cs {
+		c.closedTable.Append([]string{
+			strconv.FormatUint(cnt.ID(), 10), cnt.Client(), cnt.Target(),
+			formatTime(cnt.OpenedAt(), c.root.timeFormat), formatTime(cnt.ClosedAt(), c.root.timeFormat),
+			formatBytes(cnt.BytesIn()), formatBytes(cnt.BytesOut()), cnt.CloseReason()})
+	}
+	c.closedTable.Render()
+}
+
 func NewCommand(name, short, long string, completer completeFunc, runner func(*cobra.Command, []string)) *command {
 	return &command{
 		root: nil,
@@ -561,7 +989,7 @@ func builtinCommand(root *interactiveCmd, name, short, long string, completer co
 
 func getChildCommand(cmd promptCommand, name string) promptCommand {
 	for _, c := range cmd.Children() {
-		if c.Name() == name {
+		if c.Name() == name || c.GetCmd().HasAlias(name) {
 			return c
 		}
 	}
@@ -588,16 +1016,64 @@ func (i *interactiveCmd) buildCommands() {
 		&openCmd.tunnelName, "name", "n", "", "name of this tunnel")
 	openCmd.cmd.Flags().StringVarP(
 		&openCmd.link, "link", "l", "",
-		"tunnel info, format: <local>:<remote>@<user>@<ssh_server>. e.g. :1080:192.168.1.2:1080@user@host.com:22 ")
+		"tunnel info, format: <local>:<remote>@<user>@<ssh_server>. e.g. :1080:192.168.1.2:1080@user@host.com:22, "+
+			"ports can be ranges of the same size, e.g. :8000-8010:10.0.0.5:9000-9010@user@host.com")
 	openCmd.cmd.Flags().StringVar(&openCmd.local, "local",
 		":8080", "local address of the tunnel to listen")
 	openCmd.cmd.Flags().StringVarP(&openCmd.server, "server", "s", "",
 		"ssh server address of this tunnel, e.g. user@host.com:22, "+
 			"if local not specified, the default local 22 will be used.")
 	openCmd.cmd.Flags().StringVarP(&openCmd.remote, "remote", "r", "",
-		"remote address of the tunnel. e.g. 192.168.1.2:1080")
+		"remote address of the tunnel. e.g. 192.168.1.2:1080 or a port range 192.168.1.2:9000-9010")
 	openCmd.cmd.Flags().StringVarP(&openCmd.pk, "key", "k", "",
 		"ssh private key file path, if not provided, the global key path will be used")
+	openCmd.cmd.Flags().IntVar(&openCmd.maxAge, "max-age", 0,
+		"reconnect the ssh connection once it is older than max-age seconds, 0 means no limit")
+	openCmd.cmd.Flags().IntVar(&openCmd.dialTimeout, "dial-timeout", 0,
+		"how long connecting to the server may take in seconds, 0 means the global --dial-timeout")
+	openCmd.cmd.Flags().BoolVar(&openCmd.noReconnect, "no-reconnect", false,
+		"don't reconnect when the health check fails, leave the tunnel errored until `up`")
+	openCmd.cmd.Flags().IntVar(&openCmd.maxRetries, "max-retries", 0,
+		"give up reconnecting after this many failed reconnects in a row and leave the tunnel errored until `up`, "+
+			"0 means retrying forever")
+	openCmd.cmd.Flags().IntVar(&openCmd.idleTimeout, "idle-timeout", 0,
+		"close the connections moving no bytes for this many seconds, 0 means never")
+	openCmd.cmd.Flags().StringVar(&openCmd.agentSocket, "agent-socket", "",
+		"unix socket of the ssh agent to authenticate with, if not provided, the global one will be used")
+	openCmd.cmd.Flags().BoolVar(&openCmd.agent, "agent", false,
+		"authenticate with the ssh agent of $SSH_AUTH_SOCK before the private key, "+
+			"it's the default of the tunnels without --key if no global agent socket is set")
+	openCmd.cmd.Flags().StringVar(&openCmd.auth, "auth", "",
+		"publickey(default) or password, the password is typed when opening and tried if the keys are rejected, "+
+			"it's never saved")
+	openCmd.cmd.Flags().IntVar(&openCmd.warnConns, "warn-conns", 0,
+		"warn once the tunnel serves more connections than warn-conns at the same time, 0 means never")
+	openCmd.cmd.Flags().IntVar(&openCmd.maxConns, "max-conns", 0,
+		"close the new connections right away once the tunnel serves max-conns at the same time, 0 means no cap")
+	openCmd.cmd.Flags().StringToStringVar(&openCmd.env, "env", nil,
+		"environment variables requested on the sessions of the tunnel, e.g. --env LANG=C,TZ=UTC")
+	openCmd.cmd.Flags().StringSliceVar(&openCmd.backends, "backends", nil,
+		"more remote addresses to spread the connections over together with remote, e.g. 192.168.1.3:1080,192.168.1.4:1080")
+	openCmd.cmd.Flags().StringVar(&openCmd.balance, "balance", "",
+		"how a backend is picked for a connection: round-robin(default) or random")
+	openCmd.cmd.Flags().BoolVar(&openCmd.reverse, "reverse", false,
+		"forward the other way like ssh -R: listen on remote of the server and forward back to local, "+
+			"e.g. --reverse --remote :9000 --local 127.0.0.1:3000 -s user@host.com")
+	openCmd.cmd.Flags().StringVar(&openCmd.remoteBind, "remote-bind", "",
+		"the host a reverse tunnel listens on of the server in place of the one of remote, the loopback if neither "+
+			"gives one, e.g. 0.0.0.0, which needs GatewayPorts clientspecified in the sshd_config of the server")
+	openCmd.cmd.Flags().StringVar(&openCmd.socks, "socks", "",
+		"open a SOCKS5 proxy on this local address dialing the requested destinations through the server, "+
+			"like ssh -D, e.g. --socks :1080 -s user@host.com")
+	openCmd.cmd.Flags().StringVarP(&openCmd.jump, "jump", "J", "",
+		"jump hosts to reach the server through like ssh -J, e.g. user@bastion:22,inner, "+
+			"\"none\" ignores the ProxyJump of ssh_config")
+	openCmd.cmd.Flags().BoolVar(&openCmd.udp, "udp", false,
+		"forward the datagrams sent to local over UDP too, the remote should be a DNS server's TCP port "+
+			"or `mario udp-relay`")
+	openCmd.cmd.Flags().StringVar(&openCmd.persist, "persist", "",
+		"save the opened tunnel to the config file, --persist for the default one or --persist=<path>")
+	openCmd.cmd.Flags().Lookup("persist").NoOptDefVal = persistDefault
 
 	closeCmd := &closeOrUpCommand{
 		command: command{
@@ -620,7 +1096,7 @@ func (i *interactiveCmd) buildCommands() {
 			name: "up",
 			cmd: &cobra.Command{
 				Use:   "up",
-				Short: "refresh a tunnel",
+				Short: "connect the tunnels not connected, --force reconnects the connected ones too",
 			},
 			children: make([]promptCommand, 0),
 		},
@@ -629,6 +1105,9 @@ func (i *interactiveCmd) buildCommands() {
 	upCmd.cmd.Run = upCmd.Run
 	upCmd.cmd.Flags().StringVarP(
 		&upCmd.tunnelName, "name", "n", "", "specify tunnel name")
+	upCmd.cmd.Flags().BoolVar(
+		&upCmd.force, "force", false,
+		"reconnect even if the tunnel is connected, its connections are kept on the old ssh connection until they finish")
 
 	saveCmd := &saveCommand{
 		command: command{
@@ -644,6 +1123,10 @@ func (i *interactiveCmd) buildCommands() {
 	saveCmd.cmd.Run = saveCmd.Run
 	saveCmd.cmd.Flags().StringVarP(&saveCmd.output, "output", "o", "",
 		"output file path to save tunnels information")
+	saveCmd.cmd.Flags().BoolVar(&saveCmd.force, "force", false,
+		"write an empty config even if there is no tunnel to save")
+	saveCmd.cmd.Flags().IntVar(&saveCmd.backups, "backups", defaultBackups,
+		"number of previous versions to keep as <output>.bak, <output>.bak.1..., 0 to keep none")
 
 	helpCmd := &command{
 		root: i,
@@ -659,20 +1142,7 @@ func (i *interactiveCmd) buildCommands() {
 		children: make([]promptCommand, 0),
 	}
 
-	exit := &command{
-		root: i,
-		name: "exit",
-		cmd: &cobra.Command{
-			Use:   "exit",
-			Short: "exit mario",
-			Run: func(cmd *cobra.Command, args []string) {
-				i.dashboard.Quit()
-				i.exitParser.Exit()
-			},
-		},
-		completer: nil,
-		children:  make([]promptCommand, 0),
-	}
+	exit := NewExitCommand(i)
 
 	viewCmd := &viewCommand{
 		command: command{
@@ -684,14 +1154,46 @@ func (i *interactiveCmd) buildCommands() {
 			},
 			children: make([]promptCommand, 0),
 		},
-		table: tablewriter.NewWriter(os.Stdout),
+		out:      &lineCounter{w: os.Stdout},
+		interval: defaultWatchInterval,
 	}
-	viewCmd.table.SetHeader([]string{"id", "detail"})
+	viewCmd.table = tablewriter.NewWriter(viewCmd.out)
+	viewCmd.table.SetHeader([]string{"id", "client", "target", "via", "opened", "duration", "in", "out"})
 	viewCmd.table.SetRowLine(false)
+	viewCmd.closedTable = tablewriter.NewWriter(viewCmd.out)
+	viewCmd.closedTable.SetHeader([]string{"id", "client", "target", "opened", "closed", "in", "out", "reason"})
+	viewCmd.closedTable.SetRowLine(false)
 	viewCmd.cmd.Run = viewCmd.Run
 	viewCmd.cmd.Flags().StringVarP(&viewCmd.tunnelName, "name", "n", "", "specify tunnel name")
+	viewCmd.cmd.Flags().BoolVar(&viewCmd.closed, "closed", false,
+		"show the recently closed connections and why they were closed")
+	viewCmd.cmd.Flags().BoolVarP(&viewCmd.watch, "watch", "w", false,
+		"re-render the connections in place until Ctrl-C")
+	viewCmd.cmd.Flags().DurationVar(&viewCmd.interval, "interval", defaultWatchInterval,
+		"refresh interval when watching, e.g. 2s. It implies --watch")
+
+	keysCmd := NewKeysCommand(i)
+
+	diffCmd := NewDiffCommand(i)
+
+	getCmd, setCmd, showCmd := NewSettingCommands(i)
+
+	infoCmd := NewInfoCommand(i)
+
+	sessionCmd := NewSessionCommand(i)
+
+	cycleCmd := NewCycleCommand(i)
 
-	i.AddChildren(listCmd, openCmd, closeCmd, upCmd, saveCmd, helpCmd, viewCmd, exit)
+	rekeyCmd := NewRekeyCommand(i)
+
+	removeCmd := NewRemoveCommand(i, listCmd)
+
+	renameCmd := NewRenameCommand(i, listCmd)
+
+	editCmd := NewEditCommand(i, listCmd)
+
+	i.AddChildren(listCmd, openCmd, closeCmd, removeCmd, renameCmd, editCmd, upCmd, cycleCmd, saveCmd, helpCmd, viewCmd, infoCmd, sessionCmd, keysCmd, diffCmd,
+		getCmd, setCmd, showCmd, rekeyCmd, exit)
 }
 
 func flagHasPrefix(w string, filterTo *[]prompt.Suggest) func(flag *pflag.Flag) {
@@ -711,14 +1213,40 @@ type ExitParser struct {
 	prompt.ConsoleParser
 
 	exit atomic.Bool
+
+	// refresh whether a key doing nothing is to be read so that the prompt is rendered again,
+	// walking whether the suggestions are being walked, which the key would end
+	refresh atomic.Bool
+	walking bool
 }
 
+// ignoredKey is read by the prompt as prompt.Ignore
+var ignoredKey = []byte{0x1b, 0x5b, 0x45}
+
 func (e *ExitParser) Read() ([]byte, error) {
 	exited := e.exit.Load()
 	if exited {
 		return []byte{0x04}, nil
 	}
-	return e.ConsoleParser.Read()
+	if !e.walking && e.refresh.CAS(true, false) {
+		return ignoredKey, nil
+	}
+	b, err := e.ConsoleParser.Read()
+	if err == nil && len(b) > 0 && !(len(b) == 1 && b[0] == 0) {
+		switch e.GetKey(b) {
+		case prompt.Tab, prompt.BackTab, prompt.Up, prompt.Down:
+			e.walking = true
+		default:
+			e.walking = false
+		}
+	}
+	return b, err
+}
+
+// Refresh makes the prompt render again, e.g. for its live prefix, it waits until the
+// suggestions are no longer walked
+func (e *ExitParser) Refresh() {
+	e.refresh.Store(true)
 }
 
 func (e *ExitParser) Exit() {
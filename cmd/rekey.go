@@ -0,0 +1,122 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/c-bata/go-prompt"
+	"github.com/spf13/cobra"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultRekeyTimeout is how long `rekey` waits for the tunnel to reconnect with the new key
+const defaultRekeyTimeout = 30 * time.Second
+
+// rekeyCommand replaces the private key of a tunnel and reconnects it, e.g. after the key is
+// rotated, without recreating the tunnel
+type rekeyCommand struct {
+	command
+
+	tunnelName string
+
+	// key the path of the new private key
+	key string
+
+	// timeout how long the tunnel is waited for to reconnect
+	timeout time.Duration
+}
+
+func (c *rekeyCommand) ClearFlags() {
+	c.command.ClearFlags()
+	c.tunnelName = ""
+	c.key = ""
+	c.timeout = defaultRekeyTimeout
+}
+
+func (c *rekeyCommand) Complete(args []string, word string) []prompt.Suggest {
+	suggests := make([]prompt.Suggest, 0)
+	if strings.HasPrefix(word, "--") {
+		c.cmd.Flags().VisitAll(flagHasPrefix(word, &suggests))
+		return suggests
+	}
+	byName := len(args) > 2 && (args[len(args)-2] == "--name" || args[len(args)-2] == "-n")
+	for _, tn := range c.root.dashboard.GetTunnels() {
+		if byName {
+			suggests = append(suggests, prompt.Suggest{
+				Text:        tn.GetName(),
+				Description: "ID: " + strconv.Itoa(tn.GetID()) + "(" + tn.GetStatus() + ")",
+			})
+			continue
+		}
+		suggests = append(suggests, prompt.Suggest{
+			Text:        strconv.Itoa(tn.GetID()),
+			Description: tn.GetName() + "(" + tn.GetStatus() + ")",
+		})
+	}
+	return prompt.FilterHasPrefix(suggests, word, true)
+}
+
+func (c *rekeyCommand) Run(cmd *cobra.Command, args []string) {
+	if len(args) == 0 && c.tunnelName == "" {
+		fmt.Println("specify tunnel id or tunnel name")
+		return
+	}
+	c.key = normalizeInput(c.key)
+	if c.key == "" {
+		fmt.Println("[Error]Should specify the new private key by --key")
+		return
+	}
+	var idOrName interface{} = c.tunnelName
+	if len(args) > 0 {
+		id, err := strconv.Atoi(args[0])
+		if err != nil {
+			fmt.Println("id should be a number", args[0])
+			return
+		}
+		idOrName = id
+	}
+	tn, ok := c.root.dashboard.GetTunnel(idOrName)
+	if !ok {
+		fmt.Printf("tunnel with id or name %v not found\n", idOrName)
+		return
+	}
+
+	waiting := make(chan error, 1)
+	if err := c.root.dashboard.Mario.Rekey(tn, c.key, waiting); err != nil {
+		fmt.Printf("the key %s is not applied: %s\n", c.key, err.Error())
+		return
+	}
+	select {
+	case err := <-waiting:
+		if err != nil {
+			fmt.Printf("tunnel %s failed to reconnect with the new key: %s\n", tn.GetName(), err.Error())
+			return
+		}
+	case <-time.After(c.timeout):
+		fmt.Printf("tunnel %s is not reconnected after %s\n", tn.GetName(), c.timeout)
+		return
+	}
+	fmt.Printf("tunnel %s reconnected with %s\n", tn.GetName(), c.key)
+}
+
+func NewRekeyCommand(root *interactiveCmd) *rekeyCommand {
+	c := &rekeyCommand{
+		command: command{
+			root: root,
+			name: "rekey",
+			cmd: &cobra.Command{
+				Use:   "rekey [tunnel id] --key <path>",
+				Short: "replace the private key of a tunnel and reconnect it, e.g. after rotating the key",
+				Args:  cobra.MaximumNArgs(1),
+			},
+			children: make([]promptCommand, 0),
+		},
+		timeout: defaultRekeyTimeout,
+	}
+	c.cmd.Run = c.Run
+	c.cmd.Flags().StringVarP(&c.tunnelName, "name", "n", "", "specify tunnel name")
+	c.cmd.Flags().StringVarP(&c.key, "key", "k", "", "the path of the new private key")
+	c.cmd.Flags().DurationVar(&c.timeout, "timeout", defaultRekeyTimeout,
+		"how long the tunnel is waited for to reconnect with the new key")
+	return c
+}
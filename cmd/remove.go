@@ -0,0 +1,104 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/c-bata/go-prompt"
+	"github.com/spf13/cobra"
+	"strconv"
+	"strings"
+)
+
+// removeCommand destroys tunnels and forgets them, unlike close they can't be brought up again
+// usage:
+//
+//	remove <tunnel_id> [tunnel_id...]
+//	remove --name tunnel_name
+//	remove --all
+type removeCommand struct {
+	command
+
+	tunnelName string
+
+	// all(--all) removes all the tunnels
+	all bool
+
+	listCmd *listCommand
+}
+
+func (c *removeCommand) ClearFlags() {
+	c.command.ClearFlags()
+	c.tunnelName = ""
+	c.all = false
+}
+
+func (c *removeCommand) Complete(args []string, word string) []prompt.Suggest {
+	suggests := make([]prompt.Suggest, 0)
+	if strings.HasPrefix(word, "--") {
+		c.cmd.Flags().VisitAll(flagHasPrefix(word, &suggests))
+		return suggests
+	}
+	byName := len(args) > 2 && (args[len(args)-2] == "--name" || args[len(args)-2] == "-n")
+	for _, tn := range c.root.dashboard.GetTunnels() {
+		if byName {
+			suggests = append(suggests, prompt.Suggest{
+				Text:        tn.GetName(),
+				Description: "ID: " + strconv.Itoa(tn.GetID()) + "(" + tn.GetStatus() + ")",
+			})
+			continue
+		}
+		suggests = append(suggests, prompt.Suggest{
+			Text:        strconv.Itoa(tn.GetID()),
+			Description: tn.GetName() + "(" + tn.GetStatus() + ")",
+		})
+	}
+	return prompt.FilterHasPrefix(suggests, word, true)
+}
+
+func (c *removeCommand) Run(cmd *cobra.Command, args []string) {
+	// removing everything by a bare `remove` is too easy a mistake, it takes --all
+	if len(args) == 0 && c.tunnelName == "" && !c.all {
+		fmt.Println("specify tunnel id, tunnel name or --all")
+		return
+	}
+	targets := make([]interface{}, 0, len(args)+1)
+	if c.all {
+		targets = append(targets, -1)
+	}
+	for _, str := range args {
+		id, err := strconv.Atoi(str)
+		if err != nil || id < 0 {
+			fmt.Println("id should be a number: ", str)
+			return
+		}
+		targets = append(targets, id)
+	}
+	if c.tunnelName != "" {
+		targets = append(targets, c.tunnelName)
+	}
+	for _, idOrName := range targets {
+		if err := c.root.dashboard.RemoveTunnel(idOrName); err != nil {
+			fmt.Println(c.name, "failed: ", err.Error())
+		}
+	}
+	c.listCmd.Run(nil, nil)
+}
+
+func NewRemoveCommand(root *interactiveCmd, listCmd *listCommand) *removeCommand {
+	c := &removeCommand{
+		command: command{
+			root: root,
+			name: "remove",
+			cmd: &cobra.Command{
+				Use:     "remove [tunnel id...]",
+				Aliases: []string{"rm"},
+				Short:   "close tunnels and forget them, they are no longer listed",
+			},
+			children: make([]promptCommand, 0),
+		},
+		listCmd: listCmd,
+	}
+	c.cmd.Run = c.Run
+	c.cmd.Flags().StringVarP(&c.tunnelName, "name", "n", "", "specify tunnel name")
+	c.cmd.Flags().BoolVar(&c.all, "all", false, "remove all the tunnels")
+	return c
+}
@@ -0,0 +1,96 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/c-bata/go-prompt"
+	"github.com/spf13/cobra"
+	"strconv"
+	"strings"
+)
+
+// renameCommand changes the name of a tunnel, the tunnel is left as it is
+// usage:
+//
+//	rename <tunnel_id> <new_name>
+//	rename --name tunnel_name <new_name>
+type renameCommand struct {
+	command
+
+	tunnelName string
+
+	listCmd *listCommand
+}
+
+func (c *renameCommand) ClearFlags() {
+	c.command.ClearFlags()
+	c.tunnelName = ""
+}
+
+func (c *renameCommand) Complete(args []string, word string) []prompt.Suggest {
+	suggests := make([]prompt.Suggest, 0)
+	if strings.HasPrefix(word, "--") {
+		c.cmd.Flags().VisitAll(flagHasPrefix(word, &suggests))
+		return suggests
+	}
+	byName := len(args) > 2 && (args[len(args)-2] == "--name" || args[len(args)-2] == "-n")
+	// only the tunnel is completed, the new name is up to the user
+	if !byName && len(args) > 2 {
+		return suggests
+	}
+	for _, tn := range c.root.dashboard.GetTunnels() {
+		if byName {
+			suggests = append(suggests, prompt.Suggest{
+				Text:        tn.GetName(),
+				Description: "ID: " + strconv.Itoa(tn.GetID()) + "(" + tn.GetStatus() + ")",
+			})
+			continue
+		}
+		suggests = append(suggests, prompt.Suggest{
+			Text:        strconv.Itoa(tn.GetID()),
+			Description: tn.GetName() + "(" + tn.GetStatus() + ")",
+		})
+	}
+	return prompt.FilterHasPrefix(suggests, word, true)
+}
+
+func (c *renameCommand) Run(cmd *cobra.Command, args []string) {
+	var idOrName interface{} = c.tunnelName
+	var name string
+	switch {
+	case c.tunnelName != "" && len(args) == 1:
+		name = args[0]
+	case c.tunnelName == "" && len(args) == 2:
+		id, err := strconv.Atoi(args[0])
+		if err != nil {
+			fmt.Println("id should be a number", args[0])
+			return
+		}
+		idOrName, name = id, args[1]
+	default:
+		fmt.Println("usage: rename <tunnel id> <new name>, or rename --name <tunnel name> <new name>")
+		return
+	}
+	if err := c.root.dashboard.RenameTunnel(idOrName, normalizeInput(name)); err != nil {
+		fmt.Println(c.name, "failed: ", err.Error())
+		return
+	}
+	c.listCmd.Run(nil, nil)
+}
+
+func NewRenameCommand(root *interactiveCmd, listCmd *listCommand) *renameCommand {
+	c := &renameCommand{
+		command: command{
+			root: root,
+			name: "rename",
+			cmd: &cobra.Command{
+				Use:   "rename [tunnel id] <new name>",
+				Short: "change the name of a tunnel",
+			},
+			children: make([]promptCommand, 0),
+		},
+		listCmd: listCmd,
+	}
+	c.cmd.Run = c.Run
+	c.cmd.Flags().StringVarP(&c.tunnelName, "name", "n", "", "specify tunnel name")
+	return c
+}
@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/c-bata/go-prompt"
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// sessionCommand prints the negotiated parameters of the ssh connection of a tunnel
+type sessionCommand struct {
+	command
+}
+
+func (c *sessionCommand) Complete(args []string, word string) []prompt.Suggest {
+	if len(args) > 2 {
+		return nil
+	}
+	suggests := make([]prompt.Suggest, 0)
+	for _, tn := range c.root.dashboard.GetTunnels() {
+		suggests = append(suggests, prompt.Suggest{
+			Text:        strconv.Itoa(tn.GetID()),
+			Description: tn.GetName() + "(" + tn.GetStatus() + ")",
+		})
+	}
+	return prompt.FilterHasPrefix(suggests, word, true)
+}
+
+func (c *sessionCommand) Run(cmd *cobra.Command, args []string) {
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		fmt.Println("id should be a number", args[0])
+		return
+	}
+	tn, ok := c.root.dashboard.GetTunnel(id)
+	if !ok {
+		fmt.Printf("tunnel with id %d not found\n", id)
+		return
+	}
+	params, err := tn.GetSession()
+	if err != nil {
+		fmt.Printf("can not read the session of tunnel %d: %s\n", id, err.Error())
+		return
+	}
+
+	// only the algorithms offered by mario are known, the negotiated ones are not exposed
+	offered := func(algos []string) string {
+		if len(algos) == 0 {
+			return "default (negotiated one not exposed)"
+		}
+		return strings.Join(algos, ", ") + " (negotiated one not exposed)"
+	}
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetAutoWrapText(false)
+	table.SetRowLine(false)
+	table.AppendBulk([][]string{
+		{"user", params.User},
+		{"server version", params.ServerVersion},
+		{"client version", params.ClientVersion},
+		{"session id", params.SessionID},
+		{"local address", params.LocalAddr},
+		{"remote address", params.RemoteAddr},
+		{"host key", params.HostKeyType},
+		{"host key fingerprint", params.HostKeyFingerprint},
+		{"connected at", formatTime(params.ConnectedAt, c.root.timeFormat)},
+		{"ciphers", offered(params.Ciphers)},
+		{"macs", offered(params.MACs)},
+		{"key exchanges", offered(params.KeyExchanges)},
+	})
+	table.Render()
+}
+
+func NewSessionCommand(root *interactiveCmd) *sessionCommand {
+	c := &sessionCommand{
+		command: command{
+			root: root,
+			name: "session",
+			cmd: &cobra.Command{
+				Use:   "session <tunnel id>",
+				Short: "print the parameters of the ssh connection of a tunnel, e.g. the host key algorithm",
+				Args:  cobra.ExactArgs(1),
+			},
+			children: make([]promptCommand, 0),
+		},
+	}
+	c.cmd.Run = c.Run
+	return c
+}
@@ -0,0 +1,274 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Jonwing/mario/pkg/ssh"
+	"github.com/c-bata/go-prompt"
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap/zapcore"
+	"os"
+	"strconv"
+	"time"
+)
+
+// setting is a runtime knob of mario which can be read by `get` and changed by `set`
+// without restarting
+type setting struct {
+	name string
+
+	usage string
+
+	// get returns the current value in the form accepted by set
+	get func() string
+
+	// set validates and applies the value
+	set func(value string) error
+}
+
+// settings returns the registry of the runtime knobs, in the order `show` lists them
+func (i *interactiveCmd) settings() []*setting {
+	m := i.dashboard.Mario
+	return []*setting{
+		{
+			name:  "heartbeat",
+			usage: "the check-alive interval of the tunnels opened afterwards, e.g. 15s",
+			get: func() string {
+				return m.CheckAliveInterval.String()
+			},
+			set: func(value string) error {
+				d, err := parsePositiveDuration(value)
+				if err != nil {
+					return err
+				}
+				m.CheckAliveInterval = d
+				return nil
+			},
+		},
+		{
+			name:  "dial-timeout",
+			usage: "how long connecting to an ssh server may take for the tunnels opened afterwards, e.g. 10s",
+			get: func() string {
+				if m.DialTimeout == 0 {
+					return "default"
+				}
+				return m.DialTimeout.String()
+			},
+			set: func(value string) error {
+				d, err := parsePositiveDuration(value)
+				if err != nil {
+					return err
+				}
+				m.DialTimeout = d
+				return nil
+			},
+		},
+		{
+			name:  "key",
+			usage: "the global private key file path used by the tunnels opened afterwards",
+			get: func() string {
+				return m.KeyPath
+			},
+			set: m.SetKeyPath,
+		},
+		{
+			name:  "log-level",
+			usage: "the level of the logs: debug, info, warn or error",
+			get: func() string {
+				return i.logLevel.Level().String()
+			},
+			set: func(value string) error {
+				var level zapcore.Level
+				if err := level.UnmarshalText([]byte(value)); err != nil {
+					return err
+				}
+				if level > zapcore.ErrorLevel {
+					return errors.New("log level should be one of debug, info, warn or error")
+				}
+				i.logLevel.SetLevel(level)
+				return nil
+			},
+		},
+		{
+			name:  "jitter",
+			usage: "the fraction the check-alive interval of the tunnels opened afterwards is randomized by, e.g. 0.1",
+			get: func() string {
+				return strconv.FormatFloat(m.Jitter, 'f', -1, 64)
+			},
+			set: func(value string) error {
+				f, err := strconv.ParseFloat(value, 64)
+				if err != nil || f < 0 || f > ssh.MaxJitter {
+					return fmt.Errorf("jitter should be a number between 0 and %v", ssh.MaxJitter)
+				}
+				m.Jitter = f
+				return nil
+			},
+		},
+		{
+			name:  "drain-timeout",
+			usage: "how long a replaced ssh connection is kept for its connections after a soft reconnect, e.g. 5m",
+			get: func() string {
+				if m.DrainTimeout == 0 {
+					return "default"
+				}
+				return m.DrainTimeout.String()
+			},
+			set: func(value string) error {
+				d, err := parsePositiveDuration(value)
+				if err != nil {
+					return err
+				}
+				m.DrainTimeout = d
+				return nil
+			},
+		},
+		{
+			name:  "max-connections",
+			usage: "the most connections served by all the tunnels at the same time, 0 means no limit",
+			get: func() string {
+				return strconv.Itoa(m.Connections.Max())
+			},
+			set: func(value string) error {
+				n, err := strconv.Atoi(value)
+				if err != nil || n < 0 {
+					return errors.New("max-connections should be a non-negative integer")
+				}
+				m.Connections.SetMax(n)
+				return nil
+			},
+		},
+		{
+			name:  "status-bar",
+			usage: "whether the throughput of all the tunnels is shown before the prompt: on or off",
+			get: func() string {
+				if i.statusBar.shown.Load() {
+					return "on"
+				}
+				return "off"
+			},
+			set: func(value string) error {
+				switch value {
+				case "on":
+					i.statusBar.shown.Store(true)
+				case "off":
+					i.statusBar.shown.Store(false)
+				default:
+					return errors.New("status-bar should be on or off")
+				}
+				return nil
+			},
+		},
+	}
+}
+
+// parsePositiveDuration parses a duration like 15s, a bare number is taken as seconds
+func parsePositiveDuration(value string) (time.Duration, error) {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		secs, e := strconv.Atoi(value)
+		if e != nil {
+			return 0, err
+		}
+		d = time.Duration(secs) * time.Second
+	}
+	if d <= 0 {
+		return 0, errors.New("duration should be positive")
+	}
+	return d, nil
+}
+
+func lookupSetting(settings []*setting, name string) (*setting, error) {
+	for _, s := range settings {
+		if s.name == name {
+			return s, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown setting %s, run `show` for the available ones", name)
+}
+
+// settingCommand is one of `get`, `set` and `show`, they share the registry of settings
+type settingCommand struct {
+	command
+
+	settings []*setting
+}
+
+func (s *settingCommand) Complete(args []string, word string) []prompt.Suggest {
+	// only the first argument is a setting name
+	if s.name == "show" || len(args) > 2 {
+		return nil
+	}
+	suggests := make([]prompt.Suggest, 0, len(s.settings))
+	for _, st := range s.settings {
+		suggests = append(suggests, prompt.Suggest{Text: st.name, Description: st.usage})
+	}
+	return prompt.FilterHasPrefix(suggests, word, true)
+}
+
+func (s *settingCommand) runGet(cmd *cobra.Command, args []string) {
+	st, err := lookupSetting(s.settings, args[0])
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	fmt.Println(st.get())
+}
+
+func (s *settingCommand) runSet(cmd *cobra.Command, args []string) {
+	st, err := lookupSetting(s.settings, args[0])
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	if err := st.set(normalizeInput(args[1])); err != nil {
+		fmt.Printf("can not set %s: %s\n", st.name, err.Error())
+		return
+	}
+	fmt.Printf("%s = %s\n", st.name, st.get())
+}
+
+func (s *settingCommand) runShow(cmd *cobra.Command, args []string) {
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"setting", "value", "usage"})
+	table.SetRowLine(false)
+	for _, st := range s.settings {
+		table.Append([]string{st.name, st.get(), st.usage})
+	}
+	table.Render()
+}
+
+// NewSettingCommands builds the `get`, `set` and `show` commands of the runtime settings
+func NewSettingCommands(root *interactiveCmd) (get, set, show *settingCommand) {
+	settings := root.settings()
+	newCommand := func(name string, c *cobra.Command) *settingCommand {
+		return &settingCommand{
+			command: command{
+				root:     root,
+				name:     name,
+				cmd:      c,
+				children: make([]promptCommand, 0),
+			},
+			settings: settings,
+		}
+	}
+	get = newCommand("get", &cobra.Command{
+		Use:   "get <setting>",
+		Short: "print the value of a runtime setting, see `show`",
+		Args:  cobra.ExactArgs(1),
+	})
+	get.cmd.Run = get.runGet
+	set = newCommand("set", &cobra.Command{
+		Use:   "set <setting> <value>",
+		Short: "change a runtime setting, e.g. set heartbeat 10s",
+		Args:  cobra.ExactArgs(2),
+	})
+	set.cmd.Run = set.runSet
+	show = newCommand("show", &cobra.Command{
+		Use:   "show",
+		Short: "list the runtime settings and their values",
+		Args:  cobra.NoArgs,
+	})
+	show.cmd.Run = show.runShow
+	return get, set, show
+}
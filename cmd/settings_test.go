@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	"github.com/Jonwing/mario/internal"
+	"testing"
+	"time"
+)
+
+func TestSettings(t *testing.T) {
+	root := &interactiveCmd{dashboard: internal.DefaultDashboard("", 15)}
+	root.statusBar = &statusBar{dashboard: root.dashboard}
+	root.logger, root.logLevel = newLeveledLogger(false)
+	settings := root.settings()
+
+	cases := []struct {
+		name  string
+		value string
+		want  string
+		fail  bool
+	}{
+		{"heartbeat", "10s", "10s", false},
+		{"heartbeat", "30", "30s", false},
+		{"heartbeat", "-1s", "", true},
+		{"log-level", "debug", "debug", false},
+		{"log-level", "fatal", "", true},
+		{"jitter", "0.2", "0.2", false},
+		{"jitter", "0.9", "", true},
+		{"drain-timeout", "1m", "1m0s", false},
+		{"max-connections", "100", "100", false},
+		{"max-connections", "-1", "", true},
+		{"key", "/nonexistent/id_rsa", "", true},
+		{"status-bar", "on", "on", false},
+		{"status-bar", "yes", "", true},
+	}
+	for _, c := range cases {
+		st, err := lookupSetting(settings, c.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = st.set(c.value)
+		if (err != nil) != c.fail {
+			t.Errorf("set %s %s: unexpected error %v", c.name, c.value, err)
+			continue
+		}
+		if !c.fail && st.get() != c.want {
+			t.Errorf("set %s %s: got %s, want %s", c.name, c.value, st.get(), c.want)
+		}
+	}
+
+	if root.dashboard.Mario.CheckAliveInterval != 30*time.Second {
+		t.Errorf("heartbeat isn't applied to mario: %s", root.dashboard.Mario.CheckAliveInterval)
+	}
+	if _, err := lookupSetting(settings, "nope"); err == nil {
+		t.Error("expected an error for an unknown setting")
+	}
+}
@@ -0,0 +1,46 @@
+//go:build !windows
+// +build !windows
+
+package cmd
+
+import (
+	"github.com/Jonwing/mario/internal"
+	"go.uber.org/zap"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// handleSignals serves the signals used to operate mario as a service:
+//
+//	SIGUSR1: dumps the state of all tunnels to the log, like `list` does
+//	SIGUSR2: rotates the log files. mario only logs to stderr currently, so that
+//	         it just flushes the logger
+//
+// SIGHUP is left to its default behavior. Only the log is written to, so the
+// interactive prompt is not disturbed. The returned function stops handling.
+func handleSignals(dashboard *internal.Dashboard, logger *zap.SugaredLogger) (stop func()) {
+	sigs := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(sigs, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		for {
+			select {
+			case sig := <-sigs:
+				switch sig {
+				case syscall.SIGUSR1:
+					dumpTunnels(dashboard, logger)
+				case syscall.SIGUSR2:
+					logger.Info("received SIGUSR2, no log file to rotate")
+					_ = logger.Sync()
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(sigs)
+		close(done)
+	}
+}
@@ -0,0 +1,11 @@
+package cmd
+
+import (
+	"github.com/Jonwing/mario/internal"
+	"go.uber.org/zap"
+)
+
+// handleSignals does nothing on windows which has no SIGUSR1/SIGUSR2
+func handleSignals(dashboard *internal.Dashboard, logger *zap.SugaredLogger) (stop func()) {
+	return func() {}
+}
@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"github.com/Jonwing/mario/internal"
+	"go.uber.org/atomic"
+	"time"
+)
+
+// statusBarInterval how often the status bar is checked for a new throughput
+const statusBarInterval = time.Second
+
+// statusBar shows the throughput of all the tunnels before the prompt, e.g. "↑120KB/s ↓3.2MB/s > ".
+// It's off until `set status-bar on`.
+type statusBar struct {
+	dashboard *internal.Dashboard
+
+	shown atomic.Bool
+
+	// last the throughput rendered last, the prompt is refreshed once it changes
+	last atomic.String
+}
+
+// text is the throughput sent to and received from the remotes by all the tunnels
+func (s *statusBar) text() string {
+	in, out := s.dashboard.Throughput()
+	return "↑" + formatRate(out) + " ↓" + formatRate(in)
+}
+
+// livePrefix is the prefix of the prompt while the status bar is shown, see
+// prompt.OptionLivePrefix
+func (s *statusBar) livePrefix() (string, bool) {
+	if !s.shown.Load() {
+		return "", false
+	}
+	text := s.text()
+	s.last.Store(text)
+	return text + " > ", true
+}
+
+// refresh makes the prompt render the status bar again whenever the throughput changes, until
+// stop is closed
+func (s *statusBar) refresh(parser *ExitParser, stop <-chan struct{}) {
+	ticker := time.NewTicker(statusBarInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if s.shown.Load() && s.text() != s.last.Load() {
+				parser.Refresh()
+			}
+		}
+	}
+}
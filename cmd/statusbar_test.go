@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"bytes"
+	"github.com/Jonwing/mario/internal"
+	"github.com/c-bata/go-prompt"
+	"testing"
+)
+
+// keysParser reads the keys one by one, Tab and the letters are the only keys it knows
+type keysParser struct {
+	prompt.ConsoleParser
+
+	keys [][]byte
+}
+
+func (k *keysParser) Read() ([]byte, error) {
+	if len(k.keys) == 0 {
+		return []byte{0}, nil
+	}
+	b := k.keys[0]
+	k.keys = k.keys[1:]
+	return b, nil
+}
+
+func (k *keysParser) GetKey(b []byte) prompt.Key {
+	if bytes.Equal(b, []byte{0x09}) {
+		return prompt.Tab
+	}
+	return prompt.NotDefined
+}
+
+func TestStatusBar(t *testing.T) {
+	bar := &statusBar{dashboard: internal.DefaultDashboard("", 15)}
+	if _, ok := bar.livePrefix(); ok {
+		t.Error("expected the status bar hidden by default")
+	}
+	bar.shown.Store(true)
+	if prefix, ok := bar.livePrefix(); !ok || prefix != "↑0B/s ↓0B/s > " {
+		t.Errorf("unexpected prefix %q", prefix)
+	}
+
+	parser := &ExitParser{ConsoleParser: &keysParser{keys: [][]byte{{0x09}, []byte("a")}}}
+	parser.Refresh()
+	if b, _ := parser.Read(); !bytes.Equal(b, ignoredKey) {
+		t.Errorf("expected the ignored key read for the refresh, got %v", b)
+	}
+	if b, _ := parser.Read(); !bytes.Equal(b, []byte{0x09}) {
+		t.Fatalf("expected the tab read, got %v", b)
+	}
+	// walking the suggestions holds the refresh until another key
+	parser.Refresh()
+	if b, _ := parser.Read(); !bytes.Equal(b, []byte("a")) {
+		t.Errorf("expected the refresh held while walking the suggestions, got %v", b)
+	}
+	if b, _ := parser.Read(); !bytes.Equal(b, ignoredKey) {
+		t.Errorf("expected the held refresh read, got %v", b)
+	}
+}
@@ -0,0 +1,157 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// tunnelTemplate defines many similar tunnels at once, every instance provides the variables
+// referred by the fields of the tunnel, e.g.
+//
+//	{"tunnel": {"name": "db-{{.env}}", "local": ":{{.port}}", "ssh_server": "mario@{{.env}}.corp:22",
+//	    "map_to": "127.0.0.1:5432"},
+//	 "instances": [{"env": "prod", "port": "15432"}, {"env": "staging", "port": "25432"}]}
+type tunnelTemplate struct {
+	// Tunnel the config of the tunnels, its string fields are text/template templates
+	Tunnel *tConfig `json:"tunnel"`
+
+	// Instances the variables of each tunnel to expand to
+	Instances []map[string]string `json:"instances"`
+}
+
+// expandTemplates expands every instance of the templates into a tunnel, the problems of the
+// templates and the expanded tunnels are returned together
+func expandTemplates(tpls []*tunnelTemplate, lines map[string]int) (tns []*tConfig, problems []*configProblem) {
+	for i, tpl := range tpls {
+		prefix := "templates[" + strconv.Itoa(i) + "]"
+		add := func(field, msg string) {
+			line, ok := lines[field]
+			if !ok {
+				line = lines[prefix]
+			}
+			problems = append(problems, &configProblem{line: line, field: field, msg: msg})
+		}
+		if tpl == nil {
+			add(prefix, "template should be an object")
+			continue
+		}
+		if tpl.Tunnel == nil {
+			add(prefix+".tunnel", "required field is missing")
+			continue
+		}
+		if len(tpl.Instances) == 0 {
+			add(prefix+".instances", "at least one instance is required")
+			continue
+		}
+		for j, vars := range tpl.Instances {
+			field := prefix + ".instances[" + strconv.Itoa(j) + "]"
+			tn, err := tpl.instantiate(vars)
+			if err != nil {
+				add(field, err.Error())
+				continue
+			}
+			tn.origin = field
+			problems = append(problems, checkTunnelConfig(field, tn, lines)...)
+			tns = append(tns, tn)
+		}
+	}
+	return
+}
+
+// instantiate expands the string fields of the tunnel with the variables, all the variables
+// referred must be provided
+func (t *tunnelTemplate) instantiate(vars map[string]string) (*tConfig, error) {
+	tn := *t.Tunnel
+	tn.fromTemplate = true
+	fields := []struct {
+		name  string
+		value *string
+	}{
+		{"name", &tn.Name},
+		{"local", &tn.Local},
+		{"ssh_server", &tn.SshServer},
+		{"map_to", &tn.MapTo},
+		{"private_key", &tn.PrivateKey},
+		{"identity_agent", &tn.IdentityAgent},
+		{"keepalive", &tn.Keepalive},
+		{"balance", &tn.Balance},
+	}
+	for _, f := range fields {
+		expanded, err := expandVars(f.name, *f.value, vars)
+		if err != nil {
+			return nil, err
+		}
+		*f.value = expanded
+	}
+	expandAll := func(name string, values []string) ([]string, error) {
+		if values == nil {
+			return nil, nil
+		}
+		expanded := make([]string, len(values))
+		for i, v := range values {
+			var err error
+			if expanded[i], err = expandVars(name+"["+strconv.Itoa(i)+"]", v, vars); err != nil {
+				return nil, err
+			}
+		}
+		return expanded, nil
+	}
+	var err error
+	if tn.DependsOn, err = expandAll("depends_on", tn.DependsOn); err != nil {
+		return nil, err
+	}
+	if tn.Backends, err = expandAll("backends", tn.Backends); err != nil {
+		return nil, err
+	}
+	if tn.Env != nil {
+		env := make(map[string]string, len(tn.Env))
+		for k, v := range tn.Env {
+			if env[k], err = expandVars("env."+k, v, vars); err != nil {
+				return nil, err
+			}
+		}
+		tn.Env = env
+	}
+	return &tn, nil
+}
+
+// expandVars executes the template of the field with the variables
+func expandVars(field, text string, vars map[string]string) (string, error) {
+	if !strings.Contains(text, "{{") {
+		return text, nil
+	}
+	tpl, err := template.New(field).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", errors.New(field + ": invalid template: " + err.Error())
+	}
+	buf := new(bytes.Buffer)
+	if err := tpl.Execute(buf, vars); err != nil {
+		return "", errors.New(field + ": " + missingVar(err))
+	}
+	return buf.String(), nil
+}
+
+// missingVar shortens the error of a variable not provided, the other errors are kept
+func missingVar(err error) string {
+	msg := err.Error()
+	const noEntry = "map has no entry for key "
+	if i := strings.Index(msg, noEntry); i >= 0 {
+		return "variable " + msg[i+len(noEntry):] + " is not provided"
+	}
+	return msg
+}
+
+// withoutInstances returns the tunnels not expanded from the templates, which are kept as
+// they are when the config is written back
+func withoutInstances(tns []*tConfig) []*tConfig {
+	kept := make([]*tConfig, 0, len(tns))
+	for _, tn := range tns {
+		if tn == nil || !tn.fromTemplate {
+			kept = append(kept, tn)
+		}
+	}
+	return kept
+}
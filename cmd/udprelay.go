@@ -0,0 +1,45 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Jonwing/mario/pkg/ssh"
+	"github.com/spf13/cobra"
+	"net"
+)
+
+// newUDPRelayCommand builds the `udp-relay` command which runs on the remote side of a tunnel
+// forwarding UDP, it turns the streams of the tunnel back into datagrams to the target, e.g.
+//
+//	mario udp-relay --listen 127.0.0.1:5300 --target 10.0.0.2:514
+func newUDPRelayCommand() *cobra.Command {
+	var listen, target string
+	cmd := &cobra.Command{
+		Use:   "udp-relay",
+		Short: "relay the datagrams of a tunnel forwarding UDP to the target, run it on the remote side",
+		Long: "Accept the TCP streams of a tunnel opened with --udp on the listen address and send the\n" +
+			"datagrams framed in them to the UDP target, the replies are framed back. Map the tunnel\n" +
+			"to the listen address. A DNS server doesn't need it, map the tunnel to its TCP port instead.",
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			listen, target = normalizeInput(listen), normalizeInput(target)
+			if target == "" {
+				return errors.New("the UDP target is required, e.g. --target 10.0.0.2:514")
+			}
+			if err := checkHostPort(target); err != nil {
+				return fmt.Errorf("wrong target %s: %v", target, err)
+			}
+			l, err := net.Listen("tcp", listen)
+			if err != nil {
+				return err
+			}
+			defer l.Close()
+			fmt.Printf("relaying the datagrams from %s to udp %s\n", l.Addr().String(), target)
+			return ssh.ServeUDPRelay(l, target)
+		},
+	}
+	cmd.Flags().StringVar(&listen, "listen", "127.0.0.1:5300", "the TCP address the tunnel is mapped to")
+	cmd.Flags().StringVar(&target, "target", "", "the UDP address to send the datagrams to")
+	return cmd
+}
@@ -0,0 +1,169 @@
+package cmd
+
+import (
+	"fmt"
+	json "github.com/json-iterator/go"
+	"github.com/spf13/cobra"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// validateReport is the result of `validate`, it's written as is with --json
+type validateReport struct {
+	Config string `json:"config"`
+
+	Valid bool `json:"valid"`
+
+	// Tunnels how many tunnels the config defines, including those expanded from the templates
+	Tunnels int `json:"tunnels"`
+
+	Problems []validateProblem `json:"problems"`
+}
+
+type validateProblem struct {
+	// Line the 1-based line number in the config file, 0 if unknown
+	Line int `json:"line"`
+
+	// Field the json path of the problematic field, e.g. tunnels[0].map_to
+	Field string `json:"field,omitempty"`
+
+	Message string `json:"message"`
+}
+
+// newValidateCommand builds the `validate` command which checks a config file without opening
+// any tunnel, e.g. in CI or a pre-commit hook
+//
+//	mario validate tunnels.json --json
+func newValidateCommand() *cobra.Command {
+	var asJSON bool
+	cmd := &cobra.Command{
+		Use:   "validate <config>",
+		Short: "check a config file without opening the tunnels, exit with 1 if it has problems",
+		Long: "Load and check the config file like mario does at startup, plus that the private keys exist\n" +
+			"and no two tunnels share a name or a local port. No tunnel is opened.",
+		Args:          cobra.ExactArgs(1),
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			report := validateConfig(args[0])
+			if err := writeReport(os.Stdout, report, asJSON); err != nil {
+				return err
+			}
+			if !report.Valid {
+				os.Exit(1)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&asJSON, "json", false, "write the report as a JSON object")
+	return cmd
+}
+
+// validateConfig checks the config file at path and reports all the problems found
+func validateConfig(path string) *validateReport {
+	report := &validateReport{Config: path, Problems: make([]validateProblem, 0)}
+	var problems configErrors
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		problems = configErrors{{msg: err.Error()}}
+	} else if cfg, err := parseConfig(content); err != nil {
+		if problems, _ = err.(configErrors); problems == nil {
+			problems = configErrors{{msg: err.Error()}}
+		}
+	} else {
+		report.Tunnels = len(cfg.Tunnels)
+		_, lines, _ := indexConfigLines(content)
+		problems = lintConfig(cfg, lines)
+	}
+	for _, p := range problems {
+		report.Problems = append(report.Problems, validateProblem{Line: p.line, Field: p.field, Message: p.msg})
+	}
+	report.Valid = len(report.Problems) == 0
+	return report
+}
+
+// lintConfig finds the problems of a parsed config that would only show up once the tunnels
+// are opened: missing private keys, duplicate names and local ports used more than once
+func lintConfig(cfg *tConfigs, lines map[string]int) (problems configErrors) {
+	add := func(origin, field, msg string) {
+		p := origin + "." + field
+		line, ok := lines[p]
+		if !ok {
+			line = lines[origin]
+		}
+		problems = append(problems, &configProblem{line: line, field: p, msg: msg})
+	}
+	names := make(map[string]string, len(cfg.Tunnels))
+	listening := make(map[string]string, len(cfg.Tunnels)+1)
+	// checkPortInUse reports the local address if another tunnel listens on the same port
+	checkPortInUse := func(origin, field, addr string) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || port == "0" {
+			return
+		}
+		for used, by := range listening {
+			usedHost, usedPort, _ := net.SplitHostPort(used)
+			if usedPort == port && (host == usedHost || isWildcardHost(host) || isWildcardHost(usedHost)) {
+				add(origin, field, "port "+port+" is also listened by "+by)
+				return
+			}
+		}
+		listening[addr] = origin
+	}
+	for _, tn := range cfg.Tunnels {
+		if tn.PrivateKey != "" {
+			if _, err := os.Stat(tn.PrivateKey); err != nil {
+				add(tn.origin, "private_key", "can not read the private key: "+err.Error())
+			}
+		}
+		if tn.Name != "" {
+			if by, ok := names[tn.Name]; ok {
+				add(tn.origin, "name", "name "+strconv.Quote(tn.Name)+" is also used by "+by)
+			} else {
+				names[tn.Name] = tn.origin
+			}
+		}
+		// local is dialed rather than listened by a reverse tunnel
+		if !tn.Reverse {
+			checkPortInUse(tn.origin, "local", tn.Local)
+		}
+	}
+	if cfg.Socks != nil {
+		checkPortInUse("socks", "listen", cfg.Socks.Listen)
+	}
+	sort.SliceStable(problems, func(i, j int) bool {
+		return problems[i].line < problems[j].line
+	})
+	return
+}
+
+// isWildcardHost tells whether listening on host takes the port of all the interfaces
+func isWildcardHost(host string) bool {
+	return host == "" || host == "0.0.0.0" || host == "::"
+}
+
+func writeReport(w io.Writer, report *validateReport, asJSON bool) error {
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+	if report.Valid {
+		_, err := fmt.Fprintf(w, "%s: ok, %d tunnel(s)\n", report.Config, report.Tunnels)
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "%s: %d problem(s)\n", report.Config, len(report.Problems)); err != nil {
+		return err
+	}
+	for _, p := range report.Problems {
+		cp := &configProblem{line: p.Line, field: p.Field, msg: p.Message}
+		if _, err := fmt.Fprintln(w, "    "+cp.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package cmd
+
+import (
+	"bytes"
+	json "github.com/json-iterator/go"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mario")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key := filepath.Join(dir, "id_rsa")
+	if err := ioutil.WriteFile(key, []byte("key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	write := func(content string) string {
+		path := filepath.Join(dir, "tunnels.json")
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	report := validateConfig(write(`{"tunnels": [
+		{"name": "db", "local": ":13306", "ssh_server": "mario@host:22", "map_to": "127.0.0.1:3306",
+			"private_key": "` + key + `"},
+		{"name": "cache", "local": "127.0.0.1:16379", "ssh_server": "mario@host:22", "map_to": "127.0.0.1:6379"}
+	]}`))
+	if !report.Valid || report.Tunnels != 2 || len(report.Problems) != 0 {
+		t.Errorf("expected the config to be valid, got %+v", report)
+	}
+
+	report = validateConfig(write(`{"tunnels": [
+		{"name": "db", "local": ":13306", "ssh_server": "mario@host:22", "map_to": "127.0.0.1:3306",
+			"private_key": "` + filepath.Join(dir, "missing") + `"},
+		{"name": "db", "local": "127.0.0.1:13306", "ssh_server": "mario@host:22", "map_to": "127.0.0.1:3307"}
+	]}`))
+	want := map[string]string{
+		"tunnels[0].private_key": "can not read the private key",
+		"tunnels[1].name":        `name "db" is also used by tunnels[0]`,
+		"tunnels[1].local":       "port 13306 is also listened by tunnels[0]",
+	}
+	if report.Valid || len(report.Problems) != len(want) {
+		t.Fatalf("expected %d problems, got %+v", len(want), report.Problems)
+	}
+	for _, p := range report.Problems {
+		if msg, ok := want[p.Field]; !ok || !strings.Contains(p.Message, msg) || p.Line == 0 {
+			t.Errorf("unexpected problem %+v", p)
+		}
+	}
+
+	// the problems of parsing are reported the same way
+	report = validateConfig(write(`{"tunnels": [{"name": "db", "local": ":13306", "ssh_server": "@host"}]}`))
+	if report.Valid || len(report.Problems) != 2 {
+		t.Errorf("expected the problems of ssh_server and map_to, got %+v", report.Problems)
+	}
+	buf := new(bytes.Buffer)
+	if err := writeReport(buf, report, true); err != nil {
+		t.Fatal(err)
+	}
+	decoded := &validateReport{}
+	if err := json.Unmarshal(buf.Bytes(), decoded); err != nil || decoded.Valid || len(decoded.Problems) != 2 {
+		t.Errorf("unexpected JSON report %s, error: %v", buf.String(), err)
+	}
+
+	if report = validateConfig(filepath.Join(dir, "nope.json")); report.Valid || len(report.Problems) != 1 {
+		t.Errorf("expected the config file to be unreadable, got %+v", report)
+	}
+}
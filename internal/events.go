@@ -0,0 +1,181 @@
+package internal
+
+import (
+	"errors"
+	"github.com/Jonwing/mario/pkg/ssh"
+	"time"
+)
+
+// The types of the events
+const (
+	// EventOpen a tunnel is opened, it may be connected later
+	EventOpen = "open"
+
+	// EventConnect a tunnel is connected for the first time
+	EventConnect = "connect"
+
+	// EventReconnect a tunnel is connected again
+	EventReconnect = "reconnect"
+
+	// EventError a tunnel failed, Error tells why
+	EventError = "error"
+
+	// EventClose a tunnel is closed or removed
+	EventClose = "close"
+
+	// EventRemoteDown a tunnel is connected but its remote is unreachable, see ssh.WithRemoteProbe
+	EventRemoteDown = "remote-down"
+
+	// EventConnectionOpen a connection is being forwarded by a tunnel
+	EventConnectionOpen = "connection-open"
+
+	// EventConnectionClose a connection forwarded by a tunnel is closed, Reason tells why
+	EventConnectionClose = "connection-close"
+)
+
+// Event is a lifecycle event of a tunnel. It's a stable contract for programmatic consumers,
+// e.g. `mario --events` writes every event as a JSON object in a line:
+//
+//	{"time":"2020-01-02T15:04:05.000000000+08:00","type":"connect","tunnel_id":1,"tunnel":"db","status":"connected"}
+//	{"time":"...","type":"connection-open","tunnel_id":1,"tunnel":"db","client":"127.0.0.1:52144","target":"10.0.0.2:3306"}
+//
+// Fields may be added, but the existing ones are neither renamed nor removed.
+type Event struct {
+	Time time.Time `json:"time"`
+
+	// Type one of the Event* constants
+	Type string `json:"type"`
+
+	TunnelID int `json:"tunnel_id"`
+
+	Tunnel string `json:"tunnel"`
+
+	// Status the status of the tunnel, e.g. connected, for the events of tunnels
+	Status string `json:"status,omitempty"`
+
+	// Error the error of the tunnel for EventError
+	Error string `json:"error,omitempty"`
+
+	// Client the local address of the connection for the events of connections
+	Client string `json:"client,omitempty"`
+
+	// Target the remote address of the connection for the events of connections
+	Target string `json:"target,omitempty"`
+
+	// Reason why the connection is closed for EventConnectionClose
+	Reason string `json:"reason,omitempty"`
+}
+
+func newEvent(typ string, tn *TunnelInfo) *Event {
+	return &Event{Time: time.Now(), Type: typ, TunnelID: tn.GetID(), Tunnel: tn.GetName()}
+}
+
+// Subscribe returns a channel receiving the events of all the tunnels and a function to stop
+// receiving. size is the buffer of the channel, the events are dropped for a subscriber not
+// keeping up, the tunnels never wait for subscribers.
+func (m *Mario) Subscribe(size int) (<-chan *Event, func()) {
+	ch := make(chan *Event, size)
+	m.sm.Lock()
+	m.subscribers[ch] = struct{}{}
+	m.sm.Unlock()
+	return ch, func() {
+		m.sm.Lock()
+		if _, ok := m.subscribers[ch]; ok {
+			delete(m.subscribers, ch)
+			close(ch)
+		}
+		m.sm.Unlock()
+	}
+}
+
+func (m *Mario) publish(e *Event) {
+	m.sm.RLock()
+	defer m.sm.RUnlock()
+	for ch := range m.subscribers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// connectorEvent is the ssh.ConnectorHook of every tunnel
+func (m *Mario) connectorEvent(t *ssh.Tunnel, c *ssh.Connector, closed bool) {
+	e := newEvent(EventConnectionOpen, m.wrapperOf(t, ""))
+	e.Client, e.Target = c.Client(), c.Target()
+	if closed {
+		e.Type = EventConnectionClose
+		e.Reason = c.CloseReason()
+	}
+	m.publish(e)
+}
+
+// statusEvent returns the event of the current status of the tunnel, nil if the status is
+// transient, e.g. connecting
+func statusEvent(tn *TunnelInfo) *Event {
+	st := tn.t.Status()
+	var typ string
+	switch {
+	case st&ssh.StatusRemoved == ssh.StatusRemoved, st&ssh.StatusClosed == ssh.StatusClosed && tn.Error() == nil:
+		typ = EventClose
+	case tn.Error() != nil:
+		typ = EventError
+	case st == ssh.StatusConnected && tn.t.RemoteDown():
+		typ = EventRemoteDown
+	case st&ssh.StatusConnected == ssh.StatusConnected:
+		typ = EventConnect
+		if tn.GetReconnects() > 0 {
+			typ = EventReconnect
+		}
+	default:
+		return nil
+	}
+	e := newEvent(typ, tn)
+	e.Status = tn.GetStatus()
+	if err := tn.Error(); err != nil && typ == EventError {
+		e.Error = err.Error()
+	}
+	return e
+}
+
+// WaitForStatus blocks until the tunnel reaches the target status, e.g. ssh.StatusConnected,
+// or it fails or is removed, in which case the error is returned, or the timeout passes. The
+// tunnel is checked on its events rather than polled, so the target should be a status with
+// events, i.e. connected or closed rather than connecting.
+func (m *Mario) WaitForStatus(tn *TunnelInfo, target ssh.TunnelStatus, timeout time.Duration) error {
+	// subscribed before checking so that no change is missed between
+	events, stop := m.Subscribe(16)
+	defer stop()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		if done, err := reachedStatus(tn, target); done {
+			return err
+		}
+		select {
+		case <-events:
+			// any event may be of the tunnel, it's cheaper to check the status than to tell
+		case <-timer.C:
+			return errors.New("still " + tn.GetStatus() + " after " + timeout.String())
+		}
+	}
+}
+
+// reachedStatus tells whether waiting for the tunnel to reach the target is done, the error
+// tells why it never will
+func reachedStatus(tn *TunnelInfo, target ssh.TunnelStatus) (bool, error) {
+	st := tn.t.Status()
+	if st == target || target != ssh.StatusNew && st&target == target {
+		return true, nil
+	}
+	if st&ssh.StatusRemoved == ssh.StatusRemoved {
+		return true, errors.New("tunnel " + tn.GetName() + " is removed")
+	}
+	if err := tn.Error(); err != nil {
+		return true, err
+	}
+	if st&ssh.StatusFailed == ssh.StatusFailed {
+		return true, errors.New("tunnel " + tn.GetName() + " failed")
+	}
+	return false, nil
+}
@@ -3,10 +3,19 @@ package internal
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"github.com/Jonwing/mario/pkg/ssh"
+	"go.uber.org/zap"
+	sh "golang.org/x/crypto/ssh"
+	"io"
 	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
 	"os/user"
 	"path"
+	"path/filepath"
+	"reflect"
 	"strconv"
 	"strings"
 	"sync"
@@ -14,10 +23,25 @@ import (
 	"time"
 )
 
+const (
+	// SourceManual the source of the tunnels opened by hand, e.g. by the open command
+	SourceManual = "manual"
+
+	// SourceBatch the source of the tunnels read from stdin by the batch command
+	SourceBatch = "batch"
+)
+
+// ConfigSource returns the source of the tunnels loaded from the config file
+func ConfigSource(configPath string) string {
+	return "config:" + filepath.Base(configPath)
+}
+
 const (
 	actOpen = act(iota)
 	actClose
 	actReconnect
+	// actUp reconnects the tunnels which are not connected, the connected ones are left alone
+	actUp
 )
 
 var status = map[ssh.TunnelStatus]string{
@@ -27,8 +51,18 @@ var status = map[ssh.TunnelStatus]string{
 	ssh.StatusClosed:       "closed",
 	ssh.StatusReconnecting: "reconnecting",
 	ssh.StatusError:        "error",
+	ssh.StatusFailed:       "failed",
 }
 
+// The statuses of a connected tunnel whose remote is down, see ssh.WithRemoteProbe
+const (
+	// statusRemoteDown the ssh connection is fine but ForwardTo is unreachable
+	statusRemoteDown = "remote down"
+
+	// statusReconnectingRemote reconnecting because ForwardTo is unreachable
+	statusReconnectingRemote = "reconnecting (remote down)"
+)
+
 type act int
 
 type tnAction struct {
@@ -49,9 +83,44 @@ func newAction(tn *TunnelInfo, action act, errBack chan error) *tnAction {
 type TunnelInfo struct {
 	t          *ssh.Tunnel
 	id         int
-	name       string
 	privateKey string
 	mario      *Mario
+
+	// identityFile the IdentityFile of ssh_config the tunnel authenticates with, it's empty if
+	// the tunnel has a key of its own or uses the global one
+	identityFile string
+
+	// nm guards name and server, a tunnel may be renamed, see Mario.Rename, or edited
+	nm   sync.RWMutex
+	name string
+
+	// server the ssh server as it was given, e.g. an alias of ssh_config, see GetConfiguredServer
+	server string
+
+	// sshConfigJump the jump hosts taken from the ProxyJump of ssh_config, if any
+	sshConfigJump []string
+
+	// source where the tunnel comes from, see SourceManual and ConfigSource
+	source string
+
+	// scm guards schedule, scheduleActive and scheduledOff
+	scm sync.Mutex
+
+	// schedule the windows the tunnel is up in, nil if it's not scheduled, see Mario.SetSchedule
+	schedule *Schedule
+
+	// scheduleActive whether the schedule was active at the last check
+	scheduleActive bool
+
+	// scheduledOff the tunnel is closed by the schedule
+	scheduledOff bool
+
+	// tpm guards samples
+	tpm sync.Mutex
+
+	// samples the bytes moved by the tunnel in the last few seconds, the oldest first, see
+	// GetThroughput
+	samples []byteSample
 }
 
 func (t *TunnelInfo) GetID() int {
@@ -59,38 +128,408 @@ func (t *TunnelInfo) GetID() int {
 }
 
 func (t *TunnelInfo) GetName() string {
+	t.nm.RLock()
+	defer t.nm.RUnlock()
 	return t.name
 }
 
+// GetSource returns where the tunnel comes from, e.g. manual or config:tunnels.json
+func (t *TunnelInfo) GetSource() string {
+	return t.source
+}
+
 func (t *TunnelInfo) GetPrivateKeyPath() string {
 	return t.privateKey
 }
 
+// GetIdentityFile returns the IdentityFile of ssh_config the tunnel authenticates with instead
+// of the global key, it's empty if it doesn't
+func (t *TunnelInfo) GetIdentityFile() string {
+	return t.identityFile
+}
+
 func (t *TunnelInfo) GetLocal() string {
-	return t.t.Local
+	local, _, _ := t.t.Addresses()
+	return local
+}
+
+// schemes are the hints of the services commonly behind the well-known remote ports
+var schemes = map[string]string{
+	"22":    "ssh",
+	"80":    "http",
+	"443":   "https",
+	"1080":  "socks5",
+	"3306":  "mysql",
+	"5432":  "postgres",
+	"6379":  "redis",
+	"8080":  "http",
+	"9200":  "http",
+	"11211": "memcached",
+	"27017": "mongodb",
+}
+
+// LocalURL returns where a client should point to use the tunnel, the wildcard bind is
+// formatted as 127.0.0.1 and the scheme is guessed by the remote port, tcp if unknown,
+// e.g. postgres://127.0.0.1:15432. It's socks5 for a SOCKS5 tunnel.
+func (t *TunnelInfo) LocalURL() string {
+	local, _, remote := t.t.Addresses()
+	host, port, err := net.SplitHostPort(local)
+	if err != nil {
+		return local
+	}
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	scheme := "tcp"
+	if remote == "" {
+		scheme = "socks5"
+	} else if _, remotePort, err := net.SplitHostPort(remote); err == nil && schemes[remotePort] != "" {
+		scheme = schemes[remotePort]
+	}
+	return scheme + "://" + net.JoinHostPort(host, port)
 }
 
 func (t *TunnelInfo) GetServer() string {
-	return t.t.User() + "@" + t.t.SSHUri
+	_, server, _ := t.t.Addresses()
+	return t.t.User() + "@" + server
+}
+
+// GetConfiguredServer returns the ssh server as it was given, it's not expanded by ssh_config
+// so that saving the tunnel keeps the alias
+func (t *TunnelInfo) GetConfiguredServer() string {
+	t.nm.RLock()
+	defer t.nm.RUnlock()
+	if t.server == "" {
+		return t.GetServer()
+	}
+	return t.server
 }
 
 func (t *TunnelInfo) GetRemote() string {
-	return t.t.ForwardTo
+	_, _, remote := t.t.Addresses()
+	return remote
 }
 
 func (t *TunnelInfo) GetStatus() string {
-	st, ok := status[t.t.Status()]
+	if t.ScheduledOff() && t.t.Status()&ssh.StatusConnected != ssh.StatusConnected {
+		return statusScheduledOff
+	}
+	if t.t.Status()&ssh.StatusFailed == ssh.StatusFailed {
+		return status[ssh.StatusFailed]
+	}
+	raw := t.t.Status()
+	// the running goroutine keeps its bit while it listens again, e.g. when it's brought up
+	// after closed
+	if raw == ssh.StatusConnecting|ssh.StatusRunning {
+		raw = ssh.StatusConnecting
+	}
+	st, ok := status[raw]
 	if t.t.Error() != nil {
 		return "error"
 	}
 	if !ok {
 		return "unknown"
 	}
+	if t.t.RemoteDown() {
+		switch t.t.Status() {
+		case ssh.StatusConnected:
+			return statusRemoteDown
+		case ssh.StatusReconnecting:
+			return statusReconnectingRemote
+		}
+	}
 	return st
 }
 
+// Status returns the status bits of the tunnel, GetStatus is the one for humans
+func (t *TunnelInfo) Status() ssh.TunnelStatus {
+	return t.t.Status()
+}
+
+// GetSchedule returns the schedule of the tunnel, nil if it's not scheduled
+func (t *TunnelInfo) GetSchedule() *Schedule {
+	t.scm.Lock()
+	defer t.scm.Unlock()
+	return t.schedule
+}
+
+// GetClosed tells whether the tunnel is meant to be closed: it's closed by hand or opened without
+// connecting. A tunnel closed by its schedule or broken isn't, it's brought up again by itself.
+func (t *TunnelInfo) GetClosed() bool {
+	if t.ScheduledOff() {
+		return false
+	}
+	st := t.t.Status()
+	return st == ssh.StatusNew || st == ssh.StatusClosed
+}
+
+// ScheduledOff tells whether the tunnel is closed because it's outside its schedule
+func (t *TunnelInfo) ScheduledOff() bool {
+	t.scm.Lock()
+	defer t.scm.Unlock()
+	return t.scheduledOff
+}
+
+// GetPasswordAuth tells whether the tunnel falls back to a password
+func (t *TunnelInfo) GetPasswordAuth() bool {
+	return t.t.PasswordAuth()
+}
+
+// GetRemoteProbe returns how many failed probes of the remote make it down, 0 means the
+// remote isn't probed, and whether it reconnects then
+func (t *TunnelInfo) GetRemoteProbe() (failures int, reconnect bool) {
+	return t.t.RemoteProbe()
+}
+
+// GetReverse tells whether the tunnel forwards from the ssh server back to its local address
+func (t *TunnelInfo) GetReverse() bool {
+	return t.t.Reverse()
+}
+
+// GetRemoteBind returns the host a reverse tunnel listens on of the ssh server in place of the
+// one of its remote, it's empty if not given
+func (t *TunnelInfo) GetRemoteBind() string {
+	return t.t.RemoteBind()
+}
+
+// GetJumpHosts returns the jump hosts the tunnel reaches its ssh server through
+func (t *TunnelInfo) GetJumpHosts() []string {
+	return t.t.JumpHosts()
+}
+
+// GetConfiguredJumpHosts returns the jump hosts the tunnel has of its own, those taken from the
+// ProxyJump of ssh_config are left to it. It's "none" if the tunnel ignores the ProxyJump.
+func (t *TunnelInfo) GetConfiguredJumpHosts() []string {
+	hops := t.t.JumpHosts()
+	if len(t.sshConfigJump) == 0 {
+		return hops
+	}
+	if len(hops) == 0 {
+		return []string{"none"}
+	}
+	if reflect.DeepEqual(hops, t.sshConfigJump) {
+		return nil
+	}
+	return hops
+}
+
+// GetUDP tells whether the tunnel forwards the datagrams sent to its local address over UDP
+func (t *TunnelInfo) GetUDP() bool {
+	return t.t.UDP()
+}
+
+// GetIdleTimeout returns how long a connection may move no bytes before it's closed, 0 for never
+func (t *TunnelInfo) GetIdleTimeout() time.Duration {
+	return t.t.IdleTimeout()
+}
+
+// GetRetries returns the reconnects failed in a row and the most tried, 0 for forever
+func (t *TunnelInfo) GetRetries() (failed, max int) {
+	return t.t.Retries()
+}
+
+// GetNextRetry returns when the tunnel will retry connecting, it's zero if the tunnel
+// isn't waiting to retry
+func (t *TunnelInfo) GetNextRetry() time.Time {
+	return t.t.NextRetry()
+}
+
+// GetAgentSocket returns the ssh agent socket of the tunnel if it's not the global one
+func (t *TunnelInfo) GetAgentSocket() string {
+	pk := t.privateKey
+	if pk == "" {
+		pk = t.identityFile
+	}
+	if socket := t.t.AgentSocket(); socket != t.mario.defaultAgent(pk) {
+		return socket
+	}
+	return ""
+}
+
+// GetWarnConnections returns the active connections above which the tunnel warns, 0 means never
+func (t *TunnelInfo) GetWarnConnections() int {
+	return t.t.WarnConnections()
+}
+
+// OverWarnConnections tells whether the tunnel is serving more connections than its warning threshold
+func (t *TunnelInfo) OverWarnConnections() bool {
+	return t.t.OverWarnConnections()
+}
+
+// GetResolvedIPs returns the IPs the ssh server resolved to when the tunnel dialed it last time
+func (t *TunnelInfo) GetResolvedIPs() []string {
+	return t.t.ResolvedIPs()
+}
+
+// GetMaxConnectors returns the cap of the connections tracked by the tunnel, 0 means no cap
+func (t *TunnelInfo) GetMaxConnectors() int {
+	return t.t.MaxConnectors()
+}
+
+// GetPeakConnectors returns the most connections the tunnel has tracked at the same time
+func (t *TunnelInfo) GetPeakConnectors() int {
+	return t.t.PeakConnectors()
+}
+
+// GetLastError returns when the tunnel errored last time and how many times it has errored
+func (t *TunnelInfo) GetLastError() (at time.Time, count int) {
+	return t.t.LastError()
+}
+
+// GetCappedConnections returns how many connections were refused by the cap of the tunnel
+func (t *TunnelInfo) GetCappedConnections() uint64 {
+	return t.t.CappedConnections()
+}
+
+// GetEnv returns the environment variables requested on the sessions of the tunnel
+func (t *TunnelInfo) GetEnv() map[string]string {
+	return t.t.Env()
+}
+
+// NewSession opens a session on the ssh connection of the tunnel
+func (t *TunnelInfo) NewSession() (*sh.Session, error) {
+	return t.t.NewSession()
+}
+
+func (t *TunnelInfo) GetAutoReconnect() bool {
+	return t.t.AutoReconnect()
+}
+
+// GetKeepalive returns how the tunnel checks its ssh connection and whether a reply is required
+func (t *TunnelInfo) GetKeepalive() (ssh.KeepaliveMethod, bool) {
+	return t.t.Keepalive()
+}
+
+// GetDialTimeout returns how long connecting to the ssh server may take, 0 if it's the global one
+func (t *TunnelInfo) GetDialTimeout() time.Duration {
+	timeout := t.t.DialTimeout()
+	if t.mario != nil && timeout == t.mario.DialTimeout {
+		return 0
+	}
+	return timeout
+}
+
+// GetKeepaliveMisses returns the keepalives failed in a row and how many it takes to reconnect
+func (t *TunnelInfo) GetKeepaliveMisses() (missed, max int) {
+	return t.t.KeepaliveMisses()
+}
+
+// GetHeartbeat returns the health check interval of the tunnel if it isn't the global one of
+// mario, 0 otherwise
+func (t *TunnelInfo) GetHeartbeat() time.Duration {
+	interval := t.t.HealthCheckInterval()
+	if t.mario != nil && interval == t.mario.CheckAliveInterval {
+		return 0
+	}
+	return interval
+}
+
+// GetServerVersion returns the version of the ssh server, empty if it has never connected
+func (t *TunnelInfo) GetServerVersion() string {
+	return t.t.ServerVersion()
+}
+
+// GetReconnects returns how many times the tunnel has reconnected
+func (t *TunnelInfo) GetReconnects() int {
+	return t.t.Reconnects()
+}
+
+// GetSession returns the parameters of the current ssh connection
+func (t *TunnelInfo) GetSession() (*ssh.SessionParams, error) {
+	return t.t.Session()
+}
+
+// GetUptime returns how long the current ssh connection has been up, 0 if it's not connected
+func (t *TunnelInfo) GetUptime() time.Duration {
+	if t.t.Status()&ssh.StatusConnected != ssh.StatusConnected {
+		return 0
+	}
+	return time.Since(t.t.ConnectedAt())
+}
+
+// GetBackends returns the remote addresses besides GetRemote that the connections are spread over
+func (t *TunnelInfo) GetBackends() []string {
+	return t.t.Backends()[1:]
+}
+
+// GetBalance returns how a backend is picked for a connection
+func (t *TunnelInfo) GetBalance() ssh.BalanceStrategy {
+	return t.t.Balance()
+}
+
+func (t *TunnelInfo) GetMaxConnectionAge() time.Duration {
+	return t.t.MaxConnectionAge()
+}
+
+// DirectionLocal the tunnel listens locally and forwards to the remote through the ssh server,
+// like `ssh -L`
+const DirectionLocal = "local"
+
+// DirectionRemote the tunnel listens on the ssh server and forwards back to the local address,
+// like `ssh -R`
+const DirectionRemote = "remote"
+
+// DirectionDynamic the tunnel is a SOCKS5 proxy forwarding to the destinations requested by
+// the clients, like `ssh -D`. It has no remote.
+const DirectionDynamic = "dynamic"
+
+// Representation is the structure of a tunnel for the programmatic consumers, so that they
+// don't have to parse Represent
+type Representation struct {
+	// Direction how the tunnel forwards, DirectionLocal, DirectionRemote or DirectionDynamic
+	Direction string `json:"direction"`
+
+	// Local the local listening address, or the local address forwarded to for DirectionRemote
+	Local string `json:"local"`
+
+	User string `json:"user"`
+
+	// Host the host of the ssh server
+	Host string `json:"host"`
+
+	// Port the port of the ssh server, empty if it's not given
+	Port string `json:"port,omitempty"`
+
+	// Remote the address forwarded to, the address listened on the ssh server for
+	// DirectionRemote, empty for DirectionDynamic
+	Remote string `json:"remote"`
+}
+
+// String formats the representation like "local -> ssh server -> remote", the arrows are
+// reversed for DirectionRemote
+func (r *Representation) String() string {
+	server := r.Host
+	if r.Port != "" {
+		server = net.JoinHostPort(r.Host, r.Port)
+	}
+	if r.Direction == DirectionRemote {
+		return r.Local + " <- " + server + " <- " + r.Remote
+	}
+	if r.Direction == DirectionDynamic {
+		return r.Local + " -> " + server + " -> socks5"
+	}
+	return r.Local + " -> " + server + " -> " + r.Remote
+}
+
+// Representation returns the components of the tunnel
+func (t *TunnelInfo) Representation() *Representation {
+	local, server, remote := t.t.Addresses()
+	r := &Representation{Direction: DirectionLocal, Local: local, User: t.t.User(), Host: server,
+		Remote: remote}
+	if host, port, err := net.SplitHostPort(server); err == nil {
+		r.Host, r.Port = host, port
+	}
+	if t.t.Reverse() {
+		r.Direction = DirectionRemote
+	} else if t.t.Dynamic() {
+		r.Direction = DirectionDynamic
+	}
+	return r
+}
+
+// Represent formats the tunnel for humans, e.g. ":8080 -> host:22 -> 10.0.0.1:80"
 func (t *TunnelInfo) Represent() string {
-	return t.t.String()
+	return t.Representation().String()
 }
 
 func (t *TunnelInfo) Error() error {
@@ -105,10 +544,25 @@ func (t *TunnelInfo) Up(waitDone chan error) {
 	t.mario.Up(t, waitDone)
 }
 
+// WaitForStatus waits for the tunnel to reach the target status, see Mario.WaitForStatus
+func (t *TunnelInfo) WaitForStatus(target ssh.TunnelStatus, timeout time.Duration) error {
+	return t.mario.WaitForStatus(t, target, timeout)
+}
+
 func (t *TunnelInfo) Connections() []*ssh.Connector {
 	return t.t.GetConnectors()
 }
 
+// ConnectionCount returns how many connections the tunnel serves, it's cheaper than Connections
+func (t *TunnelInfo) ConnectionCount() int {
+	return t.t.ConnectorCount()
+}
+
+// ClosedConnections returns the recently closed connections, the latest first
+func (t *TunnelInfo) ClosedConnections() []*ssh.Connector {
+	return t.t.ClosedConnectors()
+}
+
 type Mario struct {
 	tunnelCount int32
 
@@ -117,8 +571,49 @@ type Mario struct {
 	// the global private key file path
 	KeyPath string
 
+	// AgentSocket the socket of the ssh agent that tunnels authenticate with by default, the
+	// tunnels without a private key of their own use $SSH_AUTH_SOCK if it's empty
+	AgentSocket string
+
+	// Proxy the HTTP proxy that tunnels reach their ssh servers through, nil for none
+	Proxy *url.URL
+
+	// Logger the logs of every tunnel are written to it with the tunnel id and name
+	Logger *zap.SugaredLogger
+
+	// DrainTimeout how long a replaced ssh client is kept for its connections, 0 for the default
+	DrainTimeout time.Duration
+
+	// DialTimeout how long connecting to an ssh server may take, 0 for the default
+	DialTimeout time.Duration
+
+	// Connections limits the connections served by all the tunnels together
+	Connections *ssh.ConnectionLimit
+
+	// Jitter the fraction the health check interval of every tunnel is randomized by
+	Jitter float64
+
+	// AuthCallback if set, the tunnels without their own private keys authenticate with it
+	// instead of the global private key, which isn't required then. It's for embedding
+	// mario as a library, the CLI doesn't set it.
+	AuthCallback ssh.AuthCallback
+
+	// KeyboardInteractive if set, answers the keyboard-interactive questions of the servers,
+	// e.g. an OTP. The global private key isn't required then.
+	KeyboardInteractive sh.KeyboardInteractiveChallenge
+
+	// SSHConfig if set, resolves the host aliases of the ssh servers like ssh does, e.g. the
+	// User, HostName, Port and IdentityFile of ~/.ssh/config
+	SSHConfig *ssh.SSHConfig
+
+	// km guards the cache of the global key, tunnels may be established concurrently
+	km sync.Mutex
+
+	// keyBuf the content of the global key at keyBufPath, it's reloaded once KeyPath changes
 	keyBuf []byte
 
+	keyBufPath string
+
 	actions chan *tnAction
 
 	// this channel is used to broadcast tunnel status
@@ -131,6 +626,11 @@ type Mario struct {
 
 	wm sync.RWMutex
 
+	// subscribers receive the events of the tunnels, see Subscribe
+	subscribers map[chan *Event]struct{}
+
+	sm sync.RWMutex
+
 	stop chan struct{}
 }
 
@@ -143,65 +643,274 @@ func (m *Mario) wrap(t *ssh.Tunnel) *TunnelInfo {
 	return &TunnelInfo{id: int(id), t: t, name: strconv.Itoa(int(id)), mario: m}
 }
 
+// wrapperOf returns the only TunnelInfo of the tunnel, it's created with the name if the
+// tunnel isn't known yet. An empty name means the id. The name is suffixed by -2, -3 and so on
+// if it's used by another tunnel, see uniqueName.
+func (m *Mario) wrapperOf(t *ssh.Tunnel, name string) *TunnelInfo {
+	m.wm.Lock()
+	defer m.wm.Unlock()
+	return m.wrapLocked(t, name)
+}
+
+// register wraps the new tunnel by the name, an empty name means the id. Unlike wrapperOf, a
+// name given which is used by another tunnel is an error.
+func (m *Mario) register(t *ssh.Tunnel, name string) (*TunnelInfo, error) {
+	m.wm.Lock()
+	defer m.wm.Unlock()
+	if owner := m.nameOwner(name); owner != nil && owner.t != t {
+		return nil, fmt.Errorf("name %s is used by tunnel %d", name, owner.GetID())
+	}
+	return m.wrapLocked(t, name), nil
+}
+
+// wrapLocked is wrapperOf with wm held
+func (m *Mario) wrapLocked(t *ssh.Tunnel, name string) *TunnelInfo {
+	if tw, ok := m.wrappers[t]; ok {
+		return tw
+	}
+	tw := m.wrap(t)
+	if name == "" {
+		name = tw.name
+	}
+	tw.name = m.uniqueName(name)
+	m.wrappers[t] = tw
+	return tw
+}
+
+// nameOwner returns the tunnel of the name, nil if there's none. wm should be held.
+func (m *Mario) nameOwner(name string) *TunnelInfo {
+	if name == "" {
+		return nil
+	}
+	for _, tw := range m.wrappers {
+		if tw.GetName() == name {
+			return tw
+		}
+	}
+	return nil
+}
+
+// uniqueName returns the name, or the name suffixed by the first of -2, -3 and so on no tunnel
+// uses if it's used. wm should be held.
+func (m *Mario) uniqueName(name string) string {
+	unique := name
+	for i := 2; m.nameOwner(unique) != nil; i++ {
+		unique = name + "-" + strconv.Itoa(i)
+	}
+	return unique
+}
+
+// isKnown tells whether the tunnel has a TunnelInfo, i.e. it's neither new nor removed
+func (m *Mario) isKnown(t *ssh.Tunnel) bool {
+	m.wm.RLock()
+	defer m.wm.RUnlock()
+	_, ok := m.wrappers[t]
+	return ok
+}
+
 // Establish setups a new channel, if `noConnect` is true, only initiate a new tunnel.
 // args
 // 	name: 		name of a tunnel
+// 	source: 	where the tunnel comes from, e.g. SourceManual
 // 	local:		local listening address
 // 	server: 	ssh server address
 // 	remote: 	address of remote peer of the tunnel
 // 	pk: 		private key path
 // 	noConnect: 	don't connect now
-func (m *Mario) Establish(name string, local, server, remote string, pk string, noConnect bool) (*TunnelInfo, error) {
+// 	opts:		optional settings of the tunnel
+func (m *Mario) Establish(name, source string, local, server, remote string, pk string, noConnect bool, opts ...ssh.Option) (*TunnelInfo, error) {
 	words := strings.Split(name, " ")
 	if len(words) > 1 {
 		return nil, errors.New("spaces in tunnel name are not supported currently")
 	}
-	var key *bytes.Buffer
-	if pk == "" {
-		if m.keyBuf == nil {
-			keyFile, err := ioutil.ReadFile(m.KeyPath)
-			if err != nil {
-				return nil, err
+	// the values given are saved, not those expanded by ssh_config
+	given := server
+	// agent the IdentityAgent of ssh_config, if any
+	var agent, identityFile string
+	var sshConfigJump []string
+	if m.SSHConfig != nil {
+		resolved, host := m.SSHConfig.Resolve(server)
+		agent = host.IdentityAgent
+		if resolved != server {
+			m.Logger.Debugw("resolved the ssh server by ssh_config", "server", server, "resolved", resolved)
+		}
+		server = resolved
+		// the tunnels with a key of their own keep it, and so do those using the global key
+		if pk == "" && m.AuthCallback == nil {
+			if _, err := m.globalKey(); err != nil {
+				for _, identity := range host.IdentityFiles {
+					if _, err := os.Stat(identity); err == nil {
+						identityFile = identity
+						break
+					}
+				}
+			}
+		}
+		// the tunnel's own jump hosts, if any, override those of ssh_config
+		if hops := ssh.ParseJumpHosts(host.ProxyJump); len(hops) > 0 {
+			for i, hop := range hops {
+				hops[i], _ = m.SSHConfig.Resolve(hop)
 			}
-			m.keyBuf = keyFile
+			m.Logger.Debugw("reaching the ssh server through the jump hosts of ssh_config", "server", server,
+				"jump_hosts", hops)
+			opts = append([]ssh.Option{ssh.WithJumpHosts(hops)}, opts...)
+			sshConfigJump = hops
+		}
+	}
+	keyPath := pk
+	if keyPath == "" {
+		keyPath = identityFile
+	}
+	var key io.Reader
+	// a missing global key is only reported if the tunnel can't authenticate otherwise
+	var keyErr error
+	if keyPath == "" && m.AuthCallback != nil {
+		// the tunnel authenticates with the callback only
+		opts = append([]ssh.Option{ssh.WithAuthCallback(m.AuthCallback)}, opts...)
+	} else if keyPath == "" {
+		var keyBytes []byte
+		if keyBytes, keyErr = m.globalKey(); keyErr == nil {
+			key = bytes.NewBuffer(keyBytes)
 		}
-		key = bytes.NewBuffer(m.keyBuf)
 	} else {
-		keyBytes, err := ioutil.ReadFile(pk)
+		keyBytes, err := ioutil.ReadFile(keyPath)
 		if err != nil {
 			return nil, err
 		}
 		key = bytes.NewBuffer(keyBytes)
 	}
 
-	tn, err := ssh.NewTunnel(local, server, remote, key, m.handleTunnel, m.CheckAliveInterval)
+	// the tunnel's own options, if any, override the global ones
+	opts = append([]ssh.Option{ssh.WithConnectionLimit(m.Connections), ssh.WithConnectorHook(m.connectorEvent)}, opts...)
+	if m.DrainTimeout > 0 {
+		opts = append([]ssh.Option{ssh.WithDrainTimeout(m.DrainTimeout)}, opts...)
+	}
+	if m.DialTimeout > 0 {
+		opts = append([]ssh.Option{ssh.WithDialTimeout(m.DialTimeout)}, opts...)
+	}
+	if m.Jitter > 0 {
+		opts = append([]ssh.Option{ssh.WithJitter(m.Jitter)}, opts...)
+	}
+	if m.Proxy != nil {
+		opts = append([]ssh.Option{ssh.WithProxy(m.Proxy)}, opts...)
+	}
+	// the IdentityAgent of the host wins over the default agent, "none" disables both
+	if agent == "" {
+		agent = m.defaultAgent(keyPath)
+	}
+	if agent != "" && agent != "none" {
+		opts = append([]ssh.Option{ssh.WithAgent(agent)}, opts...)
+	}
+	if m.KeyboardInteractive != nil {
+		opts = append([]ssh.Option{ssh.WithKeyboardInteractive(m.KeyboardInteractive)}, opts...)
+	}
+	tn, err := ssh.NewTunnel(local, server, remote, key, m.handleTunnel, m.CheckAliveInterval, opts...)
+	if err == ssh.ErrNoAuth && keyErr != nil {
+		return nil, errors.New("the tunnel has no private key of its own and the global key is not loaded: " +
+			keyErr.Error())
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	tw := m.wrap(tn)
-	if name != "" {
-		tw.name = name
+	tw, err := m.register(tn, name)
+	if err != nil {
+		return nil, err
 	}
+	tw.source = source
+	tw.privateKey, tw.identityFile = pk, identityFile
+	tw.server, tw.sshConfigJump = given, sshConfigJump
+	tn.SetLogger(m.tunnelLogger(tw))
+	m.publish(newEvent(EventOpen, tw))
 
-	if pk != "" {
-		tw.privateKey = pk
+	if !noConnect {
+		go tn.Up()
 	}
+	return tw, nil
+}
 
+// tunnelLogger returns the logger of the tunnel, identifying it by the id and the name
+func (m *Mario) tunnelLogger(tn *TunnelInfo) *zap.SugaredLogger {
+	return m.Logger.With("tunnel_id", tn.id, "tunnel", tn.GetName())
+}
+
+// Rename changes the name of the tunnel, its logs are named by the new name from now on. A
+// name used by another tunnel is rejected, the names are unique.
+func (m *Mario) Rename(tn *TunnelInfo, name string) error {
+	if tn == nil {
+		return errors.New("nil tn")
+	}
+	if name == "" || strings.ContainsAny(name, " \t") {
+		return errors.New("a tunnel name should not be empty or contain spaces")
+	}
+	old := tn.GetName()
+	// held so that two renames can't take the same name
 	m.wm.Lock()
-	m.wrappers[tn] = tw
+	if owner := m.nameOwner(name); owner != nil && owner != tn {
+		m.wm.Unlock()
+		return fmt.Errorf("name %s is used by tunnel %d", name, owner.GetID())
+	}
+	tn.nm.Lock()
+	tn.name = name
+	tn.nm.Unlock()
 	m.wm.Unlock()
-	if !noConnect {
-		go tn.Up()
+	tn.t.SetLogger(m.tunnelLogger(tn))
+	m.Logger.Infow("tunnel renamed", "tunnel_id", tn.id, "from", old, "to", name)
+	return nil
+}
+
+// defaultAgent returns the ssh agent socket a tunnel authenticates with unless it has its own,
+// the agent of $SSH_AUTH_SOCK is preferred for the tunnels without a private key of their own
+func (m *Mario) defaultAgent(pk string) string {
+	if m.AgentSocket != "" || pk != "" {
+		return m.AgentSocket
 	}
-	return tw, nil
+	return ssh.EnvAgentSocket()
+}
+
+// SetKeyPath changes the global private key, the key is loaded at once so that a bad path is
+// rejected. The tunnels opened with the previous key are not affected.
+func (m *Mario) SetKeyPath(pkPath string) error {
+	keyFile, err := ioutil.ReadFile(pkPath)
+	if err != nil {
+		return err
+	}
+	if _, err := sh.ParsePrivateKey(keyFile); err != nil {
+		return err
+	}
+	m.km.Lock()
+	defer m.km.Unlock()
+	m.KeyPath = pkPath
+	m.keyBuf, m.keyBufPath = keyFile, pkPath
+	return nil
 }
 
+// globalKey returns the content of the global key, it's read once for each KeyPath
+func (m *Mario) globalKey() ([]byte, error) {
+	m.km.Lock()
+	defer m.km.Unlock()
+	if m.keyBuf != nil && m.keyBufPath == m.KeyPath {
+		return m.keyBuf, nil
+	}
+	keyFile, err := ioutil.ReadFile(m.KeyPath)
+	if err != nil {
+		return nil, err
+	}
+	m.keyBuf, m.keyBufPath = keyFile, m.KeyPath
+	return keyFile, nil
+}
+
+// Up ensures the tunnel is connected, it's reconnected unless it's connected already, see
+// Restart to reconnect a connected one
 func (m *Mario) Up(tn *TunnelInfo, waitDone chan error) {
 	if tn == nil {
 		waitDone <- errors.New("nil tn")
 		return
 	}
+	// brought up by hand, the schedule takes over again at its next window
+	tn.scm.Lock()
+	tn.scheduledOff = false
+	tn.scm.Unlock()
 	if tn.t.Status()&ssh.StatusConnected == ssh.StatusConnected {
 		waitDone <- nil
 		return
@@ -219,12 +928,148 @@ func (m *Mario) Close(tn *TunnelInfo, waitDone chan error) {
 	m.actions <- at
 }
 
+// Remove destroys the tunnel and forgets it, the result of destroying it is sent to waitDone.
+// The tunnel is forgotten once it's destroyed so that its last status is still published.
+func (m *Mario) Remove(tn *TunnelInfo, waitDone chan error) {
+	if tn == nil {
+		waitDone <- errors.New("nil tn")
+		return
+	}
+	destroyed := make(chan error, 1)
+	tn.t.Destroy(destroyed)
+	go func() {
+		err := <-destroyed
+		m.wm.Lock()
+		delete(m.wrappers, tn.t)
+		m.wm.Unlock()
+		waitDone <- err
+	}()
+}
+
+// Restart reconnects the tunnel, the result of reconnecting is sent to waitDone
+func (m *Mario) Restart(tn *TunnelInfo, waitDone chan error) {
+	if tn == nil {
+		waitDone <- errors.New("nil tn")
+		return
+	}
+	restart(tn.t, waitDone)
+}
+
+// Rekey replaces the private key of the tunnel with the key file at pk and reconnects it, the
+// id, name and forwarding of the tunnel are kept. An invalid key is rejected before anything
+// is changed, the result of reconnecting is sent to waitDone.
+func (m *Mario) Rekey(tn *TunnelInfo, pk string, waitDone chan error) error {
+	if tn == nil {
+		return errors.New("nil tn")
+	}
+	keyBytes, err := ioutil.ReadFile(pk)
+	if err != nil {
+		return err
+	}
+	if err := tn.t.Rekey(bytes.NewBuffer(keyBytes), waitDone); err != nil {
+		return err
+	}
+	tn.privateKey, tn.identityFile = pk, ""
+	return nil
+}
+
+// Edit changes the local address, the ssh server and the remote of the tunnel and reconnects
+// it, the empty ones are kept. The server is resolved by ssh_config like Establish does, but
+// the key and the jump hosts of the tunnel are kept. Invalid values are rejected before
+// anything is changed, the result of reconnecting is sent to waitDone.
+func (m *Mario) Edit(tn *TunnelInfo, local, server, remote string, waitDone chan error) error {
+	if tn == nil {
+		return errors.New("nil tn")
+	}
+	given := server
+	if server != "" && m.SSHConfig != nil {
+		if resolved, _ := m.SSHConfig.Resolve(server); resolved != server {
+			m.Logger.Debugw("resolved the ssh server by ssh_config", "server", server, "resolved", resolved)
+			server = resolved
+		}
+	}
+	if err := tn.t.Edit(local, server, remote, waitDone); err != nil {
+		return err
+	}
+	if given != "" {
+		tn.nm.Lock()
+		tn.server = given
+		tn.nm.Unlock()
+	}
+	return nil
+}
+
+// restart reconnects the tunnel, a healthy one is reconnected softly since a planned
+// reconnect shouldn't break its connections
+func restart(t *ssh.Tunnel, waitDone chan error) {
+	if t.Status()&ssh.StatusConnected == ssh.StatusConnected {
+		t.SoftReconnect(waitDone)
+		return
+	}
+	t.Reconnect(waitDone)
+}
+
+// SetSchedule sets the windows the tunnel is up in, nil for always. The tunnel is brought up
+// once a window opens and closed once it closes, it's left alone between, e.g. it's still
+// closed by hand at the time of the schedule. The caller decides whether the tunnel is
+// connected now, e.g. by Schedule.Active.
+func (m *Mario) SetSchedule(tn *TunnelInfo, s *Schedule) {
+	tn.scm.Lock()
+	defer tn.scm.Unlock()
+	tn.schedule = s
+	tn.scheduleActive = s.Active(time.Now())
+	tn.scheduledOff = !tn.scheduleActive
+}
+
+// applySchedules brings the scheduled tunnels up or down whose windows opened or closed since
+// the last check
+func (m *Mario) applySchedules(now time.Time) {
+	m.wm.RLock()
+	defer m.wm.RUnlock()
+	for raw, tn := range m.wrappers {
+		tn.scm.Lock()
+		if tn.schedule == nil {
+			tn.scm.Unlock()
+			continue
+		}
+		active := tn.schedule.Active(now)
+		changed := active != tn.scheduleActive
+		tn.scheduleActive = active
+		if changed {
+			tn.scheduledOff = !active
+		}
+		tn.scm.Unlock()
+		if !changed {
+			continue
+		}
+		// not waited for here, the tunnel publishes its status to the monitor
+		if active {
+			m.Logger.Infow("schedule window opened, bringing the tunnel up", "tunnel", tn.GetName())
+			go func(t *ssh.Tunnel) {
+				if t.Status()&ssh.StatusConnected != ssh.StatusConnected {
+					t.Reconnect(nil)
+				}
+			}(raw)
+		} else {
+			m.Logger.Infow("schedule window closed, closing the tunnel", "tunnel", tn.GetName())
+			go raw.Down(nil)
+		}
+	}
+}
+
 func (m *Mario) ApplyAll(action act, waitDone bool) {
 	m.wm.RLock()
-	waiting := make(chan error, len(m.wrappers))
+	count := len(m.wrappers)
+	waiting := make(chan error, count)
 	var method func(*ssh.Tunnel, chan error)
 	if action == actReconnect {
+		method = restart
+	} else if action == actUp {
 		method = func(t *ssh.Tunnel, w chan error) {
+			if t.Status()&ssh.StatusConnected == ssh.StatusConnected {
+				w <- nil
+				return
+			}
 			t.Reconnect(w)
 		}
 	} else {
@@ -241,37 +1086,56 @@ func (m *Mario) ApplyAll(action act, waitDone bool) {
 	if !waitDone {
 		return
 	}
-	m.waitTimeout(2*time.Second, waiting, len(m.wrappers))
+	m.waitTimeout(2*time.Second, waiting, count)
 }
 
 func (m *Mario) Monitor() (<-chan *TunnelInfo, error) {
-	keyFile, err := ioutil.ReadFile(m.KeyPath)
-	if err != nil {
-		return nil, err
+	// the global key is loaded early so that a bad one is noticed at startup, it's only needed
+	// by the tunnels without a key or an agent of their own, which fail to open without it
+	if _, err := m.globalKey(); err != nil && m.AuthCallback == nil && m.KeyboardInteractive == nil &&
+		m.defaultAgent("") == "" {
+		m.Logger.Warnw("the global private key is not loaded, the tunnels need keys of their own",
+			"path", m.KeyPath, "error", err)
 	}
-	m.keyBuf = keyFile
 	go func() {
+		// the type of the last event of every tunnel, so that only the changes are published
+		lastEvents := make(map[*ssh.Tunnel]string)
+		scheduleTicker := time.NewTicker(scheduleInterval)
+		defer scheduleTicker.Stop()
+		throughputTicker := time.NewTicker(throughputInterval)
+		defer throughputTicker.Stop()
 		for {
 			select {
+			case now := <-scheduleTicker.C:
+				m.applySchedules(now)
+			case now := <-throughputTicker.C:
+				m.sampleThroughput(now)
 			case action := <-m.actions:
 				switch action.act {
 				case actOpen:
-					m.wrappers[action.tn.t] = action.tn
+					m.wm.Lock()
+					removed := action.tn.t.Status()&ssh.StatusRemoved == ssh.StatusRemoved
+					if _, ok := m.wrappers[action.tn.t]; !ok && !removed {
+						m.wrappers[action.tn.t] = action.tn
+					}
+					m.wm.Unlock()
 				case actClose:
 					action.tn.t.Down(action.err)
 				case actReconnect:
 					action.tn.t.Reconnect(action.err)
 				}
 			case raw := <-m.updatedTunnels:
-				m.wm.Lock()
-				wrapped, ok := m.wrappers[raw]
-				if !ok {
-					wrapped = m.wrap(raw)
-					wrapped.name = "unknown"
-					m.wrappers[wrapped.t] = wrapped
+				if raw.Status()&ssh.StatusRemoved == ssh.StatusRemoved && !m.isKnown(raw) {
+					// removed by Remove, a late status shouldn't bring it back
+					delete(lastEvents, raw)
+					continue
+				}
+				tw := m.wrapperOf(raw, "unknown")
+				if e := statusEvent(tw); e != nil && e.Type+e.Error != lastEvents[raw] {
+					lastEvents[raw] = e.Type + e.Error
+					m.publish(e)
 				}
-				m.wm.Unlock()
-				m.publishWrapper <- wrapped
+				m.publishWrapper <- tw
 			case <-m.stop:
 				break
 			}
@@ -329,7 +1193,10 @@ func NewMario(pkPath string, heartbeat time.Duration) *Mario {
 		publishWrapper:     make(chan *TunnelInfo, 1),
 		wrappers:           make(map[*ssh.Tunnel]*TunnelInfo),
 		wm:                 sync.RWMutex{},
+		subscribers:        make(map[chan *Event]struct{}),
 		stop:               make(chan struct{}),
+		Logger:             zap.NewNop().Sugar(),
+		Connections:        ssh.NewConnectionLimit(0),
 	}
 	return m
 }
@@ -0,0 +1,186 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// statusScheduledOff the status of a tunnel closed because it's outside its schedule
+const statusScheduledOff = "scheduled-off"
+
+// scheduleInterval how often the schedules of the tunnels are checked
+const scheduleInterval = 30 * time.Second
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Schedule is the time windows a tunnel is active in, in the local time. A nil Schedule is
+// always active.
+type Schedule struct {
+	windows []window
+
+	// raw the windows as they are written, see ParseSchedule
+	raw []string
+}
+
+type window struct {
+	days [7]bool
+
+	// start and end the minutes since midnight, a window ending before it starts crosses
+	// midnight and belongs to the day it starts
+	start, end int
+}
+
+// ParseSchedule parses the windows of a schedule, a window is the days followed by the time
+// range, e.g. "mon-fri 09:00-18:00", "sat,sun 10:00-14:00" or "22:00-06:00". The days are
+// either a range, a list or * and they default to every day, the time range defaults to the
+// whole day. It returns nil for no windows.
+func ParseSchedule(windows []string) (*Schedule, error) {
+	if len(windows) == 0 {
+		return nil, nil
+	}
+	s := &Schedule{}
+	for _, raw := range windows {
+		w, err := parseWindow(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid window %q: %s", raw, err.Error())
+		}
+		s.windows = append(s.windows, w)
+		s.raw = append(s.raw, raw)
+	}
+	return s, nil
+}
+
+func parseWindow(raw string) (window, error) {
+	w := window{start: 0, end: 24 * 60}
+	fields := strings.Fields(raw)
+	switch len(fields) {
+	case 1:
+		if strings.Contains(fields[0], ":") {
+			fields = []string{"*", fields[0]}
+		} else {
+			fields = append(fields, "")
+		}
+	case 2:
+	default:
+		return w, errors.New("expected the days and the time range, e.g. mon-fri 09:00-18:00")
+	}
+	days, err := parseDays(fields[0])
+	if err != nil {
+		return w, err
+	}
+	w.days = days
+	if fields[1] == "" {
+		return w, nil
+	}
+	bounds := strings.Split(fields[1], "-")
+	if len(bounds) != 2 {
+		return w, errors.New("expected a time range like 09:00-18:00")
+	}
+	if w.start, err = parseClock(bounds[0]); err != nil {
+		return w, err
+	}
+	if w.end, err = parseClock(bounds[1]); err != nil {
+		return w, err
+	}
+	if w.start == w.end {
+		return w, errors.New("the window is empty")
+	}
+	return w, nil
+}
+
+// parseDays parses e.g. mon-fri, sat,sun or *
+func parseDays(s string) (days [7]bool, err error) {
+	if s == "*" {
+		for i := range days {
+			days[i] = true
+		}
+		return days, nil
+	}
+	for _, part := range strings.Split(strings.ToLower(s), ",") {
+		bounds := strings.Split(part, "-")
+		if len(bounds) > 2 {
+			return days, fmt.Errorf("invalid days %s", part)
+		}
+		from, ok := weekdays[bounds[0]]
+		if !ok {
+			return days, fmt.Errorf("unknown day %s", bounds[0])
+		}
+		to := from
+		if len(bounds) == 2 {
+			if to, ok = weekdays[bounds[1]]; !ok {
+				return days, fmt.Errorf("unknown day %s", bounds[1])
+			}
+		}
+		// a range may wrap around the week, e.g. fri-mon
+		for d := from; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == to {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+// parseClock parses HH:MM into the minutes since midnight, 24:00 is the end of the day
+func parseClock(s string) (int, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 || len(parts[1]) != 2 {
+		return 0, fmt.Errorf("invalid time %s, expected HH:MM", s)
+	}
+	h, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %s, expected HH:MM", s)
+	}
+	m, err := strconv.Atoi(parts[1])
+	if err != nil || h < 0 || m < 0 || m > 59 || h > 24 || h == 24 && m != 0 {
+		return 0, fmt.Errorf("invalid time %s, expected HH:MM", s)
+	}
+	return h*60 + m, nil
+}
+
+// Active tells whether the time is in any window of the schedule
+func (s *Schedule) Active(now time.Time) bool {
+	if s == nil {
+		return true
+	}
+	minute := now.Hour()*60 + now.Minute()
+	today := now.Weekday()
+	yesterday := (today + 6) % 7
+	for _, w := range s.windows {
+		if w.start < w.end {
+			if w.days[today] && minute >= w.start && minute < w.end {
+				return true
+			}
+			continue
+		}
+		// crossing midnight
+		if w.days[today] && minute >= w.start || w.days[yesterday] && minute < w.end {
+			return true
+		}
+	}
+	return false
+}
+
+// Windows returns the windows as they are parsed
+func (s *Schedule) Windows() []string {
+	if s == nil {
+		return nil
+	}
+	return s.raw
+}
+
+func (s *Schedule) String() string {
+	return strings.Join(s.Windows(), ", ")
+}
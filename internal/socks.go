@@ -0,0 +1,143 @@
+package internal
+
+import (
+	"errors"
+	"github.com/Jonwing/mario/pkg/ssh"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+var errNoRoute = errors.New("no tunnel to route to")
+
+// SocksRoute routes the SOCKS requests to destinations in Network through Tunnel
+type SocksRoute struct {
+	Network *net.IPNet
+
+	// Tunnel is the name of the tunnel to dial through
+	Tunnel string
+}
+
+// ParseSocksRoute creates a SocksRoute from a CIDR like "10.0.0.0/8"
+func ParseSocksRoute(cidr, tunnel string) (*SocksRoute, error) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	return &SocksRoute{Network: network, Tunnel: tunnel}, nil
+}
+
+// SocksRouter is a SOCKS5 proxy which dials every request through the tunnel chosen by
+// the destination of the request
+type SocksRouter struct {
+	dashboard *Dashboard
+
+	// routes sorted from the most specific network to the least
+	routes []*SocksRoute
+
+	// fallback is the tunnel for destinations matching no route, requests of these
+	// destinations are refused if it's empty
+	fallback string
+
+	listener net.Listener
+}
+
+// route picks the name of the tunnel for the destination host, the host is resolved
+// locally if it's a domain name.
+func (r *SocksRouter) route(host string) string {
+	ips := make([]net.IP, 0, 1)
+	if ip := net.ParseIP(host); ip != nil {
+		ips = append(ips, ip)
+	} else if resolved, err := net.LookupIP(host); err == nil {
+		ips = resolved
+	}
+	for _, rt := range r.routes {
+		for _, ip := range ips {
+			if rt.Network.Contains(ip) {
+				return rt.Tunnel
+			}
+		}
+	}
+	return r.fallback
+}
+
+func (r *SocksRouter) serve() {
+	for {
+		conn, err := r.listener.Accept()
+		if err != nil {
+			return
+		}
+		go r.handle(conn)
+	}
+}
+
+func (r *SocksRouter) handle(conn net.Conn) {
+	// a client which sends nothing doesn't hold the connection
+	_ = conn.SetDeadline(time.Now().Add(ssh.SocksHandshakeTimeout))
+	target, err := ssh.ReadSocksRequest(conn)
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	_ = conn.SetDeadline(time.Time{})
+	host, _, _ := net.SplitHostPort(target)
+	name := r.route(host)
+	if name == "" {
+		_ = ssh.WriteSocksReply(conn, ssh.SocksNotAllowed)
+		_ = conn.Close()
+		return
+	}
+	tn := r.dashboard.getTunnel(name)
+	if tn == nil {
+		_ = ssh.WriteSocksReply(conn, ssh.SocksNetworkUnreachable)
+		_ = conn.Close()
+		return
+	}
+	_ = tn.t.Forward(conn, target, func(err error) error {
+		if err != nil {
+			return ssh.WriteSocksReply(conn, ssh.SocksHostUnreachable)
+		}
+		return ssh.WriteSocksReply(conn, ssh.SocksSucceeded)
+	})
+}
+
+// Addr returns the listening address of the router
+func (r *SocksRouter) Addr() net.Addr {
+	return r.listener.Addr()
+}
+
+// Close stops accepting SOCKS requests, the connections being forwarded are left to
+// their tunnels
+func (r *SocksRouter) Close() error {
+	return r.listener.Close()
+}
+
+// ServeSocks starts a SOCKS5 proxy on listen, routing every request through the
+// tunnel of the most specific route matching the destination, or through the fallback
+// tunnel if no route matches. Tunnels are looked up by name when requests come, so they
+// don't have to be opened beforehand.
+func (d *Dashboard) ServeSocks(listen string, routes []*SocksRoute, fallback string) (*SocksRouter, error) {
+	if len(routes) == 0 && fallback == "" {
+		return nil, errNoRoute
+	}
+	sorted := make([]*SocksRoute, len(routes))
+	copy(sorted, routes)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		si, _ := sorted[i].Network.Mask.Size()
+		sj, _ := sorted[j].Network.Mask.Size()
+		return si > sj
+	})
+	l, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, err
+	}
+	r := &SocksRouter{
+		dashboard: d,
+		routes:    sorted,
+		fallback:  strings.TrimSpace(fallback),
+		listener:  l,
+	}
+	go r.serve()
+	return r, nil
+}
@@ -0,0 +1,90 @@
+package internal
+
+import (
+	"time"
+)
+
+const (
+	// throughputInterval how often the bytes of the tunnels are sampled
+	throughputInterval = time.Second
+
+	// throughputSamples the samples kept for the throughput, it's estimated over the last
+	// few seconds
+	throughputSamples = 5
+)
+
+// byteSample the bytes a tunnel has received and sent by the time
+type byteSample struct {
+	at      time.Time
+	in, out uint64
+}
+
+// sampleBytes records the bytes moved by the tunnel so far, the oldest sample is dropped once
+// there are throughputSamples
+func (t *TunnelInfo) sampleBytes(now time.Time) {
+	in, out := t.GetBytes()
+	t.tpm.Lock()
+	defer t.tpm.Unlock()
+	if len(t.samples) == throughputSamples {
+		copy(t.samples, t.samples[1:])
+		t.samples = t.samples[:throughputSamples-1]
+	}
+	t.samples = append(t.samples, byteSample{at: now, in: in, out: out})
+}
+
+// GetBytes returns the bytes received from the remote and sent to it by all the connections
+// of the tunnel, the closed ones included
+func (t *TunnelInfo) GetBytes() (in, out uint64) {
+	return t.t.Bytes()
+}
+
+// GetThroughput returns the bytes per second moved by the tunnel in both directions over the
+// last few seconds, 0 until it's sampled
+func (t *TunnelInfo) GetThroughput() float64 {
+	in, out := t.GetThroughputInOut()
+	return in + out
+}
+
+// GetThroughputInOut returns the bytes per second received from the remote and sent to it by
+// the tunnel over the last few seconds, 0 until it's sampled
+func (t *TunnelInfo) GetThroughputInOut() (in, out float64) {
+	bytesIn, bytesOut := t.GetBytes()
+	now := time.Now()
+	t.tpm.Lock()
+	defer t.tpm.Unlock()
+	if len(t.samples) == 0 {
+		return 0, 0
+	}
+	oldest := t.samples[0]
+	elapsed := now.Sub(oldest.at).Seconds()
+	if elapsed <= 0 {
+		return 0, 0
+	}
+	if bytesIn >= oldest.in {
+		in = float64(bytesIn-oldest.in) / elapsed
+	}
+	if bytesOut >= oldest.out {
+		out = float64(bytesOut-oldest.out) / elapsed
+	}
+	return in, out
+}
+
+// Throughput returns the bytes per second received and sent by all the tunnels over the last
+// few seconds
+func (d *Dashboard) Throughput() (in, out float64) {
+	for _, tn := range d.GetTunnels() {
+		i, o := tn.GetThroughputInOut()
+		in += i
+		out += o
+	}
+	return in, out
+}
+
+// sampleThroughput samples the bytes of all the tunnels, it only reads their counters
+func (m *Mario) sampleThroughput(now time.Time) {
+	m.wm.RLock()
+	defer m.wm.RUnlock()
+	for _, tn := range m.wrappers {
+		tn.sampleBytes(now)
+	}
+}
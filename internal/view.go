@@ -53,6 +53,9 @@ type Dashboard struct {
 	// tunnels holds information of all tunnels in an id-ascending order
 	tunnels []*TunnelInfo
 
+	// known the tunnels listed, a tunnel is listed once even if it's published by another wrapper
+	known map[*ssh.Tunnel]bool
+
 	Mario *Mario
 
 	input chan string
@@ -93,15 +96,23 @@ func DefaultDashboard(pk string, timeout int) *Dashboard {
 
 func (d *Dashboard) updateTunnelInfo() {
 	for tn := range d.tunnelRecv {
+		if tn.t.Status()&ssh.StatusRemoved == ssh.StatusRemoved {
+			// see RemoveTunnel
+			continue
+		}
 		d.mu.Lock()
+		if d.known == nil {
+			d.known = make(map[*ssh.Tunnel]bool)
+		}
 		idx := sort.Search(len(d.tunnels), func(i int) bool {
 			return d.tunnels[i].GetID() >= tn.GetID()
 		})
-		if idx >= len(d.tunnels) || d.tunnels[idx].GetID() != tn.GetID() {
-			d.tunnels = append(d.tunnels, tn)
-			if len(d.tunnels) <= 1 || tn.GetID() <= d.tunnels[len(d.tunnels)-1].GetID() {
-				tnSorter(byID).sort(d.tunnels)
-			}
+		if !d.known[tn.t] && (idx >= len(d.tunnels) || d.tunnels[idx].GetID() != tn.GetID()) {
+			d.known[tn.t] = true
+			// insert at idx so that the tunnels keep ascending by id
+			d.tunnels = append(d.tunnels, nil)
+			copy(d.tunnels[idx+1:], d.tunnels[idx:])
+			d.tunnels[idx] = tn
 		}
 		d.mu.Unlock()
 	}
@@ -111,13 +122,13 @@ func (d *Dashboard) Update(tn *TunnelInfo) {
 	d.tunnelRecv <- tn
 }
 
-func (d *Dashboard) NewTunnel(name string, local, server, remote string, pk string, noConnect bool) error {
-	tn, err := d.Mario.Establish(name, local, server, remote, pk, noConnect)
+func (d *Dashboard) NewTunnel(name, source string, local, server, remote string, pk string, noConnect bool, opts ...ssh.Option) (*TunnelInfo, error) {
+	tn, err := d.Mario.Establish(name, source, local, server, remote, pk, noConnect, opts...)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	d.tunnelRecv <- tn
-	return nil
+	return tn, nil
 }
 
 func (d *Dashboard) getTunnel(idOrName interface{}) (tn *TunnelInfo) {
@@ -133,6 +144,7 @@ func (d *Dashboard) getTunnel(idOrName interface{}) (tn *TunnelInfo) {
 			return d.tunnels[idx]
 		}
 	case string:
+		// the names are unique, see Mario.register
 		name := idOrName.(string)
 		for _, tn := range d.tunnels {
 			if tn.GetName() == name {
@@ -143,6 +155,22 @@ func (d *Dashboard) getTunnel(idOrName interface{}) (tn *TunnelInfo) {
 	return
 }
 
+// WaitForStatus waits for the tunnel of the id(int) or name(string) to reach the target status,
+// see Mario.WaitForStatus
+func (d *Dashboard) WaitForStatus(idOrName interface{}, target ssh.TunnelStatus, timeout time.Duration) error {
+	tn := d.getTunnel(idOrName)
+	if tn == nil {
+		return fmt.Errorf("tunnel with id or name %v not found", idOrName)
+	}
+	return d.Mario.WaitForStatus(tn, target, timeout)
+}
+
+// GetTunnel looks up a tunnel by its id(int) or name(string), false if it's not found
+func (d *Dashboard) GetTunnel(idOrName interface{}) (*TunnelInfo, bool) {
+	tn := d.getTunnel(idOrName)
+	return tn, tn != nil
+}
+
 func (d *Dashboard) CloseTunnel(idOrName interface{}, waitDone bool) (err error) {
 	if tid, ok := idOrName.(int); ok && tid == -1 {
 		d.Mario.ApplyAll(actClose, waitDone)
@@ -158,9 +186,10 @@ func (d *Dashboard) CloseTunnel(idOrName interface{}, waitDone bool) (err error)
 	return nil
 }
 
+// UpTunnel ensures the tunnel is connected, a connected one is left as it is. -1 means all the tunnels.
 func (d *Dashboard) UpTunnel(idOrName interface{}, waitDone bool) (err error) {
 	if tid, ok := idOrName.(int); ok && tid == -1 {
-		d.Mario.ApplyAll(actReconnect, waitDone)
+		d.Mario.ApplyAll(actUp, waitDone)
 		return nil
 	}
 	tn := d.getTunnel(idOrName)
@@ -174,6 +203,77 @@ func (d *Dashboard) UpTunnel(idOrName interface{}, waitDone bool) (err error) {
 	return nil
 }
 
+// ForceUpTunnel reconnects the tunnel whatever its status is, a connected one is reconnected
+// softly without breaking its connections. -1 means all the tunnels.
+func (d *Dashboard) ForceUpTunnel(idOrName interface{}, waitDone bool) (err error) {
+	if tid, ok := idOrName.(int); ok && tid == -1 {
+		d.Mario.ApplyAll(actReconnect, waitDone)
+		return nil
+	}
+	tn := d.getTunnel(idOrName)
+	if tn == nil {
+		return errors.New(fmt.Sprintf("tunnel with id or name %s not found", idOrName))
+	}
+	waiting := make(chan error, 1)
+	d.Mario.Restart(tn, waiting)
+
+	d.Mario.waitTimeout(time.Second, waiting, 1)
+	return nil
+}
+
+// RenameTunnel renames the tunnel of the id(int) or name(string), a name used by another tunnel
+// is rejected
+func (d *Dashboard) RenameTunnel(idOrName interface{}, name string) error {
+	tn := d.getTunnel(idOrName)
+	if tn == nil {
+		return fmt.Errorf("tunnel with id or name %v not found", idOrName)
+	}
+	return d.Mario.Rename(tn, name)
+}
+
+// RemoveTunnel destroys the tunnel and removes it from the dashboard, it's no longer listed
+// and its id isn't reused. -1 means all the tunnels.
+func (d *Dashboard) RemoveTunnel(idOrName interface{}) error {
+	var tns []*TunnelInfo
+	if tid, ok := idOrName.(int); ok && tid == -1 {
+		tns = d.GetTunnels()
+	} else if tn := d.getTunnel(idOrName); tn != nil {
+		tns = []*TunnelInfo{tn}
+	} else {
+		return fmt.Errorf("tunnel with id or name %v not found", idOrName)
+	}
+	waiting := make(chan error, len(tns))
+	for _, tn := range tns {
+		d.Mario.Remove(tn, waiting)
+	}
+	// removed from the list once destroyed, the statuses published after are ignored
+	d.Mario.waitTimeout(2*time.Second, waiting, len(tns))
+	d.forget(tns)
+	return nil
+}
+
+// forget removes the tunnels from the list
+func (d *Dashboard) forget(tns []*TunnelInfo) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	removed := make(map[*TunnelInfo]bool, len(tns))
+	for _, tn := range tns {
+		removed[tn] = true
+		delete(d.known, tn.t)
+	}
+	kept := d.tunnels[:0]
+	for _, tn := range d.tunnels {
+		if !removed[tn] {
+			kept = append(kept, tn)
+		}
+	}
+	// the removed ones beyond are released
+	for i := len(kept); i < len(d.tunnels); i++ {
+		d.tunnels[i] = nil
+	}
+	d.tunnels = kept
+}
+
 func (d *Dashboard) GetTunnelConnections(idOrName interface{}) []*ssh.Connector {
 	tn := d.getTunnel(idOrName)
 	if tn == nil {
@@ -182,6 +282,15 @@ func (d *Dashboard) GetTunnelConnections(idOrName interface{}) []*ssh.Connector
 	return tn.Connections()
 }
 
+// GetClosedConnections returns the recently closed connections of the tunnel, the latest first
+func (d *Dashboard) GetClosedConnections(idOrName interface{}) []*ssh.Connector {
+	tn := d.getTunnel(idOrName)
+	if tn == nil {
+		return nil
+	}
+	return tn.ClosedConnections()
+}
+
 func (d *Dashboard) formatTunnel(tn *TunnelInfo) string {
 	return strconv.Itoa(tn.GetID()) + "    " + tn.GetName() + "    " + tn.Represent()
 }
@@ -198,3 +307,46 @@ func (d *Dashboard) GetTunnels() []*TunnelInfo {
 	}
 	return tns
 }
+
+// Summary counts the tunnels by their status
+type Summary struct {
+	Total int
+
+	Connected int
+
+	// Pending the tunnels connecting or reconnecting
+	Pending int
+
+	// Failed the tunnels failed to connect, including those to be retried, or whose remote is down
+	Failed int
+
+	// Idle the tunnels new or closed, which are not trying to connect
+	Idle int
+
+	// Connections the connections served by all the tunnels
+	Connections int
+}
+
+// SummarizeTunnels counts the tunnels by their status
+func SummarizeTunnels(tns []*TunnelInfo) Summary {
+	s := Summary{Total: len(tns)}
+	for _, tn := range tns {
+		switch tn.GetStatus() {
+		case status[ssh.StatusConnected]:
+			s.Connected++
+		case status[ssh.StatusConnecting], status[ssh.StatusReconnecting], statusReconnectingRemote:
+			s.Pending++
+		case status[ssh.StatusError], status[ssh.StatusFailed], statusRemoteDown:
+			s.Failed++
+		default:
+			s.Idle++
+		}
+		s.Connections += tn.ConnectionCount()
+	}
+	return s
+}
+
+// Summary counts all the tunnels by their status
+func (d *Dashboard) Summary() Summary {
+	return SummarizeTunnels(d.GetTunnels())
+}
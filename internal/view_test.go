@@ -0,0 +1,781 @@
+package internal
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"github.com/Jonwing/mario/pkg/ssh"
+	sh "golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestInfo(id int) *TunnelInfo {
+	return &TunnelInfo{id: id, name: "t" + strconv.Itoa(id), t: new(ssh.Tunnel)}
+}
+
+func TestDashboard_ConcurrentAccess(t *testing.T) {
+	d := &Dashboard{
+		tunnels:    make([]*TunnelInfo, 0),
+		tunnelRecv: make(chan *TunnelInfo),
+	}
+	go d.updateTunnelInfo()
+	defer close(d.tunnelRecv)
+
+	const count = 100
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		// ids arrive out of order
+		for i := count; i > 0; i-- {
+			d.Update(newTestInfo(i))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < count; i++ {
+			for _, tn := range d.GetTunnels() {
+				if _, ok := d.GetTunnel(tn.GetID()); !ok {
+					t.Errorf("tunnel %d is listed but not found", tn.GetID())
+				}
+			}
+			d.GetTunnel("t1")
+		}
+	}()
+	wg.Wait()
+
+	// the channel is unbuffered, once this is received the updates before are applied
+	d.Update(newTestInfo(1))
+	tns := d.GetTunnels()
+	if len(tns) != count {
+		t.Fatalf("expected %d tunnels, got %d", count, len(tns))
+	}
+	for i, tn := range tns {
+		if tn.GetID() != i+1 {
+			t.Fatalf("tunnels are not ordered by id: %d at %d", tn.GetID(), i)
+		}
+	}
+}
+
+func TestDashboard_UpdateOutOfOrder(t *testing.T) {
+	cases := [][]int{
+		{1, 2, 3, 4},
+		{4, 3, 2, 1},
+		{2, 4, 1, 3},
+		{3, 1, 3, 2, 1, 4},
+	}
+	for _, arrival := range cases {
+		d := &Dashboard{
+			tunnels:    make([]*TunnelInfo, 0),
+			tunnelRecv: make(chan *TunnelInfo),
+		}
+		go d.updateTunnelInfo()
+		infos := make(map[int]*TunnelInfo)
+		for _, id := range arrival {
+			if infos[id] == nil {
+				infos[id] = newTestInfo(id)
+			}
+			d.Update(infos[id])
+		}
+		// make sure the last one is applied
+		d.Update(infos[arrival[0]])
+		close(d.tunnelRecv)
+
+		tns := d.GetTunnels()
+		ids := make([]int, len(tns))
+		for i, tn := range tns {
+			ids[i] = tn.GetID()
+		}
+		if len(ids) != 4 || ids[0] != 1 || ids[1] != 2 || ids[2] != 3 || ids[3] != 4 {
+			t.Errorf("arrival %v: got ids %v, want [1 2 3 4]", arrival, ids)
+		}
+	}
+}
+
+func TestDashboard_UpdateSameTunnel(t *testing.T) {
+	d := &Dashboard{
+		tunnels:    make([]*TunnelInfo, 0),
+		tunnelRecv: make(chan *TunnelInfo),
+	}
+	go d.updateTunnelInfo()
+	first := newTestInfo(1)
+	d.Update(first)
+	// the same tunnel wrapped again with another id
+	d.Update(&TunnelInfo{id: 2, name: "unknown", t: first.t})
+	d.Update(first)
+	close(d.tunnelRecv)
+
+	if tns := d.GetTunnels(); len(tns) != 1 || tns[0] != first {
+		t.Errorf("the tunnel should be listed once, got %d", len(tns))
+	}
+}
+
+func TestMario_WrapperOf(t *testing.T) {
+	m := NewMario("", time.Second)
+	tn := new(ssh.Tunnel)
+	tw := m.wrapperOf(tn, "")
+	if again := m.wrapperOf(tn, "unknown"); again != tw {
+		t.Errorf("the tunnel is wrapped twice: %d and %d", tw.GetID(), again.GetID())
+	}
+	if tw.GetName() != strconv.Itoa(tw.GetID()) {
+		t.Errorf("the default name should be the id, got %s", tw.GetName())
+	}
+	if other := m.wrapperOf(new(ssh.Tunnel), "other"); other.GetID() == tw.GetID() || other.GetName() != "other" {
+		t.Errorf("unexpected wrapper %d %s", other.GetID(), other.GetName())
+	}
+}
+
+func TestMario_UniqueNames(t *testing.T) {
+	m := NewMario("", time.Second)
+	db, err := m.register(new(ssh.Tunnel), "db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.register(new(ssh.Tunnel), "db"); err == nil || !strings.Contains(err.Error(), "is used by") {
+		t.Errorf("expected the used name rejected, got %v", err)
+	}
+	// registering the same tunnel again is fine
+	if again, err := m.register(db.t, "db"); err != nil || again != db {
+		t.Errorf("expected the tunnel registered once, got %v", err)
+	}
+	// the names which aren't given are suffixed instead
+	for _, want := range []string{"unknown", "unknown-2", "unknown-3"} {
+		if tw := m.wrapperOf(new(ssh.Tunnel), "unknown"); tw.GetName() != want {
+			t.Errorf("expected the name %s, got %s", want, tw.GetName())
+		}
+	}
+	// the id of the next tunnel is taken by this one
+	taken, err := m.register(new(ssh.Tunnel), strconv.Itoa(int(m.tunnelCount)+2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tw, _ := m.register(new(ssh.Tunnel), ""); tw.GetName() != taken.GetName()+"-2" {
+		t.Errorf("expected the id taken as a name suffixed, got %s", tw.GetName())
+	}
+	if err := m.Rename(db, "unknown"); err == nil {
+		t.Error("expected renaming to a used name rejected")
+	}
+}
+
+func TestMario_Subscribe(t *testing.T) {
+	m := NewMario("", time.Second)
+	events, unsubscribe := m.Subscribe(1)
+	tw := m.wrapperOf(new(ssh.Tunnel), "db")
+
+	m.publish(newEvent(EventOpen, tw))
+	// the subscriber doesn't keep up, the event is dropped instead of blocking
+	m.publish(newEvent(EventClose, tw))
+	if e := <-events; e.Type != EventOpen || e.Tunnel != "db" || e.TunnelID != tw.GetID() {
+		t.Errorf("unexpected event %+v", e)
+	}
+	select {
+	case e := <-events:
+		t.Errorf("the event should be dropped, got %+v", e)
+	default:
+	}
+
+	unsubscribe()
+	unsubscribe()
+	if _, ok := <-events; ok {
+		t.Error("the events should be closed once unsubscribed")
+	}
+	m.publish(newEvent(EventOpen, tw))
+
+	// a new tunnel is in a transient status
+	if e := statusEvent(tw); e != nil {
+		t.Errorf("unexpected event of a new tunnel %+v", e)
+	}
+}
+
+func TestTunnelInfo_LocalURL(t *testing.T) {
+	cases := []struct {
+		local, remote, want string
+	}{
+		{":15432", "10.0.0.1:5432", "postgres://127.0.0.1:15432"},
+		{"0.0.0.0:8000", "web.internal:80", "http://127.0.0.1:8000"},
+		{"[::]:6380", "10.0.0.2:6379", "redis://127.0.0.1:6380"},
+		{"192.168.1.2:9000", "10.0.0.3:9000", "tcp://192.168.1.2:9000"},
+		{"[::1]:2222", "10.0.0.4:22", "ssh://[::1]:2222"},
+	}
+	for _, c := range cases {
+		tn := &TunnelInfo{t: &ssh.Tunnel{Local: c.local, ForwardTo: c.remote}}
+		if got := tn.LocalURL(); got != c.want {
+			t.Errorf("LocalURL() of %s -> %s = %s, want %s", c.local, c.remote, got, c.want)
+		}
+	}
+}
+
+func TestTunnelInfo_Representation(t *testing.T) {
+	noAuth := ssh.WithAuthCallback(func() ([]sh.AuthMethod, error) { return nil, nil })
+	cases := []struct {
+		server string
+		want   Representation
+	}{
+		{"mario@ssh.corp:2222", Representation{DirectionLocal, ":8080", "mario", "ssh.corp", "2222", "10.0.0.1:80"}},
+		{"mario@[fe80::1]:22", Representation{DirectionLocal, ":8080", "mario", "fe80::1", "22", "10.0.0.1:80"}},
+		// the port defaults to 22
+		{"mario@ssh.corp", Representation{DirectionLocal, ":8080", "mario", "ssh.corp", "22", "10.0.0.1:80"}},
+		// no remote makes a SOCKS5 tunnel
+		{"mario@ssh.corp:22", Representation{DirectionDynamic, ":8080", "mario", "ssh.corp", "22", ""}},
+	}
+	for _, c := range cases {
+		raw, err := ssh.NewTunnel(":8080", c.server, c.want.Remote, nil, nil, time.Second, noAuth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tn := &TunnelInfo{t: raw}
+		if got := tn.Representation(); *got != c.want {
+			t.Errorf("Representation() of %s = %+v, want %+v", c.server, *got, c.want)
+		}
+		// the human form is derived from it
+		if got, want := tn.Represent(), raw.String(); got != want {
+			t.Errorf("Represent() of %s = %s, want %s", c.server, got, want)
+		}
+	}
+
+	raw, err := ssh.NewTunnel("127.0.0.1:3000", "mario@ssh.corp:22", ":9000", nil, nil, time.Second, noAuth,
+		ssh.WithReverse())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tn := &TunnelInfo{t: raw}
+	want := Representation{DirectionRemote, "127.0.0.1:3000", "mario", "ssh.corp", "22", ":9000"}
+	if got := tn.Representation(); *got != want || tn.Represent() != "127.0.0.1:3000 <- ssh.corp:22 <- :9000" {
+		t.Errorf("unexpected reverse tunnel %+v, %s", *got, tn.Represent())
+	}
+}
+
+func TestMario_GlobalKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mario")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name, content string) string {
+		p := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(p, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	first, second := write("first", "first key"), write("second", "second key")
+
+	m := &Mario{KeyPath: first}
+	if key, err := m.globalKey(); err != nil || string(key) != "first key" {
+		t.Fatalf("got %q, error: %v", key, err)
+	}
+	// the cache is reused for the same path
+	write("first", "rewritten")
+	if key, _ := m.globalKey(); string(key) != "first key" {
+		t.Errorf("expected the cached key, got %q", key)
+	}
+	// and dropped once the path changes
+	m.KeyPath = second
+	if key, err := m.globalKey(); err != nil || string(key) != "second key" {
+		t.Errorf("expected the key of the new path, got %q, error: %v", key, err)
+	}
+	m.KeyPath = filepath.Join(dir, "missing")
+	if _, err := m.globalKey(); err == nil {
+		t.Error("expected an error of a missing key instead of the cached one")
+	}
+}
+
+// writeTestKey writes a new private key into dir and returns its path
+func writeTestKey(t *testing.T, dir string) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk := filepath.Join(dir, "id_ecdsa")
+	if err := ioutil.WriteFile(pk, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return pk
+}
+
+func TestMario_MissingGlobalKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mario")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Setenv("SSH_AUTH_SOCK", os.Getenv("SSH_AUTH_SOCK"))
+	os.Unsetenv("SSH_AUTH_SOCK")
+
+	m := NewMario(filepath.Join(dir, "missing"), time.Second)
+	if _, err := m.Monitor(); err != nil {
+		t.Fatalf("expected mario to start without the global key, got %v", err)
+	}
+	if _, err := m.Establish("global", SourceManual, ":0", "mario@127.0.0.1:22", "127.0.0.1:80", "", true); err == nil {
+		t.Error("expected the tunnel needing the global key to fail")
+	}
+
+	if _, err := m.Establish("own", SourceManual, ":0", "mario@127.0.0.1:22", "127.0.0.1:80", writeTestKey(t, dir), true); err != nil {
+		t.Errorf("expected the tunnel with its own key to open, got %v", err)
+	}
+	m.AgentSocket = filepath.Join(dir, "agent.sock")
+	if _, err := m.Establish("agent", SourceManual, ":0", "mario@127.0.0.1:22", "127.0.0.1:80", "", true); err != nil {
+		t.Errorf("expected the tunnel with the agent to open, got %v", err)
+	}
+}
+
+func TestMario_IdentityAgent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mario")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	m := NewMario(writeTestKey(t, dir), time.Second)
+	if _, err := m.Monitor(); err != nil {
+		t.Fatal(err)
+	}
+	m.AgentSocket = filepath.Join(dir, "global.sock")
+	hostAgent := filepath.Join(dir, "host.sock")
+	if m.SSHConfig, err = ssh.ParseSSHConfig(strings.NewReader(
+		"Host agent\n\tIdentityAgent " + hostAgent + "\nHost off\n\tIdentityAgent none\n")); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		server, want string
+	}{
+		{"mario@agent:22", hostAgent},
+		{"mario@off:22", ""},
+		{"mario@other:22", m.AgentSocket},
+	}
+	for _, c := range cases {
+		tn, err := m.Establish("", SourceManual, ":0", c.server, "127.0.0.1:80", "", true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := tn.t.AgentSocket(); got != c.want {
+			t.Errorf("expected the tunnel to %s authenticating with the agent %q, got %q", c.server, c.want, got)
+		}
+	}
+}
+
+func TestMario_SSHConfigKeepsGiven(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mario")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	identity := writeTestKey(t, dir)
+	global := filepath.Join(dir, "global")
+	if err := os.Rename(identity, global); err != nil {
+		t.Fatal(err)
+	}
+	identity = writeTestKey(t, dir)
+	m := NewMario(global, time.Second)
+	if _, err := m.Monitor(); err != nil {
+		t.Fatal(err)
+	}
+	if m.SSHConfig, err = ssh.ParseSSHConfig(strings.NewReader("Host db\n\tHostName 10.0.0.1\n" +
+		"\tProxyJump bastion\nHost bastion\n\tHostName 10.0.0.2\nHost *\n\tIdentityFile " + identity + "\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	tn, err := m.Establish("db", SourceManual, ":0", "mario@db", "127.0.0.1:80", "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tn.GetServer() != "mario@10.0.0.1:22" || tn.GetConfiguredServer() != "mario@db" {
+		t.Errorf("expected mario@db resolved to mario@10.0.0.1:22, got %s and %s", tn.GetConfiguredServer(), tn.GetServer())
+	}
+	if len(tn.GetJumpHosts()) != 1 || tn.GetConfiguredJumpHosts() != nil {
+		t.Errorf("expected the jump hosts of ssh_config left to it, got %v", tn.GetConfiguredJumpHosts())
+	}
+	// the global key wins over the IdentityFile
+	if tn.GetPrivateKeyPath() != "" || tn.GetIdentityFile() != "" {
+		t.Errorf("expected the global key used, got %q and %q", tn.GetPrivateKeyPath(), tn.GetIdentityFile())
+	}
+	ignored, err := m.Establish("direct", SourceManual, ":0", "mario@db", "127.0.0.1:80", "", true,
+		ssh.WithJumpHosts(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hops := ignored.GetConfiguredJumpHosts(); len(hops) != 1 || hops[0] != "none" {
+		t.Errorf("expected the ProxyJump ignored by none, got %v", hops)
+	}
+
+	m.KeyPath = filepath.Join(dir, "missing")
+	tn, err = m.Establish("fallback", SourceManual, ":0", "mario@db", "127.0.0.1:80", "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tn.GetPrivateKeyPath() != "" || tn.GetIdentityFile() != identity {
+		t.Errorf("expected the IdentityFile used without the global key, got %q and %q", tn.GetPrivateKeyPath(),
+			tn.GetIdentityFile())
+	}
+}
+
+// serveSSH serves an ssh server accepting any key and refusing the channels, it's closed by
+// closing the listener returned
+func serveSSH(t *testing.T) net.Listener {
+	hostKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := sh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &sh.ServerConfig{
+		PublicKeyCallback: func(sh.ConnMetadata, sh.PublicKey) (*sh.Permissions, error) {
+			return nil, nil
+		},
+	}
+	config.AddHostKey(signer)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, chans, reqs, err := sh.NewServerConn(conn, config)
+				if err != nil {
+					_ = conn.Close()
+					return
+				}
+				go sh.DiscardRequests(reqs)
+				for ch := range chans {
+					_ = ch.Reject(sh.Prohibited, "no channels")
+				}
+			}()
+		}
+	}()
+	return l
+}
+
+func TestTunnelInfo_GetStatusConnectingAgain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mario")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	server := serveSSH(t)
+	defer server.Close()
+	m := NewMario(writeTestKey(t, dir), time.Second)
+	updates, err := m.Monitor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for range updates {
+		}
+	}()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := l.Addr().String()
+	_ = l.Close()
+	tn, err := m.Establish("again", SourceManual, local, "mario@"+server.Addr().String(), "127.0.0.1:80", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tn.t.Destroy(nil)
+	if err := tn.WaitForStatus(ssh.StatusConnected, 2*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	waiting := make(chan error, 1)
+	tn.t.Down(waiting)
+	if err := <-waiting; err != nil {
+		t.Fatal(err)
+	}
+
+	// the local address is taken so that the tunnel keeps retrying to listen
+	if l, err = net.Listen("tcp", local); err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	tn.t.Reconnect(waiting)
+	connecting := false
+	for deadline := time.Now().Add(300 * time.Millisecond); time.Now().Before(deadline); {
+		switch st := tn.GetStatus(); st {
+		case "connecting":
+			connecting = true
+		case "unknown":
+			t.Fatalf("expected the tunnel listening again shown as connecting, got %s", st)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if !connecting {
+		t.Errorf("expected the tunnel shown as connecting while it listens again, got %s", tn.GetStatus())
+	}
+	<-waiting
+}
+
+func TestDashboard_WaitForStatus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mario")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	d := DefaultDashboard(writeTestKey(t, dir), 1)
+	if err := d.Work(); err != nil {
+		t.Fatal(err)
+	}
+
+	idle, err := d.NewTunnel("idle", SourceManual, "127.0.0.1:0", "mario@127.0.0.1:22", "127.0.0.1:80", "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = idle.WaitForStatus(ssh.StatusConnected, 100*time.Millisecond)
+	if err == nil || err.Error() != "still new after 100ms" {
+		t.Errorf("expected the idle tunnel to time out, got %v", err)
+	}
+	// the dashboard has listed it by now
+	if err := d.WaitForStatus("idle", ssh.StatusNew, time.Second); err != nil {
+		t.Errorf("expected the idle tunnel to be new, got %v", err)
+	}
+	if err := d.WaitForStatus("missing", ssh.StatusConnected, time.Second); err == nil {
+		t.Error("expected an error of the missing tunnel")
+	}
+
+	// nothing listens on the port of the server
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := l.Addr().String()
+	l.Close()
+	refused, err := d.NewTunnel("refused", SourceManual, "127.0.0.1:0", "mario@"+server, "127.0.0.1:80", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err := refused.WaitForStatus(ssh.StatusConnected, 5*time.Second); err == nil || time.Since(start) > 4*time.Second {
+		t.Errorf("expected the error of the tunnel before the timeout, got %v after %s", err, time.Since(start))
+	}
+}
+
+func TestParseSchedule(t *testing.T) {
+	s, err := ParseSchedule([]string{"mon-fri 09:00-18:00", "sat,sun 22:00-02:00"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(day, clock string) time.Time {
+		// 2024-01-01 is a Monday
+		tm, err := time.ParseInLocation("2006-01-02 15:04", "2024-01-0"+day+" "+clock, time.Local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+	cases := []struct {
+		day, clock string
+		want       bool
+	}{
+		{"1", "09:00", true},
+		{"1", "08:59", false},
+		{"5", "17:59", true},
+		{"5", "18:00", false},
+		{"6", "12:00", false},
+		{"6", "23:00", true},
+		// crossing midnight, it belongs to the day it starts
+		{"7", "01:30", true},
+		{"1", "01:30", true},
+		{"1", "02:00", false},
+		{"6", "01:30", false},
+	}
+	for _, c := range cases {
+		if got := s.Active(at(c.day, c.clock)); got != c.want {
+			t.Errorf("Active(%s %s) = %v, want %v", c.day, c.clock, got, c.want)
+		}
+	}
+
+	var always *Schedule
+	if !always.Active(time.Now()) || always.String() != "" {
+		t.Errorf("expected no schedule to be always active")
+	}
+	if s, err := ParseSchedule([]string{"sun"}); err != nil || !s.Active(at("7", "00:00")) || s.Active(at("1", "00:00")) {
+		t.Errorf("expected the whole sunday, got %v", err)
+	}
+	for _, bad := range []string{"mon-fri 9-18", "fun 09:00-18:00", "09:00-09:00", "* 09:00-25:00", "mon 09:00 18:00"} {
+		if _, err := ParseSchedule([]string{bad}); err == nil {
+			t.Errorf("expected %q to be invalid", bad)
+		}
+	}
+}
+
+func TestTunnelInfo_Throughput(t *testing.T) {
+	tn := newTestInfo(1)
+	if got := tn.GetThroughput(); got != 0 {
+		t.Errorf("expected no throughput before sampling, got %f", got)
+	}
+	start := time.Now().Add(-10 * time.Second)
+	for i := 0; i < throughputSamples+2; i++ {
+		tn.sampleBytes(start.Add(time.Duration(i) * time.Second))
+	}
+	if len(tn.samples) != throughputSamples || !tn.samples[0].at.Equal(start.Add(2*time.Second)) {
+		t.Errorf("expected the last %d samples kept, got %+v", throughputSamples, tn.samples)
+	}
+	if got := tn.GetThroughput(); got != 0 {
+		t.Errorf("expected no throughput of an idle tunnel, got %f", got)
+	}
+	if in, out := tn.GetThroughputInOut(); in != 0 || out != 0 {
+		t.Errorf("expected no throughput in either direction, got %f in and %f out", in, out)
+	}
+}
+
+func TestDashboard_RemoveTunnel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mario")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	d := DefaultDashboard(writeTestKey(t, dir), 1)
+	if err := d.Work(); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"db", "cache", "web"} {
+		tn, err := d.NewTunnel(name, SourceManual, "127.0.0.1:0", "mario@127.0.0.1:22", "127.0.0.1:80", "", true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tn.WaitForStatus(ssh.StatusNew, time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitListed := func(n int) {
+		deadline := time.Now().Add(time.Second)
+		for len(d.GetTunnels()) != n && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitListed(3)
+
+	db, _ := d.GetTunnel("db")
+	if err := d.RemoveTunnel("db"); err != nil {
+		t.Fatal(err)
+	}
+	if db.t.Status()&ssh.StatusRemoved != ssh.StatusRemoved {
+		t.Errorf("expected the tunnel destroyed, got status %d", db.t.Status())
+	}
+	if _, ok := d.GetTunnel("db"); ok || len(d.GetTunnels()) != 2 {
+		t.Errorf("expected the tunnel no longer listed, got %d tunnels", len(d.GetTunnels()))
+	}
+	// a status published late doesn't bring it back
+	d.Update(db)
+	time.Sleep(50 * time.Millisecond)
+	d.Mario.wm.RLock()
+	_, known := d.Mario.wrappers[db.t]
+	d.Mario.wm.RUnlock()
+	if _, ok := d.GetTunnel("db"); ok || known {
+		t.Error("expected the removed tunnel forgotten")
+	}
+	if err := d.RemoveTunnel("db"); err == nil {
+		t.Error("expected an error of removing it again")
+	}
+
+	if err := d.RemoveTunnel(-1); err != nil {
+		t.Fatal(err)
+	}
+	if tns := d.GetTunnels(); len(tns) != 0 {
+		t.Errorf("expected no tunnels left, got %d", len(tns))
+	}
+}
+
+func TestDashboard_RenameTunnel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mario")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	d := DefaultDashboard(writeTestKey(t, dir), 1)
+	if err := d.Work(); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"db", "cache"} {
+		if _, err := d.NewTunnel(name, SourceManual, "127.0.0.1:0", "mario@127.0.0.1:22", "127.0.0.1:80", "", true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(time.Second)
+	for len(d.GetTunnels()) != 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	db, ok := d.GetTunnel("db")
+	if !ok {
+		t.Fatal("expected the tunnel db listed")
+	}
+
+	if err := d.RenameTunnel(db.GetID(), "cache"); err == nil || !strings.Contains(err.Error(), "is used by") {
+		t.Errorf("expected the used name rejected, got %v", err)
+	}
+	if err := d.RenameTunnel("db", "my db"); err == nil {
+		t.Error("expected the name with spaces rejected")
+	}
+	if err := d.RenameTunnel("db", "postgres"); err != nil {
+		t.Fatal(err)
+	}
+	if tn, ok := d.GetTunnel("postgres"); !ok || tn != db || db.GetName() != "postgres" {
+		t.Errorf("expected the tunnel found by its new name, got %v", tn)
+	}
+	if _, ok := d.GetTunnel("db"); ok {
+		t.Error("expected the old name gone")
+	}
+	// renaming to its own name is fine
+	if err := d.RenameTunnel("postgres", "postgres"); err != nil {
+		t.Errorf("expected renaming to the same name to pass, got %v", err)
+	}
+	if err := d.RenameTunnel("missing", "x"); err == nil {
+		t.Error("expected an error of the missing tunnel")
+	}
+}
+
+func TestTunnelInfo_GetClosed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mario")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	d := DefaultDashboard(writeTestKey(t, dir), 1)
+	if err := d.Work(); err != nil {
+		t.Fatal(err)
+	}
+	tn, err := d.NewTunnel("db", SourceManual, "127.0.0.1:0", "mario@127.0.0.1:22", "127.0.0.1:80", "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tn.GetClosed() {
+		t.Error("expected the tunnel opened without connecting closed")
+	}
+	tn.scm.Lock()
+	tn.scheduledOff = true
+	tn.scm.Unlock()
+	if tn.GetClosed() {
+		t.Error("expected the tunnel closed by its schedule not closed on purpose")
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for len(d.GetTunnels()) != 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// brought up, it's meant to be connected even if it fails to
+	if err := d.UpTunnel(tn.GetID(), true); err != nil {
+		t.Fatal(err)
+	}
+	if tn.GetClosed() {
+		t.Errorf("expected the tunnel brought up not closed, got %s", tn.GetStatus())
+	}
+}
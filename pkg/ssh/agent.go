@@ -0,0 +1,65 @@
+package ssh
+
+import (
+	sh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"net"
+	"os"
+	"sync"
+)
+
+// EnvAgentSocket returns the socket of the ssh agent in $SSH_AUTH_SOCK, it's empty if no
+// agent is running
+func EnvAgentSocket() string {
+	return os.Getenv("SSH_AUTH_SOCK")
+}
+
+// agentSigners provides the keys held by the ssh agent listening on a unix socket. The
+// connection to the agent is kept for signing and redialed if it's broken.
+type agentSigners struct {
+	mu sync.Mutex
+
+	socket string
+
+	conn net.Conn
+}
+
+func (a *agentSigners) Signers() ([]sh.Signer, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.conn != nil {
+		signers, err := agent.NewClient(a.conn).Signers()
+		if err == nil {
+			return signers, nil
+		}
+		_ = a.conn.Close()
+		a.conn = nil
+	}
+	conn, err := net.Dial("unix", a.socket)
+	if err != nil {
+		return nil, err
+	}
+	a.conn = conn
+	return agent.NewClient(conn).Signers()
+}
+
+// publicKeysWithAgent authenticates with the keys of the agent on socket followed by the
+// signer of the private key if any. They have to be combined in a single auth method because
+// the ssh client tries each kind of method only once.
+func publicKeysWithAgent(socket string, signer sh.Signer) sh.AuthMethod {
+	a := &agentSigners{socket: socket}
+	return sh.PublicKeysCallback(func() ([]sh.Signer, error) {
+		signers, err := a.Signers()
+		if err != nil && signer == nil {
+			return nil, err
+		}
+		if err != nil {
+			// the agent is unavailable, fall back to the private key
+			signers = nil
+		}
+		if signer == nil {
+			return signers, nil
+		}
+		return append(signers, signer), nil
+	})
+}
@@ -0,0 +1,93 @@
+package ssh
+
+import (
+	"crypto/rand"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh/agent"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// agentServer serves an ssh agent holding a key on a unix socket in dir
+func agentServer(t *testing.T, dir string) (socket string, l net.Listener) {
+	socket = filepath.Join(dir, "agent.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyring := agent.NewKeyring()
+	_, agentKey, _ := ed25519.GenerateKey(rand.Reader)
+	if err := keyring.Add(agent.AddedKey{PrivateKey: agentKey}); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go agent.ServeAgent(keyring, conn)
+		}
+	}()
+	return socket, l
+}
+
+func TestAgentSigners(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mario-agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket, l := agentServer(t, dir)
+	defer l.Close()
+
+	a := &agentSigners{socket: socket}
+	signers, err := a.Signers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(signers) != 1 {
+		t.Fatalf("expected 1 signer from agent, got %d", len(signers))
+	}
+	// the connection is reused
+	conn := a.conn
+	if _, err = a.Signers(); err != nil || a.conn != conn {
+		t.Errorf("expected the agent connection to be reused, err: %v", err)
+	}
+	// and redialed once broken
+	_ = conn.Close()
+	if _, err = a.Signers(); err != nil || a.conn == conn {
+		t.Errorf("expected the agent connection to be redialed, err: %v", err)
+	}
+}
+
+func TestTunnel_AgentWithoutKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mario-agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket, l := agentServer(t, dir)
+	defer l.Close()
+	server := newTestServer(t)
+	defer server.stop()
+
+	tn, err := NewTunnel(freeAddr(t), "mario@"+server.addr, "127.0.0.1:1", nil, nil, time.Second, WithAgent(socket))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go tn.Up()
+	defer tn.Destroy(nil)
+	waitStatus(t, tn, 2*time.Second, isConnected)
+
+	// there's nothing to fall back to once the agent is gone
+	_ = l.Close()
+	if _, err := AuthTest("mario@"+server.addr, nil, time.Second, WithAgent(socket)); err == nil {
+		t.Error("expected the auth to fail without the agent")
+	}
+}
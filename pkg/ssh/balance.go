@@ -0,0 +1,115 @@
+package ssh
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// BalanceStrategy is how a tunnel with several backends picks the one a connection goes to
+type BalanceStrategy string
+
+const (
+	// BalanceRoundRobin takes the backends in turn, it's the default
+	BalanceRoundRobin BalanceStrategy = "round-robin"
+
+	// BalanceRandom picks a backend at random
+	BalanceRandom BalanceStrategy = "random"
+)
+
+// ParseBalanceStrategy parses the name of a balance strategy, empty means the default one
+func ParseBalanceStrategy(name string) (BalanceStrategy, error) {
+	switch BalanceStrategy(name) {
+	case "", BalanceRoundRobin:
+		return BalanceRoundRobin, nil
+	case BalanceRandom:
+		return BalanceRandom, nil
+	}
+	return "", fmt.Errorf("unknown balance strategy %s, should be %s or %s", name,
+		BalanceRoundRobin, BalanceRandom)
+}
+
+// Backends returns the remote addresses the connections are spread over, ForwardTo is the first
+func (t *Tunnel) Backends() []string {
+	_, _, remote := t.Addresses()
+	return append([]string{remote}, t.backends...)
+}
+
+// Balance returns how a backend is picked for a connection
+func (t *Tunnel) Balance() BalanceStrategy {
+	return t.balance
+}
+
+// pickBackend picks the backend for a new connection by the strategy of the tunnel, the
+// backends failed to dial within the last health check interval are skipped unless all
+// of them failed. It's only called by the running goroutine.
+func (t *Tunnel) pickBackend() string {
+	if len(t.backends) == 0 {
+		return t.ForwardTo
+	}
+	backends := t.Backends()
+	start := t.nextBackend
+	if t.balance == BalanceRandom {
+		start = rand.Intn(len(backends))
+	}
+	t.nextBackend = (start + 1) % len(backends)
+	for i := range backends {
+		backend := backends[(start+i)%len(backends)]
+		if failedAt, ok := t.backendDown[backend]; !ok || time.Since(failedAt) >= t.keepaliveInterval {
+			return backend
+		}
+	}
+	return backends[start]
+}
+
+// backendOrder returns the backends a new connection tries in order: the one picked by
+// pickBackend first, then the others in turn, with those failed recently at the end. It's
+// only called by the running goroutine.
+func (t *Tunnel) backendOrder() []string {
+	first := t.pickBackend()
+	if len(t.backends) == 0 {
+		return []string{first}
+	}
+	backends := t.Backends()
+	start := 0
+	for i, b := range backends {
+		if b == first {
+			start = i
+			break
+		}
+	}
+	order := []string{first}
+	down := make([]string, 0)
+	for i := 1; i < len(backends); i++ {
+		backend := backends[(start+i)%len(backends)]
+		if failedAt, ok := t.backendDown[backend]; ok && time.Since(failedAt) < t.keepaliveInterval {
+			down = append(down, backend)
+			continue
+		}
+		order = append(order, backend)
+	}
+	return append(order, down...)
+}
+
+// markBackend remembers whether dialing the backend failed, see pickBackend. The other
+// targets, e.g. those dialed by Forward, are ignored.
+func (t *Tunnel) markBackend(backend string, err error) {
+	if len(t.backends) == 0 {
+		return
+	}
+	known := false
+	for _, b := range t.Backends() {
+		if b == backend {
+			known = true
+			break
+		}
+	}
+	if !known {
+		return
+	}
+	if err == nil {
+		delete(t.backendDown, backend)
+		return
+	}
+	t.backendDown[backend] = time.Now()
+}
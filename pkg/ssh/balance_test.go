@@ -0,0 +1,116 @@
+package ssh
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// nameServer writes its name to every connection and closes it
+func nameServer(t *testing.T, name string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = conn.Write([]byte(name))
+			_ = conn.Close()
+		}
+	}()
+	return l
+}
+
+func TestParseBalanceStrategy(t *testing.T) {
+	for name, want := range map[string]BalanceStrategy{"": BalanceRoundRobin, "round-robin": BalanceRoundRobin, "random": BalanceRandom} {
+		if got, err := ParseBalanceStrategy(name); err != nil || got != want {
+			t.Errorf("ParseBalanceStrategy(%q) = %s, %v", name, got, err)
+		}
+	}
+	if _, err := ParseBalanceStrategy("least-conn"); err == nil {
+		t.Error("expected an error for an unknown strategy")
+	}
+}
+
+func TestTunnel_RoundRobinBackends(t *testing.T) {
+	server := newTestServer(t)
+	defer server.stop()
+	a := nameServer(t, "a")
+	defer a.Close()
+	b := nameServer(t, "b")
+
+	localAddr := freeAddr(t)
+	tn, err := NewTunnel(localAddr, "mario@"+server.addr, a.Addr().String(), testKey(t), nil, time.Minute,
+		WithBackends([]string{b.Addr().String()}, BalanceRoundRobin))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go tn.Up()
+	defer tn.Destroy(nil)
+	waitStatus(t, tn, 2*time.Second, isConnected)
+
+	read := func() string {
+		conn, err := net.Dial("tcp", localAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		got, _ := ioutil.ReadAll(conn)
+		return string(got)
+	}
+
+	for i, want := range []string{"a", "b", "a", "b", "a"} {
+		if got := read(); got != want {
+			t.Fatalf("connection %d went to %q, want %q", i, got, want)
+		}
+	}
+
+	// b goes away, the connection to it fails over to a and b is skipped afterwards
+	_ = b.Close()
+	if got := read(); got != "a" {
+		t.Fatalf("the connection to the closed backend should fail over to a, got %q", got)
+	}
+	for i := 0; i < 2; i++ {
+		if got := read(); got != "a" {
+			t.Errorf("the failed backend should be skipped, got %q", got)
+		}
+	}
+}
+
+func TestTunnel_BackendFailover(t *testing.T) {
+	server := newTestServer(t)
+	defer server.stop()
+	// nothing listens on the first backend, dialing it is refused
+	refused := freeAddr(t)
+	b := nameServer(t, "b")
+	defer b.Close()
+
+	localAddr := freeAddr(t)
+	tn, err := NewTunnel(localAddr, "mario@"+server.addr, refused, testKey(t), nil, time.Minute,
+		WithBackends([]string{b.Addr().String()}, BalanceRoundRobin))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go tn.Up()
+	defer tn.Destroy(nil)
+	waitStatus(t, tn, 2*time.Second, isConnected)
+
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", localAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		got, _ := ioutil.ReadAll(conn)
+		_ = conn.Close()
+		if string(got) != "b" {
+			t.Fatalf("connection %d got %q, want it failed over to b", i, got)
+		}
+	}
+}
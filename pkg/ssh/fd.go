@@ -0,0 +1,56 @@
+package ssh
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// FdExhaustedError is the error of running out of file descriptors, it's usually the process
+// hitting its limit of open files with too many tunnels and connections
+type FdExhaustedError struct {
+	err error
+
+	// open the file descriptors in use and limit the soft limit of them, they are 0 if unknown
+	open, limit int
+}
+
+func (e *FdExhaustedError) Error() string {
+	msg := e.err.Error()
+	if e.limit > 0 {
+		usage := strconv.Itoa(e.limit) + " file descriptors"
+		if e.open > 0 {
+			usage = strconv.Itoa(e.open) + " of " + usage
+		}
+		msg += ", " + usage + " in use"
+	}
+	return msg + ": raise the limit of open files, e.g. `ulimit -n 65536`, or serve fewer tunnels"
+}
+
+// newFdExhaustedError wraps err with the current file descriptor usage
+func newFdExhaustedError(err error) *FdExhaustedError {
+	open, limit := fdUsage()
+	return &FdExhaustedError{err: err, open: open, limit: limit}
+}
+
+// isFdExhausted tells whether err is EMFILE or ENFILE
+func isFdExhausted(err error) bool {
+	for err != nil {
+		switch e := err.(type) {
+		case *FdExhaustedError:
+			return true
+		case *net.OpError:
+			err = e.Err
+		case *os.SyscallError:
+			err = e.Err
+		case *os.PathError:
+			err = e.Err
+		case syscall.Errno:
+			return e == syscall.EMFILE || e == syscall.ENFILE
+		default:
+			return false
+		}
+	}
+	return false
+}
@@ -0,0 +1,36 @@
+package ssh
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestIsFdExhausted(t *testing.T) {
+	listenErr := &net.OpError{Op: "listen", Net: "tcp", Err: os.NewSyscallError("socket", syscall.EMFILE)}
+	cases := []struct {
+		err  error
+		want bool
+	}{
+		{listenErr, true},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("socket", syscall.ENFILE)}, true},
+		{&os.PathError{Op: "open", Path: "/dev/null", Err: syscall.EMFILE}, true},
+		{newFdExhaustedError(listenErr), true},
+		{&net.OpError{Op: "listen", Net: "tcp", Err: os.NewSyscallError("bind", syscall.EADDRINUSE)}, false},
+		{errors.New("too many open files"), false},
+		{nil, false},
+	}
+	for _, c := range cases {
+		if got := isFdExhausted(c.err); got != c.want {
+			t.Errorf("isFdExhausted(%v) = %v, want %v", c.err, got, c.want)
+		}
+	}
+
+	msg := (&FdExhaustedError{err: listenErr, open: 1020, limit: 1024}).Error()
+	if !strings.Contains(msg, "1020 of 1024 file descriptors") || !strings.Contains(msg, "ulimit -n") {
+		t.Errorf("the message should tell the usage and how to fix it, got %q", msg)
+	}
+}
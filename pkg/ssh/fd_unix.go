@@ -0,0 +1,31 @@
+//go:build !windows
+// +build !windows
+
+package ssh
+
+import (
+	"os"
+	"syscall"
+)
+
+// fdUsage returns the open file descriptors of the process and its soft limit, 0 if unknown
+func fdUsage() (open, limit int) {
+	var rl syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rl); err == nil {
+		limit = int(rl.Cur)
+	}
+	for _, dir := range []string{"/proc/self/fd", "/dev/fd"} {
+		// it needs a file descriptor itself, so it fails if there is none left
+		f, err := os.Open(dir)
+		if err != nil {
+			continue
+		}
+		names, err := f.Readdirnames(-1)
+		_ = f.Close()
+		if err == nil {
+			// not counting the one just closed
+			return len(names) - 1, limit
+		}
+	}
+	return 0, limit
+}
@@ -0,0 +1,104 @@
+package ssh
+
+import (
+	"fmt"
+	sh "golang.org/x/crypto/ssh"
+	"net"
+	"strings"
+)
+
+// ParseJumpHosts splits the jump hosts separated by commas like ProxyJump of OpenSSH, e.g.
+// "user@bastion:22,inner". "none" and an empty string mean no jump host.
+func ParseJumpHosts(jump string) []string {
+	if strings.TrimSpace(jump) == "none" {
+		return nil
+	}
+	hops := make([]string, 0)
+	for _, hop := range strings.Split(jump, ",") {
+		if hop = strings.TrimSpace(hop); hop != "" {
+			hops = append(hops, hop)
+		}
+	}
+	if len(hops) == 0 {
+		return nil
+	}
+	return hops
+}
+
+// splitJumpHost splits a jump host in form of [user@]host[:port] into the user and the address,
+// the port defaults to 22
+func splitJumpHost(hop string) (user, addr string) {
+	addr = hop
+	if i := strings.LastIndex(hop, "@"); i >= 0 {
+		user, addr = hop[:i], hop[i+1:]
+	}
+	if withPort, err := withSSHPort(addr); err == nil {
+		addr = withPort
+	}
+	return user, addr
+}
+
+// jumpConn is the connection to the ssh server forwarded by the jump hosts, closing it closes
+// the jump hosts too so that the whole chain goes away with the ssh client using it
+type jumpConn struct {
+	net.Conn
+
+	// hops the clients of the jump hosts in the order of dialing
+	hops []*sh.Client
+}
+
+func (c *jumpConn) Close() error {
+	err := c.Conn.Close()
+	closeJumpHosts(c.hops)
+	return err
+}
+
+func closeJumpHosts(hops []*sh.Client) {
+	for i := len(hops) - 1; i >= 0; i-- {
+		_ = hops[i].Close()
+	}
+}
+
+// dialJumpHosts connects to the ssh server through the jump hosts in order, each jump host is
+// logged in with the auth of the tunnel, as the user of the tunnel if it has none, and forwards
+// the connection to the next one. The first jump host is reached through the proxy if any.
+func (t *Tunnel) dialJumpHosts(config *sh.ClientConfig) (net.Conn, error) {
+	_, first := splitJumpHost(t.jumpHosts[0])
+	var conn net.Conn
+	var err error
+	if t.proxy != nil {
+		conn, err = dialHTTPProxy(t.proxy, first, config.Timeout)
+	} else {
+		conn, err = net.DialTimeout("tcp", first, config.Timeout)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to jump host %s: %v", t.jumpHosts[0], err)
+	}
+	hops := make([]*sh.Client, 0, len(t.jumpHosts))
+	for i, hop := range t.jumpHosts {
+		user, addr := splitJumpHost(hop)
+		hopConfig := *config
+		if user != "" {
+			hopConfig.User = user
+		}
+		// the host key of the ssh server is the one recorded, not those of the jump hosts
+		hopConfig.HostKeyCallback = t.sshConfig.HostKeyCallback
+		c, chans, reqs, err := sh.NewClientConn(conn, addr, &hopConfig)
+		if err != nil {
+			_ = conn.Close()
+			closeJumpHosts(hops)
+			return nil, fmt.Errorf("jump host %s: %v", hop, err)
+		}
+		client := sh.NewClient(c, chans, reqs)
+		hops = append(hops, client)
+		next := t.SSHUri
+		if i < len(t.jumpHosts)-1 {
+			_, next = splitJumpHost(t.jumpHosts[i+1])
+		}
+		if conn, err = client.Dial("tcp", next); err != nil {
+			closeJumpHosts(hops)
+			return nil, fmt.Errorf("failed to reach %s through jump host %s: %v", next, hop, err)
+		}
+	}
+	return &jumpConn{Conn: conn, hops: hops}, nil
+}
@@ -0,0 +1,98 @@
+package ssh
+
+import (
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseJumpHosts(t *testing.T) {
+	cases := []struct {
+		jump string
+		want []string
+	}{
+		{"", nil},
+		{"none", nil},
+		{"bastion", []string{"bastion"}},
+		{"mario@bastion:2222, inner ,", []string{"mario@bastion:2222", "inner"}},
+	}
+	for _, c := range cases {
+		if got := ParseJumpHosts(c.jump); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("ParseJumpHosts(%q) = %v, want %v", c.jump, got, c.want)
+		}
+	}
+	if user, addr := splitJumpHost("luigi@[fe80::1]"); user != "luigi" || addr != "[fe80::1]:22" {
+		t.Errorf("unexpected jump host %s %s", user, addr)
+	}
+}
+
+// echoThrough writes to the local address of a tunnel and expects it echoed
+func echoThrough(t *testing.T, local string) {
+	conn, err := net.DialTimeout("tcp", local, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write([]byte("mario")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "mario" {
+		t.Fatalf("expected the echo through the tunnel, got %q, error: %v", buf, err)
+	}
+}
+
+func TestTunnel_JumpHosts(t *testing.T) {
+	server := newTestServer(t)
+	defer server.stop()
+	first := newTestServer(t)
+	defer first.stop()
+	second := newTestServer(t)
+	defer second.stop()
+	echo := echoServer(t)
+	defer echo.Close()
+
+	local := freeAddr(t)
+	tn, err := NewTunnel(local, "mario@"+server.addr, echo.Addr().String(), testKey(t), nil, time.Second,
+		WithHealthCheckInterval(100*time.Millisecond), WithJumpHosts([]string{first.addr, "luigi@" + second.addr}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go tn.Up()
+	defer tn.Destroy(nil)
+	waitStatus(t, tn, 2*time.Second, isConnected)
+	echoThrough(t, local)
+	if ips := tn.ResolvedIPs(); ips != nil {
+		t.Errorf("the ssh server behind the jump hosts shouldn't be resolved, got %v", ips)
+	}
+	first.waitClients(1, time.Second)
+	second.waitClients(1, time.Second)
+	server.waitClients(1, time.Second)
+
+	// the whole chain is dialed again once the first jump host drops the connection
+	first.stop()
+	first.start()
+	waitStatus(t, tn, 3*time.Second, func(st TunnelStatus) bool {
+		return isConnected(st) && tn.Reconnects() >= 1
+	})
+	echoThrough(t, local)
+	first.waitClients(1, time.Second)
+	second.waitClients(1, time.Second)
+	server.waitClients(1, time.Second)
+
+	// a jump host refusing the auth fails the tunnel
+	denied, err := NewTunnel(freeAddr(t), "mario@"+server.addr, echo.Addr().String(), testKey(t), nil, time.Second,
+		WithJumpHosts([]string{"denied@" + first.addr}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client, _, err := denied.dial(); err == nil {
+		client.Close()
+		t.Fatal("expected the jump host to refuse the user")
+	} else if _, ok := classifyDialError(err).(*AuthError); !ok {
+		t.Errorf("expected an auth error, got %v", err)
+	}
+}
@@ -0,0 +1,57 @@
+package ssh
+
+import (
+	"bytes"
+	"errors"
+	sh "golang.org/x/crypto/ssh"
+	"io/ioutil"
+)
+
+var errNotPrivateKey = errors.New("not a private key")
+
+// KeyInfo describes a private key file
+type KeyInfo struct {
+	Path string
+
+	// Type is the key algorithm, e.g. ssh-rsa, ssh-ed25519
+	Type string
+
+	// Fingerprint is the SHA256 fingerprint of the public key, as printed by `ssh-keygen -l`
+	Fingerprint string
+
+	// Encrypted indicates the private key is protected by a passphrase, in which case the
+	// public key is read from the accompanying .pub file
+	Encrypted bool
+}
+
+// InspectKey reads the private key file at path and returns its type and fingerprint
+func InspectKey(path string) (*KeyInfo, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Contains(content, []byte("PRIVATE KEY")) {
+		return nil, errNotPrivateKey
+	}
+
+	info := &KeyInfo{Path: path}
+	var pub sh.PublicKey
+	signer, err := sh.ParsePrivateKey(content)
+	if err == nil {
+		pub = signer.PublicKey()
+	} else {
+		// the private key can't be decoded without the passphrase, try the public one
+		pubContent, pubErr := ioutil.ReadFile(path + ".pub")
+		if pubErr != nil {
+			return nil, err
+		}
+		pub, _, _, _, pubErr = sh.ParseAuthorizedKey(pubContent)
+		if pubErr != nil {
+			return nil, err
+		}
+		info.Encrypted = true
+	}
+	info.Type = pub.Type()
+	info.Fingerprint = sh.FingerprintSHA256(pub)
+	return info, nil
+}
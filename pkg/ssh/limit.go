@@ -0,0 +1,63 @@
+package ssh
+
+import "sync"
+
+// ConnectionLimit caps the connections served at the same time by all the tunnels sharing
+// it, see WithConnectionLimit. The cap can be changed at any time, 0 means no limit.
+type ConnectionLimit struct {
+	mu sync.Mutex
+
+	max int
+
+	active int
+}
+
+// NewConnectionLimit returns a limit of max connections, 0 means no limit
+func NewConnectionLimit(max int) *ConnectionLimit {
+	return &ConnectionLimit{max: max}
+}
+
+// SetMax changes the cap, the connections already served are kept even if they exceed it
+func (l *ConnectionLimit) SetMax(max int) {
+	l.mu.Lock()
+	l.max = max
+	l.mu.Unlock()
+}
+
+func (l *ConnectionLimit) Max() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.max
+}
+
+// Active returns the number of connections being served under the limit
+func (l *ConnectionLimit) Active() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.active
+}
+
+// acquire takes a slot for a new connection, false if the cap is reached
+func (l *ConnectionLimit) acquire() bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.max > 0 && l.active >= l.max {
+		return false
+	}
+	l.active++
+	return true
+}
+
+func (l *ConnectionLimit) release() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	if l.active > 0 {
+		l.active--
+	}
+	l.mu.Unlock()
+}
@@ -0,0 +1,79 @@
+package ssh
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnectionLimit(t *testing.T) {
+	l := NewConnectionLimit(1)
+	if !l.acquire() {
+		t.Fatal("the first connection should be allowed")
+	}
+	if l.acquire() {
+		t.Fatal("the second connection should be refused")
+	}
+	l.SetMax(0)
+	if !l.acquire() || l.Active() != 2 {
+		t.Fatalf("no limit after SetMax(0), active %d", l.Active())
+	}
+	l.release()
+	l.release()
+	l.release()
+	if l.Active() != 0 {
+		t.Errorf("active should not go below 0, got %d", l.Active())
+	}
+
+	var nilLimit *ConnectionLimit
+	if !nilLimit.acquire() {
+		t.Error("a nil limit should allow any connection")
+	}
+	nilLimit.release()
+}
+
+func TestTunnel_ConnectionLimit(t *testing.T) {
+	server := newTestServer(t)
+	defer server.stop()
+	echo := echoServer(t)
+	defer echo.Close()
+
+	limit := NewConnectionLimit(1)
+	localAddr := freeAddr(t)
+	tn, err := NewTunnel(localAddr, "mario@"+server.addr, echo.Addr().String(), testKey(t), nil, time.Second,
+		WithConnectionLimit(limit))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go tn.Up()
+	defer tn.Destroy(nil)
+	waitStatus(t, tn, 2*time.Second, isConnected)
+
+	first, err := net.Dial("tcp", localAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	// round trip to make sure the first connection is being served
+	if _, err := first.Write([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	_ = first.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(first, make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := net.Dial("tcp", localAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	_ = second.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := second.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("the connection over the limit should be closed, got %v", err)
+	}
+	if limit.Active() != 1 {
+		t.Errorf("expected 1 active connection, got %d", limit.Active())
+	}
+}
@@ -0,0 +1,301 @@
+package ssh
+
+import (
+	"fmt"
+	sh "golang.org/x/crypto/ssh"
+	"net/url"
+	"time"
+)
+
+// Option configures the optional behaviors of a Tunnel, it is applied by NewTunnel
+type Option func(*Tunnel)
+
+// WithMaxConnectionAge makes the tunnel reconnect its ssh client once the client has been
+// connected for longer than age regardless of its health, 0 means no limit.
+func WithMaxConnectionAge(age time.Duration) Option {
+	return func(t *Tunnel) {
+		t.maxConnAge = age
+	}
+}
+
+// WithAutoReconnect controls whether the tunnel reconnects by itself when the health
+// check fails. If disabled, the tunnel is only marked as errored and left to be brought
+// up manually. It's enabled by default.
+func WithAutoReconnect(enabled bool) Option {
+	return func(t *Tunnel) {
+		t.autoReconnect = enabled
+	}
+}
+
+// WithMaxRetries makes the tunnel give up reconnecting by itself after n failed reconnects in
+// a row, it stays errored until it's brought up manually. A successful connect starts the
+// count over. 0 means retrying forever, the default.
+func WithMaxRetries(n int) Option {
+	return func(t *Tunnel) {
+		t.maxRetries = n
+	}
+}
+
+// WithAgent authenticates the tunnel with the keys held by the ssh agent listening on the
+// unix socket, e.g. the IdentityAgent of OpenSSH or EnvAgentSocket, before trying the private
+// key. The private key of NewTunnel can be nil then.
+func WithAgent(socket string) Option {
+	return func(t *Tunnel) {
+		t.agentSocket = socket
+	}
+}
+
+// AuthCallback supplies the auth methods of a tunnel, e.g. from a credential store or a
+// hardware token. It's called every time the tunnel dials the ssh server.
+type AuthCallback func() ([]sh.AuthMethod, error)
+
+// WithAuthCallback makes the tunnel authenticate with the methods returned by callback instead
+// of the private key and the agent, the private key of NewTunnel can be nil then.
+func WithAuthCallback(callback AuthCallback) Option {
+	return func(t *Tunnel) {
+		t.authCallback = callback
+	}
+}
+
+// WithRemoteProbe makes the tunnel probe ForwardTo through the ssh connection on every health
+// check, the remote is down once failures probes in a row fail, see RemoteDown. If reconnect
+// is true, the ssh connection is reconnected once for an outage in case its forwarding is
+// broken while the connection looks healthy. 0 failures means no probing.
+func WithRemoteProbe(failures int, reconnect bool) Option {
+	return func(t *Tunnel) {
+		t.remoteProbes = failures
+		t.reconnectOnRemoteDown = reconnect
+	}
+}
+
+// WithKeyboardInteractive makes the tunnel answer the keyboard-interactive questions of the
+// server with challenge, e.g. for OTP or 2FA. It's tried after the private key, which can be
+// nil then. It's ignored with WithAuthCallback, whose methods should include it instead.
+func WithKeyboardInteractive(challenge sh.KeyboardInteractiveChallenge) Option {
+	return func(t *Tunnel) {
+		t.challenge = challenge
+	}
+}
+
+// WithPassword makes the tunnel authenticate with the password if the private key and the agent,
+// if any, are rejected or there is none. The private key of NewTunnel can be nil then. It's
+// ignored with WithAuthCallback.
+func WithPassword(password string) Option {
+	return func(t *Tunnel) {
+		t.password = password
+	}
+}
+
+// WithProxy makes the tunnel reach the ssh server through the CONNECT method of the
+// HTTP(S) proxy, see ParseProxy. nil means connecting directly.
+func WithProxy(proxy *url.URL) Option {
+	return func(t *Tunnel) {
+		t.proxy = proxy
+	}
+}
+
+// WithJumpHosts makes the tunnel reach the ssh server through the jump hosts in order like
+// ProxyJump of OpenSSH, each in form of [user@]host[:port], see ParseJumpHosts. The jump hosts
+// are logged in with the auth of the tunnel, and the whole chain is dialed again on every
+// reconnecting. The first one is reached through the proxy if any.
+func WithJumpHosts(hops []string) Option {
+	return func(t *Tunnel) {
+		t.jumpHosts = append([]string(nil), hops...)
+		if len(t.jumpHosts) == 0 {
+			t.jumpHosts = nil
+		}
+	}
+}
+
+// WithWarnConnections makes the tunnel log a warning and flag itself once it's serving more
+// than n connections at the same time. It doesn't limit the connections. 0 means never warn.
+func WithWarnConnections(n int) Option {
+	return func(t *Tunnel) {
+		t.warnConns = n
+	}
+}
+
+// WithMaxConnectors caps the connections the tunnel tracks at the same time, the new ones
+// beyond it are closed right away and counted, see CappedConnections. It bounds the memory
+// of a tunnel with runaway connections, unlike WithWarnConnections. 0 means no cap.
+func WithMaxConnectors(n int) Option {
+	return func(t *Tunnel) {
+		t.maxConnectors = n
+	}
+}
+
+// WithIdleTimeout closes the connections of the tunnel moving no bytes in either direction for
+// timeout, so that the forgotten ones don't hold the channels of the server. 0 means never.
+func WithIdleTimeout(timeout time.Duration) Option {
+	return func(t *Tunnel) {
+		t.idleTimeout = timeout
+	}
+}
+
+// WithEnv sets the environment variables requested on the sessions of the tunnel, they only
+// take effect if the server accepts them, see AcceptEnv of OpenSSH.
+func WithEnv(env map[string]string) Option {
+	return func(t *Tunnel) {
+		t.env = make(map[string]string, len(env))
+		for k, v := range env {
+			t.env[k] = v
+		}
+	}
+}
+
+// WithDrainTimeout sets the longest time a replaced ssh client is kept for the connections
+// still on it after a soft reconnect, default to 5 minutes.
+func WithDrainTimeout(timeout time.Duration) Option {
+	return func(t *Tunnel) {
+		t.drainTimeout = timeout
+	}
+}
+
+// WithHealthCheckInterval overrides the sshTimeout of NewTunnel, the interval of the health
+// checks, each of which sends a keepalive.
+func WithHealthCheckInterval(interval time.Duration) Option {
+	return func(t *Tunnel) {
+		t.keepaliveInterval = interval
+	}
+}
+
+// WithDialTimeout sets how long connecting to the ssh server may take, including the handshake
+// and the authentication. It's 10 seconds by default, independent of the health checks.
+func WithDialTimeout(timeout time.Duration) Option {
+	return func(t *Tunnel) {
+		t.dialTimeout = timeout
+	}
+}
+
+// MaxJitter is the largest jitter fraction accepted by WithJitter
+const MaxJitter = 0.5
+
+// WithJitter randomizes every health check interval of the tunnel by up to fraction of it, e.g.
+// 0.1 spreads the checks and reconnects over ±10% of the interval, so that the tunnels sharing
+// a server don't reconnect at the same time after it's back. It's capped at MaxJitter, 0 means
+// no jitter, which is the default.
+func WithJitter(fraction float64) Option {
+	return func(t *Tunnel) {
+		switch {
+		case fraction < 0:
+			fraction = 0
+		case fraction > MaxJitter:
+			fraction = MaxJitter
+		}
+		t.jitter = fraction
+	}
+}
+
+// ConnectorHook is called with the connector opened or closed on the tunnel. It's called in the
+// work loop of the tunnel, so it must return quickly and must not call the methods of the tunnel.
+type ConnectorHook func(t *Tunnel, c *Connector, closed bool)
+
+// WithConnectorHook makes the tunnel call hook whenever a connector is opened or closed
+func WithConnectorHook(hook ConnectorHook) Option {
+	return func(t *Tunnel) {
+		t.onConnector = hook
+	}
+}
+
+// WithPendingQueue sets how many local connections are held while the ssh connection is
+// being reconnected and how long each of them waits, the ones beyond size or waiting longer
+// than timeout are closed. Default to 32 connections and 30 seconds.
+func WithPendingQueue(size int, timeout time.Duration) Option {
+	return func(t *Tunnel) {
+		t.pendingSize = size
+		t.pendingTimeout = timeout
+	}
+}
+
+// WithConnectionLimit makes the tunnel refuse new local connections once the tunnels sharing
+// the limit are serving its maximum connections. nil means no limit.
+func WithConnectionLimit(limit *ConnectionLimit) Option {
+	return func(t *Tunnel) {
+		t.connLimit = limit
+	}
+}
+
+// KeepaliveMethod is how a tunnel checks whether its ssh connection is alive
+type KeepaliveMethod string
+
+const (
+	// KeepaliveGlobalRequest sends the keepalive@openssh.com global request, it's the default
+	KeepaliveGlobalRequest KeepaliveMethod = "global"
+
+	// KeepaliveSession opens a session and closes it at once, for the servers answering the
+	// global request unexpectedly
+	KeepaliveSession KeepaliveMethod = "session"
+)
+
+// ParseKeepaliveMethod parses the name of a keepalive method, empty means the default one
+func ParseKeepaliveMethod(name string) (KeepaliveMethod, error) {
+	switch KeepaliveMethod(name) {
+	case "", KeepaliveGlobalRequest:
+		return KeepaliveGlobalRequest, nil
+	case KeepaliveSession:
+		return KeepaliveSession, nil
+	}
+	return "", fmt.Errorf("unknown keepalive method %s, should be %s or %s", name,
+		KeepaliveGlobalRequest, KeepaliveSession)
+}
+
+// WithKeepalive sets how the tunnel checks its ssh connection on every health check. If
+// wantReply is false, the global request only fails when it can't be sent, it doesn't
+// apply to KeepaliveSession whose session is always confirmed by the server.
+func WithKeepalive(method KeepaliveMethod, wantReply bool) Option {
+	return func(t *Tunnel) {
+		t.keepalive = method
+		t.keepaliveReply = wantReply
+	}
+}
+
+// WithMaxKeepaliveMisses makes the tunnel reconnect only after n keepalives failed in a row
+// like the ServerAliveCountMax of OpenSSH, the misses before are only logged. It's 1 by
+// default, i.e. the first failed keepalive reconnects.
+func WithMaxKeepaliveMisses(n int) Option {
+	return func(t *Tunnel) {
+		if n < 1 {
+			n = 1
+		}
+		t.maxKeepaliveMisses = n
+	}
+}
+
+// WithBackends spreads the connections of the tunnel over ForwardTo and the backends by the
+// strategy. A backend failed to dial is skipped until the next health check interval.
+func WithBackends(backends []string, strategy BalanceStrategy) Option {
+	return func(t *Tunnel) {
+		t.backends = append([]string(nil), backends...)
+		t.balance = strategy
+	}
+}
+
+// WithUDP makes the tunnel listen on Local over UDP as well, the datagrams of every client are
+// framed by their length in 2 bytes of big endian into a TCP stream to ForwardTo. A DNS server
+// takes the framing on its TCP port as is, other UDP services need ServeUDPRelay running on the
+// remote to turn the streams back into datagrams. The datagrams sent while the tunnel is
+// reconnecting are dropped.
+func WithUDP() Option {
+	return func(t *Tunnel) {
+		t.udp = true
+	}
+}
+
+// WithReverse makes the tunnel forward the other way like `ssh -R`: it listens on ForwardTo of
+// the ssh server, e.g. :9000 on the loopback or 0.0.0.0:9000 if the server allows GatewayPorts,
+// and forwards the connections to Local. The listener is listened again on every reconnecting.
+func WithReverse() Option {
+	return func(t *Tunnel) {
+		t.reverse = true
+	}
+}
+
+// WithRemoteBind sets the host a reverse tunnel listens on of the ssh server in place of the
+// one of ForwardTo, e.g. 0.0.0.0 for all the interfaces. The loopback is listened if neither
+// gives one. A non-loopback host needs `GatewayPorts clientspecified` in the sshd_config of the
+// server, OpenSSH binds the loopback instead with `GatewayPorts no`, its default.
+func WithRemoteBind(host string) Option {
+	return func(t *Tunnel) {
+		t.remoteBind = host
+	}
+}
@@ -0,0 +1,96 @@
+package ssh
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// testBanner is sent by serveConnect in the same write as the response
+const testBanner = "SSH-2.0-proxied\r\n"
+
+// serveConnect accepts a single CONNECT request, sends a banner right after the response like an
+// ssh server does and echoes the tunneled bytes back
+func serveConnect(t *testing.T, l net.Listener, requests chan<- *http.Request) {
+	conn, err := l.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	req, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	requests <- req
+	if req.Header.Get("Proxy-Authorization") == "" {
+		_, _ = io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+		return
+	}
+	_, _ = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"+testBanner)
+	_, _ = io.Copy(conn, conn)
+}
+
+func TestDialHTTPProxy(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	requests := make(chan *http.Request, 1)
+	go serveConnect(t, l, requests)
+
+	proxy, err := ParseProxy("http://user:pass@" + l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialHTTPProxy(proxy, "ssh.example.com:22", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	req := <-requests
+	if req.Method != http.MethodConnect || req.Host != "ssh.example.com:22" {
+		t.Errorf("unexpected request %s %s", req.Method, req.Host)
+	}
+	if got := req.Header.Get("Proxy-Authorization"); got != "Basic dXNlcjpwYXNz" {
+		t.Errorf("Proxy-Authorization = %q", got)
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	banner := make([]byte, len(testBanner))
+	if _, err := io.ReadFull(conn, banner); err != nil || string(banner) != testBanner {
+		t.Fatalf("expected the banner sent right after the response, got %q, %v", banner, err)
+	}
+	_, _ = conn.Write([]byte("SSH-2.0-test\r\n"))
+	buf := make([]byte, 14)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "SSH-2.0-test\r\n" {
+		t.Errorf("expected the tunneled bytes echoed, got %q, %v", buf, err)
+	}
+}
+
+func TestDialHTTPProxy_Refused(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go serveConnect(t, l, make(chan *http.Request, 1))
+
+	proxy, _ := ParseProxy("http://" + l.Addr().String())
+	if _, err := dialHTTPProxy(proxy, "ssh.example.com:22", time.Second); err == nil {
+		t.Error("expected an error when the proxy refuses to connect")
+	}
+}
+
+func TestParseProxy(t *testing.T) {
+	for _, p := range []string{"socks5://127.0.0.1:1080", "127.0.0.1:3128", "http://"} {
+		if _, err := ParseProxy(p); err == nil {
+			t.Errorf("expected %s to be rejected", p)
+		}
+	}
+}
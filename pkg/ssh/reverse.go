@@ -0,0 +1,181 @@
+package ssh
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"time"
+)
+
+// reverseDialTimeout how long dialing Local for a connection accepted on the ssh server may take
+const reverseDialTimeout = 5 * time.Second
+
+var (
+	errReverseOptions     = errors.New("a reverse tunnel forwards to local, dynamic, udp, probes and backends are not supported")
+	errRemoteListenerLost = errors.New("the listener on the ssh server is lost")
+	errRemoteBindForward  = errors.New("the remote bind is the host a reverse tunnel listens on of the ssh server")
+)
+
+// RemoteBindError is the error of the ssh server refusing to listen on a host other than the
+// loopback for a reverse tunnel, which is usually its GatewayPorts policy
+type RemoteBindError struct {
+	err error
+
+	// Addr the address the tunnel asked the server to listen on
+	Addr string
+}
+
+func (e *RemoteBindError) Error() string {
+	return "the ssh server refused to listen on " + e.Addr + ": " + e.err.Error() +
+		": a non-loopback bind needs `GatewayPorts clientspecified` in the sshd_config of the server"
+}
+
+// Reverse tells whether the tunnel listens on ForwardTo of the ssh server and forwards the
+// connections back to Local, like `ssh -R`
+func (t *Tunnel) Reverse() bool {
+	return t.reverse
+}
+
+// RemoteBind returns the host a reverse tunnel listens on of the ssh server given by
+// WithRemoteBind, it's empty for the host of ForwardTo
+func (t *Tunnel) RemoteBind() string {
+	return t.remoteBind
+}
+
+// remoteAddr is the address listened on the ssh server: ForwardTo with the host replaced by
+// remoteBind if it's given, the loopback if neither has one
+func (t *Tunnel) remoteAddr() string {
+	host, port, err := net.SplitHostPort(t.ForwardTo)
+	if err != nil {
+		return t.ForwardTo
+	}
+	if t.remoteBind != "" {
+		host = t.remoteBind
+	}
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// isLoopback tells whether host is a loopback ip or localhost
+func isLoopback(host string) bool {
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// listenRemote listens on ForwardTo of the ssh server with the current client, the listener of
+// the previous client is dropped. It runs in the work loop.
+func (t *Tunnel) listenRemote() error {
+	if t.listener != nil {
+		_ = t.listener.Close()
+	}
+	addr := t.remoteAddr()
+	l, err := t.sshClient.Listen("tcp", addr)
+	if err != nil {
+		if host, _, _ := net.SplitHostPort(addr); !isLoopback(host) {
+			err = &RemoteBindError{err: err, Addr: addr}
+		}
+		t.log().Warnw("failed to listen on the ssh server", "remote", addr, "error", err)
+		return err
+	}
+	t.log().Debugw("listening on the ssh server", "remote", addr)
+	t.listener = l
+	go t.acceptRemote(l)
+	return nil
+}
+
+// acceptRemote accepts the connections to the listener on the ssh server until it's closed. If
+// it's lost while still in use, the tunnel errors so that the health check reconnects it.
+func (t *Tunnel) acceptRemote(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			_ = t.submit(func() error {
+				if t.listener != l || t.closed() || t.removed() {
+					// replaced by reconnecting or closed on purpose
+					return nil
+				}
+				t.log().Warnw("stopped accepting connections on the ssh server", "remote", t.ForwardTo, "error", err)
+				t.setStatusError(StatusError, errRemoteListenerLost)
+				return nil
+			})
+			return
+		}
+		err = t.submitOr(func() error {
+			if t.removed() || t.listener != l {
+				_ = conn.Close()
+				return nil
+			}
+			_ = t.forwardReverse(l, conn)
+			return nil
+		}, func(error) { _ = conn.Close() })
+		if err != nil {
+			_ = conn.Close()
+			return
+		}
+	}
+}
+
+// forwardReverse takes a slot for the connection accepted on the ssh server, Local is dialed
+// for it out of the work loop so that a slow Local doesn't hold up the other works. The
+// connection is closed if the tunnel can't take it. It runs in the work loop.
+func (t *Tunnel) forwardReverse(l net.Listener, remote net.Conn) error {
+	if t.maxConnectors > 0 && t.connectors.Len() >= t.maxConnectors {
+		if !t.atMaxConnectors {
+			t.log().Warnw("refused the connection, the tunnel is tracking too many connections",
+				"client", remote.RemoteAddr().String(), "max_connectors", t.maxConnectors)
+		}
+		t.atMaxConnectors = true
+		t.mu.Lock()
+		t.cappedConnections++
+		t.mu.Unlock()
+		_ = remote.Close()
+		return errTooManyConnections
+	}
+	t.atMaxConnectors = false
+	if !t.connLimit.acquire() {
+		t.log().Warnw("refused the connection, too many connections",
+			"client", remote.RemoteAddr().String(), "max_connections", t.connLimit.Max())
+		_ = remote.Close()
+		return errTooManyConnections
+	}
+	go t.dialReverse(l, remote, t.Local)
+	return nil
+}
+
+// dialReverse dials local for the connection accepted on the ssh server by l and registers the
+// connector in the work loop, the slot taken by forwardReverse is released if it fails
+func (t *Tunnel) dialReverse(l net.Listener, remote net.Conn, local string) {
+	fail := func(error) {
+		t.connLimit.release()
+		_ = remote.Close()
+	}
+	conn, err := net.DialTimeout("tcp", local, reverseDialTimeout)
+	if err != nil {
+		t.log().Warnw("failed to dial local", "client", remote.RemoteAddr().String(), "local", local, "error", err)
+		fail(err)
+		return
+	}
+	err = t.submitOr(func() error {
+		if t.removed() || t.closed() || t.listener != l || t.sshClient == nil {
+			// closed or reconnected while dialing
+			_ = conn.Close()
+			fail(nil)
+			return nil
+		}
+		cnt := t.newConnector(conn, remote, t.sshClient, local)
+		go cnt.forward()
+		return nil
+	}, func(err error) {
+		_ = conn.Close()
+		fail(err)
+	})
+	if err != nil {
+		_ = conn.Close()
+		fail(err)
+	}
+}
@@ -0,0 +1,180 @@
+package ssh
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTunnel_Reverse(t *testing.T) {
+	server := newTestServer(t)
+	defer server.stop()
+	echo := echoServer(t)
+	defer echo.Close()
+
+	// the port listened by the test server on its loopback
+	remote := freeAddr(t)
+	tn, err := NewTunnel(echo.Addr().String(), "mario@"+server.addr, remote, testKey(t), nil, time.Second,
+		WithHealthCheckInterval(100*time.Millisecond), WithReverse())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := echo.Addr().String() + " <- " + server.addr + " <- " + remote; tn.String() != want {
+		t.Errorf("String() = %s, want %s", tn.String(), want)
+	}
+	go tn.Up()
+	defer tn.Destroy(nil)
+	waitStatus(t, tn, 2*time.Second, isConnected)
+	echoThrough(t, remote)
+
+	// the port is listened again once the ssh connection is back
+	server.stop()
+	server.start()
+	waitStatus(t, tn, 3*time.Second, func(st TunnelStatus) bool {
+		return isConnected(st) && tn.Reconnects() >= 1
+	})
+	echoThrough(t, remote)
+
+	done := make(chan error, 1)
+	tn.Down(done)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if conn, err := net.DialTimeout("tcp", remote, time.Second); err == nil {
+		conn.Close()
+		t.Error("expected the port on the ssh server released once the tunnel is closed")
+	}
+
+	if _, err := NewTunnel(echo.Addr().String(), "mario@"+server.addr, remote, testKey(t), nil, time.Second,
+		WithReverse(), WithUDP()); err != errReverseOptions {
+		t.Errorf("expected udp refused for a reverse tunnel, got %v", err)
+	}
+}
+
+func TestTunnel_ReverseMaxConnectors(t *testing.T) {
+	server := newTestServer(t)
+	defer server.stop()
+	echo := echoServer(t)
+	defer echo.Close()
+
+	remote := freeAddr(t)
+	tn, err := NewTunnel(echo.Addr().String(), "mario@"+server.addr, remote, testKey(t), nil, time.Minute,
+		WithReverse(), WithMaxConnectors(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go tn.Up()
+	defer tn.Destroy(nil)
+	waitStatus(t, tn, 2*time.Second, isConnected)
+
+	// the first connection is dialed to local out of the work loop and tracked
+	held, err := net.Dial("tcp", remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Close()
+	_, _ = held.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	_ = held.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(held, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// those beyond the cap are closed right away
+	for i := 0; i < 2; i++ {
+		refused, err := net.Dial("tcp", remote)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = refused.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if n, err := refused.Read(buf); err == nil {
+			t.Fatalf("the connection beyond the cap should be closed, read %d bytes", n)
+		}
+		refused.Close()
+	}
+	if got := tn.CappedConnections(); got != 2 {
+		t.Errorf("CappedConnections() = %d, want 2", got)
+	}
+	if got := tn.ConnectorCount(); got != 1 {
+		t.Errorf("ConnectorCount() = %d, want 1", got)
+	}
+}
+
+func TestTunnel_RemoteBind(t *testing.T) {
+	server := newTestServer(t)
+	defer server.stop()
+	echo := echoServer(t)
+	defer echo.Close()
+
+	lastBind := func() string {
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		if len(server.binds) == 0 {
+			return ""
+		}
+		return server.binds[len(server.binds)-1]
+	}
+	_, port, _ := net.SplitHostPort(freeAddr(t))
+
+	// the loopback is listened without a host
+	tn, err := NewTunnel(echo.Addr().String(), "mario@"+server.addr, ":"+port, testKey(t), nil, time.Second,
+		WithReverse())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go tn.Up()
+	waitStatus(t, tn, 2*time.Second, isConnected)
+	if got := lastBind(); got != "127.0.0.1" {
+		t.Errorf("expected the loopback bound by default, got %q", got)
+	}
+	echoThrough(t, "127.0.0.1:"+port)
+	tn.Destroy(nil)
+
+	// the server refuses the other hosts without GatewayPorts
+	tn, err = NewTunnel(echo.Addr().String(), "mario@"+server.addr, "127.0.0.1:"+port, testKey(t), nil, time.Second,
+		WithReverse(), WithRemoteBind("0.0.0.0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tn.RemoteBind() != "0.0.0.0" {
+		t.Errorf("RemoteBind() = %s, want 0.0.0.0", tn.RemoteBind())
+	}
+	go tn.Up()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, ok := tn.Error().(*RemoteBindError); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the bind refused, got %v", tn.Error())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if msg := tn.Error().Error(); !strings.Contains(msg, "0.0.0.0:"+port) || !strings.Contains(msg, "GatewayPorts") {
+		t.Errorf("expected the address and GatewayPorts in the error, got %s", msg)
+	}
+	tn.Destroy(nil)
+
+	server.mu.Lock()
+	server.gatewayPorts = true
+	server.mu.Unlock()
+	tn, err = NewTunnel(echo.Addr().String(), "mario@"+server.addr, ":"+port, testKey(t), nil, time.Second,
+		WithReverse(), WithRemoteBind("0.0.0.0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go tn.Up()
+	defer tn.Destroy(nil)
+	waitStatus(t, tn, 2*time.Second, isConnected)
+	if got := lastBind(); got != "0.0.0.0" {
+		t.Errorf("expected 0.0.0.0 bound, got %q", got)
+	}
+
+	if _, err := NewTunnel(freeAddr(t), "mario@"+server.addr, "127.0.0.1:1", testKey(t), nil, time.Second,
+		WithRemoteBind("0.0.0.0")); err != errRemoteBindForward {
+		t.Errorf("expected the remote bind refused for a forward tunnel, got %v", err)
+	}
+}
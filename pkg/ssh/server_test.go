@@ -0,0 +1,379 @@
+package ssh
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	sh "golang.org/x/crypto/ssh"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testServer is an in-process ssh server accepting any public key except for the user
+// `denied`, it serves direct-tcpip
+// channels by dialing the targets, listens for tcpip-forward requests on the loopback and
+// replies to all the other global requests. Session channels
+// only accept the environment variables in acceptEnv.
+type testServer struct {
+	t *testing.T
+
+	mu sync.Mutex
+
+	acceptEnv map[string]bool
+
+	// env the environment variables accepted on sessions
+	env map[string]string
+
+	addr string
+
+	config *sh.ServerConfig
+
+	listener net.Listener
+
+	conns []net.Conn
+
+	// clients the number of ssh connections being served
+	clients int
+
+	// gatewayPorts whether tcpip-forward requests for the other hosts than the loopback are
+	// accepted, binds the hosts requested
+	gatewayPorts bool
+	binds        []string
+}
+
+// testOTP is the answer to the keyboard-interactive question of the test server
+const testOTP = "123456"
+
+// testPassword is the password the test server accepts
+const testPassword = "its-a-me"
+
+func newTestServer(t *testing.T) *testServer {
+	hostKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := sh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &sh.ServerConfig{
+		PublicKeyCallback: func(conn sh.ConnMetadata, key sh.PublicKey) (*sh.Permissions, error) {
+			if conn.User() == "denied" {
+				return nil, errors.New("permission denied")
+			}
+			return nil, nil
+		},
+		PasswordCallback: func(conn sh.ConnMetadata, password []byte) (*sh.Permissions, error) {
+			if string(password) != testPassword {
+				return nil, errors.New("wrong password")
+			}
+			return nil, nil
+		},
+		// the users without a key answer testOTP instead
+		KeyboardInteractiveCallback: func(conn sh.ConnMetadata, challenge sh.KeyboardInteractiveChallenge) (*sh.Permissions, error) {
+			answers, err := challenge(conn.User(), "two-factor authentication", []string{"OTP: "}, []bool{false})
+			if err != nil {
+				return nil, err
+			}
+			if len(answers) != 1 || answers[0] != testOTP {
+				return nil, errors.New("wrong code")
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(signer)
+	s := &testServer{
+		t:         t,
+		addr:      "127.0.0.1:0",
+		config:    config,
+		acceptEnv: make(map[string]bool),
+		env:       make(map[string]string),
+	}
+	s.start()
+	return s
+}
+
+// start listens on the address of the server, a stopped server is restarted on the same address
+func (s *testServer) start() {
+	l, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	s.mu.Lock()
+	s.listener = l
+	s.addr = l.Addr().String()
+	s.mu.Unlock()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns = append(s.conns, conn)
+			s.mu.Unlock()
+			go s.serve(conn)
+		}
+	}()
+}
+
+// stop closes the listener and drops all the ssh connections
+func (s *testServer) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_ = s.listener.Close()
+	for _, c := range s.conns {
+		_ = c.Close()
+	}
+	s.conns = nil
+}
+
+// waitClients waits until the server is serving n ssh connections
+func (s *testServer) waitClients(n int, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for {
+		s.mu.Lock()
+		clients := s.clients
+		s.mu.Unlock()
+		if clients == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			s.t.Fatalf("the server is serving %d ssh connections, want %d", clients, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (s *testServer) serve(conn net.Conn) {
+	sconn, chans, reqs, err := sh.NewServerConn(conn, s.config)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	s.clients++
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.clients--
+		s.mu.Unlock()
+	}()
+	go func() {
+		// the listeners of tcpip-forward by their addresses, they go away with the connection
+		forwards := make(map[string]net.Listener)
+		defer func() {
+			for _, l := range forwards {
+				_ = l.Close()
+			}
+		}()
+		for req := range reqs {
+			switch req.Type {
+			case "tcpip-forward":
+				s.remoteForward(sconn, req, forwards)
+				continue
+			case "cancel-tcpip-forward":
+				var bind struct {
+					Addr string
+					Port uint32
+				}
+				if sh.Unmarshal(req.Payload, &bind) == nil {
+					addr := net.JoinHostPort(bind.Addr, strconv.Itoa(int(bind.Port)))
+					if l, ok := forwards[addr]; ok {
+						_ = l.Close()
+						delete(forwards, addr)
+					}
+				}
+			}
+			if req.WantReply {
+				_ = req.Reply(true, nil)
+			}
+		}
+	}()
+	for nc := range chans {
+		switch nc.ChannelType() {
+		case "direct-tcpip":
+			go s.forward(nc)
+		case "session":
+			go s.session(nc)
+		default:
+			_ = nc.Reject(sh.UnknownChannelType, "unsupported channel type")
+		}
+	}
+}
+
+func (s *testServer) session(nc sh.NewChannel) {
+	ch, reqs, err := nc.Accept()
+	if err != nil {
+		return
+	}
+	defer ch.Close()
+	for req := range reqs {
+		ok := false
+		if req.Type == "env" {
+			var kv struct{ Name, Value string }
+			if err := sh.Unmarshal(req.Payload, &kv); err == nil {
+				s.mu.Lock()
+				if ok = s.acceptEnv[kv.Name]; ok {
+					s.env[kv.Name] = kv.Value
+				}
+				s.mu.Unlock()
+			}
+		}
+		if req.WantReply {
+			_ = req.Reply(ok, nil)
+		}
+	}
+}
+
+func (s *testServer) forward(nc sh.NewChannel) {
+	// the payload of direct-tcpip: host, port, origin host, origin port
+	payload := nc.ExtraData()
+	size := binary.BigEndian.Uint32(payload)
+	host := string(payload[4 : 4+size])
+	port := binary.BigEndian.Uint32(payload[4+size:])
+	target, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+	if err != nil {
+		_ = nc.Reject(sh.ConnectionFailed, err.Error())
+		return
+	}
+	ch, reqs, err := nc.Accept()
+	if err != nil {
+		_ = target.Close()
+		return
+	}
+	go sh.DiscardRequests(reqs)
+	go func() {
+		_, _ = io.Copy(ch, target)
+		_ = ch.Close()
+	}()
+	_, _ = io.Copy(target, ch)
+	_ = target.Close()
+}
+
+// remoteForward listens on the port of the tcpip-forward request on the loopback and opens a
+// forwarded-tcpip channel to the client for every connection accepted. The other hosts are
+// refused unless gatewayPorts.
+func (s *testServer) remoteForward(conn *sh.ServerConn, req *sh.Request, forwards map[string]net.Listener) {
+	var bind struct {
+		Addr string
+		Port uint32
+	}
+	if err := sh.Unmarshal(req.Payload, &bind); err != nil {
+		_ = req.Reply(false, nil)
+		return
+	}
+	s.mu.Lock()
+	s.binds = append(s.binds, bind.Addr)
+	refused := !s.gatewayPorts && !isLoopback(bind.Addr)
+	s.mu.Unlock()
+	if refused {
+		_ = req.Reply(false, nil)
+		return
+	}
+	l, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(bind.Port))))
+	if err != nil {
+		_ = req.Reply(false, nil)
+		return
+	}
+	port := uint32(l.Addr().(*net.TCPAddr).Port)
+	forwards[net.JoinHostPort(bind.Addr, strconv.Itoa(int(port)))] = l
+	_ = req.Reply(true, sh.Marshal(struct{ Port uint32 }{port}))
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			origin := c.RemoteAddr().(*net.TCPAddr)
+			payload := sh.Marshal(struct {
+				Addr       string
+				Port       uint32
+				OriginAddr string
+				OriginPort uint32
+			}{bind.Addr, port, origin.IP.String(), uint32(origin.Port)})
+			ch, reqs, err := conn.OpenChannel("forwarded-tcpip", payload)
+			if err != nil {
+				_ = c.Close()
+				continue
+			}
+			go sh.DiscardRequests(reqs)
+			go func() {
+				_, _ = io.Copy(ch, c)
+				_ = ch.CloseWrite()
+			}()
+			go func() {
+				_, _ = io.Copy(c, ch)
+				_ = c.Close()
+			}()
+		}
+	}()
+}
+
+// testKey returns a private key in PEM for tunnels to authenticate with
+func testKey(t *testing.T) *bytes.Buffer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.NewBuffer(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+}
+
+// echoServer echoes whatever it receives
+func echoServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(conn, conn)
+				_ = conn.Close()
+			}()
+		}
+	}()
+	return l
+}
+
+// freeAddr returns a local address that is free to listen on
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// waitStatus waits until the status of the tunnel satisfies ok
+func waitStatus(t *testing.T, tn *Tunnel, timeout time.Duration, ok func(TunnelStatus) bool) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if ok(tn.Status()) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("unexpected status %b after %s", tn.Status(), timeout)
+}
+
+func isConnected(st TunnelStatus) bool {
+	return st&StatusConnected == StatusConnected && st&StatusError != StatusError
+}
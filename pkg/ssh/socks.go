@@ -0,0 +1,146 @@
+package ssh
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// SocksHandshakeTimeout is how long a SOCKS5 client has to send its request
+const SocksHandshakeTimeout = 10 * time.Second
+
+const socksVersion = 5
+
+// reply codes of a SOCKS5 request, see RFC 1928
+const (
+	SocksSucceeded           = byte(0)
+	SocksGeneralFailure      = byte(1)
+	SocksNotAllowed          = byte(2)
+	SocksNetworkUnreachable  = byte(3)
+	SocksHostUnreachable     = byte(4)
+	SocksCommandNotSupported = byte(7)
+	SocksAddressNotSupported = byte(8)
+)
+
+const (
+	socksNoAuth       = byte(0)
+	socksNoAcceptable = byte(0xff)
+	socksConnect      = byte(1)
+	socksIPv4         = byte(1)
+	socksDomain       = byte(3)
+	socksIPv6         = byte(4)
+)
+
+var (
+	errSocksVersion = errors.New("unsupported socks version")
+	errSocksAuth    = errors.New("no acceptable socks authentication method")
+	errSocksCommand = errors.New("only socks CONNECT command is supported")
+	errSocksAddress = errors.New("unsupported socks address type")
+)
+
+// ReadSocksRequest negotiates with a SOCKS5 client on conn and reads its CONNECT request,
+// the requested target is returned in form of "host:port". Only the no authentication
+// method is supported. The client is answered if the request is unsupported, otherwise the
+// caller should reply it with WriteSocksReply.
+func ReadSocksRequest(conn net.Conn) (target string, err error) {
+	// greeting: VER NMETHODS METHODS...
+	header := make([]byte, 2)
+	if _, err = io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+	if header[0] != socksVersion {
+		return "", errSocksVersion
+	}
+	methods := make([]byte, header[1])
+	if _, err = io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+	method := socksNoAcceptable
+	for _, m := range methods {
+		if m == socksNoAuth {
+			method = socksNoAuth
+			break
+		}
+	}
+	if _, err = conn.Write([]byte{socksVersion, method}); err != nil {
+		return "", err
+	}
+	if method == socksNoAcceptable {
+		return "", errSocksAuth
+	}
+
+	// request: VER CMD RSV ATYP DST.ADDR DST.PORT
+	req := make([]byte, 4)
+	if _, err = io.ReadFull(conn, req); err != nil {
+		return "", err
+	}
+	if req[0] != socksVersion {
+		return "", errSocksVersion
+	}
+
+	var host string
+	switch req[3] {
+	case socksIPv4, socksIPv6:
+		size := net.IPv4len
+		if req[3] == socksIPv6 {
+			size = net.IPv6len
+		}
+		ip := make(net.IP, size)
+		if _, err = io.ReadFull(conn, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socksDomain:
+		size := make([]byte, 1)
+		if _, err = io.ReadFull(conn, size); err != nil {
+			return "", err
+		}
+		domain := make([]byte, size[0])
+		if _, err = io.ReadFull(conn, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		_ = WriteSocksReply(conn, SocksAddressNotSupported)
+		return "", errSocksAddress
+	}
+
+	port := make([]byte, 2)
+	if _, err = io.ReadFull(conn, port); err != nil {
+		return "", err
+	}
+	if req[1] != socksConnect {
+		_ = WriteSocksReply(conn, SocksCommandNotSupported)
+		return "", errSocksCommand
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// WriteSocksReply answers the SOCKS5 request with the reply code, the bound address is
+// always reported as 0.0.0.0:0
+func WriteSocksReply(conn net.Conn, code byte) error {
+	_, err := conn.Write([]byte{socksVersion, code, 0, socksIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// serveSocks reads the SOCKS5 request of a client of the dynamic tunnel and forwards it to the
+// requested destination, the client is answered once the destination is dialed
+func (t *Tunnel) serveSocks(conn net.Conn) {
+	_ = conn.SetDeadline(time.Now().Add(SocksHandshakeTimeout))
+	target, err := ReadSocksRequest(conn)
+	if err != nil {
+		t.log().Debugw("bad socks request", "client", conn.RemoteAddr().String(), "error", err)
+		_ = conn.Close()
+		return
+	}
+	_ = conn.SetDeadline(time.Time{})
+	_ = t.Forward(conn, target, func(err error) error {
+		if err != nil {
+			return WriteSocksReply(conn, SocksHostUnreachable)
+		}
+		return WriteSocksReply(conn, SocksSucceeded)
+	})
+}
@@ -0,0 +1,136 @@
+package ssh
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReadSocksRequest(t *testing.T) {
+	cases := []struct {
+		name   string
+		req    []byte
+		target string
+	}{
+		{"ipv4", []byte{5, 1, 0, 5, 1, 0, 1, 10, 0, 0, 1, 0, 80}, "10.0.0.1:80"},
+		{"domain", []byte{5, 1, 0, 5, 1, 0, 3, 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 1, 187}, "example:443"},
+		{"ipv6", append([]byte{5, 1, 0, 5, 1, 0, 4}, append(net.ParseIP("fd00::1"), 0, 22)...), "[fd00::1]:22"},
+	}
+	for _, c := range cases {
+		client, server := net.Pipe()
+		go func() {
+			_, _ = client.Write(c.req)
+		}()
+		answered := make(chan []byte, 1)
+		go func() {
+			buf := make([]byte, 2)
+			_, _ = client.Read(buf)
+			answered <- buf
+		}()
+		target, err := ReadSocksRequest(server)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.name, err)
+		}
+		if target != c.target {
+			t.Errorf("%s: target = %s, want %s", c.name, target, c.target)
+		}
+		if got := <-answered; !bytes.Equal(got, []byte{5, 0}) {
+			t.Errorf("%s: method selection = %v, want [5 0]", c.name, got)
+		}
+		_ = client.Close()
+		_ = server.Close()
+	}
+}
+
+func TestReadSocksRequest_NoAcceptableAuth(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		// only username/password offered
+		_, _ = client.Write([]byte{5, 1, 2})
+	}()
+	answered := make(chan []byte, 1)
+	go func() {
+		buf := make([]byte, 2)
+		_, _ = client.Read(buf)
+		answered <- buf
+		_ = server.Close()
+	}()
+	if _, err := ReadSocksRequest(server); err != errSocksAuth {
+		t.Errorf("expected errSocksAuth, got %v", err)
+	}
+	if got := <-answered; !bytes.Equal(got, []byte{5, 0xff}) {
+		t.Errorf("method selection = %v, want [5 255]", got)
+	}
+}
+
+// dialSocks asks the SOCKS5 proxy at proxy to connect to the IPv4 target, the reply code
+// is returned with the connection
+func dialSocks(t *testing.T, proxy string, target *net.TCPAddr) (net.Conn, byte) {
+	conn, err := net.DialTimeout("tcp", proxy, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+	req := append([]byte{5, 1, 0, 5, 1, 0, 1}, target.IP.To4()...)
+	req = append(req, 0, 0)
+	binary.BigEndian.PutUint16(req[len(req)-2:], uint16(target.Port))
+	if _, err := conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	// method selection, then the reply with the bound address
+	reply := make([]byte, 2+10)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	return conn, reply[3]
+}
+
+func TestTunnel_Dynamic(t *testing.T) {
+	server := newTestServer(t)
+	defer server.stop()
+	echo := echoServer(t)
+	defer echo.Close()
+
+	local := freeAddr(t)
+	tn, err := NewTunnel(local, "mario@"+server.addr, "", testKey(t), nil, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tn.Dynamic() || tn.String() != local+" -> "+server.addr+" -> socks5" {
+		t.Errorf("unexpected SOCKS5 tunnel %s", tn.String())
+	}
+	go tn.Up()
+	defer tn.Destroy(nil)
+	waitStatus(t, tn, 2*time.Second, isConnected)
+
+	conn, code := dialSocks(t, local, echo.Addr().(*net.TCPAddr))
+	defer conn.Close()
+	if code != SocksSucceeded {
+		t.Fatalf("expected the destination connected, got reply %d", code)
+	}
+	if _, err := conn.Write([]byte("mario")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "mario" {
+		t.Errorf("expected the echo through the SOCKS5 tunnel, got %q, error: %v", buf, err)
+	}
+
+	// the destinations failing to dial are answered
+	closed := echoServer(t)
+	addr := closed.Addr().(*net.TCPAddr)
+	closed.Close()
+	refused, code := dialSocks(t, local, addr)
+	defer refused.Close()
+	if code != SocksHostUnreachable {
+		t.Errorf("expected the host unreachable, got reply %d", code)
+	}
+
+	if _, err := NewTunnel(freeAddr(t), "mario@"+server.addr, "", testKey(t), nil, time.Second, WithUDP()); err != errDynamicRemote {
+		t.Errorf("expected udp refused without a remote, got %v", err)
+	}
+}
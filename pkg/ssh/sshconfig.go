@@ -0,0 +1,239 @@
+package ssh
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// HostConfig is what an ssh_config file says about a host, the fields not set are empty
+type HostConfig struct {
+	HostName string
+
+	User string
+
+	Port string
+
+	// IdentityFiles the private keys to try, in order
+	IdentityFiles []string
+
+	// ProxyJump the jump hosts to reach the host through, e.g. user@bastion:22,other
+	ProxyJump string
+
+	// IdentityAgent the socket of the ssh agent to authenticate with, SSH_AUTH_SOCK and the
+	// environment variables like $XDG_RUNTIME_DIR are expanded. "none" disables the agent
+	IdentityAgent string
+}
+
+// SSHConfig is the Host blocks of an ssh_config file like ~/.ssh/config of OpenSSH. Only the
+// options mario understands are kept: HostName, User, Port, IdentityFile, ProxyJump and
+// IdentityAgent.
+type SSHConfig struct {
+	blocks []*hostBlock
+}
+
+type hostBlock struct {
+	// patterns the patterns of Host, nil for the options before the first Host which apply
+	// to all the hosts
+	patterns []string
+
+	options []hostOption
+}
+
+type hostOption struct {
+	// key the lower cased keyword
+	key string
+
+	value string
+}
+
+// DefaultSSHConfigPath returns the ssh_config of the user, i.e. ~/.ssh/config
+func DefaultSSHConfigPath() string {
+	return path.Join(homeDir(), ".ssh", "config")
+}
+
+// LoadSSHConfig reads the ssh_config file, a file not existing is an empty config
+func LoadSSHConfig(path string) (*SSHConfig, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return &SSHConfig{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseSSHConfig(f)
+}
+
+// ParseSSHConfig parses the content of an ssh_config file. The Match blocks are skipped, and
+// so are the options mario doesn't understand.
+func ParseSSHConfig(r io.Reader) (*SSHConfig, error) {
+	c := &SSHConfig{}
+	block := &hostBlock{}
+	c.blocks = append(c.blocks, block)
+	skipping := false
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value := splitOption(line)
+		switch key {
+		case "host":
+			block = &hostBlock{patterns: strings.Fields(value)}
+			c.blocks = append(c.blocks, block)
+			skipping = false
+			continue
+		case "match":
+			skipping = true
+			continue
+		}
+		if skipping {
+			continue
+		}
+		switch key {
+		case "hostname", "user", "port", "identityfile", "proxyjump", "identityagent":
+			block.options = append(block.options, hostOption{key: key, value: value})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// splitOption splits a line into the lower cased keyword and the value, they are separated by
+// spaces or an equal sign. The quotes around the value are removed.
+func splitOption(line string) (key, value string) {
+	i := strings.IndexAny(line, " \t=")
+	if i < 0 {
+		return strings.ToLower(line), ""
+	}
+	key, value = strings.ToLower(line[:i]), strings.TrimSpace(line[i:])
+	value = strings.TrimSpace(strings.TrimPrefix(value, "="))
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		value = value[1 : len(value)-1]
+	}
+	return key, value
+}
+
+// matches tells whether the block applies to the host, a negated pattern matching excludes it
+func (b *hostBlock) matches(host string) bool {
+	if b.patterns == nil {
+		return true
+	}
+	matched := false
+	for _, p := range b.patterns {
+		negated := strings.HasPrefix(p, "!")
+		if ok, _ := path.Match(strings.TrimPrefix(p, "!"), host); ok {
+			if negated {
+				return false
+			}
+			matched = true
+		}
+	}
+	return matched
+}
+
+// Lookup returns the settings of the host like ssh does: the first value of an option among the
+// blocks matching the host wins, while the identity files add up
+func (c *SSHConfig) Lookup(host string) *HostConfig {
+	hc := &HostConfig{}
+	for _, b := range c.blocks {
+		if !b.matches(host) {
+			continue
+		}
+		for _, o := range b.options {
+			switch o.key {
+			case "hostname":
+				if hc.HostName == "" {
+					hc.HostName = strings.Replace(o.value, "%h", host, -1)
+				}
+			case "user":
+				if hc.User == "" {
+					hc.User = o.value
+				}
+			case "port":
+				if hc.Port == "" {
+					hc.Port = o.value
+				}
+			case "identityfile":
+				hc.IdentityFiles = append(hc.IdentityFiles, expandHome(o.value))
+			case "proxyjump":
+				if hc.ProxyJump == "" {
+					hc.ProxyJump = o.value
+				}
+			case "identityagent":
+				if hc.IdentityAgent == "" {
+					hc.IdentityAgent = expandAgent(o.value)
+				}
+			}
+		}
+	}
+	return hc
+}
+
+// Resolve expands the ssh server in form of [user@]host[:port] with the settings of the host,
+// the user and the port given in server win over those of the config. The settings found are
+// returned too, the server is returned as is if the config has nothing for it.
+func (c *SSHConfig) Resolve(server string) (string, *HostConfig) {
+	userName, host := "", server
+	if i := strings.LastIndex(server, "@"); i >= 0 {
+		userName, host = server[:i], server[i+1:]
+	}
+	port := ""
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		host, port = h, p
+	}
+	hc := c.Lookup(host)
+	if userName == "" {
+		userName = hc.User
+	}
+	if port == "" {
+		port = hc.Port
+	}
+	if hc.HostName != "" {
+		host = hc.HostName
+	}
+	resolved := host
+	if port != "" {
+		resolved = net.JoinHostPort(host, port)
+	}
+	if userName != "" {
+		resolved = userName + "@" + resolved
+	}
+	return resolved, hc
+}
+
+// expandHome replaces the leading ~ and %d of ssh_config with the home directory
+func expandHome(p string) string {
+	if p == "~" || strings.HasPrefix(p, "~/") {
+		return filepath.Join(homeDir(), p[1:])
+	}
+	return strings.Replace(p, "%d", homeDir(), -1)
+}
+
+// expandAgent expands the IdentityAgent of ssh_config like ssh does: SSH_AUTH_SOCK is the agent
+// of the environment, the environment variables and the leading ~ are replaced
+func expandAgent(p string) string {
+	if p == "SSH_AUTH_SOCK" {
+		return EnvAgentSocket()
+	}
+	if p == "none" {
+		return p
+	}
+	return expandHome(os.ExpandEnv(p))
+}
+
+func homeDir() string {
+	if u, err := user.Current(); err == nil {
+		return u.HomeDir
+	}
+	return os.Getenv("HOME")
+}
@@ -0,0 +1,133 @@
+package ssh
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testSSHConfig = `
+# the defaults
+IdentityFile ~/.ssh/id_ed25519
+
+Host db prod-*
+	HostName %h.corp.example.com
+	User mario
+	Port 2222
+	IdentityFile ~/.ssh/prod
+
+Host prod-* !prod-legacy
+	ProxyJump bastion@gate.example.com
+	User luigi
+
+Match host legacy
+	User peach
+
+Host = bastion
+	HostName="10.0.0.1"
+
+Host *
+	Port 22
+`
+
+func TestSSHConfig_Lookup(t *testing.T) {
+	cfg, err := ParseSSHConfig(strings.NewReader(testSSHConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	home := homeDir()
+	cases := []struct {
+		host string
+		want HostConfig
+	}{
+		{"db", HostConfig{HostName: "db.corp.example.com", User: "mario", Port: "2222",
+			IdentityFiles: []string{filepath.Join(home, ".ssh/id_ed25519"), filepath.Join(home, ".ssh/prod")}}},
+		// the first value wins
+		{"prod-web", HostConfig{HostName: "prod-web.corp.example.com", User: "mario", Port: "2222",
+			IdentityFiles: []string{filepath.Join(home, ".ssh/id_ed25519"), filepath.Join(home, ".ssh/prod")},
+			ProxyJump:     "bastion@gate.example.com"}},
+		// excluded by the negated pattern
+		{"prod-legacy", HostConfig{HostName: "prod-legacy.corp.example.com", User: "mario", Port: "2222",
+			IdentityFiles: []string{filepath.Join(home, ".ssh/id_ed25519"), filepath.Join(home, ".ssh/prod")}}},
+		{"bastion", HostConfig{HostName: "10.0.0.1", Port: "22",
+			IdentityFiles: []string{filepath.Join(home, ".ssh/id_ed25519")}}},
+		{"legacy", HostConfig{Port: "22", IdentityFiles: []string{filepath.Join(home, ".ssh/id_ed25519")}}},
+	}
+	for _, c := range cases {
+		if got := cfg.Lookup(c.host); !reflect.DeepEqual(*got, c.want) {
+			t.Errorf("Lookup(%s) = %+v, want %+v", c.host, *got, c.want)
+		}
+	}
+}
+
+func TestSSHConfig_Resolve(t *testing.T) {
+	cfg, err := ParseSSHConfig(strings.NewReader(testSSHConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		server, want string
+	}{
+		{"db", "mario@db.corp.example.com:2222"},
+		// the user and the port given win
+		{"yoshi@db:22", "yoshi@db.corp.example.com:22"},
+		{"unknown.example.com", "unknown.example.com:22"},
+		{"toad@[fe80::1]:2200", "toad@[fe80::1]:2200"},
+	}
+	for _, c := range cases {
+		if got, _ := cfg.Resolve(c.server); got != c.want {
+			t.Errorf("Resolve(%s) = %s, want %s", c.server, got, c.want)
+		}
+	}
+
+	empty, err := LoadSSHConfig(filepath.Join(t.Name(), "missing"))
+	if err != nil {
+		t.Fatalf("expected a missing ssh_config to be empty, got %v", err)
+	}
+	if got, _ := empty.Resolve("mario@host"); got != "mario@host" {
+		t.Errorf("expected the server unchanged without a config, got %s", got)
+	}
+}
+
+func TestSSHConfig_IdentityAgent(t *testing.T) {
+	defer os.Setenv("SSH_AUTH_SOCK", os.Getenv("SSH_AUTH_SOCK"))
+	os.Setenv("SSH_AUTH_SOCK", "/tmp/ssh-agent.sock")
+	defer os.Setenv("MARIO_AGENT_DIR", os.Getenv("MARIO_AGENT_DIR"))
+	os.Setenv("MARIO_AGENT_DIR", "/run/agents")
+	cfg, err := ParseSSHConfig(strings.NewReader(`
+Host env
+	IdentityAgent SSH_AUTH_SOCK
+
+Host var
+	IdentityAgent $MARIO_AGENT_DIR/agent.sock
+
+Host home
+	IdentityAgent ~/.1password/agent.sock
+
+Host off
+	IdentityAgent none
+
+Host *
+	IdentityAgent "/var/run/default.sock"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		host, want string
+	}{
+		{"env", "/tmp/ssh-agent.sock"},
+		{"var", "/run/agents/agent.sock"},
+		{"home", filepath.Join(homeDir(), ".1password/agent.sock")},
+		{"off", "none"},
+		// the first value wins
+		{"other", "/var/run/default.sock"},
+	}
+	for _, c := range cases {
+		if got := cfg.Lookup(c.host).IdentityAgent; got != c.want {
+			t.Errorf("Lookup(%s).IdentityAgent = %s, want %s", c.host, got, c.want)
+		}
+	}
+}
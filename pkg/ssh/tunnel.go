@@ -2,14 +2,20 @@ package ssh
 
 import (
 	"bytes"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"github.com/google/btree"
+	"go.uber.org/zap"
 	sh "golang.org/x/crypto/ssh"
 	"io"
+	"math/rand"
 	"net"
+	"net/url"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -30,29 +36,124 @@ const (
 	StatusError = TunnelStatus(1 << 16)
 	// the tunnel has been shutdown and removed
 	StatusRemoved = TunnelStatus(1 << 17)
+	// the tunnel gave up reconnecting because retrying won't help, e.g. the ssh server
+	// rejected the credentials. It can be retried manually.
+	StatusFailed = TunnelStatus(1 << 18)
+)
+
+// maxFdBackoff caps the retry interval after running out of file descriptors to
+// 2^maxFdBackoff health check intervals
+const maxFdBackoff = 4
+
+// closedHistory is how many recently closed connectors a tunnel keeps
+const closedHistory = 20
+
+// defaultDrainTimeout is how long a replaced ssh client is kept for its connectors
+// to finish after a soft reconnect
+const defaultDrainTimeout = 5 * time.Minute
+
+const (
+	// defaultPendingSize is the most local connections held while reconnecting
+	defaultPendingSize = 32
+
+	// defaultPendingTimeout is how long a held local connection waits for the reconnecting
+	defaultPendingTimeout = 30 * time.Second
+
+	// defaultDialTimeout is how long connecting to the ssh server may take by default
+	defaultDialTimeout = 10 * time.Second
+
+	// defaultSSHPort the port of the ssh servers given without one
+	defaultSSHPort = "22"
 )
 
 var (
-	errInvalidLocalAddr = errors.New("invalid local listening address")
-	errAnonymous        = errors.New("user not specified")
-	errMissedPort       = errors.New("remote port not specified")
-	errRemoteLost       = errors.New("remote connection lost")
+	errInvalidLocalAddr   = errors.New("invalid local listening address")
+	errAnonymous          = errors.New("user not specified")
+	errMissedPort         = errors.New("remote port not specified")
+	errInvalidServerAddr  = errors.New("invalid ssh server address, an IPv6 host with a port should be in brackets")
+	errDynamicRemote      = errors.New("a SOCKS5 tunnel has no fixed remote for udp, probes or backends")
+	errRemoteLost         = errors.New("remote connection lost")
+	errNotConnected       = errors.New("tunnel is not connected")
+	errTooManyConnections = errors.New("too many connections")
+	errTunnelRemoved      = errors.New("tunnel is removed")
+	errNotRunning         = errors.New("tunnel is not running")
 )
 
+// ErrNoAuth is returned by NewTunnel if the tunnel has no way to authenticate
+var ErrNoAuth = errors.New("neither a private key, an ssh agent, a password, a keyboard-interactive challenge nor an auth callback is provided")
+
 type TunnelStatus int
 type tunnelHandler func(*Tunnel)
 
+// AuthError is returned when the ssh server rejects the credentials of the tunnel,
+// retrying with the same credentials will not succeed.
+type AuthError struct {
+	err error
+}
+
+func (e *AuthError) Error() string {
+	return "authentication failed: " + e.err.Error()
+}
+
+// classifyDialError tells authentication failures from the other errors of sh.Dial
+func classifyDialError(err error) error {
+	if err != nil && strings.Contains(err.Error(), "unable to authenticate") {
+		return &AuthError{err: err}
+	}
+	if isFdExhausted(err) {
+		return newFdExhaustedError(err)
+	}
+	return err
+}
+
+// nopLogger logs nothing, it's the logger of a tunnel by default
+var nopLogger = zap.NewNop().Sugar()
+
 // Connector a Connector represents a pair of tunneled connections
 type Connector struct {
+	// bytesIn and bytesOut the bytes copied from the remote to the client and from the client
+	// to the remote, updated atomically by the copies. They come first to be 64-bit aligned.
+	bytesIn  uint64
+	bytesOut uint64
+
+	// lastActive when the connection last moved bytes in unix nanoseconds, updated atomically
+	lastActive int64
+
 	counter    uint64
 	openedAt   time.Time
 	tunnel     *Tunnel
 	localConn  net.Conn
 	remoteConn net.Conn
+	// client is the ssh client which the remote connection belongs to
+	client *sh.Client
+	// target is the address dialed through the ssh server
+	target string
+
+	closeMu sync.Mutex
+	// closeReason why this connection was closed, the first reason recorded wins
+	closeReason string
+	closedAt    time.Time
 }
 
 func (c *Connector) String() string {
-	return c.localConn.RemoteAddr().String() + "->" + c.tunnel.String()
+	return c.localConn.RemoteAddr().String() + "->" + c.tunnel.String() +
+		" (in " + strconv.FormatUint(c.BytesIn(), 10) + "B, out " + strconv.FormatUint(c.BytesOut(), 10) + "B)"
+}
+
+// Client returns the address of the local client of this connection
+func (c *Connector) Client() string {
+	return c.localConn.RemoteAddr().String()
+}
+
+// Target returns the remote address this connection was dialed to through the ssh server
+func (c *Connector) Target() string {
+	return c.target
+}
+
+// Via returns the ssh server this connection goes through
+func (c *Connector) Via() string {
+	_, server, _ := c.tunnel.Addresses()
+	return server
 }
 
 func (c *Connector) ID() uint64 {
@@ -72,23 +173,102 @@ func (c *Connector) OpenedAt() time.Time {
 	return c.openedAt
 }
 
+// LastActive returns when the connection moved bytes last time, or when it was opened
+func (c *Connector) LastActive() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&c.lastActive))
+}
+
+// BytesIn returns the bytes received from the remote and sent to the client so far
+func (c *Connector) BytesIn() uint64 {
+	return atomic.LoadUint64(&c.bytesIn)
+}
+
+// BytesOut returns the bytes sent by the client to the remote so far
+func (c *Connector) BytesOut() uint64 {
+	return atomic.LoadUint64(&c.bytesOut)
+}
+
+// CloseReason returns why the connection was closed, it's empty if it's still open
+func (c *Connector) CloseReason() string {
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+	return c.closeReason
+}
+
+// ClosedAt returns when the connection was closed, it's zero if it's still open
+func (c *Connector) ClosedAt() time.Time {
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+	return c.closedAt
+}
+
+// setCloseReason records the reason unless the connection is already closed for another one
+func (c *Connector) setCloseReason(reason string) {
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+	if c.closeReason == "" {
+		c.closeReason = reason
+		c.closedAt = time.Now()
+	}
+}
+
+// closeReason describes why copying from side stopped with err. An io.EOF is not an
+// error that will be returned from io.Copy, so a nil err means side closed the connection.
+func closeReason(side string, err error) string {
+	if err == nil {
+		return side + " closed"
+	}
+	if strings.Contains(err.Error(), "connection reset") {
+		return side + " reset"
+	}
+	return side + " error: " + err.Error()
+}
+
 // forward forwards packages between local connection and remote connection
 func (c *Connector) forward() error {
 	go c.localToRemote()
-	_, err := io.Copy(c.localConn, c.remoteConn)
+	_, err := io.Copy(c.counting(c.localConn, &c.bytesIn, &c.tunnel.bytesIn), c.remoteConn)
+	c.setCloseReason(closeReason("remote", err))
 	c.Close()
 	return err
 }
 
 func (c *Connector) localToRemote() {
-	// ignore errors of io.Copy
-	// an io.EOF is not an error that will be returned from io.Copy
-	// so if the io.Copy returns, we know that the local connection is closed
-	_, _ = io.Copy(c.remoteConn, c.localConn)
+	// once one side stops, the connector is closed and the other copy returns with
+	// an error of the closed connection, which won't override the reason
+	_, err := io.Copy(c.counting(c.remoteConn, &c.bytesOut, &c.tunnel.bytesOut), c.localConn)
+	c.setCloseReason(closeReason("local", err))
 	c.Close()
 }
 
+// countingWriter adds the bytes written to n and total as they are written, so that the counts
+// of a long lived connection are up to date while it's copying
+type countingWriter struct {
+	w io.Writer
+	n *uint64
+
+	// total the count of the tunnel
+	total *uint64
+
+	// active the last activity of the connector, see Connector.LastActive
+	active *int64
+}
+
+// counting returns the writer counting the bytes written to w of the connector
+func (c *Connector) counting(w io.Writer, n, total *uint64) *countingWriter {
+	return &countingWriter{w: w, n: n, total: total, active: &c.lastActive}
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	atomic.AddUint64(cw.n, uint64(n))
+	atomic.AddUint64(cw.total, uint64(n))
+	atomic.StoreInt64(cw.active, time.Now().UnixNano())
+	return n, err
+}
+
 func (c *Connector) Close() {
+	c.setCloseReason("closed by mario")
 	c.breakDown()
 	c.tunnel.closeConnector(c)
 }
@@ -99,6 +279,15 @@ func (c *Connector) breakDown() {
 }
 
 type Tunnel struct {
+	// bytesIn and bytesOut the bytes moved by all the connectors of the tunnel including the
+	// closed ones, updated atomically along with those of the connectors
+	bytesIn  uint64
+	bytesOut uint64
+
+	// connCount the connectors tracked, it follows connectors so that it's counted without
+	// the work loop. Updated atomically.
+	connCount int64
+
 	mu sync.RWMutex
 	// Local the listen address for local tcp server
 	Local string
@@ -108,13 +297,35 @@ type Tunnel struct {
 	SSHUri string
 
 	// ForwardTo The remote server's uri you want your LocalPort to map to, is in form of
-	// "hostname:port"
+	// "hostname:port". If it's empty, the tunnel is a SOCKS5 proxy dialing the destinations
+	// requested by the clients, like `ssh -D`
 	ForwardTo string
 
-	works chan func() error
+	works chan work
+
+	// looping whether the running goroutine is claimed, see startLoop. guarded by mu
+	looping bool
+
+	// done is closed once the tunnel is removed, no works are run after that
+	done     chan struct{}
+	doneOnce sync.Once
+	drainMu  sync.Mutex
 
 	listener net.Listener
 
+	// reverse whether the tunnel listens on ForwardTo of the ssh server and forwards back to
+	// Local, see WithReverse. listener is the one on the ssh server then.
+	reverse bool
+
+	// remoteBind the host a reverse tunnel listens on of the ssh server, see WithRemoteBind
+	remoteBind string
+
+	// udp whether the datagrams sent to Local over UDP are forwarded too, see WithUDP
+	udp bool
+
+	// udpRelay listens on Local over UDP along with listener if udp is set
+	udpRelay *udpRelay
+
 	sshConfig *sh.ClientConfig
 
 	sshClient *sh.Client
@@ -122,22 +333,188 @@ type Tunnel struct {
 	// connectors connections this tunnel is serving
 	connectors *btree.BTree
 
-	// OnStatus when tunnel's state is changed, this function will be called
+	// retiring holds the ssh clients replaced by a soft reconnect, mapping to the
+	// number of connectors still using them. They are closed once drained.
+	retiring map[*sh.Client]int
+
+	// drainTimeout is the longest time a retiring ssh client is kept
+	drainTimeout time.Duration
+
+	// connLimit caps the connections served by this tunnel together with the others sharing it
+	connLimit *ConnectionLimit
+
+	// connectedAt is when the current ssh client connected
+	connectedAt time.Time
+
+	// serverVersion the version of the ssh server the current client is connected to
+	serverVersion string
+
+	// hostKey the host key the server of the current client presented
+	hostKey sh.PublicKey
+
+	// resolved the IPs the host of the ssh server resolved to when it was dialed last time
+	resolved []string
+
+	// remoteProbes how many probes of ForwardTo in a row failing make the remote down, 0
+	// means ForwardTo isn't probed
+	remoteProbes int
+
+	// reconnectOnRemoteDown whether the ssh connection is reconnected once when the remote
+	// is down, in case the forwarding of the connection is broken
+	reconnectOnRemoteDown bool
+
+	// remoteFailures the probes failed in a row, only used by the running goroutine
+	remoteFailures int
+
+	// remoteReconnected whether it has reconnected for the current outage of the remote, only
+	// used by the running goroutine
+	remoteReconnected bool
+
+	// remoteDown whether the ssh connection is fine but ForwardTo is unreachable, guarded by mu
+	remoteDown bool
+
+	// reconnects how many times the ssh client has been replaced since the first connecting
+	reconnects int
+
+	// maxConnAge is the max lifetime of a ssh client, 0 means no limit
+	maxConnAge time.Duration
+
+	// autoReconnect if false, the tunnel is not reconnected when health check fails
+	autoReconnect bool
+
+	// keepalive how the ssh connection is checked on every health check
+	keepalive KeepaliveMethod
+
+	// keepaliveReply whether the keepalive request waits for the reply of the server
+	keepaliveReply bool
+
+	// maxKeepaliveMisses the keepalives failed in a row it takes to reconnect, like the
+	// ServerAliveCountMax of OpenSSH, see WithMaxKeepaliveMisses
+	maxKeepaliveMisses int
+
+	// keepaliveMisses the keepalives failed in a row so far, guarded by mu
+	keepaliveMisses int
+
+	// backends the remote addresses besides ForwardTo that connections are spread over
+	backends []string
+
+	balance BalanceStrategy
+
+	// nextBackend the index of the backend to try first for the next connection
+	nextBackend int
+
+	// backendDown when dialing the backends failed last time
+	backendDown map[string]time.Time
+
+	// retryAt is when the next reconnecting will be tried after a failed one
+	retryAt time.Time
+
+	// maxRetries the failed reconnects in a row after which the tunnel stops reconnecting by
+	// itself, 0 means retrying forever, see WithMaxRetries
+	maxRetries int
+
+	// retries the reconnects failed in a row, guarded by mu
+	retries int
+
+	// agentSocket the unix socket of the ssh agent to authenticate with, if any
+	agentSocket string
+
+	// authCallback supplies the auth methods on every dialing instead of the private key
+	authCallback AuthCallback
+
+	// challenge answers the keyboard-interactive questions of the server, e.g. an OTP,
+	// if the private key isn't enough
+	challenge sh.KeyboardInteractiveChallenge
+
+	// password the password to authenticate with if the keys are rejected, empty for none
+	password string
+
+	// proxy the HTTP proxy to reach the ssh server through, if any
+	proxy *url.URL
+
+	// jumpHosts the jump hosts to reach the ssh server through in order, see WithJumpHosts
+	jumpHosts []string
+
+	// logger the *zap.SugaredLogger logging what happens to the tunnel, it's replaced
+	// atomically, see SetLogger. Nothing is logged by default
+	logger atomic.Value
+
+	// warnConns is the number of active connections above which the tunnel warns, 0 means never
+	warnConns int
+
+	// overWarnConns whether the active connections are above warnConns
+	overWarnConns bool
+
+	// idleTimeout the connectors moving no bytes for it are closed, 0 means never
+	idleTimeout time.Duration
+
+	// maxConnectors caps the connections tracked by the tunnel at the same time, the ones
+	// beyond it are refused. 0 means no cap.
+	maxConnectors int
+
+	// atMaxConnectors whether the cap was hit since the connections were last below it, so
+	// that it's logged once for a burst of refused connections
+	atMaxConnectors bool
+
+	// peakConnectors the most connections tracked at the same time, guarded by mu
+	peakConnectors int
+
+	// cappedConnections how many connections were refused by maxConnectors, guarded by mu
+	cappedConnections uint64
+
+	// env the environment variables requested on every session of the tunnel
+	env map[string]string
+
+	// pending holds the local connections accepted while the ssh connection is lost, they
+	// are forwarded once it's reconnected, or closed after pendingTimeout
+	pending []*pendingConn
+
+	// pendingSize the most connections held in pending, the ones beyond are closed
+	pendingSize int
+
+	pendingTimeout time.Duration
+
+	// recentlyClosed is a ring buffer of the last closed connectors, next is where the
+	// next closed one goes
+	recentlyClosed []*Connector
+	next           int
+
+	// OnStatus when tunnel's state is changed, this function will be called. It's optional,
+	// a tunnel works on its own without it.
 	OnStatus tunnelHandler
 
+	// onConnector is called when a connector is opened or closed, see WithConnectorHook
+	onConnector ConnectorHook
+
 	status TunnelStatus
 
 	// cCount records connections this tunnel a currently serving
 	cCount uint64
 
-	// healthCheckInterval is the interval to check whether ssh connection is alive
-	// it's also the timeout of a ssh client
-	healthCheckInterval time.Duration
+	// keepaliveInterval is the interval to check whether ssh connection is alive, a keepalive
+	// is sent on every check
+	keepaliveInterval time.Duration
+
+	// dialTimeout how long connecting to the ssh server may take, see WithDialTimeout
+	dialTimeout time.Duration
+
+	// jitter the fraction the health check interval is randomized by, see WithJitter
+	jitter float64
+
+	// fdFailures the reconnects failed in a row for running out of file descriptors, the
+	// retries are backed off by it
+	fdFailures int
 
 	once sync.Once
 
 	// err stores the latest error of this tunnel
 	err error
+
+	// lastErrorAt when an error was set last time, guarded by mu
+	lastErrorAt time.Time
+
+	// errorCount how many times an error has been set, guarded by mu
+	errorCount int
 }
 
 func (t *Tunnel) Status() (st TunnelStatus) {
@@ -158,229 +535,1547 @@ func (t *Tunnel) Error() (err error) {
 	return err
 }
 
+// ConnectedAt returns when the current ssh client connected
+func (t *Tunnel) ConnectedAt() time.Time {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.connectedAt
+}
+
+// ServerVersion returns the version of the ssh server the tunnel has connected to, e.g.
+// SSH-2.0-OpenSSH_7.4, it's empty if the tunnel has never connected
+func (t *Tunnel) ServerVersion() string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.serverVersion
+}
+
+// Reconnects returns how many times the tunnel has reconnected to the ssh server
+func (t *Tunnel) Reconnects() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.reconnects
+}
+
+// NextRetry returns when the tunnel will try to reconnect again after a failed reconnecting,
+// it's zero if the tunnel isn't waiting to retry
+func (t *Tunnel) NextRetry() time.Time {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.retryAt
+}
+
+// AgentSocket returns the socket of the ssh agent the tunnel authenticates with, it's
+// empty if no agent is used
+func (t *Tunnel) AgentSocket() string {
+	return t.agentSocket
+}
+
+// Retries returns the reconnects failed in a row and the most tried before the tunnel gives up,
+// which is 0 for retrying forever, see WithMaxRetries
+func (t *Tunnel) Retries() (failed, max int) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.retries, t.maxRetries
+}
+
+// AutoReconnect tells whether the tunnel reconnects by itself when health check fails
+func (t *Tunnel) AutoReconnect() bool {
+	return t.autoReconnect
+}
+
+// MaxConnectionAge returns the max lifetime of the ssh client, 0 means no limit
+func (t *Tunnel) MaxConnectionAge() time.Duration {
+	return t.maxConnAge
+}
+
+// DialTimeout returns how long connecting to the ssh server may take
+func (t *Tunnel) DialTimeout() time.Duration {
+	return t.dialTimeout
+}
+
+// HealthCheckInterval returns the interval of the health checks before the jitter
+func (t *Tunnel) HealthCheckInterval() time.Duration {
+	return t.keepaliveInterval
+}
+
+// Keepalive returns how the tunnel checks its ssh connection and whether a reply is required
+func (t *Tunnel) Keepalive() (KeepaliveMethod, bool) {
+	return t.keepalive, t.keepaliveReply
+}
+
+// sendKeepalive checks the ssh connection by the keepalive method of the tunnel
+func (t *Tunnel) sendKeepalive() error {
+	if t.keepalive == KeepaliveSession {
+		session, err := t.sshClient.NewSession()
+		if err != nil {
+			return err
+		}
+		if err := session.Close(); err != nil && err != io.EOF {
+			return err
+		}
+		return nil
+	}
+	_, _, err := t.sshClient.SendRequest("keepalive@openssh.com", t.keepaliveReply, nil)
+	return err
+}
+
+// SetLogger sets the logger of the tunnel, it's expected to identify the tunnel in every
+// line, e.g. with logger.With("tunnel", name). It may be replaced while the tunnel is up, e.g.
+// once it's renamed.
+func (t *Tunnel) SetLogger(logger *zap.SugaredLogger) {
+	if logger == nil {
+		logger = nopLogger
+	}
+	t.logger.Store(logger)
+}
+
+// log returns the logger of the tunnel, see SetLogger
+func (t *Tunnel) log() *zap.SugaredLogger {
+	if logger, ok := t.logger.Load().(*zap.SugaredLogger); ok {
+		return logger
+	}
+	return nopLogger
+}
+
 func (t *Tunnel) String() string {
-	return t.Local + " -> " + t.SSHUri + " -> " + t.ForwardTo
+	local, server, remote := t.Addresses()
+	if t.reverse {
+		return local + " <- " + server + " <- " + remote
+	}
+	if remote == "" {
+		return local + " -> " + server + " -> socks5"
+	}
+	return local + " -> " + server + " -> " + remote
+}
+
+// Addresses returns Local, SSHUri and ForwardTo of the tunnel, they may be changed by Edit
+// while the tunnel is running so that they should be read by it out of the running goroutine
+func (t *Tunnel) Addresses() (local, server, remote string) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.Local, t.SSHUri, t.ForwardTo
+}
+
+// Dynamic tells whether the tunnel is a SOCKS5 proxy without a fixed remote, like `ssh -D`
+func (t *Tunnel) Dynamic() bool {
+	_, _, remote := t.Addresses()
+	return remote == ""
+}
+
+// dial connects to the ssh server, through the HTTP proxy if there is one. The host key
+// presented by the server is returned with the client.
+func (t *Tunnel) dial() (*sh.Client, sh.PublicKey, error) {
+	var hostKey sh.PublicKey
+	if t.proxy == nil && len(t.jumpHosts) == 0 {
+		// the ssh server behind the jump hosts may not resolve here
+		t.resolve()
+	}
+	config := *t.sshConfig
+	config.Timeout = t.dialTimeout
+	if t.authCallback != nil {
+		// a failed callback, e.g. the credential source is unavailable, is retried like
+		// an unreachable server
+		methods, err := t.authCallback()
+		if err != nil {
+			return nil, nil, err
+		}
+		config.Auth = methods
+	}
+	config.HostKeyCallback = func(hostname string, remote net.Addr, key sh.PublicKey) error {
+		hostKey = key
+		return t.sshConfig.HostKeyCallback(hostname, remote, key)
+	}
+	var conn net.Conn
+	var err error
+	if len(t.jumpHosts) > 0 {
+		conn, err = t.dialJumpHosts(&config)
+	} else if t.proxy != nil {
+		conn, err = dialHTTPProxy(t.proxy, t.SSHUri, config.Timeout)
+	} else {
+		conn, err = net.DialTimeout("tcp", t.SSHUri, config.Timeout)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	// the handshake and the authentication are bound by the dial timeout too, a connection
+	// forwarded by the jump hosts may not support deadlines, it's fine
+	if config.Timeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(config.Timeout))
+	}
+	c, chans, reqs, err := sh.NewClientConn(conn, t.SSHUri, &config)
+	if err != nil {
+		_ = conn.Close()
+		return nil, nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return sh.NewClient(c, chans, reqs), hostKey, nil
 }
 
+// forceConnect is the hard reconnect: the current ssh client and all the connections
+// on it are dropped before connecting again.
 func (t *Tunnel) forceConnect() error {
 	if t.sshClient != nil {
-		t.sshClient.Close()
+		client := t.sshClient
+		t.connectors.Ascend(func(i btree.Item) bool {
+			if cnt := i.(*Connector); cnt.client == client {
+				cnt.setCloseReason("ssh connection reset by reconnecting")
+			}
+			return true
+		})
+		client.Close()
 	}
 	var err error
-	client, err := sh.Dial("tcp", t.SSHUri, t.sshConfig)
+	t.log().Debugw("connecting to ssh server", "server", t.SSHUri)
+	client, hostKey, err := t.dial()
 	if err != nil {
-		return err
+		t.log().Warnw("failed to connect to ssh server", "server", t.SSHUri, "error", err)
+		return classifyDialError(err)
 	}
-	t.sshClient = client
+	t.setClient(client, hostKey)
 
-	if t.listener == nil || t.closed() {
+	if t.reverse {
+		// the listener on the ssh server goes away with the previous client
 		t.setStatusError(StatusConnecting, nil)
-		listener, err := net.Listen("tcp", t.Local)
+		if err := t.listenRemote(); err != nil {
+			return err
+		}
+	} else if t.listener == nil || t.closed() {
+		t.setStatusError(StatusConnecting, nil)
+		listener, err := t.listen()
 		if err != nil {
+			if isFdExhausted(err) {
+				err = newFdExhaustedError(err)
+			}
+			t.log().Warnw("failed to listen", "local", t.Local, "error", err)
 			return err
 		}
+		if t.udp {
+			relay, err := listenUDP(t.Local, t.forwardUDP, t.log())
+			if err != nil {
+				_ = listener.Close()
+				t.log().Warnw("failed to listen on udp", "local", t.Local, "error", err)
+				return err
+			}
+			t.udpRelay = relay
+		}
+		t.log().Debugw("listening", "local", t.Local, "udp", t.udp)
 		t.listener = listener
 		go t.listenLocal()
 	}
 
 	t.setStatusError(StatusConnected, nil)
+	t.log().Infow("tunnel connected", "server", t.SSHUri)
+	t.flushPending()
 	return nil
 }
 
-func (t *Tunnel) runOnce() {
-	defer func() {
-		t.mu.Lock()
-		t.status &= ^StatusRunning
-		t.mu.Unlock()
-	}()
+const (
+	// listenRetries is how many more times listening on the local address is tried
+	listenRetries = 5
 
-	if t.listener != nil {
-		return
+	// listenRetryDelay is the wait between the tries of listening
+	listenRetryDelay = 100 * time.Millisecond
+)
+
+// listen listens on the local address, it's retried a few times after a short delay since
+// the address may be held for a moment, e.g. by the listener just closed when reopening.
+// Running out of file descriptors isn't retried here, see fdFailures.
+func (t *Tunnel) listen() (net.Listener, error) {
+	for i := 0; ; i++ {
+		listener, err := net.Listen("tcp", t.Local)
+		if err == nil || i >= listenRetries || isFdExhausted(err) {
+			return listener, err
+		}
+		t.log().Debugw("failed to listen, retry shortly", "local", t.Local, "error", err, "retry", i+1)
+		time.Sleep(listenRetryDelay)
 	}
-	err := t.forceConnect()
+}
+
+// softConnect is the graceful reconnect for a healthy tunnel: the new ssh client is
+// established before the old one is retired, so that the serving connectors are kept
+// until they are done or the drain timeout is reached.
+func (t *Tunnel) softConnect() error {
+	// the port on the ssh server can't be listened by two clients at once
+	if t.sshClient == nil || t.listener == nil || t.closed() || t.reverse {
+		return t.forceConnect()
+	}
+	t.setStatusError(StatusReconnecting, nil)
+	client, hostKey, err := t.dial()
+	if err != nil {
+		// the old client is still serving, keep it
+		t.log().Warnw("soft reconnect failed, keep the current ssh connection", "error", err)
+		t.setStatusError(StatusConnected, nil)
+		return classifyDialError(err)
+	}
+	old := t.sshClient
+	t.setClient(client, hostKey)
+	t.retire(old)
+	t.setStatusError(StatusConnected, nil)
+	t.log().Infow("tunnel soft reconnected", "server", t.SSHUri)
+	return nil
+}
+
+// resolve looks up the host of the ssh server and logs the IPs, which reveals an unexpected
+// resolution, e.g. by a split-horizon DNS or a stale cache. The dialing goes on if it fails.
+func (t *Tunnel) resolve() {
+	host, _, err := net.SplitHostPort(t.SSHUri)
 	if err != nil {
-		t.setStatusError(StatusError, err)
 		return
 	}
-	ticker := time.NewTicker(t.healthCheckInterval)
-	for {
-		select {
-		case work := <-t.works:
-			err := work()
-			if err != nil {
-				t.setStatusError(StatusError, err)
-			}
-			if t.Status()&StatusRemoved == StatusRemoved {
-				return
-			}
-		case <-ticker.C:
-			if t.Status()&StatusRemoved == StatusRemoved {
-				return
-			}
-			if t.closed() && t.Error() == nil {
-				continue
-			}
-			if t.sshClient == nil {
-				t.setStatusError(StatusError, errRemoteLost)
-			} else {
-				_, _, err := t.sshClient.SendRequest("keepalive@openssh.com", true, nil)
-				if err == nil {
-					continue
-				}
-				t.setStatusError(StatusError, err)
-			}
-			_ = t.forceConnect()
-		}
+	ips, err := net.LookupHost(host)
+	if err != nil {
+		t.log().Warnw("failed to resolve the ssh server", "host", host, "error", err)
+	} else {
+		t.log().Infow("resolved the ssh server", "host", host, "ips", ips)
 	}
+	t.mu.Lock()
+	t.resolved = ips
+	t.mu.Unlock()
 }
 
-func (t *Tunnel) Up() {
-	if t.running() {
+// ResolvedIPs returns the IPs the host of the ssh server resolved to when it was dialed last
+// time, nil if it failed to resolve or it's reached through a proxy
+func (t *Tunnel) ResolvedIPs() []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.resolved
+}
+
+// setClient replaces the ssh client and records the connected time
+func (t *Tunnel) setClient(client *sh.Client, hostKey sh.PublicKey) {
+	t.sshClient = client
+	t.mu.Lock()
+	if !t.connectedAt.IsZero() {
+		t.reconnects++
+	}
+	t.serverVersion = string(client.ServerVersion())
+	t.hostKey = hostKey
+	t.connectedAt = time.Now()
+	t.retryAt = time.Time{}
+	t.retries = 0
+	t.keepaliveMisses = 0
+	t.mu.Unlock()
+}
+
+// closeClient closes the current ssh client, a closed tunnel doesn't hold the ssh connection.
+// It's dialed again when the tunnel is brought up.
+func (t *Tunnel) closeClient() {
+	if t.sshClient == nil {
 		return
 	}
-	t.runOnce()
+	_ = t.sshClient.Close()
+	t.sshClient = nil
 }
 
-func (t *Tunnel) listenLocal() {
-	defer t.listener.Close()
+// retire closes the client once no connector is using it, or the drain timeout is reached
+func (t *Tunnel) retire(client *sh.Client) {
+	refs := 0
+	t.connectors.Ascend(func(i btree.Item) bool {
+		if i.(*Connector).client == client {
+			refs++
+		}
+		return true
+	})
+	if refs == 0 {
+		_ = client.Close()
+		return
+	}
+	t.retiring[client] = refs
+	time.AfterFunc(t.drainTimeout, func() {
+		_ = t.submit(func() error {
+			if _, ok := t.retiring[client]; ok {
+				delete(t.retiring, client)
+				_ = client.Close()
+			}
+			return nil
+		})
+	})
+}
+
+// closeRetiring closes all the retiring clients immediately
+func (t *Tunnel) closeRetiring() {
+	for client := range t.retiring {
+		_ = client.Close()
+		delete(t.retiring, client)
+	}
+}
+
+// connectFailed sets the status after a failed connecting. Authentication failures move
+// the tunnel to StatusFailed so that it won't be retried automatically, which would
+// only spam the server and risk locking the account out.
+func (t *Tunnel) connectFailed(err error) {
+	t.mu.Lock()
+	t.retryAt = time.Time{}
+	t.mu.Unlock()
+	if _, ok := err.(*AuthError); ok {
+		t.log().Errorw("authentication failed, won't retry until brought up manually", "error", err)
+		t.setStatusError(StatusFailed, err)
+		t.dropPending()
+		return
+	}
+	t.setStatusError(StatusError, err)
+}
+
+// runOnce is the running goroutine claimed by startLoop, it connects the tunnel and runs the
+// works until the tunnel is removed. The result of the first connecting is sent to waitDone, the
+// goroutine stops if it fails and the works left are aborted with the error.
+func (t *Tunnel) runOnce(waitDone chan<- error) {
+	stopErr := errNotRunning
+	defer func() {
+		t.mu.Lock()
+		t.status &= ^StatusRunning
+		t.looping = false
+		t.mu.Unlock()
+		if t.removed() {
+			t.finish()
+			return
+		}
+		t.abort(stopErr)
+	}()
+
+	if t.listener != nil {
+		if waitDone != nil {
+			waitDone <- stopErr
+		}
+		return
+	}
+	err := t.forceConnect()
+	if err != nil {
+		t.connectFailed(err)
+	}
+	if waitDone != nil {
+		waitDone <- err
+	}
+	if err != nil {
+		stopErr = err
+		return
+	}
+	timer := time.NewTimer(t.checkInterval())
+	defer timer.Stop()
+	var idleSweep <-chan time.Time
+	if t.idleTimeout > 0 {
+		ticker := time.NewTicker(idleSweepInterval(t.idleTimeout))
+		defer ticker.Stop()
+		idleSweep = ticker.C
+	}
 	for {
-		conn, err := t.listener.Accept()
+		select {
+		case now := <-idleSweep:
+			t.closeIdle(now)
+		case w := <-t.works:
+			err := w.run()
+			if err != nil {
+				t.setStatusError(StatusError, err)
+			}
+			if t.Status()&StatusRemoved == StatusRemoved {
+				return
+			}
+		case <-timer.C:
+			interval := t.checkInterval()
+			timer.Reset(interval)
+			if t.Status()&StatusRemoved == StatusRemoved {
+				return
+			}
+			if t.closed() && t.Error() == nil {
+				continue
+			}
+			if t.Status()&StatusFailed == StatusFailed || t.retriesExhausted() {
+				// wait for a manual retry
+				continue
+			}
+			if !t.autoReconnect && t.Error() != nil {
+				// it's up to the user to bring it up again
+				continue
+			}
+			if t.fdFailures > 0 && time.Now().Before(t.NextRetry()) {
+				// backing off from running out of file descriptors, retrying sooner makes it worse
+				continue
+			}
+			if t.maxConnAge > 0 && t.Error() == nil && time.Since(t.ConnectedAt()) >= t.maxConnAge {
+				// it's a planned reconnect, keep the serving connections. If it fails,
+				// the old client keeps serving and it will be retried on next tick
+				_ = t.softConnect()
+				continue
+			}
+			if t.sshClient == nil {
+				t.setStatusError(StatusError, errRemoteLost)
+			} else if t.reverse && t.Error() == errRemoteListenerLost {
+				// the ssh connection may be fine while the listener on the server is gone,
+				// reconnecting listens again
+				t.log().Warnw("health check failed", "error", errRemoteListenerLost)
+			} else {
+				err := t.sendKeepalive()
+				misses := t.countKeepalive(err)
+				if err == nil {
+					if t.remoteProbes > 0 {
+						t.probeRemote()
+					}
+					continue
+				}
+				if misses < t.maxKeepaliveMisses {
+					// a blip shouldn't break all the connections
+					t.log().Warnw("keepalive missed", "misses", misses, "max", t.maxKeepaliveMisses, "error", err)
+					continue
+				}
+				t.log().Warnw("health check failed", "error", err)
+				t.setStatusError(StatusError, err)
+			}
+			if !t.autoReconnect {
+				continue
+			}
+			t.log().Infow("reconnecting")
+			if err := t.forceConnect(); err != nil {
+				t.connectFailed(err)
+				if t.retryFailed(err) {
+					continue
+				}
+				if t.Status()&StatusFailed != StatusFailed {
+					// it will be retried on next tick, or later if out of file descriptors
+					wait := interval
+					if isFdExhausted(err) {
+						if t.fdFailures < maxFdBackoff {
+							t.fdFailures++
+						}
+						wait = interval << uint(t.fdFailures)
+					} else {
+						t.fdFailures = 0
+					}
+					t.mu.Lock()
+					t.retryAt = time.Now().Add(wait)
+					t.mu.Unlock()
+					t.log().Infow("reconnect failed, will retry", "in", wait.String())
+				}
+			} else {
+				t.fdFailures = 0
+			}
+		}
+	}
+}
+
+// idleSweepInterval how often the connectors are checked for the idle timeout, so that an idle
+// one is closed within half of the timeout after it's due
+func idleSweepInterval(timeout time.Duration) time.Duration {
+	if interval := timeout / 2; interval > 0 {
+		return interval
+	}
+	return timeout
+}
+
+// closeIdle closes the connectors not moving any bytes for idleTimeout, they are removed once
+// their copies return. It runs in the work loop.
+func (t *Tunnel) closeIdle(now time.Time) {
+	idle := make([]*Connector, 0)
+	t.connectors.Ascend(func(i btree.Item) bool {
+		if cnt := i.(*Connector); now.Sub(cnt.LastActive()) >= t.idleTimeout {
+			idle = append(idle, cnt)
+		}
+		return true
+	})
+	for _, cnt := range idle {
+		t.log().Debugw("closing the idle connection", "client", cnt.Client(), "idle_timeout", t.idleTimeout.String())
+		cnt.setCloseReason("idle for " + t.idleTimeout.String())
+		cnt.breakDown()
+	}
+}
+
+// countKeepalive counts the keepalives failed in a row by the result of the last one and
+// returns the count
+func (t *Tunnel) countKeepalive(err error) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err == nil {
+		t.keepaliveMisses = 0
+	} else {
+		t.keepaliveMisses++
+	}
+	return t.keepaliveMisses
+}
+
+// KeepaliveMisses returns the keepalives failed in a row and how many it takes to reconnect
+func (t *Tunnel) KeepaliveMisses() (missed, max int) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.keepaliveMisses, t.maxKeepaliveMisses
+}
+
+// probeRemote dials ForwardTo through the ssh connection. After remoteProbes failures in a
+// row the remote is down, and the ssh connection is reconnected once if configured. It runs
+// in the work loop.
+func (t *Tunnel) probeRemote() {
+	conn, err := t.sshClient.Dial("tcp", t.ForwardTo)
+	if err == nil {
+		_ = conn.Close()
+		if t.RemoteDown() {
+			t.log().Infow("remote is reachable again", "remote", t.ForwardTo)
+			t.setRemoteDown(false)
+		}
+		t.remoteFailures = 0
+		t.remoteReconnected = false
+		return
+	}
+	t.remoteFailures++
+	t.log().Warnw("failed to probe remote", "remote", t.ForwardTo, "failures", t.remoteFailures, "error", err)
+	if t.remoteFailures < t.remoteProbes {
+		return
+	}
+	if !t.RemoteDown() {
+		t.log().Warnw("ssh connection is fine but remote is down", "remote", t.ForwardTo)
+		t.setRemoteDown(true)
+	}
+	if !t.reconnectOnRemoteDown || t.remoteReconnected {
+		return
+	}
+	// it's only tried once for an outage, the remote itself is likely down if it doesn't help
+	t.remoteReconnected = true
+	t.remoteFailures = 0
+	t.log().Infow("reconnecting due to remote failures", "remote", t.ForwardTo)
+	t.setStatusError(StatusReconnecting, nil)
+	if err := t.forceConnect(); err != nil {
+		t.connectFailed(err)
+	}
+}
+
+// setRemoteDown flags whether the remote is down and notifies OnStatus
+func (t *Tunnel) setRemoteDown(down bool) {
+	t.mu.Lock()
+	t.remoteDown = down
+	t.mu.Unlock()
+	if t.OnStatus != nil {
+		t.OnStatus(t)
+	}
+}
+
+// PasswordAuth tells whether the tunnel falls back to a password, see WithPassword
+func (t *Tunnel) PasswordAuth() bool {
+	return t.password != ""
+}
+
+// RemoteDown tells whether the ssh connection is fine but ForwardTo failed to be probed, see
+// WithRemoteProbe
+func (t *Tunnel) RemoteDown() bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.remoteDown
+}
+
+// RemoteProbe returns how many failed probes make the remote down, 0 means no probing, and
+// whether the ssh connection is reconnected then
+func (t *Tunnel) RemoteProbe() (failures int, reconnect bool) {
+	return t.remoteProbes, t.reconnectOnRemoteDown
+}
+
+// JumpHosts returns the jump hosts the ssh server is reached through, nil if it's dialed directly
+func (t *Tunnel) JumpHosts() []string {
+	return t.jumpHosts
+}
+
+// UDP tells whether the datagrams sent to Local over UDP are forwarded too
+func (t *Tunnel) UDP() bool {
+	return t.udp
+}
+
+// checkInterval returns the interval to the next health check, it's randomized by the jitter
+// so that the tunnels sharing a server don't check and reconnect in lockstep
+func (t *Tunnel) checkInterval() time.Duration {
+	if t.jitter <= 0 {
+		return t.keepaliveInterval
+	}
+	delta := (2*rand.Float64() - 1) * t.jitter * float64(t.keepaliveInterval)
+	return t.keepaliveInterval + time.Duration(delta)
+}
+
+func (t *Tunnel) Up() {
+	if !t.startLoop() {
+		return
+	}
+	t.runOnce(nil)
+}
+
+// start brings the tunnel up in the background unless it's running, the works submitted after
+// it returns are run once it's connected, or aborted if it fails to
+func (t *Tunnel) start() {
+	if t.startLoop() {
+		go t.runOnce(nil)
+	}
+}
+
+// startLoop claims the running goroutine, false if it's claimed already or the tunnel is
+// removed. The claimer runs runOnce, the works submitted meanwhile wait for it. A tunnel which
+// isn't running can be changed by the claimer before it runs runOnce since nobody else does.
+func (t *Tunnel) startLoop() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.looping || t.status&StatusRemoved == StatusRemoved {
+		return false
+	}
+	t.looping = true
+	return true
+}
+
+func (t *Tunnel) isLooping() bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.looping
+}
+
+// work is run by the running goroutine, abort answers its caller instead if the goroutine
+// stops before running it. abort may be nil if nobody waits for the work.
+type work struct {
+	run   func() error
+	abort func(err error)
+}
+
+// submit queues the work to the running goroutine, it fails with errTunnelRemoved instead
+// of blocking forever once the tunnel is removed. The work is dropped if the goroutine stops
+// before running it, see submitOr.
+func (t *Tunnel) submit(run func() error) error {
+	return t.submitOr(run, nil)
+}
+
+// submitOr is submit with abort, which is called with the error the running goroutine stops
+// with instead of run if it stops before running it, e.g. the tunnel failed to connect, or if
+// it's not even running
+func (t *Tunnel) submitOr(run func() error, abort func(err error)) error {
+	select {
+	case <-t.done:
+		return errTunnelRemoved
+	default:
+	}
+	select {
+	case t.works <- work{run: run, abort: abort}:
+		select {
+		case <-t.done:
+			// raced with the removal, the running goroutine is gone
+			t.drain()
+		default:
+			if !t.isLooping() {
+				// nobody runs the work, the goroutine has stopped or never started
+				err := t.Error()
+				if err == nil {
+					err = errNotRunning
+				}
+				t.abort(err)
+			}
+		}
+		return nil
+	case <-t.done:
+		return errTunnelRemoved
+	}
+}
+
+// finish marks the tunnel as done, it's called once the running goroutine is gone
+func (t *Tunnel) finish() {
+	t.doneOnce.Do(func() {
+		close(t.done)
+	})
+	t.drain()
+}
+
+// drain runs the works left in the queue after the tunnel is done so that their callers
+// are answered, those changing the tunnel bail out as it's removed.
+func (t *Tunnel) drain() {
+	t.drainMu.Lock()
+	defer t.drainMu.Unlock()
+	for {
+		select {
+		case w := <-t.works:
+			_ = w.run()
+		default:
+			return
+		}
+	}
+}
+
+// answer is the abort of a work whose result is sent to waitDone, the error is sent instead
+func answer(waitDone chan<- error) func(err error) {
+	return func(err error) {
+		if waitDone != nil {
+			waitDone <- err
+		}
+	}
+}
+
+// abort answers the works left in the queue with err once the running goroutine stops without
+// removing the tunnel, so that their callers aren't left waiting
+func (t *Tunnel) abort(err error) {
+	t.drainMu.Lock()
+	defer t.drainMu.Unlock()
+	for {
+		select {
+		case w := <-t.works:
+			if w.abort != nil {
+				w.abort(err)
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (t *Tunnel) listenLocal() {
+	// the listener may be replaced by another one, see Edit
+	l := t.listener
+	defer l.Close()
+	// how long to pause accepting when running out of file descriptors
+	var pause time.Duration
+	for {
+		conn, err := l.Accept()
+		if err != nil && isFdExhausted(err) {
+			// the pending connection is still in the backlog, accepting again at once
+			// only spins. Pause until some file descriptors are released.
+			if pause == 0 {
+				pause = 5 * time.Millisecond
+			} else if pause *= 2; pause > time.Second {
+				pause = time.Second
+			}
+			t.log().Warnw("pause accepting connections", "local", t.Local,
+				"error", newFdExhaustedError(err).Error(), "pause", pause.String())
+			time.Sleep(pause)
+			continue
+		}
+		pause = 0
 		if err != nil {
-			t.works <- func() error {
-				if t.closed() {
+			_ = t.submit(func() error {
+				if t.closed() || t.removed() || t.listener != l {
 					return nil
 				}
+				t.log().Warnw("stopped accepting connections", "local", t.Local, "error", err)
 				t.setStatusError(StatusClosed, err)
 				return nil
-			}
+			})
 			return
 		}
-		t.works <- func() error {
-			remoteConn, err := t.sshClient.Dial("tcp", t.ForwardTo)
-			if err != nil {
+		if t.Dynamic() {
+			// the handshake is done out of the work loop, see Forward
+			go t.serveSocks(conn)
+			continue
+		}
+		err = t.submitOr(func() error {
+			if t.removed() {
+				_ = conn.Close()
 				return nil
 			}
-			cnt := t.newConnector(conn, remoteConn)
-			go cnt.forward()
+			t.serveLocal(conn)
 			return nil
+		}, func(error) { _ = conn.Close() })
+		if err != nil {
+			_ = conn.Close()
+			return
 		}
 	}
 }
 
+// pendingConn is a local connection held while reconnecting, it's closed when timer fires
+type pendingConn struct {
+	conn  net.Conn
+	timer *time.Timer
+}
+
+// serveLocal forwards the accepted local connection, or holds it if the ssh connection is
+// lost and being reconnected, so that the client waits instead of being refused
+func (t *Tunnel) serveLocal(conn net.Conn) {
+	if t.reconnecting() {
+		if len(t.pending) >= t.pendingSize {
+			t.log().Warnw("too many connections waiting for reconnecting, close it",
+				"client", conn.RemoteAddr().String(), "pending", len(t.pending))
+			_ = conn.Close()
+			return
+		}
+		t.log().Debugw("ssh connection is lost, hold the connection until reconnected",
+			"client", conn.RemoteAddr().String())
+		p := &pendingConn{conn: conn}
+		p.timer = time.AfterFunc(t.pendingTimeout, func() {
+			_ = t.submit(func() error {
+				t.expirePending(p)
+				return nil
+			})
+		})
+		t.pending = append(t.pending, p)
+		return
+	}
+	_ = t.forwardConn(conn, t.backendOrder(), nil)
+}
+
+// expirePending closes the held connection if it's still waiting for the reconnecting
+func (t *Tunnel) expirePending(p *pendingConn) {
+	for i, held := range t.pending {
+		if held == p {
+			t.pending = append(t.pending[:i], t.pending[i+1:]...)
+			t.log().Debugw("the held connection timed out waiting for reconnecting",
+				"client", p.conn.RemoteAddr().String())
+			_ = p.conn.Close()
+			return
+		}
+	}
+}
+
+// reconnecting tells whether the ssh connection is lost and will be reconnected automatically
+func (t *Tunnel) reconnecting() bool {
+	st := t.Status()
+	return t.autoReconnect && st&StatusError == StatusError && st&StatusFailed != StatusFailed &&
+		!t.retriesExhausted()
+}
+
+// retryFailed counts a failed reconnect, it tells whether the tunnel gives up reconnecting
+// by itself for reaching maxRetries. It stays errored until it's brought up manually then.
+func (t *Tunnel) retryFailed(err error) bool {
+	t.mu.Lock()
+	t.retries++
+	retries := t.retries
+	t.mu.Unlock()
+	if t.maxRetries <= 0 || retries < t.maxRetries || t.Status()&StatusFailed == StatusFailed {
+		return false
+	}
+	t.log().Errorw("reconnect failed too many times, won't retry until brought up manually",
+		"retries", retries, "error", err)
+	t.mu.Lock()
+	t.retryAt = time.Time{}
+	t.mu.Unlock()
+	t.setStatusError(StatusError, fmt.Errorf("gave up reconnecting after %d failed attempts: %v", retries, err))
+	t.dropPending()
+	return true
+}
+
+// retriesExhausted tells whether the tunnel gave up reconnecting for reaching maxRetries
+func (t *Tunnel) retriesExhausted() bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.maxRetries > 0 && t.retries >= t.maxRetries
+}
+
+// flushPending forwards the connections held while reconnecting
+func (t *Tunnel) flushPending() {
+	pending := t.pending
+	t.pending = nil
+	for _, p := range pending {
+		p.timer.Stop()
+		_ = t.forwardConn(p.conn, t.backendOrder(), nil)
+	}
+}
+
+// dropPending closes the connections held while reconnecting, since the tunnel won't be back
+func (t *Tunnel) dropPending() {
+	for _, p := range t.pending {
+		p.timer.Stop()
+		_ = p.conn.Close()
+	}
+	t.pending = nil
+}
+
+// Forward serves the local connection by forwarding it to target through the ssh connection
+// of the tunnel. If onDialed is not nil, it's called with the result of dialing target before
+// anything is forwarded, and the forwarding is aborted if it returns an error.
+func (t *Tunnel) Forward(local net.Conn, target string, onDialed func(err error) error) error {
+	if t.Status()&StatusConnected != StatusConnected {
+		err := errNotConnected
+		if onDialed != nil {
+			_ = onDialed(err)
+		}
+		_ = local.Close()
+		return err
+	}
+	done := make(chan error, 1)
+	err := t.submitOr(func() error {
+		if t.removed() {
+			done <- errTunnelRemoved
+			return nil
+		}
+		done <- t.forwardConn(local, []string{target}, onDialed)
+		return nil
+	}, func(err error) {
+		if onDialed != nil {
+			_ = onDialed(err)
+		}
+		_ = local.Close()
+		done <- err
+	})
+	if err != nil {
+		if onDialed != nil {
+			_ = onDialed(err)
+		}
+		_ = local.Close()
+		return err
+	}
+	return <-done
+}
+
+// forwardUDP forwards the stream of a UDP client to ForwardTo, see udpRelay
+func (t *Tunnel) forwardUDP(stream net.Conn) error {
+	return t.Forward(stream, t.ForwardTo, nil)
+}
+
+// closeUDP stops relaying the datagrams, the streams of the clients are closed. It runs in the
+// work loop.
+func (t *Tunnel) closeUDP() {
+	if t.udpRelay != nil {
+		_ = t.udpRelay.Close()
+		t.udpRelay = nil
+	}
+}
+
+// forwardConn dials the targets in order with the current ssh client until one succeeds and
+// forwards local to it, the next target is only tried if dialing the previous one failed.
+// local is closed if all of them fail. It runs in the work loop.
+func (t *Tunnel) forwardConn(local net.Conn, targets []string, onDialed func(err error) error) error {
+	if t.sshClient == nil {
+		// closed by Down before the work ran
+		if onDialed != nil {
+			_ = onDialed(errNotConnected)
+		}
+		_ = local.Close()
+		return errNotConnected
+	}
+	if t.maxConnectors > 0 && t.connectors.Len() >= t.maxConnectors {
+		if !t.atMaxConnectors {
+			t.log().Warnw("refused the connection, the tunnel is tracking too many connections",
+				"client", local.RemoteAddr().String(), "max_connectors", t.maxConnectors)
+		}
+		t.atMaxConnectors = true
+		t.mu.Lock()
+		t.cappedConnections++
+		t.mu.Unlock()
+		if onDialed != nil {
+			_ = onDialed(errTooManyConnections)
+		}
+		_ = local.Close()
+		return errTooManyConnections
+	}
+	t.atMaxConnectors = false
+	if !t.connLimit.acquire() {
+		t.log().Warnw("refused the connection, too many connections",
+			"client", local.RemoteAddr().String(), "max_connections", t.connLimit.Max())
+		if onDialed != nil {
+			_ = onDialed(errTooManyConnections)
+		}
+		_ = local.Close()
+		return errTooManyConnections
+	}
+	client := t.sshClient
+	var (
+		remoteConn net.Conn
+		target     string
+		err        error
+	)
+	for i, tg := range targets {
+		target = tg
+		remoteConn, err = client.Dial("tcp", target)
+		t.markBackend(target, err)
+		if err == nil {
+			break
+		}
+		if i < len(targets)-1 {
+			t.log().Warnw("failed to dial remote, fail over to the next backend", "client", local.RemoteAddr().String(),
+				"target", target, "next", targets[i+1], "error", err)
+			continue
+		}
+		t.log().Warnw("failed to dial remote", "client", local.RemoteAddr().String(), "target", target, "error", err)
+	}
+	if onDialed != nil {
+		if e := onDialed(err); e != nil && err == nil {
+			_ = remoteConn.Close()
+			err = e
+		}
+	}
+	if err != nil {
+		t.connLimit.release()
+		_ = local.Close()
+		return err
+	}
+	cnt := t.newConnector(local, remoteConn, client, target)
+	go cnt.forward()
+	return nil
+}
+
 func (t *Tunnel) Down(waitDone chan<- error) {
+	if t.removed() {
+		if waitDone != nil {
+			waitDone <- errTunnelRemoved
+		}
+		return
+	}
 	if !t.running() {
 		if waitDone != nil {
 			waitDone <- nil
 		}
 		return
 	}
-	t.works <- func() error {
+	err := t.submitOr(func() error {
+		if t.removed() {
+			if waitDone != nil {
+				waitDone <- errTunnelRemoved
+			}
+			return nil
+		}
 		t.connectors.Ascend(func(i btree.Item) bool {
 			cnt := i.(*Connector)
+			cnt.setCloseReason("tunnel closed")
 			cnt.breakDown()
+			t.recordClosed(cnt)
+			t.connLimit.release()
 			return true
 		})
 		t.connectors.Clear(false)
+		atomic.StoreInt64(&t.connCount, 0)
+		// the connections are gone without being removed one by one
+		t.checkWarnConns()
+		t.closeRetiring()
+		t.dropPending()
+		t.closeClient()
 		t.setStatusError(StatusClosed, nil)
 		t.listener.Close()
+		t.closeUDP()
 		if waitDone != nil {
 			waitDone <- nil
 		}
 		return nil
+	}, answer(waitDone))
+	if err != nil && waitDone != nil {
+		waitDone <- err
 	}
 }
 
 // the difference between Down() and Destroy() is that Destroy() exits the running
 // goroutine so that all subsequent works will failed, which making this tunnel unavailable
 func (t *Tunnel) Destroy(waitDone chan<- error) {
+	if t.removed() {
+		if waitDone != nil {
+			waitDone <- errTunnelRemoved
+		}
+		return
+	}
 	if !t.running() {
 		t.setStatusError(StatusRemoved, nil)
+		t.finish()
 		if waitDone != nil {
 			waitDone <- nil
 		}
 		return
 	}
-	t.works <- func() error {
+	err := t.submitOr(func() error {
+		if t.removed() {
+			if waitDone != nil {
+				waitDone <- errTunnelRemoved
+			}
+			return nil
+		}
 		t.connectors.Ascend(func(i btree.Item) bool {
 			cnt := i.(*Connector)
+			cnt.setCloseReason("tunnel closed")
 			cnt.breakDown()
+			t.recordClosed(cnt)
+			t.connLimit.release()
 			return true
 		})
 		t.connectors.Clear(false)
+		atomic.StoreInt64(&t.connCount, 0)
+		// the connections are gone without being removed one by one
+		t.checkWarnConns()
+		t.closeRetiring()
+		t.dropPending()
+		t.closeClient()
 		t.setStatusError(StatusRemoved, nil)
 		t.listener.Close()
+		t.closeUDP()
 		if waitDone != nil {
 			waitDone <- nil
 		}
 		return nil
+	}, answer(waitDone))
+	if err != nil && waitDone != nil {
+		waitDone <- err
 	}
 }
 
 func (t *Tunnel) Reconnect(waitDone chan<- error) {
-	if !t.running() {
-		go t.Up()
+	if t.removed() {
+		if waitDone != nil {
+			waitDone <- errTunnelRemoved
+		}
+		return
 	}
-	if waitDone == nil {
-		t.works <- t.forceConnect
+	if t.startLoop() {
+		// not running, bringing it up is the reconnect
+		t.mu.Lock()
+		t.retries = 0
+		t.mu.Unlock()
+		go t.runOnce(waitDone)
 		return
 	}
-	t.works <- func() error {
-		_ = t.forceConnect()
-		waitDone <- nil
+	err := t.submitOr(func() error {
+		if t.removed() {
+			if waitDone != nil {
+				waitDone <- errTunnelRemoved
+			}
+			return nil
+		}
+		// brought up manually, the retries start over
+		t.mu.Lock()
+		t.retries = 0
+		t.mu.Unlock()
+		err := t.forceConnect()
+		if err != nil {
+			t.connectFailed(err)
+		}
+		if waitDone != nil {
+			waitDone <- err
+		}
 		return nil
+	}, answer(waitDone))
+	if err != nil && waitDone != nil {
+		waitDone <- err
 	}
 }
 
-func (t *Tunnel) UpdateStatus(st TunnelStatus, err error) {
-	t.works <- func() error {
-		t.setStatusError(st, err)
+// SoftReconnect replaces the ssh client of a healthy tunnel with a new one without
+// dropping the serving connections, which are drained on the old client. A tunnel
+// which is not connected is reconnected the hard way.
+func (t *Tunnel) SoftReconnect(waitDone chan<- error) {
+	if !t.running() {
+		t.Reconnect(waitDone)
+		return
+	}
+	err := t.submitOr(func() error {
+		if t.removed() {
+			if waitDone != nil {
+				waitDone <- errTunnelRemoved
+			}
+			return nil
+		}
+		err := t.softConnect()
+		if waitDone != nil {
+			waitDone <- err
+		}
 		return nil
+	}, answer(waitDone))
+	if err != nil && waitDone != nil {
+		waitDone <- err
 	}
 }
 
-func (t *Tunnel) setStatusError(st TunnelStatus, err error) {
+// Rekey replaces the private key the tunnel authenticates with, e.g. after the key is rotated,
+// and reconnects the tunnel with it. The key is parsed before anything is changed, an invalid
+// one is returned as error and the tunnel is left as it is. The result of reconnecting is sent
+// to waitDone, a tunnel which isn't running, e.g. its previous key was rejected, is brought up
+// with the new key. A connected tunnel failing to reconnect with the new key keeps serving with
+// the previous one.
+func (t *Tunnel) Rekey(pk io.Reader, waitDone chan<- error) error {
+	if t.authCallback != nil {
+		return errors.New("the tunnel authenticates with a callback instead of a key")
+	}
+	key := new(bytes.Buffer)
+	if _, err := key.ReadFrom(pk); err != nil {
+		return err
+	}
+	signer, err := sh.ParsePrivateKey(key.Bytes())
+	if err != nil {
+		return err
+	}
+	if t.removed() {
+		return errTunnelRemoved
+	}
+	if t.startLoop() {
+		// nobody runs the tunnel, e.g. the previous key was rejected, it's brought up with the
+		// new key
+		if err := t.configAuth(signer); err != nil {
+			t.mu.Lock()
+			t.looping = false
+			t.mu.Unlock()
+			t.abort(err)
+			return err
+		}
+		t.log().Infow("private key is replaced, connecting", "fingerprint", sh.FingerprintSHA256(signer.PublicKey()))
+		t.mu.Lock()
+		t.retries = 0
+		t.mu.Unlock()
+		go t.runOnce(waitDone)
+		return nil
+	}
+	return t.submitOr(func() error {
+		if t.removed() {
+			if waitDone != nil {
+				waitDone <- errTunnelRemoved
+			}
+			return nil
+		}
+		// sshConfig is only read by dialing in the running goroutine
+		previous := t.sshConfig.Auth
+		if err := t.configAuth(signer); err != nil {
+			if waitDone != nil {
+				waitDone <- err
+			}
+			return nil
+		}
+		t.log().Infow("private key is replaced, reconnecting", "fingerprint", sh.FingerprintSHA256(signer.PublicKey()))
+		var err error
+		if t.Status()&StatusConnected == StatusConnected {
+			// the current connection keeps serving if the new key is rejected, so is the old key
+			if err = t.softConnect(); err != nil {
+				t.log().Warnw("failed to reconnect with the new private key, keep the previous one", "error", err)
+				t.sshConfig.Auth = previous
+			}
+		} else if err = t.forceConnect(); err != nil {
+			t.connectFailed(err)
+		}
+		if waitDone != nil {
+			waitDone <- err
+		}
+		return nil
+	}, answer(waitDone))
+}
+
+// Edit changes the local address, the ssh server and the remote of the tunnel, an empty one is
+// left as it is. They are validated like NewTunnel does before anything is changed, an invalid
+// one is returned as error. The tunnel is reconnected to apply them: a new local address is
+// listened instead of the current one, a new server is dialed as the user given. The result of
+// reconnecting is sent to waitDone, a tunnel which isn't running is brought up.
+func (t *Tunnel) Edit(local, server, remote string, waitDone chan<- error) error {
+	if local != "" {
+		_, localPort, err := net.SplitHostPort(local)
+		if err != nil {
+			return errInvalidLocalAddr
+		}
+		if _, err := strconv.Atoi(localPort); err != nil {
+			return err
+		}
+	}
+	if remote != "" {
+		if _, _, err := net.SplitHostPort(remote); err != nil {
+			return errMissedPort
+		}
+	}
+	var user, serverAddr string
+	if server != "" {
+		at := strings.LastIndex(server, "@")
+		if at < 0 {
+			return errAnonymous
+		}
+		var err error
+		if serverAddr, err = withSSHPort(server[at+1:]); err != nil {
+			return err
+		}
+		user = server[:at]
+	}
+	if t.removed() {
+		return errTunnelRemoved
+	}
+	if t.startLoop() {
+		// nobody runs the tunnel, e.g. it failed to connect, it's brought up with the new
+		// addresses
+		t.edit(local, serverAddr, user, remote)
+		t.log().Infow("tunnel is edited, connecting", "local", t.Local, "server", t.SSHUri, "remote", t.ForwardTo)
+		go t.runOnce(waitDone)
+		return nil
+	}
+	return t.submitOr(func() error {
+		if t.removed() {
+			if waitDone != nil {
+				waitDone <- errTunnelRemoved
+			}
+			return nil
+		}
+		t.edit(local, serverAddr, user, remote)
+		t.log().Infow("tunnel is edited, reconnecting", "local", t.Local, "server", t.SSHUri, "remote", t.ForwardTo)
+		err := t.forceConnect()
+		if err != nil {
+			t.connectFailed(err)
+		}
+		if waitDone != nil {
+			waitDone <- err
+		}
+		return nil
+	}, answer(waitDone))
+}
+
+// edit changes the addresses of the tunnel validated by Edit, the empty ones are kept. It runs
+// in the running goroutine or before it's started.
+func (t *Tunnel) edit(local, serverAddr, user, remote string) {
+	// the listener of the previous address is closed so that forceConnect listens again,
+	// a reverse tunnel only dials it
+	if local != "" && local != t.Local && !t.reverse && t.listener != nil {
+		_ = t.listener.Close()
+		t.listener = nil
+		t.closeUDP()
+	}
 	t.mu.Lock()
 	defer t.mu.Unlock()
+	if local != "" {
+		t.Local = local
+	}
+	if remote != "" {
+		t.ForwardTo = remote
+	}
+	if serverAddr != "" {
+		t.SSHUri = serverAddr
+		// the auth methods and the callbacks are kept, only the user is new
+		config := *t.sshConfig
+		config.User = user
+		t.sshConfig = &config
+	}
+	t.retries = 0
+}
+
+func (t *Tunnel) UpdateStatus(st TunnelStatus, err error) {
+	_ = t.submit(func() error {
+		if !t.removed() {
+			t.setStatusError(st, err)
+		}
+		return nil
+	})
+}
+
+// setStatusError changes the status and notifies OnStatus, if any. The handler is called
+// after mu is released so that it can read the tunnel, e.g. its Status.
+func (t *Tunnel) setStatusError(st TunnelStatus, err error) {
+	t.mu.Lock()
 	if err != nil {
 		st |= StatusError
 		t.err = err
+		t.lastErrorAt = time.Now()
+		t.errorCount++
 	}
-	t.status = st
+	// the running bit is owned by the running goroutine, an error doesn't stop it
+	t.status = st | t.status&StatusRunning
+	t.mu.Unlock()
 	if t.OnStatus != nil {
 		t.OnStatus(t)
 	}
 }
 
 func (t *Tunnel) User() string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
 	return t.sshConfig.User
 }
 
-func (t *Tunnel) newConnector(local, remote net.Conn) *Connector {
+func (t *Tunnel) newConnector(local, remote net.Conn, client *sh.Client, target string) *Connector {
 	t.cCount++
+	now := time.Now()
 	cnt := &Connector{
 		tunnel:     t,
 		localConn:  local,
 		remoteConn: remote,
-		openedAt:   time.Now(),
+		client:     client,
+		target:     target,
+		openedAt:   now,
+		lastActive: now.UnixNano(),
 		counter:    t.cCount,
 	}
 	t.connectors.ReplaceOrInsert(cnt)
+	atomic.AddInt64(&t.connCount, 1)
+	t.mu.Lock()
+	if active := t.connectors.Len(); active > t.peakConnectors {
+		t.peakConnectors = active
+	}
+	t.mu.Unlock()
+	t.checkWarnConns()
+	if t.onConnector != nil {
+		t.onConnector(t, cnt, false)
+	}
 	return cnt
 }
 
+// checkWarnConns flags the tunnel once its active connections exceed the warning
+// threshold, and clears the flag once they are back. It runs in the work loop.
+func (t *Tunnel) checkWarnConns() {
+	if t.warnConns <= 0 {
+		return
+	}
+	active := t.connectors.Len()
+	over := active > t.warnConns
+	t.mu.Lock()
+	changed := over != t.overWarnConns
+	t.overWarnConns = over
+	t.mu.Unlock()
+	if changed && over {
+		t.log().Warnw("too many connections", "active", active, "warn_connections", t.warnConns)
+	}
+}
+
+// WarnConnections returns the warning threshold of the active connections, 0 means never warn
+func (t *Tunnel) WarnConnections() int {
+	return t.warnConns
+}
+
+// OverWarnConnections tells whether the active connections are above the warning threshold
+func (t *Tunnel) OverWarnConnections() bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.overWarnConns
+}
+
+// IdleTimeout returns how long a connection may move no bytes before it's closed, 0 means never
+func (t *Tunnel) IdleTimeout() time.Duration {
+	return t.idleTimeout
+}
+
+// MaxConnectors returns the cap of the connections tracked at the same time, 0 means no cap
+func (t *Tunnel) MaxConnectors() int {
+	return t.maxConnectors
+}
+
+// PeakConnectors returns the most connections the tunnel has tracked at the same time
+func (t *Tunnel) PeakConnectors() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.peakConnectors
+}
+
+// Bytes returns the bytes received from the remotes and sent to them by all the connections of
+// the tunnel so far, the closed ones included. It doesn't wait on the work loop.
+func (t *Tunnel) Bytes() (in, out uint64) {
+	return atomic.LoadUint64(&t.bytesIn), atomic.LoadUint64(&t.bytesOut)
+}
+
+// LastError returns when the tunnel errored last time and how many times it has errored, the
+// time is zero if it never errored. They are kept after the tunnel recovers.
+func (t *Tunnel) LastError() (at time.Time, count int) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.lastErrorAt, t.errorCount
+}
+
+// CappedConnections returns how many connections were refused because the tunnel was at its
+// cap of connectors, see WithMaxConnectors
+func (t *Tunnel) CappedConnections() uint64 {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.cappedConnections
+}
+
 func (t *Tunnel) closeConnector(c *Connector) {
-	t.works <- func() error {
-		t.connectors.Delete(c)
+	_ = t.submit(func() error {
+		if t.connectors.Delete(c) == nil {
+			return nil
+		}
+		atomic.AddInt64(&t.connCount, -1)
+		t.connLimit.release()
+		t.checkWarnConns()
+		t.recordClosed(c)
+		if refs, ok := t.retiring[c.client]; ok {
+			if refs <= 1 {
+				delete(t.retiring, c.client)
+				_ = c.client.Close()
+			} else {
+				t.retiring[c.client] = refs - 1
+			}
+		}
 		return nil
-	}
+	})
+}
+
+// ConnectorCount returns how many connections the tunnel serves, unlike GetConnectors it
+// doesn't wait on the work loop
+func (t *Tunnel) ConnectorCount() int {
+	return int(atomic.LoadInt64(&t.connCount))
 }
 
 func (t *Tunnel) GetConnectors() []*Connector {
 	if !t.running() {
 		return nil
 	}
-	connChan := make(chan []*Connector)
-	t.works <- func() error {
+	connChan := make(chan []*Connector, 1)
+	err := t.submitOr(func() error {
 		cs := make([]*Connector, 0, t.connectors.Len())
 		t.connectors.Ascend(func(i btree.Item) bool {
 			cs = append(cs, i.(*Connector))
@@ -388,6 +2083,151 @@ func (t *Tunnel) GetConnectors() []*Connector {
 		})
 		connChan <- cs
 		return nil
+	}, func(error) { connChan <- nil })
+	if err != nil {
+		return nil
+	}
+	return <-connChan
+}
+
+// recordClosed keeps the closed connector in the ring buffer of recently closed ones
+func (t *Tunnel) recordClosed(c *Connector) {
+	t.log().Debugw("connection closed", "client", c.Client(), "target", c.target, "reason", c.CloseReason())
+	if t.onConnector != nil {
+		t.onConnector(t, c, true)
+	}
+	if len(t.recentlyClosed) < closedHistory {
+		t.recentlyClosed = append(t.recentlyClosed, c)
+	} else {
+		t.recentlyClosed[t.next] = c
+	}
+	t.next = (t.next + 1) % closedHistory
+}
+
+// NewSession opens a session on the ssh connection of the tunnel for running commands. The
+// environment variables of the tunnel are requested on it, those rejected by the server,
+// e.g. not in its AcceptEnv, are ignored.
+func (t *Tunnel) NewSession() (*sh.Session, error) {
+	if t.Status()&StatusConnected != StatusConnected {
+		return nil, errNotConnected
+	}
+	clientChan := make(chan *sh.Client, 1)
+	err := t.submitOr(func() error {
+		clientChan <- t.sshClient
+		return nil
+	}, func(error) { clientChan <- nil })
+	if err != nil {
+		return nil, err
+	}
+	client := <-clientChan
+	if client == nil {
+		return nil, errNotConnected
+	}
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range t.env {
+		if err := session.Setenv(name, value); err != nil {
+			t.log().Debugw("environment variable rejected by the server", "name", name, "error", err)
+		}
+	}
+	return session, nil
+}
+
+// SessionParams the parameters of the current ssh connection of a tunnel.
+// x/crypto/ssh doesn't expose the negotiated cipher, MAC and key exchange, only the
+// algorithms the client offers are known, empty means the defaults of x/crypto/ssh.
+type SessionParams struct {
+	User          string
+	ServerVersion string
+	ClientVersion string
+
+	// SessionID the hex of the session identifier, from the first key exchange
+	SessionID string
+
+	LocalAddr  string
+	RemoteAddr string
+
+	// HostKeyType the negotiated host key algorithm, e.g. ssh-ed25519
+	HostKeyType        string
+	HostKeyFingerprint string
+
+	ConnectedAt time.Time
+
+	Ciphers      []string
+	MACs         []string
+	KeyExchanges []string
+}
+
+// Session returns the parameters of the current ssh connection, it's read only and
+// reuses the established client.
+func (t *Tunnel) Session() (*SessionParams, error) {
+	if t.Status()&StatusConnected != StatusConnected {
+		return nil, errNotConnected
+	}
+	clientChan := make(chan *sh.Client, 1)
+	err := t.submitOr(func() error {
+		clientChan <- t.sshClient
+		return nil
+	}, func(error) { clientChan <- nil })
+	if err != nil {
+		return nil, err
+	}
+	client := <-clientChan
+	if client == nil {
+		return nil, errNotConnected
+	}
+	t.mu.RLock()
+	config := t.sshConfig
+	t.mu.RUnlock()
+	params := &SessionParams{
+		User:          config.User,
+		ServerVersion: string(client.ServerVersion()),
+		ClientVersion: string(client.ClientVersion()),
+		SessionID:     hex.EncodeToString(client.SessionID()),
+		LocalAddr:     client.LocalAddr().String(),
+		RemoteAddr:    client.RemoteAddr().String(),
+		Ciphers:       config.Ciphers,
+		MACs:          config.MACs,
+		KeyExchanges:  config.KeyExchanges,
+	}
+	t.mu.RLock()
+	if t.hostKey != nil {
+		params.HostKeyType = t.hostKey.Type()
+		params.HostKeyFingerprint = sh.FingerprintSHA256(t.hostKey)
+	}
+	params.ConnectedAt = t.connectedAt
+	t.mu.RUnlock()
+	return params, nil
+}
+
+// Env returns the environment variables requested on the sessions of the tunnel
+func (t *Tunnel) Env() map[string]string {
+	env := make(map[string]string, len(t.env))
+	for k, v := range t.env {
+		env[k] = v
+	}
+	return env
+}
+
+// ClosedConnectors returns the recently closed connectors, the latest first
+func (t *Tunnel) ClosedConnectors() []*Connector {
+	if !t.running() {
+		return nil
+	}
+	connChan := make(chan []*Connector, 1)
+	err := t.submitOr(func() error {
+		cs := make([]*Connector, 0, len(t.recentlyClosed))
+		for i := 1; i <= len(t.recentlyClosed); i++ {
+			idx := (t.next - i + closedHistory) % closedHistory
+			cs = append(cs, t.recentlyClosed[idx])
+		}
+		connChan <- cs
+		return nil
+	}, func(error) { connChan <- nil })
+	if err != nil {
+		return nil
 	}
 	return <-connChan
 }
@@ -400,61 +2240,203 @@ func (t *Tunnel) running() bool {
 	return t.Status()&StatusRunning == StatusRunning
 }
 
+func (t *Tunnel) removed() bool {
+	return t.Status()&StatusRemoved == StatusRemoved
+}
+
 // NewTunnel create a new Tunnel forwarding packages from <local> to <remote> which is in the
 // network of ssh server <server>. 'server' is in form of 'user@host:port', if port is absent,
 // the default ssh port 22 is used. 'remote' is in form of 'host:port',
-// 'pk' should contain the private key of this tunnel.
-func NewTunnel(local string, server string, remote string, pk io.Reader, onStatus tunnelHandler, sshTimeout time.Duration) (tn *Tunnel, err error) {
-	locals := strings.Split(local, ":")
-	if len(locals) < 2 {
+// 'pk' should contain the private key of this tunnel, it can be nil if WithAuthCallback is
+// given. 'opts' customize the optional behaviors.
+func NewTunnel(local string, server string, remote string, pk io.Reader, onStatus tunnelHandler, sshTimeout time.Duration, opts ...Option) (tn *Tunnel, err error) {
+	// the hosts may be IPv6 literals in brackets, e.g. [::1]:8080
+	_, localPort, err := net.SplitHostPort(local)
+	if err != nil {
 		return nil, errInvalidLocalAddr
 	}
 
-	if _, err := strconv.Atoi(locals[1]); err != nil {
+	if _, err := strconv.Atoi(localPort); err != nil {
 		return nil, err
 	}
 
-	serverParts := strings.Split(server, "@")
-	if len(serverParts) < 2 {
-		return nil, errAnonymous
-	}
-
-	remoteParts := strings.Split(remote, ":")
-	if len(remoteParts) < 2 {
-		return nil, errMissedPort
+	// an empty remote makes a SOCKS5 tunnel
+	if remote != "" {
+		if _, _, err := net.SplitHostPort(remote); err != nil {
+			return nil, errMissedPort
+		}
 	}
 
-	key := new(bytes.Buffer)
-	_, err = key.ReadFrom(pk)
+	tn, signer, err := newClientTunnel(server, pk, sshTimeout)
 	if err != nil {
 		return nil, err
 	}
+	tn.Local = local
+	tn.ForwardTo = remote
+	tn.OnStatus = onStatus
+	for _, opt := range opts {
+		opt(tn)
+	}
+	if tn.reverse && (tn.Dynamic() || tn.udp || tn.remoteProbes > 0 || len(tn.backends) > 0) {
+		return nil, errReverseOptions
+	}
+	if tn.remoteBind != "" && !tn.reverse {
+		return nil, errRemoteBindForward
+	}
+	if tn.Dynamic() && (tn.udp || tn.remoteProbes > 0 || len(tn.backends) > 0) {
+		return nil, errDynamicRemote
+	}
+	if err := tn.configAuth(signer); err != nil {
+		return nil, err
+	}
+	return tn, nil
+}
 
-	signer, err := sh.ParsePrivateKey(key.Bytes())
+// newClientTunnel parses the ssh server and the private key into a Tunnel which is able to dial
+// the ssh server but forwards nothing, the options and the auth methods are left to the caller.
+func newClientTunnel(server string, pk io.Reader, sshTimeout time.Duration) (*Tunnel, sh.Signer, error) {
+	// the host is after the last @, it may be an IPv6 literal in brackets, e.g. user@[::1]:22
+	at := strings.LastIndex(server, "@")
+	if at < 0 {
+		return nil, nil, errAnonymous
+	}
+	serverAddr, err := withSSHPort(server[at+1:])
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	serverParts := []string{server[:at], serverAddr}
+
+	// the private key is optional if the auth methods come from an AuthCallback
+	var signer sh.Signer
+	if pk != nil {
+		key := new(bytes.Buffer)
+		if _, err := key.ReadFrom(pk); err != nil {
+			return nil, nil, err
+		}
+		var err error
+		if signer, err = sh.ParsePrivateKey(key.Bytes()); err != nil {
+			return nil, nil, err
+		}
 	}
 
 	sshConfig := &sh.ClientConfig{
 		User: serverParts[0],
-		Auth: []sh.AuthMethod{sh.PublicKeys(signer)},
 		HostKeyCallback: func(hostname string, remote net.Addr, key sh.PublicKey) error {
 			// Always accept key.
 			return nil
 		},
-		Timeout: sshTimeout,
 	}
 
-	tn = &Tunnel{
-		Local:               local,
-		SSHUri:              serverParts[1],
-		ForwardTo:           remote,
-		sshConfig:           sshConfig,
-		connectors:          btree.New(2),
-		OnStatus:            onStatus,
-		status:              StatusNew,
-		works:               make(chan func() error, 1),
-		healthCheckInterval: sshTimeout,
+	tn := &Tunnel{
+		SSHUri:             serverParts[1],
+		sshConfig:          sshConfig,
+		connectors:         btree.New(2),
+		retiring:           make(map[*sh.Client]int),
+		drainTimeout:       defaultDrainTimeout,
+		pendingSize:        defaultPendingSize,
+		pendingTimeout:     defaultPendingTimeout,
+		status:             StatusNew,
+		works:              make(chan work, 1),
+		done:               make(chan struct{}),
+		keepaliveInterval:  sshTimeout,
+		dialTimeout:        defaultDialTimeout,
+		autoReconnect:      true,
+		keepalive:          KeepaliveGlobalRequest,
+		keepaliveReply:     true,
+		maxKeepaliveMisses: 1,
+		balance:            BalanceRoundRobin,
+		backendDown:        make(map[string]time.Time),
 	}
-	return tn, nil
+	return tn, signer, nil
+}
+
+// withSSHPort fills the missing port of the ssh server address with the default ssh port, e.g.
+// host becomes host:22 and [::1] or ::1 becomes [::1]:22
+func withSSHPort(addr string) (string, error) {
+	_, _, err := net.SplitHostPort(addr)
+	if err == nil {
+		return addr, nil
+	}
+	if ae, ok := err.(*net.AddrError); ok && ae.Err == "missing port in address" {
+		return net.JoinHostPort(strings.Trim(addr, "[]"), defaultSSHPort), nil
+	}
+	// an IPv6 literal without brackets has no port
+	if net.ParseIP(addr) != nil {
+		return net.JoinHostPort(addr, defaultSSHPort), nil
+	}
+	return "", errInvalidServerAddr
+}
+
+// configAuth sets the auth methods of the tunnel, the agent is tried before the key if configured,
+// it's used alone without a key.
+// The auth callback, if any, takes over and is called on every dialing instead.
+func (t *Tunnel) configAuth(signer sh.Signer) error {
+	if t.authCallback != nil {
+		return nil
+	}
+	methods := make([]sh.AuthMethod, 0, 2)
+	if t.agentSocket != "" {
+		methods = append(methods, publicKeysWithAgent(t.agentSocket, signer))
+	} else if signer != nil {
+		methods = append(methods, sh.PublicKeys(signer))
+	}
+	// the keys are preferred, the password is only sent if they are rejected
+	if t.password != "" {
+		methods = append(methods, sh.Password(t.password))
+	}
+	// tried after the key, a server with 2FA asks for both
+	if t.challenge != nil {
+		methods = append(methods, sh.KeyboardInteractive(t.challenge))
+	}
+	if len(methods) == 0 {
+		return ErrNoAuth
+	}
+	t.sshConfig.Auth = methods
+	return nil
+}
+
+// AuthResult what is learned from a successful handshake with an ssh server
+type AuthResult struct {
+	ServerVersion string
+	ClientVersion string
+
+	// HostKeyType the negotiated host key algorithm, e.g. ssh-ed25519
+	HostKeyType string
+
+	HostKeyFingerprint string
+
+	// Took how long the handshake and authentication took
+	Took time.Duration
+}
+
+// AuthTest only performs the ssh handshake and authentication with the server like a tunnel
+// does when connecting, no local port is listened and nothing is forwarded. 'server' and 'pk'
+// are the same as NewTunnel's, an *AuthError is returned if the server rejects the key.
+func AuthTest(server string, pk io.Reader, sshTimeout time.Duration, opts ...Option) (*AuthResult, error) {
+	tn, signer, err := newClientTunnel(server, pk, sshTimeout)
+	if err != nil {
+		return nil, err
+	}
+	tn.dialTimeout = sshTimeout
+	for _, opt := range opts {
+		opt(tn)
+	}
+	if err := tn.configAuth(signer); err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	client, hostKey, err := tn.dial()
+	if err != nil {
+		return nil, classifyDialError(err)
+	}
+	result := &AuthResult{
+		ServerVersion:      string(client.ServerVersion()),
+		ClientVersion:      string(client.ClientVersion()),
+		HostKeyType:        hostKey.Type(),
+		HostKeyFingerprint: sh.FingerprintSHA256(hostKey),
+		Took:               time.Since(start),
+	}
+	_ = client.Close()
+	return result, nil
 }
@@ -2,8 +2,13 @@ package ssh
 
 import (
 	"bytes"
+	"errors"
+	sh "golang.org/x/crypto/ssh"
+	"io"
 	"io/ioutil"
 	"net"
+	"runtime"
+	"strings"
 	"testing"
 	"time"
 )
@@ -29,6 +34,46 @@ func TestNewTunnel(t *testing.T) {
 	}
 }
 
+func TestNewTunnel_IPv6(t *testing.T) {
+	tn, err := NewTunnel("[::1]:1080", "user@[2001:db8::2]:22", "[2001:db8::1]:80", testKey(t), nil, time.Second)
+	if err != nil {
+		t.Fatalf("can not init a tunnel of IPv6 addresses, error: %s", err.Error())
+	}
+	if tn.Local != "[::1]:1080" || tn.SSHUri != "[2001:db8::2]:22" || tn.ForwardTo != "[2001:db8::1]:80" {
+		t.Errorf("unexpected addresses %s", tn.String())
+	}
+	if tn.sshConfig.User != "user" {
+		t.Errorf("expected the user to be user, got %s", tn.sshConfig.User)
+	}
+
+	// the port of the ssh server defaults to 22
+	for server, want := range map[string]string{
+		"user@host.com":    "host.com:22",
+		"user@[::1]":       "[::1]:22",
+		"user@fe80::1":     "[fe80::1]:22",
+		"user@host.com:23": "host.com:23",
+	} {
+		if tn, err := NewTunnel("[::1]:1080", server, "[::1]:80", testKey(t), nil, time.Second); err != nil || tn.SSHUri != want {
+			t.Errorf("NewTunnel with server %s: %v, want %s", server, err, want)
+		}
+	}
+
+	cases := []struct {
+		local, server, remote string
+		want                  error
+	}{
+		{"::1:1080", "user@[::1]:22", "[::1]:80", errInvalidLocalAddr},
+		{"[::1]:1080", "user@[::1]:22", "2001:db8::1", errMissedPort},
+		{"[::1]:1080", "user@[::1]:22:22", "[::1]:80", errInvalidServerAddr},
+		{"[::1]:1080", "[::1]:22", "[::1]:80", errAnonymous},
+	}
+	for _, c := range cases {
+		if _, err := NewTunnel(c.local, c.server, c.remote, testKey(t), nil, time.Second); err != c.want {
+			t.Errorf("NewTunnel(%s, %s, %s) = %v, want %v", c.local, c.server, c.remote, err, c.want)
+		}
+	}
+}
+
 func TestTunnel_Up(t *testing.T) {
 	keyFile, err := ioutil.ReadFile(privateKeyPath)
 	if err != nil {
@@ -53,3 +98,1377 @@ func TestTunnel_Up(t *testing.T) {
 		t.Errorf("can not write to tunnel, error: %s", err.Error())
 	}
 }
+
+func TestCloseReason(t *testing.T) {
+	cases := []struct {
+		side string
+		err  error
+		want string
+	}{
+		{"remote", nil, "remote closed"},
+		{"local", errors.New("read tcp 127.0.0.1:1->127.0.0.1:2: read: connection reset by peer"), "local reset"},
+		{"remote", errors.New("broken pipe"), "remote error: broken pipe"},
+	}
+	for _, c := range cases {
+		if got := closeReason(c.side, c.err); got != c.want {
+			t.Errorf("closeReason(%s, %v) = %s, want %s", c.side, c.err, got, c.want)
+		}
+	}
+}
+
+func TestTunnel_HoldConnectionsWhileReconnecting(t *testing.T) {
+	server := newTestServer(t)
+	defer server.stop()
+	echo := echoServer(t)
+	defer echo.Close()
+
+	localAddr := freeAddr(t)
+	tn, err := NewTunnel(localAddr, "mario@"+server.addr, echo.Addr().String(), testKey(t), nil, 200*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go tn.Up()
+	defer tn.Destroy(nil)
+	waitStatus(t, tn, 2*time.Second, isConnected)
+
+	// the ssh server goes away, the health check notices it
+	server.stop()
+	waitStatus(t, tn, 2*time.Second, func(st TunnelStatus) bool { return st&StatusError == StatusError })
+
+	// the local port is still bound, the client waits instead of being refused
+	conn, err := net.Dial("tcp", localAddr)
+	if err != nil {
+		t.Fatalf("local listener should be kept while reconnecting: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	server.start()
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("the held connection should be forwarded once reconnected: %v", err)
+	}
+	if string(buf) != "hello" {
+		t.Errorf("got %q, want hello", buf)
+	}
+	if tn.Reconnects() != 1 || !strings.HasPrefix(tn.ServerVersion(), "SSH-2.0-") {
+		t.Errorf("unexpected reconnects %d and server version %q", tn.Reconnects(), tn.ServerVersion())
+	}
+}
+
+func TestTunnel_NewSessionWithEnv(t *testing.T) {
+	server := newTestServer(t)
+	defer server.stop()
+	server.acceptEnv["LANG"] = true
+
+	env := map[string]string{"LANG": "C", "SECRET": "rejected"}
+	tn, err := NewTunnel(freeAddr(t), "mario@"+server.addr, "127.0.0.1:1", testKey(t), nil, time.Second, WithEnv(env))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go tn.Up()
+	defer tn.Destroy(nil)
+	waitStatus(t, tn, 2*time.Second, isConnected)
+
+	session, err := tn.NewSession()
+	if err != nil {
+		t.Fatalf("the rejected environment variable should be ignored: %v", err)
+	}
+	_ = session.Close()
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if len(server.env) != 1 || server.env["LANG"] != "C" {
+		t.Errorf("unexpected environment variables on the server: %v", server.env)
+	}
+}
+
+func TestAuthTest(t *testing.T) {
+	server := newTestServer(t)
+	defer server.stop()
+
+	result, err := AuthTest("mario@"+server.addr, testKey(t), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(result.ServerVersion, "SSH-2.0-") {
+		t.Errorf("unexpected server version %q", result.ServerVersion)
+	}
+	if result.HostKeyType != sh.KeyAlgoECDSA256 || !strings.HasPrefix(result.HostKeyFingerprint, "SHA256:") {
+		t.Errorf("unexpected host key %s %s", result.HostKeyType, result.HostKeyFingerprint)
+	}
+
+	_, err = AuthTest("denied@"+server.addr, testKey(t), time.Second)
+	if _, ok := err.(*AuthError); !ok {
+		t.Errorf("expected an auth error, got %v", err)
+	}
+}
+
+func TestTunnel_Session(t *testing.T) {
+	server := newTestServer(t)
+	defer server.stop()
+
+	tn, err := NewTunnel(freeAddr(t), "mario@"+server.addr, "127.0.0.1:1", testKey(t), nil, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tn.Session(); err != errNotConnected {
+		t.Errorf("expected %v before connecting, got %v", errNotConnected, err)
+	}
+	go tn.Up()
+	defer tn.Destroy(nil)
+	waitStatus(t, tn, 2*time.Second, isConnected)
+
+	params, err := tn.Session()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params.User != "mario" || params.RemoteAddr != server.addr || len(params.SessionID) != 64 {
+		t.Errorf("unexpected session %+v", params)
+	}
+	if params.HostKeyType != sh.KeyAlgoECDSA256 || !strings.HasPrefix(params.HostKeyFingerprint, "SHA256:") {
+		t.Errorf("unexpected host key %s %s", params.HostKeyType, params.HostKeyFingerprint)
+	}
+}
+
+func TestTunnel_SubmitConnectFailed(t *testing.T) {
+	// nothing listens on the server, connecting fails
+	tn, err := NewTunnel(freeAddr(t), "mario@"+freeAddr(t), "127.0.0.1:1", testKey(t), nil, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tn.start()
+	waiting := make(chan error, 3)
+	tn.Reconnect(waiting)
+	if err := tn.submitOr(func() error {
+		waiting <- nil
+		return nil
+	}, answer(waiting)); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-waiting:
+			if err == nil {
+				t.Error("expected the works aborted once connecting failed")
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("the works are left waiting after connecting failed")
+		}
+	}
+
+	// nothing is left in the queue, bringing it up again is answered too
+	tn.Reconnect(waiting)
+	select {
+	case err := <-waiting:
+		if err == nil {
+			t.Error("expected reconnecting failed")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("reconnecting is blocked by the works left")
+	}
+	if err := tn.submitOr(func() error { return nil }, answer(waiting)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-waiting:
+		if err == nil {
+			t.Error("expected the work submitted to the stopped tunnel aborted")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the work submitted to the stopped tunnel is left waiting")
+	}
+}
+
+func TestTunnel_DownAfterDestroy(t *testing.T) {
+	server := newTestServer(t)
+	defer server.stop()
+
+	tn, err := NewTunnel(freeAddr(t), "mario@"+server.addr, "127.0.0.1:1", testKey(t), nil, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go tn.Up()
+	waitStatus(t, tn, 2*time.Second, isConnected)
+
+	tn.Destroy(nil)
+	waiting := make(chan error, 2)
+	tn.Down(waiting)
+	tn.Reconnect(waiting)
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-waiting:
+			if err != errTunnelRemoved {
+				t.Errorf("expected %v, got %v", errTunnelRemoved, err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("works submitted after Destroy are blocked")
+		}
+	}
+	if cs := tn.GetConnectors(); cs != nil {
+		t.Errorf("a removed tunnel has no connectors, got %v", cs)
+	}
+	if _, err := tn.NewSession(); err == nil {
+		t.Error("expected an error opening a session on a removed tunnel")
+	}
+}
+
+func TestTunnel_DownClosesClient(t *testing.T) {
+	server := newTestServer(t)
+	defer server.stop()
+
+	tn, err := NewTunnel(freeAddr(t), "mario@"+server.addr, "127.0.0.1:1", testKey(t), nil, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go tn.Up()
+	defer tn.Destroy(nil)
+	waitStatus(t, tn, 2*time.Second, isConnected)
+	server.waitClients(1, 2*time.Second)
+
+	waiting := make(chan error, 1)
+	tn.Down(waiting)
+	if err := <-waiting; err != nil {
+		t.Fatal(err)
+	}
+	server.waitClients(0, 2*time.Second)
+
+	// it's dialed again when brought up
+	tn.Reconnect(waiting)
+	if err := <-waiting; err != nil {
+		t.Fatal(err)
+	}
+	server.waitClients(1, 2*time.Second)
+}
+
+func TestTunnel_DestroyUnwindsForwarders(t *testing.T) {
+	server := newTestServer(t)
+	defer server.stop()
+	echo := echoServer(t)
+	defer echo.Close()
+
+	localAddr := freeAddr(t)
+	tn, err := NewTunnel(localAddr, "mario@"+server.addr, echo.Addr().String(), testKey(t), nil, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go tn.Up()
+	waitStatus(t, tn, 2*time.Second, isConnected)
+	baseline := runtime.NumGoroutine()
+
+	for i := 0; i < 5; i++ {
+		conn, err := net.Dial("tcp", localAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if _, err := conn.Write([]byte("a")); err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := io.ReadFull(conn, make([]byte, 1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	waiting := make(chan error, 1)
+	tn.Destroy(waiting)
+	<-waiting
+	deadline := time.Now().Add(3 * time.Second)
+	for runtime.NumGoroutine() > baseline {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			t.Fatalf("%d goroutines left, %d before the connections:\n%s",
+				runtime.NumGoroutine(), baseline, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTunnel_SessionKeepalive(t *testing.T) {
+	server := newTestServer(t)
+	defer server.stop()
+
+	tn, err := NewTunnel(freeAddr(t), "mario@"+server.addr, "127.0.0.1:1", testKey(t), nil, 100*time.Millisecond,
+		WithKeepalive(KeepaliveSession, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go tn.Up()
+	defer tn.Destroy(nil)
+	waitStatus(t, tn, 2*time.Second, isConnected)
+
+	// a few health checks pass
+	time.Sleep(350 * time.Millisecond)
+	if !isConnected(tn.Status()) {
+		t.Fatalf("the session keepalive failed: %v", tn.Error())
+	}
+
+	server.stop()
+	waitStatus(t, tn, 2*time.Second, func(st TunnelStatus) bool { return st&StatusError == StatusError })
+}
+
+func TestTunnel_PendingQueue(t *testing.T) {
+	server := newTestServer(t)
+	defer server.stop()
+	echo := echoServer(t)
+	defer echo.Close()
+
+	localAddr := freeAddr(t)
+	tn, err := NewTunnel(localAddr, "mario@"+server.addr, echo.Addr().String(), testKey(t), nil, 200*time.Millisecond,
+		WithPendingQueue(2, time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go tn.Up()
+	defer tn.Destroy(nil)
+	waitStatus(t, tn, 2*time.Second, isConnected)
+
+	server.stop()
+	waitStatus(t, tn, 2*time.Second, func(st TunnelStatus) bool { return st&StatusError == StatusError })
+
+	conns := make([]net.Conn, 3)
+	for i := range conns {
+		conn, err := net.Dial("tcp", localAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conns[i] = conn
+	}
+
+	// the queue holds 2 connections, the third one is closed right away
+	_ = conns[2].SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conns[2].Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("the connection beyond the queue should be closed, got %v", err)
+	}
+
+	// the held ones are forwarded once reconnected
+	server.start()
+	for i, conn := range conns[:2] {
+		if _, err := conn.Write([]byte{byte('a' + i)}); err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		buf := make([]byte, 1)
+		if _, err := io.ReadFull(conn, buf); err != nil || buf[0] != byte('a'+i) {
+			t.Fatalf("the held connection %d should be forwarded, got %q, %v", i, buf, err)
+		}
+	}
+}
+
+func TestTunnel_PendingTimeout(t *testing.T) {
+	server := newTestServer(t)
+	defer server.stop()
+
+	localAddr := freeAddr(t)
+	tn, err := NewTunnel(localAddr, "mario@"+server.addr, "127.0.0.1:1", testKey(t), nil, 200*time.Millisecond,
+		WithPendingQueue(2, 300*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go tn.Up()
+	defer tn.Destroy(nil)
+	waitStatus(t, tn, 2*time.Second, isConnected)
+
+	server.stop()
+	waitStatus(t, tn, 2*time.Second, func(st TunnelStatus) bool { return st&StatusError == StatusError })
+
+	conn, err := net.Dial("tcp", localAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	start := time.Now()
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("the held connection should be closed after the timeout, got %v", err)
+	}
+	if took := time.Since(start); took < 200*time.Millisecond {
+		t.Errorf("the held connection is closed after %s, before the timeout", took)
+	}
+
+	pending := make(chan int, 1)
+	_ = tn.submit(func() error {
+		pending <- len(tn.pending)
+		return nil
+	})
+	if n := <-pending; n != 0 {
+		t.Errorf("%d connections are still held after the timeout", n)
+	}
+}
+
+func TestTunnel_CheckIntervalJitter(t *testing.T) {
+	tn := &Tunnel{keepaliveInterval: time.Second}
+	if d := tn.checkInterval(); d != time.Second {
+		t.Errorf("the interval without jitter should be kept, got %s", d)
+	}
+
+	WithJitter(0.2)(tn)
+	lo, hi := time.Second, time.Duration(0)
+	for i := 0; i < 1000; i++ {
+		d := tn.checkInterval()
+		if d < 800*time.Millisecond || d > 1200*time.Millisecond {
+			t.Fatalf("the interval %s is out of the jitter", d)
+		}
+		if d < lo {
+			lo = d
+		}
+		if d > hi {
+			hi = d
+		}
+	}
+	if hi-lo < 200*time.Millisecond {
+		t.Errorf("the intervals are not spread, between %s and %s", lo, hi)
+	}
+
+	WithJitter(3)(tn)
+	if tn.jitter != MaxJitter {
+		t.Errorf("the jitter should be capped at %v, got %v", MaxJitter, tn.jitter)
+	}
+}
+
+func TestTunnel_ConnectorHook(t *testing.T) {
+	server := newTestServer(t)
+	defer server.stop()
+	echo := echoServer(t)
+	defer echo.Close()
+
+	hooked := make(chan bool, 2)
+	localAddr := freeAddr(t)
+	tn, err := NewTunnel(localAddr, "mario@"+server.addr, echo.Addr().String(), testKey(t), nil, time.Second,
+		WithConnectorHook(func(tn *Tunnel, c *Connector, closed bool) {
+			if c.Target() == echo.Addr().String() {
+				hooked <- closed
+			}
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go tn.Up()
+	defer tn.Destroy(nil)
+	waitStatus(t, tn, 2*time.Second, isConnected)
+
+	conn, err := net.Dial("tcp", localAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []bool{false, true} {
+		select {
+		case closed := <-hooked:
+			if closed != want {
+				t.Fatalf("hooked with closed %v, want %v", closed, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("the hook isn't called with closed %v", want)
+		}
+		_ = conn.Close()
+	}
+}
+
+func TestTunnel_AuthCallback(t *testing.T) {
+	server := newTestServer(t)
+	defer server.stop()
+
+	if _, err := NewTunnel(freeAddr(t), "mario@"+server.addr, "127.0.0.1:1", nil, nil, time.Second); err != ErrNoAuth {
+		t.Errorf("expected %v without a key or a callback, got %v", ErrNoAuth, err)
+	}
+
+	signer, err := sh.ParsePrivateKey(testKey(t).Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls := make(chan struct{}, 10)
+	tn, err := NewTunnel(freeAddr(t), "mario@"+server.addr, "127.0.0.1:1", nil, nil, time.Second,
+		WithAuthCallback(func() ([]sh.AuthMethod, error) {
+			calls <- struct{}{}
+			return []sh.AuthMethod{sh.PublicKeys(signer)}, nil
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go tn.Up()
+	defer tn.Destroy(nil)
+	waitStatus(t, tn, 2*time.Second, isConnected)
+	if len(calls) != 1 {
+		t.Errorf("the callback should be called once for connecting, got %d", len(calls))
+	}
+}
+
+func TestTunnel_ListenRetry(t *testing.T) {
+	server := newTestServer(t)
+	defer server.stop()
+	echo := echoServer(t)
+	defer echo.Close()
+
+	// the local address is held for a moment when the tunnel is brought up
+	holder, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	localAddr := holder.Addr().String()
+	time.AfterFunc(2*listenRetryDelay, func() { _ = holder.Close() })
+
+	tn, err := NewTunnel(localAddr, "mario@"+server.addr, echo.Addr().String(), testKey(t), nil, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go tn.Up()
+	defer tn.Destroy(nil)
+	waitStatus(t, tn, 2*time.Second, isConnected)
+
+	// serve a connection so that the port is recently used, then reopen on it
+	conn, err := net.Dial("tcp", localAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+
+	waiting := make(chan error, 1)
+	tn.Down(waiting)
+	if err := <-waiting; err != nil {
+		t.Fatal(err)
+	}
+	tn.Reconnect(waiting)
+	if err := <-waiting; err != nil {
+		t.Fatalf("reopening on the recently closed port failed: %v", err)
+	}
+	waitStatus(t, tn, 2*time.Second, isConnected)
+}
+
+func TestTunnel_MaxConnectors(t *testing.T) {
+	server := newTestServer(t)
+	defer server.stop()
+	echo := echoServer(t)
+	defer echo.Close()
+
+	localAddr := freeAddr(t)
+	tn, err := NewTunnel(localAddr, "mario@"+server.addr, echo.Addr().String(), testKey(t), nil, time.Minute,
+		WithMaxConnectors(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go tn.Up()
+	defer tn.Destroy(nil)
+	waitStatus(t, tn, 2*time.Second, isConnected)
+
+	// the first connection is tracked and kept open
+	held, err := net.Dial("tcp", localAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Close()
+	_, _ = held.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	_ = held.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(held, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// the one beyond the cap is closed right away
+	refused, err := net.Dial("tcp", localAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer refused.Close()
+	_ = refused.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if n, err := refused.Read(buf); err == nil {
+		t.Fatalf("the connection beyond the cap should be closed, read %d bytes", n)
+	}
+
+	if got := tn.CappedConnections(); got != 1 {
+		t.Errorf("CappedConnections() = %d, want 1", got)
+	}
+	if got := tn.PeakConnectors(); got != 1 {
+		t.Errorf("PeakConnectors() = %d, want 1", got)
+	}
+}
+
+func TestTunnel_WarnConnectionsAfterDown(t *testing.T) {
+	server := newTestServer(t)
+	defer server.stop()
+	echo := echoServer(t)
+	defer echo.Close()
+
+	localAddr := freeAddr(t)
+	tn, err := NewTunnel(localAddr, "mario@"+server.addr, echo.Addr().String(), testKey(t), nil, time.Minute,
+		WithWarnConnections(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go tn.Up()
+	defer tn.Destroy(nil)
+	waitStatus(t, tn, 2*time.Second, isConnected)
+
+	buf := make([]byte, 4)
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", localAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		_, _ = conn.Write([]byte("ping"))
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !tn.OverWarnConnections() {
+		t.Fatal("expected the tunnel warning about 2 connections")
+	}
+
+	waiting := make(chan error, 1)
+	tn.Down(waiting)
+	if err := <-waiting; err != nil {
+		t.Fatal(err)
+	}
+	if tn.OverWarnConnections() {
+		t.Error("expected no warning once the tunnel is down")
+	}
+	tn.Reconnect(waiting)
+	if err := <-waiting; err != nil {
+		t.Fatal(err)
+	}
+	if tn.OverWarnConnections() {
+		t.Error("expected no warning left from before the tunnel was down")
+	}
+}
+
+func TestTunnel_KeyboardInteractive(t *testing.T) {
+	server := newTestServer(t)
+	defer server.stop()
+
+	answer := func(code string, asked chan<- []string) sh.KeyboardInteractiveChallenge {
+		return func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+			asked <- questions
+			answers := make([]string, len(questions))
+			for i := range questions {
+				answers[i] = code
+			}
+			return answers, nil
+		}
+	}
+
+	// the key of "denied" is rejected, the code is asked for instead
+	asked := make(chan []string, 10)
+	tn, err := NewTunnel(freeAddr(t), "denied@"+server.addr, "127.0.0.1:1", testKey(t), nil, time.Second,
+		WithKeyboardInteractive(answer(testOTP, asked)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go tn.Up()
+	defer tn.Destroy(nil)
+	waitStatus(t, tn, 2*time.Second, isConnected)
+	if questions := <-asked; len(questions) != 1 || questions[0] != "OTP: " {
+		t.Errorf("unexpected questions %v", questions)
+	}
+
+	// a wrong code doesn't get in, even without a key
+	wrong := make(chan []string, 10)
+	if _, err := AuthTest("denied@"+server.addr, nil, time.Second, WithKeyboardInteractive(answer("000000", wrong))); err == nil {
+		t.Error("a wrong code should be rejected")
+	}
+	if len(wrong) == 0 {
+		t.Error("the code should be asked for")
+	}
+}
+
+func TestTunnel_ResolvedIPs(t *testing.T) {
+	server := newTestServer(t)
+	defer server.stop()
+	_, port, _ := net.SplitHostPort(server.addr)
+
+	tn, err := NewTunnel(freeAddr(t), "mario@localhost:"+port, "127.0.0.1:1", testKey(t), nil, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go tn.Up()
+	defer tn.Destroy(nil)
+	waitStatus(t, tn, 2*time.Second, isConnected)
+
+	found := false
+	for _, ip := range tn.ResolvedIPs() {
+		found = found || ip == "127.0.0.1"
+	}
+	if !found {
+		t.Errorf("localhost should resolve to 127.0.0.1, got %v", tn.ResolvedIPs())
+	}
+}
+
+func TestTunnel_Standalone(t *testing.T) {
+	server := newTestServer(t)
+	defer server.stop()
+	echo := echoServer(t)
+	defer echo.Close()
+
+	serve := func(tn *Tunnel, localAddr string) {
+		conn, err := net.Dial("tcp", localAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		_, _ = conn.Write([]byte("ping"))
+		buf := make([]byte, 4)
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+			t.Fatalf("got %q through the tunnel, error: %v", buf, err)
+		}
+	}
+	down := func(tn *Tunnel) {
+		waiting := make(chan error, 1)
+		tn.Down(waiting)
+		if err := <-waiting; err != nil {
+			t.Fatal(err)
+		}
+		if st := tn.Status(); st&StatusClosed != StatusClosed {
+			t.Errorf("the tunnel should be closed, got %d", st)
+		}
+	}
+
+	// neither a status handler nor any option
+	localAddr := freeAddr(t)
+	tn, err := NewTunnel(localAddr, "mario@"+server.addr, echo.Addr().String(), testKey(t), nil, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go tn.Up()
+	waitStatus(t, tn, 2*time.Second, isConnected)
+	serve(tn, localAddr)
+	down(tn)
+	tn.Destroy(nil)
+
+	// a handler reading the tunnel it's notified of
+	statuses := make(chan TunnelStatus, 32)
+	localAddr = freeAddr(t)
+	tn, err = NewTunnel(localAddr, "mario@"+server.addr, echo.Addr().String(), testKey(t),
+		func(tn *Tunnel) { statuses <- tn.Status() }, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go tn.Up()
+	defer tn.Destroy(nil)
+	waitStatus(t, tn, 2*time.Second, isConnected)
+	serve(tn, localAddr)
+	down(tn)
+	if len(statuses) == 0 {
+		t.Error("the handler should be notified of the changes")
+	}
+}
+
+func TestTunnel_RemoteProbe(t *testing.T) {
+	server := newTestServer(t)
+	defer server.stop()
+	echo := echoServer(t)
+	remote := echo.Addr().String()
+
+	tn, err := NewTunnel(freeAddr(t), "mario@"+server.addr, remote, testKey(t), nil, time.Second,
+		WithHealthCheckInterval(100*time.Millisecond), WithRemoteProbe(2, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go tn.Up()
+	defer tn.Destroy(nil)
+	waitStatus(t, tn, 2*time.Second, isConnected)
+	time.Sleep(300 * time.Millisecond)
+	if tn.RemoteDown() {
+		t.Fatal("the remote should be up while it's listening")
+	}
+
+	// the ssh connection is still fine once the remote stops listening
+	echo.Close()
+	deadline := time.Now().Add(3 * time.Second)
+	for !tn.RemoteDown() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !tn.RemoteDown() {
+		t.Fatal("the remote should be down after the failed probes")
+	}
+	waitStatus(t, tn, 2*time.Second, func(st TunnelStatus) bool {
+		return isConnected(st) && tn.Reconnects() == 1
+	})
+	// it's reconnected only once for an outage
+	time.Sleep(500 * time.Millisecond)
+	if n := tn.Reconnects(); n != 1 {
+		t.Errorf("reconnected %d times for the remote being down, want 1", n)
+	}
+	if st := tn.Status(); !isConnected(st) || !tn.RemoteDown() {
+		t.Errorf("status %v, remote down: %v, want connected with the remote down", st, tn.RemoteDown())
+	}
+
+	// the remote is back on the same address
+	l, err := net.Listen("tcp", remote)
+	if err != nil {
+		t.Skip("the address of the remote is taken: ", err)
+	}
+	defer l.Close()
+	deadline = time.Now().Add(3 * time.Second)
+	for tn.RemoteDown() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if tn.RemoteDown() {
+		t.Error("the remote should be up once it's listening again")
+	}
+}
+
+func TestTunnel_Rekey(t *testing.T) {
+	server := newTestServer(t)
+	defer server.stop()
+
+	tn, err := NewTunnel(freeAddr(t), "mario@"+server.addr, "127.0.0.1:1", testKey(t), nil, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go tn.Up()
+	defer tn.Destroy(nil)
+	waitStatus(t, tn, 2*time.Second, isConnected)
+
+	waiting := make(chan error, 1)
+	if err := tn.Rekey(strings.NewReader("not a key"), waiting); err == nil {
+		t.Fatal("expected an invalid key to be rejected")
+	}
+	if n := tn.Reconnects(); n != 0 {
+		t.Errorf("reconnected %d times with an invalid key", n)
+	}
+
+	if err := tn.Rekey(testKey(t), waiting); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-waiting:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("not reconnected with the new key")
+	}
+	if !isConnected(tn.Status()) || tn.Reconnects() != 1 {
+		t.Errorf("expected the tunnel to be reconnected once, status %v, reconnects %d", tn.Status(), tn.Reconnects())
+	}
+}
+
+func TestTunnel_RekeyRejected(t *testing.T) {
+	server := newTestServer(t)
+	defer server.stop()
+	accepted := testKey(t)
+	signer, err := sh.ParsePrivateKey(accepted.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// restarted so that the callback is set before the server runs
+	server.stop()
+	server.config.PublicKeyCallback = func(conn sh.ConnMetadata, key sh.PublicKey) (*sh.Permissions, error) {
+		if !bytes.Equal(key.Marshal(), signer.PublicKey().Marshal()) {
+			return nil, errors.New("permission denied")
+		}
+		return nil, nil
+	}
+	server.start()
+
+	tn, err := NewTunnel(freeAddr(t), "mario@"+server.addr, "127.0.0.1:1", testKey(t), nil, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go tn.Up()
+	defer tn.Destroy(nil)
+	waitStatus(t, tn, 2*time.Second, func(st TunnelStatus) bool { return st&StatusFailed == StatusFailed })
+	waitStatus(t, tn, time.Second, func(TunnelStatus) bool { return !tn.isLooping() })
+
+	waiting := make(chan error, 1)
+	if err := tn.Rekey(accepted, waiting); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-waiting:
+		if err != nil {
+			t.Fatalf("expected connected with the new key, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the tunnel is not brought up with the new key")
+	}
+	if st := tn.Status(); !isConnected(st) {
+		t.Errorf("expected the tunnel connected, got %v", st)
+	}
+	// the work loop is running, the works aren't left waiting
+	tn.Reconnect(waiting)
+	select {
+	case err := <-waiting:
+		if err != nil {
+			t.Errorf("expected reconnected, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("reconnecting after rekeying is blocked")
+	}
+}
+
+func TestTunnel_Password(t *testing.T) {
+	server := newTestServer(t)
+	defer server.stop()
+
+	// the key of "denied" is rejected, the password is sent then
+	tn, err := NewTunnel(freeAddr(t), "denied@"+server.addr, "127.0.0.1:1", testKey(t), nil, time.Second,
+		WithPassword(testPassword))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tn.PasswordAuth() {
+		t.Error("expected the tunnel to fall back to the password")
+	}
+	go tn.Up()
+	defer tn.Destroy(nil)
+	waitStatus(t, tn, 2*time.Second, isConnected)
+
+	// without a key
+	if _, err := AuthTest("mario@"+server.addr, nil, time.Second, WithPassword(testPassword)); err != nil {
+		t.Errorf("expected the password to be accepted, got %v", err)
+	}
+	if _, err := AuthTest("mario@"+server.addr, nil, time.Second, WithPassword("wrong")); err == nil {
+		t.Error("expected a wrong password to be rejected")
+	}
+}
+
+func TestTunnel_LastError(t *testing.T) {
+	tn, err := NewTunnel(freeAddr(t), "mario@127.0.0.1:1", "127.0.0.1:2", testKey(t), nil, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if at, count := tn.LastError(); !at.IsZero() || count != 0 {
+		t.Errorf("a new tunnel has errored %d times at %v", count, at)
+	}
+	before := time.Now()
+	tn.setStatusError(StatusError, errRemoteLost)
+	tn.setStatusError(StatusError, errRemoteLost)
+	// recovering keeps them
+	tn.setStatusError(StatusConnected, nil)
+	if at, count := tn.LastError(); at.Before(before) || count != 2 {
+		t.Errorf("LastError() = %v, %d, want 2 errors after %v", at, count, before)
+	}
+}
+
+func TestTunnel_MaxRetries(t *testing.T) {
+	server := newTestServer(t)
+	defer server.stop()
+	tn, err := NewTunnel(freeAddr(t), "mario@"+server.addr, "127.0.0.1:2", testKey(t), nil, time.Second,
+		WithHealthCheckInterval(50*time.Millisecond), WithMaxRetries(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go tn.Up()
+	defer tn.Destroy(nil)
+	waitStatus(t, tn, 2*time.Second, isConnected)
+
+	server.stop()
+	waitStatus(t, tn, 3*time.Second, func(st TunnelStatus) bool {
+		failed, _ := tn.Retries()
+		return failed >= 2
+	})
+	if err := tn.Error(); err == nil || !strings.Contains(err.Error(), "gave up reconnecting after 2 failed attempts") {
+		t.Errorf("expected the tunnel to give up, got %v", err)
+	}
+	// it's not retried any more even if the server is back
+	server.start()
+	time.Sleep(300 * time.Millisecond)
+	if failed, max := tn.Retries(); failed != 2 || max != 2 || isConnected(tn.Status()) {
+		t.Errorf("expected no more retries, got %d of %d, status %d", failed, max, tn.Status())
+	}
+
+	done := make(chan error, 1)
+	tn.Reconnect(done)
+	if err := <-done; err != nil {
+		t.Fatalf("expected the manual reconnect to succeed, got %v", err)
+	}
+	if failed, _ := tn.Retries(); failed != 0 {
+		t.Errorf("expected the retries to start over once connected, got %d", failed)
+	}
+}
+
+func TestTunnel_DialTimeout(t *testing.T) {
+	// the server accepts but never says hello
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	tn, err := NewTunnel(freeAddr(t), "mario@"+l.Addr().String(), "127.0.0.1:2", testKey(t), nil, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tn.DialTimeout() != defaultDialTimeout || tn.HealthCheckInterval() != 10*time.Second {
+		t.Errorf("expected the dial timeout apart from the health checks, got %s and %s",
+			tn.DialTimeout(), tn.HealthCheckInterval())
+	}
+	WithDialTimeout(200 * time.Millisecond)(tn)
+	start := time.Now()
+	if _, _, err := tn.dial(); err == nil {
+		t.Fatal("expected the stuck handshake to time out")
+	}
+	if took := time.Since(start); took > 2*time.Second {
+		t.Errorf("expected the handshake bound by the dial timeout, took %s", took)
+	}
+	if tn.HealthCheckInterval() != 10*time.Second {
+		t.Errorf("the dial timeout changed the health check interval to %s", tn.HealthCheckInterval())
+	}
+}
+
+func TestTunnel_MaxKeepaliveMisses(t *testing.T) {
+	server := newTestServer(t)
+	defer server.stop()
+	tn, err := NewTunnel(freeAddr(t), "mario@"+server.addr, "127.0.0.1:2", testKey(t), nil, time.Second,
+		WithHealthCheckInterval(100*time.Millisecond), WithMaxKeepaliveMisses(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go tn.Up()
+	defer tn.Destroy(nil)
+	waitStatus(t, tn, 2*time.Second, isConnected)
+
+	server.stop()
+	waitStatus(t, tn, 2*time.Second, func(st TunnelStatus) bool {
+		missed, _ := tn.KeepaliveMisses()
+		return missed >= 1
+	})
+	// the first miss is tolerated
+	if st := tn.Status(); !isConnected(st) {
+		t.Errorf("expected the tunnel still connected after a miss, got %d: %v", st, tn.Error())
+	}
+	waitStatus(t, tn, 2*time.Second, func(st TunnelStatus) bool { return st&StatusError == StatusError })
+	if missed, max := tn.KeepaliveMisses(); missed != 3 || max != 3 {
+		t.Errorf("expected the tunnel to reconnect after 3 misses, got %d of %d", missed, max)
+	}
+
+	server.start()
+	waitStatus(t, tn, 3*time.Second, isConnected)
+	if missed, _ := tn.KeepaliveMisses(); missed != 0 {
+		t.Errorf("expected the misses reset once connected, got %d", missed)
+	}
+}
+
+func TestConnector_Bytes(t *testing.T) {
+	server := newTestServer(t)
+	defer server.stop()
+	echo := echoServer(t)
+	defer echo.Close()
+
+	localAddr := freeAddr(t)
+	tn, err := NewTunnel(localAddr, "mario@"+server.addr, echo.Addr().String(), testKey(t), nil, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go tn.Up()
+	defer tn.Destroy(nil)
+	waitStatus(t, tn, 2*time.Second, isConnected)
+
+	conn, err := net.Dial("tcp", localAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, _ = conn.Write([]byte("hello mario"))
+	buf := make([]byte, 11)
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// the counts are updated while the connection is open
+	waitStatus(t, tn, 2*time.Second, func(TunnelStatus) bool {
+		cs := tn.GetConnectors()
+		return len(cs) == 1 && cs[0].BytesIn() == 11
+	})
+	cnt := tn.GetConnectors()[0]
+	if cnt.BytesOut() != 11 {
+		t.Errorf("BytesOut() = %d, want 11", cnt.BytesOut())
+	}
+	if !strings.Contains(cnt.String(), "in 11B, out 11B") {
+		t.Errorf("expected the bytes in %s", cnt.String())
+	}
+	if n := tn.ConnectorCount(); n != 1 {
+		t.Errorf("ConnectorCount() = %d, want 1", n)
+	}
+
+	// the bytes of the tunnel are kept after its connections are closed
+	_ = conn.Close()
+	waitStatus(t, tn, 2*time.Second, func(TunnelStatus) bool { return len(tn.GetConnectors()) == 0 })
+	if in, out := tn.Bytes(); in != 11 || out != 11 {
+		t.Errorf("Bytes() = %d, %d, want 11, 11", in, out)
+	}
+	if n := tn.ConnectorCount(); n != 0 {
+		t.Errorf("ConnectorCount() = %d after closing, want 0", n)
+	}
+}
+
+func TestTunnel_ConnectorCount(t *testing.T) {
+	server := newTestServer(t)
+	defer server.stop()
+	echo := echoServer(t)
+	defer echo.Close()
+
+	localAddr := freeAddr(t)
+	tn, err := NewTunnel(localAddr, "mario@"+server.addr, echo.Addr().String(), testKey(t), nil, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go tn.Up()
+	defer tn.Destroy(nil)
+	waitStatus(t, tn, 2*time.Second, isConnected)
+
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", localAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+	}
+	waitStatus(t, tn, 2*time.Second, func(TunnelStatus) bool { return tn.ConnectorCount() == 3 })
+	if cs := tn.GetConnectors(); len(cs) != 3 {
+		t.Errorf("expected the count to follow the connectors, got %d connectors", len(cs))
+	}
+
+	// the connectors closed by Down are not counted twice once their copies return
+	done := make(chan error, 1)
+	tn.Down(done)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := tn.ConnectorCount(); n != 0 {
+		t.Errorf("ConnectorCount() = %d after Down, want 0", n)
+	}
+}
+
+func TestTunnel_IdleTimeout(t *testing.T) {
+	server := newTestServer(t)
+	defer server.stop()
+	echo := echoServer(t)
+	defer echo.Close()
+
+	localAddr := freeAddr(t)
+	tn, err := NewTunnel(localAddr, "mario@"+server.addr, echo.Addr().String(), testKey(t), nil, time.Minute,
+		WithIdleTimeout(200*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go tn.Up()
+	defer tn.Destroy(nil)
+	waitStatus(t, tn, 2*time.Second, isConnected)
+
+	ping := func(conn net.Conn) error {
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			return err
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err := io.ReadFull(conn, make([]byte, 4))
+		return err
+	}
+	busy, err := net.Dial("tcp", localAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	idle, err := net.Dial("tcp", localAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	if err := ping(idle); err != nil {
+		t.Fatal(err)
+	}
+
+	// the busy connection outlives the timeout
+	for i := 0; i < 10; i++ {
+		if err := ping(busy); err != nil {
+			t.Fatalf("the busy connection was closed: %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	_ = idle.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err := idle.Read(make([]byte, 4)); err == nil {
+		t.Fatalf("expected the idle connection closed, read %d bytes", n)
+	}
+	waitStatus(t, tn, 2*time.Second, func(TunnelStatus) bool { return len(tn.ClosedConnectors()) == 1 })
+	if reason := tn.ClosedConnectors()[0].CloseReason(); reason != "idle for 200ms" {
+		t.Errorf("unexpected close reason %q", reason)
+	}
+	if cs := tn.GetConnectors(); len(cs) != 1 {
+		t.Errorf("expected only the busy connection left, got %d", len(cs))
+	}
+}
+
+func TestTunnel_Edit(t *testing.T) {
+	server := newTestServer(t)
+	defer server.stop()
+	echo := echoServer(t)
+	defer echo.Close()
+
+	localAddr := freeAddr(t)
+	tn, err := NewTunnel(localAddr, "mario@"+server.addr, echo.Addr().String(), testKey(t), nil, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go tn.Up()
+	defer tn.Destroy(nil)
+	waitStatus(t, tn, 2*time.Second, isConnected)
+
+	// nothing is changed by the invalid values
+	invalid := []struct{ local, server, remote string }{
+		{"127.0.0.1", "", ""},
+		{"", "127.0.0.1:22", ""},
+		{"", "", "127.0.0.1"},
+	}
+	for _, c := range invalid {
+		if err := tn.Edit(c.local, c.server, c.remote, nil); err == nil {
+			t.Errorf("expected Edit(%q, %q, %q) rejected", c.local, c.server, c.remote)
+		}
+	}
+	if tn.Local != localAddr || tn.ForwardTo != echo.Addr().String() {
+		t.Fatalf("expected the tunnel left as it is, got %s", tn.String())
+	}
+
+	other := newTestServer(t)
+	defer other.stop()
+	otherEcho := echoServer(t)
+	defer otherEcho.Close()
+	newLocal := freeAddr(t)
+	// the addresses are read out of the running goroutine while they're edited, -race tells
+	reading, read := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(read)
+		for {
+			select {
+			case <-reading:
+				return
+			default:
+				_, _, _ = tn.String(), tn.User(), tn.Backends()
+			}
+		}
+	}()
+	waiting := make(chan error, 1)
+	if err := tn.Edit(newLocal, "luigi@"+other.addr, otherEcho.Addr().String(), waiting); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-waiting:
+		if err != nil {
+			t.Fatalf("failed to reconnect after editing: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the tunnel is not reconnected after editing")
+	}
+	close(reading)
+	<-read
+	if _, server, _ := tn.Addresses(); server != other.addr || tn.User() != "luigi" {
+		t.Errorf("expected the tunnel through luigi@%s, got %s@%s", other.addr, tn.User(), server)
+	}
+
+	// the previous server and remote are no longer needed
+	server.stop()
+	echo.Close()
+	if conn, err := net.DialTimeout("tcp", localAddr, 200*time.Millisecond); err == nil {
+		conn.Close()
+		t.Errorf("expected the previous local address %s closed", localAddr)
+	}
+	conn, err := net.Dial("tcp", newLocal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("expected the echo through the new local address, got %q, %v", buf, err)
+	}
+	if st := tn.Status(); !isConnected(st) {
+		t.Errorf("expected the tunnel connected, got %v", st)
+	}
+}
+
+func TestTunnel_EditUnreachable(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+	server := newTestServer(t)
+	defer server.stop()
+	// ping sends through the local address and reads the echo
+	ping := func(addr string) error {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			return err
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, err = io.ReadFull(conn, make([]byte, 4))
+		return err
+	}
+	edit := func(tn *Tunnel) {
+		waiting := make(chan error, 1)
+		if err := tn.Edit("", "mario@"+server.addr, "", waiting); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case err := <-waiting:
+			if err != nil {
+				t.Fatalf("expected connected to the new server, got %v", err)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("the edited tunnel is not answered")
+		}
+		if err := ping(tn.Local); err != nil {
+			t.Errorf("expected forwarding through the new server, got %v", err)
+		}
+		// the works aren't left behind either
+		tn.Reconnect(waiting)
+		select {
+		case <-waiting:
+		case <-time.After(3 * time.Second):
+			t.Fatal("reconnecting after editing is blocked")
+		}
+	}
+
+	// never connected, nothing listens on the server
+	unreachable, err := NewTunnel(freeAddr(t), "mario@"+freeAddr(t), echo.Addr().String(), testKey(t), nil, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go unreachable.Up()
+	defer unreachable.Destroy(nil)
+	waitStatus(t, unreachable, 2*time.Second, func(st TunnelStatus) bool {
+		return st&StatusError == StatusError && !unreachable.isLooping()
+	})
+	edit(unreachable)
+
+	// connected then errored once its server is gone
+	old := newTestServer(t)
+	errored, err := NewTunnel(freeAddr(t), "mario@"+old.addr, echo.Addr().String(), testKey(t), nil, 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go errored.Up()
+	defer errored.Destroy(nil)
+	waitStatus(t, errored, 2*time.Second, isConnected)
+	old.stop()
+	waitStatus(t, errored, 2*time.Second, func(st TunnelStatus) bool { return st&StatusError == StatusError })
+	edit(errored)
+}
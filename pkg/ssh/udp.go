@@ -0,0 +1,277 @@
+package ssh
+
+import (
+	"encoding/binary"
+	"go.uber.org/zap"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// udpSessionTimeout is how long a UDP client sending and receiving nothing is remembered
+	udpSessionTimeout = time.Minute
+
+	// udpQueueSize the datagrams of a client waiting to be written to its stream, the ones
+	// beyond are dropped like a congested network does
+	udpQueueSize = 64
+
+	// maxDatagramSize the largest datagram that fits a frame, see writeFrame
+	maxDatagramSize = 65535
+)
+
+// udpRelay listens on UDP for the tunnel and relays the datagrams of every client over its own
+// TCP stream forwarded through the ssh connection. A datagram is framed by its length in 2
+// bytes of big endian, the framing of DNS over TCP, so that a DNS server is reached directly
+// by its TCP port, and any other UDP service through ServeUDPRelay running on the remote.
+type udpRelay struct {
+	conn net.PacketConn
+
+	// forward forwards the stream of a new client through the tunnel
+	forward func(stream net.Conn) error
+
+	logger *zap.SugaredLogger
+
+	mu sync.Mutex
+
+	// sessions the clients by their addresses
+	sessions map[string]*udpSession
+}
+
+type udpSession struct {
+	addr net.Addr
+
+	// stream the local end of the pipe forwarded to the remote
+	stream net.Conn
+
+	queue chan []byte
+
+	// done is closed once the session is dropped
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// lastActive when the client sent or received a datagram last time, guarded by mu of
+	// the relay
+	lastActive time.Time
+}
+
+// listenUDP listens on the UDP address and relays the datagrams until it's closed
+func listenUDP(addr string, forward func(stream net.Conn) error, logger *zap.SugaredLogger) (*udpRelay, error) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	r := &udpRelay{
+		conn:     conn,
+		forward:  forward,
+		logger:   logger,
+		sessions: make(map[string]*udpSession),
+	}
+	go r.serve()
+	return r, nil
+}
+
+func (r *udpRelay) Addr() net.Addr {
+	return r.conn.LocalAddr()
+}
+
+// Close stops listening and closes the streams of all the clients
+func (r *udpRelay) Close() error {
+	err := r.conn.Close()
+	r.mu.Lock()
+	sessions := r.sessions
+	r.sessions = make(map[string]*udpSession)
+	r.mu.Unlock()
+	for _, s := range sessions {
+		s.close()
+	}
+	return err
+}
+
+func (r *udpRelay) serve() {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := r.conn.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+		datagram := make([]byte, n)
+		copy(datagram, buf[:n])
+		s := r.session(addr)
+		select {
+		case s.queue <- datagram:
+		default:
+			r.logger.Debugw("dropped the datagram, the stream is congested", "client", addr.String())
+		}
+	}
+}
+
+// session returns the session of the client, a new stream is forwarded for a new client
+func (r *udpRelay) session(addr net.Addr) *udpSession {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if s, ok := r.sessions[addr.String()]; ok {
+		s.lastActive = time.Now()
+		return s
+	}
+	local, remote := net.Pipe()
+	s := &udpSession{
+		addr:       addr,
+		stream:     local,
+		queue:      make(chan []byte, udpQueueSize),
+		done:       make(chan struct{}),
+		lastActive: time.Now(),
+	}
+	r.sessions[addr.String()] = s
+	go func() {
+		// the remote end of the pipe is closed by forward if it fails
+		if err := r.forward(remote); err != nil {
+			r.logger.Debugw("failed to forward the datagrams", "client", addr.String(), "error", err)
+			r.drop(s)
+		}
+	}()
+	go r.writeStream(s)
+	go r.readStream(s)
+	return s
+}
+
+// writeStream frames the datagrams of the client into its stream
+func (r *udpRelay) writeStream(s *udpSession) {
+	for {
+		select {
+		case datagram := <-s.queue:
+			if err := writeFrame(s.stream, datagram); err != nil {
+				r.drop(s)
+				return
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// readStream sends the datagrams framed in the stream back to the client, the session is
+// dropped once it's idle for udpSessionTimeout
+func (r *udpRelay) readStream(s *udpSession) {
+	defer r.drop(s)
+	buf := make([]byte, maxDatagramSize)
+	for {
+		_ = s.stream.SetReadDeadline(time.Now().Add(udpSessionTimeout))
+		n, err := readFrame(s.stream, buf)
+		if ne, ok := err.(net.Error); ok && ne.Timeout() && n == 0 {
+			r.mu.Lock()
+			idle := time.Since(s.lastActive) >= udpSessionTimeout
+			r.mu.Unlock()
+			if idle {
+				return
+			}
+			continue
+		}
+		if err != nil {
+			return
+		}
+		if _, err := r.conn.WriteTo(buf[:n], s.addr); err != nil {
+			return
+		}
+		r.mu.Lock()
+		s.lastActive = time.Now()
+		r.mu.Unlock()
+	}
+}
+
+// drop forgets the session and closes its stream, the next datagram of the client starts a new one
+func (r *udpRelay) drop(s *udpSession) {
+	r.mu.Lock()
+	if r.sessions[s.addr.String()] == s {
+		delete(r.sessions, s.addr.String())
+	}
+	r.mu.Unlock()
+	s.close()
+}
+
+func (s *udpSession) close() {
+	s.closeOnce.Do(func() {
+		_ = s.stream.Close()
+		close(s.done)
+	})
+}
+
+// writeFrame writes the datagram prefixed by its length in 2 bytes of big endian
+func writeFrame(w io.Writer, datagram []byte) error {
+	frame := make([]byte, 2+len(datagram))
+	binary.BigEndian.PutUint16(frame, uint16(len(datagram)))
+	copy(frame[2:], datagram)
+	_, err := w.Write(frame)
+	return err
+}
+
+// readFrame reads a datagram written by writeFrame into buf which should hold maxDatagramSize
+// bytes and returns its size. On failure, the bytes of the frame read are returned, the stream
+// is broken if it's not 0.
+func readFrame(r io.Reader, buf []byte) (int, error) {
+	header := make([]byte, 2)
+	if n, err := io.ReadFull(r, header); err != nil {
+		return n, err
+	}
+	size := int(binary.BigEndian.Uint16(header))
+	if n, err := io.ReadFull(r, buf[:size]); err != nil {
+		return 2 + n, err
+	}
+	return size, nil
+}
+
+// ServeUDPRelay is the remote side of the UDP forwarding of a tunnel, see WithUDP: it accepts
+// the streams of the tunnel on l and sends the datagrams framed in them to the UDP target,
+// the replies are framed back. A stream is closed once it's idle for a minute. It returns
+// when l is closed.
+func ServeUDPRelay(l net.Listener, target string) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return err
+		}
+		go relayStream(conn, target)
+	}
+}
+
+// relayStream relays the datagrams between the stream and a UDP socket to the target
+func relayStream(stream net.Conn, target string) {
+	defer stream.Close()
+	udp, err := net.Dial("udp", target)
+	if err != nil {
+		return
+	}
+	defer udp.Close()
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			_ = udp.SetReadDeadline(time.Now().Add(udpSessionTimeout))
+			n, err := udp.Read(buf)
+			if err != nil {
+				// idle or closed, either way the stream is done
+				_ = stream.Close()
+				return
+			}
+			if err := writeFrame(stream, buf[:n]); err != nil {
+				return
+			}
+		}
+	}()
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, err := readFrame(stream, buf)
+		if err != nil {
+			return
+		}
+		if _, err := udp.Write(buf[:n]); err != nil {
+			return
+		}
+	}
+}
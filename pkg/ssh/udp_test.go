@@ -0,0 +1,101 @@
+package ssh
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// udpEchoServer echoes the datagrams back to their senders
+func udpEchoServer(t *testing.T) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = conn.WriteTo(buf[:n], addr)
+		}
+	}()
+	return conn
+}
+
+func TestFrame(t *testing.T) {
+	buf := new(bytes.Buffer)
+	for _, d := range [][]byte{[]byte("mario"), {}, bytes.Repeat([]byte("x"), maxDatagramSize)} {
+		if err := writeFrame(buf, d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := make([]byte, maxDatagramSize)
+	for _, want := range []int{5, 0, maxDatagramSize} {
+		if n, err := readFrame(buf, got); err != nil || n != want {
+			t.Errorf("readFrame = %d, %v, want %d", n, err, want)
+		}
+	}
+	// a frame cut short breaks the stream
+	if n, err := readFrame(bytes.NewReader([]byte{0, 5, 'm'}), got); err == nil || n != 3 {
+		t.Errorf("readFrame of a broken frame = %d, %v", n, err)
+	}
+}
+
+func TestTunnel_UDP(t *testing.T) {
+	server := newTestServer(t)
+	defer server.stop()
+	echo := udpEchoServer(t)
+	defer echo.Close()
+	// the remote side turning the streams back into datagrams
+	relay, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer relay.Close()
+	go ServeUDPRelay(relay, echo.LocalAddr().String())
+
+	local := freeAddr(t)
+	tn, err := NewTunnel(local, "mario@"+server.addr, relay.Addr().String(), testKey(t), nil, time.Second,
+		WithUDP())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go tn.Up()
+	defer tn.Destroy(nil)
+	waitStatus(t, tn, 2*time.Second, isConnected)
+
+	for _, msg := range []string{"it's-a-me", "mario"} {
+		client, err := net.Dial("udp", local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		for i := 0; i < 3; i++ {
+			if _, err := client.Write([]byte(msg)); err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, 64)
+			_ = client.SetReadDeadline(time.Now().Add(2 * time.Second))
+			n, err := client.Read(buf)
+			if err != nil || string(buf[:n]) != msg {
+				t.Fatalf("expected the datagram %q echoed, got %q, error: %v", msg, buf[:n], err)
+			}
+		}
+	}
+
+	// the udp listener is closed along with the tunnel
+	done := make(chan error, 1)
+	tn.Down(done)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if conn, err := net.ListenPacket("udp", local); err != nil {
+		t.Errorf("expected the udp address released, got %v", err)
+	} else {
+		conn.Close()
+	}
+}